@@ -0,0 +1,98 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/internal/testevent"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+	"github.com/hugelgupf/vmtest/qemu/quimage"
+	"github.com/hugelgupf/vmtest/testtmp"
+	"github.com/u-root/mkuimage/uimage"
+)
+
+// BenchmarkResult is the result of one Go benchmark run in the guest.
+type BenchmarkResult struct {
+	// Package is the Go package the benchmark belongs to.
+	Package string
+
+	// Name is the benchmark name including the GOMAXPROCS suffix, e.g.
+	// BenchmarkFib10-4.
+	Name string
+
+	// N is the number of iterations.
+	N int
+
+	NsPerOp           float64
+	AllocedBytesPerOp uint64
+	AllocsPerOp       uint64
+	MBPerS            float64
+}
+
+// RunBenchmarks compiles the tests added with WithPackageToTest and runs their
+// benchmarks (but no tests) in a QEMU VM configured by mods.
+//
+// Results are streamed to the host as each benchmark finishes and returned in
+// the order they ran, so callers can compare them against baselines. Memory
+// allocation statistics are always collected.
+//
+// For stable numbers on shared machines, pin the VM to dedicated host CPUs
+// with WithQEMUFn(qemu.WithHostIsolation(...)).
+func RunBenchmarks(t testing.TB, name string, mods ...Modifier) []BenchmarkResult {
+	qemu.SkipWithoutQEMU(t)
+
+	goOpts := parseOptions(t, mods)
+	sharedDir := testtmp.TempDir(t)
+	saveArtifacts(t, name, sharedDir)
+	_, libs := compileTests(t, goOpts, sharedDir, false)
+
+	var uinitArgs []string
+	if goOpts.TestTimeout > 0 {
+		uinitArgs = append(uinitArgs, fmt.Sprintf("-test_timeout=%s", goOpts.TestTimeout))
+	}
+	if flags := goOpts.testBinaryFlags(); len(flags) > 0 {
+		uinitArgs = append(uinitArgs, append([]string{"--"}, flags...)...)
+	}
+	umods := append([]uimage.Modifier{
+		uimage.WithBusyboxCommands(
+			"github.com/u-root/u-root/cmds/core/init",
+			"github.com/hugelgupf/vmtest/vminit/shutdownafter",
+			"github.com/hugelgupf/vmtest/vminit/vmmount",
+			"github.com/hugelgupf/vmtest/vminit/benchinit",
+		),
+		uimage.WithInit("init"),
+		uimage.WithUinit("shutdownafter", append([]string{"--", "vmmount", "--", "benchinit"}, uinitArgs...)...),
+	}, append(libs, goOpts.Initramfs...)...)
+
+	var mu sync.Mutex
+	var results []BenchmarkResult
+	vm := qemu.StartT(t,
+		name,
+		qemu.ArchUseEnvv,
+		append([]qemu.Fn{
+			quimage.WithUimageT(t, umods...),
+			qemu.P9Directory(sharedDir, "gotestdata"),
+			qemu.WithVmtestIdent(),
+			qevent.EventChannelCallback[testevent.BenchmarkEvent]("benchmarks", func(e testevent.BenchmarkEvent) error {
+				mu.Lock()
+				defer mu.Unlock()
+				results = append(results, BenchmarkResult(e))
+				return nil
+			}),
+		}, goOpts.QEMUOpts...)...)
+	if err := vm.Wait(); err != nil {
+		t.Errorf("VM exited with %v", err)
+	}
+
+	reportErrors(t, sharedDir)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return results
+}
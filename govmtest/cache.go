@@ -0,0 +1,252 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/uio/cp"
+	"golang.org/x/tools/go/packages"
+)
+
+// testCache caches compiled guest test binaries, keyed on the content of the
+// package and its dependencies as well as the build environment and flags.
+//
+// The cache lives in VMTEST_GO_TEST_CACHE, or vmtest/gotest in the user's
+// cache directory if unset. Setting VMTEST_GO_TEST_CACHE=off disables it.
+//
+// Like the Go build cache, entries not used for cacheTrimLimit are removed by
+// trim. The cache is safe to delete at any time.
+type testCache struct {
+	dir string
+}
+
+const (
+	// cacheMTimeInterval is how out of date get lets an entry's mtime get
+	// before it updates it, to avoid a write on every use.
+	cacheMTimeInterval = time.Hour
+
+	// cacheTrimInterval is how often trim looks for unused entries.
+	cacheTrimInterval = 24 * time.Hour
+
+	// cacheTrimLimit is how long an entry may go unused before trim
+	// removes it.
+	cacheTrimLimit = 5 * 24 * time.Hour
+)
+
+// trimFile records when the cache was last trimmed.
+const trimFile = "trim.txt"
+
+func openTestCache() (*testCache, error) {
+	dir := os.Getenv("VMTEST_GO_TEST_CACHE")
+	switch dir {
+	case "off":
+		return nil, nil
+	case "":
+		d, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(d, "vmtest", "gotest")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &testCache{dir: dir}, nil
+}
+
+// key returns the cache key for building pkg's test binary with flags.
+func (c *testCache) key(env *golang.Environ, gowork, pkg string, flags []string) (string, error) {
+	version, err := env.Version()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "go %s\n", version)
+	for _, e := range append(env.Env(), workspaceEnv(gowork)...) {
+		fmt.Fprintf(h, "env %s\n", e)
+	}
+	for _, v := range []string{"GOFLAGS", "CC", "CXX", "CGO_CFLAGS", "CGO_CPPFLAGS", "CGO_CXXFLAGS", "CGO_LDFLAGS"} {
+		fmt.Fprintf(h, "env %s=%s\n", v, os.Getenv(v))
+	}
+	for _, f := range flags {
+		fmt.Fprintf(h, "flag %s\n", f)
+	}
+	fmt.Fprintf(h, "pkg %s\n", pkg)
+
+	cfg := &packages.Config{
+		Mode:  packages.NeedName | packages.NeedFiles | packages.NeedEmbedFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Env:   append(append(os.Environ(), env.Env()...), workspaceEnv(gowork)...),
+		Tests: true,
+	}
+	roots, err := packages.Load(cfg, pkg)
+	if err != nil {
+		return "", err
+	}
+
+	// Visit every package once, and hash them in a stable order.
+	deps := make(map[string]*packages.Package)
+	var failed error
+	packages.Visit(roots, nil, func(p *packages.Package) {
+		if len(p.Errors) > 0 && failed == nil {
+			failed = p.Errors[0]
+		}
+		deps[p.ID] = p
+	})
+	if failed != nil {
+		return "", failed
+	}
+	ids := make([]string, 0, len(deps))
+	for id := range deps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := hashPackage(h, deps[id], env.GOROOT); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashPackage hashes p's identity and, unless it comes from an immutable
+// module version or the standard library in goroot, its source files.
+func hashPackage(w io.Writer, p *packages.Package, goroot string) error {
+	fmt.Fprintf(w, "package %s\n", p.ID)
+	if m := p.Module; m != nil && m.Version != "" && (m.Replace == nil || m.Replace.Version != "") {
+		if m.Replace != nil {
+			m = m.Replace
+		}
+		fmt.Fprintf(w, "module %s@%s\n", m.Path, m.Version)
+		return nil
+	}
+	if p.Module == nil && len(p.GoFiles) > 0 && strings.HasPrefix(p.GoFiles[0], filepath.Clean(goroot)+string(filepath.Separator)) {
+		// Covered by the Go version.
+		return nil
+	}
+
+	files := append(append(append([]string{}, p.GoFiles...), p.OtherFiles...), p.EmbedFiles...)
+	sort.Strings(files)
+	for _, f := range files {
+		if err := hashFile(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "file %s\n", path)
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (c *testCache) path(key string) string {
+	return filepath.Join(c.dir, key+".test")
+}
+
+func (c *testCache) noTestPath(key string) string {
+	return filepath.Join(c.dir, key+".notest")
+}
+
+// get places the cached test binary for key at testFile. It returns false if
+// nothing is cached for key.
+//
+// A package without tests is cached as having no test binary, in which case
+// get returns true without creating testFile.
+func (c *testCache) get(key, testFile string) bool {
+	if fi, err := os.Stat(c.noTestPath(key)); err == nil {
+		c.used(c.noTestPath(key), fi)
+		return true
+	}
+	fi, err := os.Stat(c.path(key))
+	if err != nil {
+		return false
+	}
+	c.used(c.path(key), fi)
+	return cp.Copy(c.path(key), testFile) == nil
+}
+
+// used marks the entry at path as used now, so that trim keeps it.
+func (c *testCache) used(path string, fi os.FileInfo) {
+	if now := time.Now(); now.Sub(fi.ModTime()) >= cacheMTimeInterval {
+		_ = os.Chtimes(path, now, now)
+	}
+}
+
+// trim removes entries that were not used for cacheTrimLimit before now. It
+// does nothing if the cache was trimmed less than cacheTrimInterval ago.
+func (c *testCache) trim(now time.Time) error {
+	trimPath := filepath.Join(c.dir, trimFile)
+	if b, err := os.ReadFile(trimPath); err == nil {
+		if t, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && now.Sub(time.Unix(t, 0)) < cacheTrimInterval {
+			return nil
+		}
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-cacheTrimLimit)
+	for _, e := range entries {
+		if e.Name() == trimFile {
+			continue
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			// Removed by a concurrent trim.
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.WriteFile(trimPath, []byte(fmt.Sprintf("%d\n", now.Unix())), 0o644)
+}
+
+// put caches testFile under key, or the absence of a test binary if testFile
+// does not exist.
+func (c *testCache) put(key, testFile string) error {
+	if _, err := os.Stat(testFile); os.IsNotExist(err) {
+		return os.WriteFile(c.noTestPath(key), nil, 0o644)
+	}
+
+	// Copy and rename so that concurrent runs never see a partial binary.
+	tmp, err := os.CreateTemp(c.dir, key+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := os.Remove(tmp.Name()); err != nil {
+		return err
+	}
+	if err := cp.Copy(testFile, tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+func TestTestCacheKey(t *testing.T) {
+	c := &testCache{dir: t.TempDir()}
+	env := golang.Default(golang.DisableCGO())
+	pkg := "github.com/hugelgupf/vmtest/json2test"
+
+	k1, err := c.key(env, "", pkg, []string{"-gcflags=all=-l"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := c.key(env, "", pkg, []string{"-gcflags=all=-l"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 != k2 {
+		t.Errorf("Same build has different keys %s and %s", k1, k2)
+	}
+
+	for name, key := range map[string]func() (string, error){
+		"flags": func() (string, error) {
+			return c.key(env, "", pkg, []string{"-gcflags=all=-l", "-covermode=atomic"})
+		},
+		"package": func() (string, error) {
+			return c.key(env, "", "github.com/hugelgupf/vmtest/internal/mountspec", []string{"-gcflags=all=-l"})
+		},
+		"arch": func() (string, error) {
+			other := "arm64"
+			if env.GOARCH == other {
+				other = "amd64"
+			}
+			return c.key(golang.Default(golang.DisableCGO(), golang.WithGOARCH(other)), "", pkg, []string{"-gcflags=all=-l"})
+		},
+	} {
+		k, err := key()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k == k1 {
+			t.Errorf("Changing %s did not change the cache key", name)
+		}
+	}
+}
+
+func TestTestCacheGetPut(t *testing.T) {
+	c := &testCache{dir: t.TempDir()}
+	dir := t.TempDir()
+
+	testFile := filepath.Join(dir, "a.test")
+	if c.get("a", testFile) {
+		t.Fatalf("get on empty cache succeeded")
+	}
+	if err := os.WriteFile(testFile, []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.put("a", testFile); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.test")
+	if !c.get("a", out) {
+		t.Fatalf("get of cached binary failed")
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0o755 {
+		t.Errorf("Cached binary = %v, %v, want executable file", fi, err)
+	}
+
+	// Packages without tests don't produce a binary.
+	noTest := filepath.Join(dir, "none.test")
+	if err := c.put("b", noTest); err != nil {
+		t.Fatal(err)
+	}
+	if !c.get("b", noTest) {
+		t.Errorf("get of cached package without tests failed")
+	}
+	if _, err := os.Stat(noTest); !os.IsNotExist(err) {
+		t.Errorf("get created a binary for a package without tests")
+	}
+}
+
+func TestTestCacheTrim(t *testing.T) {
+	c := &testCache{dir: t.TempDir()}
+	testFile := filepath.Join(t.TempDir(), "a.test")
+	if err := os.WriteFile(testFile, []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"old", "used", "new"} {
+		if err := c.put(key, testFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * cacheTrimLimit)
+	for _, key := range []string{"old", "used"} {
+		if err := os.Chtimes(c.path(key), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.get("used", filepath.Join(t.TempDir(), "used.test")) {
+		t.Fatalf("get of cached binary failed")
+	}
+
+	if err := c.trim(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"old": false, "used": true, "new": true} {
+		if _, err := os.Stat(c.path(key)); (err == nil) != want {
+			t.Errorf("Entry %q kept = %v, want %v", key, err == nil, want)
+		}
+	}
+
+	// Trimming again within cacheTrimInterval does nothing.
+	if err := os.Chtimes(c.path("new"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.trim(time.Now().Add(cacheTrimInterval / 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.path("new")); err != nil {
+		t.Errorf("trim within cacheTrimInterval removed an entry: %v", err)
+	}
+	if err := c.trim(time.Now().Add(cacheTrimInterval)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.path("new")); !os.IsNotExist(err) {
+		t.Errorf("trim after cacheTrimInterval kept an unused entry: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/u-root/mkuimage/ldd"
+)
+
+// ErrCgoCrossArch is returned when cgo test binaries are requested for a guest
+// architecture different from the host's.
+var ErrCgoCrossArch = errors.New("cgo test binaries can only be run when guest and host architectures match")
+
+// WithCgo builds test binaries with cgo enabled, and adds the shared libraries
+// and dynamic linker they need to the initramfs.
+//
+// Libraries are taken from the host, so the guest architecture must match the
+// host's.
+func WithCgo() Modifier {
+	return func(_ testing.TB, o *Options) error {
+		o.Cgo = true
+		return nil
+	}
+}
+
+// sharedLibraries returns the dynamic linker and all shared libraries
+// (including symlinks to them) needed by binaries. Static binaries need none.
+func sharedLibraries(binaries ...string) ([]string, error) {
+	if len(binaries) == 0 {
+		return nil, nil
+	}
+	return ldd.FList(binaries...)
+}
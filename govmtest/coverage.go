@@ -0,0 +1,125 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// WithCoverageSummary logs the statement coverage of each guest package at
+// the end of Run, as `go test -cover` prints it. Tests are built with coverage
+// even if VMTEST_GO_PROFILE is not set.
+//
+// Setting VMTEST_COVERAGE_SUMMARY has the same effect for all Run calls.
+func WithCoverageSummary() Modifier {
+	return func(_ testing.TB, o *Options) error {
+		o.CoverageSummary = true
+		return nil
+	}
+}
+
+// coverageSummary returns whether to log a coverage summary.
+func (o *Options) coverageSummary() bool {
+	return o.CoverageSummary || os.Getenv("VMTEST_COVERAGE_SUMMARY") != ""
+}
+
+// packageCoverage is the statement coverage of one package.
+type packageCoverage struct {
+	covered, total int
+}
+
+func (c packageCoverage) percent() float64 {
+	if c.total == 0 {
+		return 0
+	}
+	return 100 * float64(c.covered) / float64(c.total)
+}
+
+// coverageByPackage reads a Go coverage profile and returns the coverage of
+// each package in it.
+//
+// Profiles of several test binaries may cover the same block; a block is
+// covered if any of them covered it.
+func coverageByPackage(r io.Reader) (map[string]packageCoverage, error) {
+	type block struct {
+		pkg     string
+		stmts   int
+		covered bool
+	}
+	blocks := make(map[string]*block)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "mode: ") {
+			continue
+		}
+		// file:startLine.startCol,endLine.endCol numStmts count
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid coverage profile line %q", line)
+		}
+		file, _, ok := strings.Cut(fields[0], ":")
+		stmts, err := strconv.Atoi(fields[1])
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid coverage profile line %q", line)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid coverage profile line %q", line)
+		}
+		b, ok := blocks[fields[0]]
+		if !ok {
+			b = &block{pkg: path.Dir(file), stmts: stmts}
+			blocks[fields[0]] = b
+		}
+		b.covered = b.covered || count > 0
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	pkgs := make(map[string]packageCoverage)
+	for _, b := range blocks {
+		c := pkgs[b.pkg]
+		c.total += b.stmts
+		if b.covered {
+			c.covered += b.stmts
+		}
+		pkgs[b.pkg] = c
+	}
+	return pkgs, nil
+}
+
+// logCoverageSummary logs the coverage of each package in the Go coverage
+// profile at path.
+func logCoverageSummary(t testing.TB, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Errorf("Could not read coverage for summary: %v", err)
+		return
+	}
+	defer f.Close()
+	pkgs, err := coverageByPackage(f)
+	if err != nil {
+		t.Errorf("Could not read coverage for summary: %v", err)
+		return
+	}
+	names := make([]string, 0, len(pkgs))
+	for pkg := range pkgs {
+		names = append(names, pkg)
+	}
+	sort.Strings(names)
+	for _, pkg := range names {
+		t.Logf("Coverage of %s: %.1f%% of statements", pkg, pkgs[pkg].percent())
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCoverageByPackage(t *testing.T) {
+	// Two test binaries' profiles appended, both covering foo.go.
+	profile := `mode: atomic
+example.com/foo/foo.go:3.10,5.2 2 0
+example.com/foo/foo.go:7.10,9.2 1 4
+example.com/foo/bar/bar.go:3.10,5.2 3 0
+mode: atomic
+example.com/foo/foo.go:3.10,5.2 2 1
+example.com/foo/foo.go:7.10,9.2 1 0
+`
+	got, err := coverageByPackage(strings.NewReader(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]packageCoverage{
+		"example.com/foo":     {covered: 3, total: 3},
+		"example.com/foo/bar": {covered: 0, total: 3},
+	}
+	if len(got) != len(want) {
+		t.Errorf("coverageByPackage = %v, want %v", got, want)
+	}
+	for pkg, c := range want {
+		if got[pkg] != c {
+			t.Errorf("coverage of %s = %v, want %v", pkg, got[pkg], c)
+		}
+	}
+	if p := got["example.com/foo"].percent(); p != 100 {
+		t.Errorf("percent = %v, want 100", p)
+	}
+
+	if _, err := coverageByPackage(strings.NewReader("foo.go:1.1,2.2 x 1\n")); err == nil {
+		t.Errorf("coverageByPackage of invalid profile = nil, want error")
+	}
+}
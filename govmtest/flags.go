@@ -0,0 +1,151 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// ErrUnsupportedTestFlag is returned by WithGoTestFlags for go test flags that
+// cannot work in the guest.
+var ErrUnsupportedTestFlag = errors.New("go test flag not supported in guest")
+
+// ErrSkipPattern is returned by WithSkipTests for patterns that cannot be
+// combined into one -test.skip flag.
+var ErrSkipPattern = errors.New("invalid skip pattern")
+
+// unsupportedTestFlags maps go test flags to the reason they cannot be passed
+// to guest test binaries.
+var unsupportedTestFlags = map[string]string{
+	"c":            "test binaries are always compiled on the host",
+	"o":            "test binaries are always compiled on the host",
+	"exec":         "test binaries are always executed in the guest",
+	"json":         "guest results are always collected as JSON",
+	"vet":          "go vet does not run in the guest",
+	"cover":        "set VMTEST_GO_PROFILE to collect coverage",
+	"covermode":    "set VMTEST_GO_PROFILE to collect coverage",
+	"coverpkg":     "set VMTEST_GO_PROFILE to collect coverage",
+	"coverprofile": "set VMTEST_GO_PROFILE to collect coverage",
+	"outputdir":    "the guest's working directory is not shared back to the host",
+	"fuzz":         "fuzz tests are not supported",
+}
+
+// normalizeTestFlag turns a go test flag like -count=2 or --short into the
+// test binary flag -test.count=2 or -test.short.
+func normalizeTestFlag(flag string) (string, error) {
+	if !strings.HasPrefix(flag, "-") {
+		return "", fmt.Errorf("%w: %q is not a flag (use -name or -name=value)", ErrUnsupportedTestFlag, flag)
+	}
+	f := strings.TrimLeft(flag, "-")
+	f = strings.TrimPrefix(f, "test.")
+	name, value, hasValue := strings.Cut(f, "=")
+	if name == "" {
+		return "", fmt.Errorf("%w: %q is not a flag", ErrUnsupportedTestFlag, flag)
+	}
+	if reason, ok := unsupportedTestFlags[name]; ok {
+		return "", fmt.Errorf("%w: -%s: %s", ErrUnsupportedTestFlag, name, reason)
+	}
+	if name == "v" && hasValue && value != "true" {
+		return "", fmt.Errorf("%w: -v=%s: verbose output is required to collect results", ErrUnsupportedTestFlag, value)
+	}
+	return "-test." + f, nil
+}
+
+// WithGoTestFlags passes go test flags, such as -count=2, -short, or
+// -shuffle=on, to every guest test binary.
+//
+// Flags must be given in -name or -name=value form; the -test. prefix is
+// optional. Flags that cannot work in the guest (e.g. -c, -exec, -json,
+// -coverprofile) are rejected.
+//
+// Flags are passed after vmtest's own defaults, so e.g. -run or -bench
+// overrides the default of running all tests and benchmarks.
+func WithGoTestFlags(flags ...string) Modifier {
+	return func(_ testing.TB, o *Options) error {
+		for _, flag := range flags {
+			f, err := normalizeTestFlag(flag)
+			if err != nil {
+				return err
+			}
+			o.TestFlags = append(o.TestFlags, f)
+		}
+		return nil
+	}
+}
+
+// hasSubtestPattern returns whether pattern has a "/" separating test and
+// subtest patterns, using the same rules as the testing package.
+func hasSubtestPattern(pattern string) bool {
+	var cs, cp int
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '[':
+			cs++
+		case ']':
+			if cs--; cs < 0 {
+				cs = 0
+			}
+		case '(':
+			if cs == 0 {
+				cp++
+			}
+		case ')':
+			if cs == 0 {
+				cp--
+			}
+		case '\\':
+			i++
+		case '/':
+			if cs == 0 && cp == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithSkipTests skips guest tests and benchmarks matching any of patterns,
+// using the guest test binaries' -test.skip flag. Use it for tests known not
+// to work in a VM rather than adding guest.SkipIfInVM to their source.
+//
+// Patterns are regular expressions in -test.skip syntax. Multiple patterns are
+// matched against top-level test names only, since -test.skip cannot combine
+// alternatives for subtests; a subtest pattern like TestFoo/bar must be the
+// only pattern.
+func WithSkipTests(patterns ...string) Modifier {
+	return func(_ testing.TB, o *Options) error {
+		for _, p := range patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("%w %q: %w", ErrSkipPattern, p, err)
+			}
+		}
+		o.SkipTests = append(o.SkipTests, patterns...)
+		if len(o.SkipTests) > 1 {
+			for _, p := range o.SkipTests {
+				if hasSubtestPattern(p) {
+					return fmt.Errorf("%w %q: subtest patterns cannot be combined with other patterns", ErrSkipPattern, p)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// testBinaryFlags returns the flags passed to every guest test binary.
+func (o *Options) testBinaryFlags() []string {
+	var flags []string
+	switch len(o.SkipTests) {
+	case 0:
+	case 1:
+		flags = append(flags, "-test.skip="+o.SkipTests[0])
+	default:
+		flags = append(flags, "-test.skip=("+strings.Join(o.SkipTests, ")|(")+")")
+	}
+	return append(flags, o.TestFlags...)
+}
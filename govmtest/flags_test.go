@@ -0,0 +1,103 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestWithGoTestFlags(t *testing.T) {
+	for _, tt := range []struct {
+		flags []string
+		want  []string
+		err   error
+	}{
+		{
+			flags: []string{"-count=2", "-short", "--shuffle=on", "-test.v", "-v=true"},
+			want:  []string{"-test.count=2", "-test.short", "-test.shuffle=on", "-test.v", "-test.v=true"},
+		},
+		{
+			flags: []string{"-run=TestFoo", "-test.bench=BenchmarkBar"},
+			want:  []string{"-test.run=TestFoo", "-test.bench=BenchmarkBar"},
+		},
+		{flags: []string{"-c"}, err: ErrUnsupportedTestFlag},
+		{flags: []string{"-exec=foo"}, err: ErrUnsupportedTestFlag},
+		{flags: []string{"-test.coverprofile=foo"}, err: ErrUnsupportedTestFlag},
+		{flags: []string{"-json"}, err: ErrUnsupportedTestFlag},
+		{flags: []string{"-v=false"}, err: ErrUnsupportedTestFlag},
+		{flags: []string{"count=2"}, err: ErrUnsupportedTestFlag},
+		{flags: []string{"-"}, err: ErrUnsupportedTestFlag},
+	} {
+		o := &Options{}
+		err := WithGoTestFlags(tt.flags...)(t, o)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("WithGoTestFlags(%v) = %v, want %v", tt.flags, err, tt.err)
+		}
+		if err == nil && !slices.Equal(o.TestFlags, tt.want) {
+			t.Errorf("WithGoTestFlags(%v) = %v, want %v", tt.flags, o.TestFlags, tt.want)
+		}
+	}
+}
+
+func TestWithSkipTests(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		patterns [][]string
+		flags    []string
+		want     []string
+		err      error
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "one",
+			patterns: [][]string{{"TestFoo/bar"}},
+			flags:    []string{"-count=2"},
+			want:     []string{"-test.skip=TestFoo/bar", "-test.count=2"},
+		},
+		{
+			name:     "combined",
+			patterns: [][]string{{"TestFoo", "^TestBar$"}, {"Benchmark(A|B)"}},
+			want:     []string{"-test.skip=(TestFoo)|(^TestBar$)|(Benchmark(A|B))"},
+		},
+		{
+			name:     "slash-in-group",
+			patterns: [][]string{{"Test(a/b)", "Test[/]"}},
+			want:     []string{"-test.skip=(Test(a/b))|(Test[/])"},
+		},
+		{
+			name:     "subtest-combined",
+			patterns: [][]string{{"TestFoo"}, {"TestBar/baz"}},
+			err:      ErrSkipPattern,
+		},
+		{
+			name:     "invalid",
+			patterns: [][]string{{"Test("}},
+			err:      ErrSkipPattern,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Options{}
+			var err error
+			for _, p := range tt.patterns {
+				if err = WithSkipTests(p...)(t, o); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = WithGoTestFlags(tt.flags...)(t, o)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("WithSkipTests = %v, want %v", err, tt.err)
+			}
+			if got := o.testBinaryFlags(); err == nil && !slices.Equal(got, tt.want) {
+				t.Errorf("testBinaryFlags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,82 +12,152 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/hugelgupf/vmtest/internal/json2test"
 	"github.com/hugelgupf/vmtest/internal/testevent"
+	"github.com/hugelgupf/vmtest/json2test"
 	"github.com/hugelgupf/vmtest/qemu"
 	"github.com/hugelgupf/vmtest/qemu/qcoverage"
 	"github.com/hugelgupf/vmtest/qemu/qevent"
+	"github.com/hugelgupf/vmtest/qemu/qnull"
 	"github.com/hugelgupf/vmtest/qemu/quimage"
+	"github.com/hugelgupf/vmtest/testartifacts"
 	"github.com/hugelgupf/vmtest/testtmp"
 	"github.com/u-root/gobusybox/src/pkg/golang"
 	"github.com/u-root/mkuimage/uimage"
-	"github.com/u-root/uio/cp"
 	"golang.org/x/tools/go/packages"
 )
 
-func lookupPkgs(env golang.Environ, dir string, patterns ...string) ([]*packages.Package, error) {
+func lookupPkgs(env golang.Environ, gowork string, dir string, patterns ...string) ([]*packages.Package, error) {
 	cfg := &packages.Config{
-		Mode:  packages.NeedName | packages.NeedFiles,
-		Env:   append(os.Environ(), env.Env()...),
+		Mode:  packages.NeedName | packages.NeedFiles | packages.NeedModule,
+		Env:   append(append(os.Environ(), env.Env()...), workspaceEnv(gowork)...),
 		Dir:   dir,
 		Tests: true,
 	}
 	return packages.Load(cfg, patterns...)
 }
 
-func compileTestAndData(env *golang.Environ, pkg, destDir string, cover bool) error {
+// testBinary is the path of pkg's test binary in destDir.
+func testBinary(pkg, destDir string) string {
+	return filepath.Join(destDir, fmt.Sprintf("%s.test", path.Base(pkg)))
+}
+
+// testBuilder compiles guest test binaries.
+type testBuilder struct {
+	env *golang.Environ
+
+	// gowork is the go.work file in use, if any.
+	gowork string
+
+	// cache holds previously compiled test binaries. It may be nil.
+	cache *testCache
+
+	// testDir is the directory test binaries and data are placed in.
+	testDir string
+
+	cover bool
+
+	logf func(format string, args ...any)
+}
+
+// compileTestAndData compiles pkg's test binary and copies its data to
+// destDir. It returns whether a test binary was produced.
+//
+// If pkg's module is a workspace member or locally replaced, the whole module
+// is copied so that the test can use files outside its package directory.
+func (b *testBuilder) compileTestAndData(pkg, destDir string) (bool, error) {
 	if err := os.MkdirAll(destDir, 0o755); err != nil {
-		return err
+		return false, err
 	}
 
-	testFile := filepath.Join(destDir, fmt.Sprintf("%s.test", path.Base(pkg)))
+	testFile := testBinary(pkg, destDir)
 
-	args := []string{
+	flags := []string{
 		"-gcflags=all=-l",
 		"-ldflags", "-s -w",
-		"-c", pkg,
-		"-o", testFile,
 	}
-	if cover {
-		args = append(args, "-covermode=atomic")
+	if b.cover {
+		flags = append(flags, "-covermode=atomic")
 	}
-	cmd := env.GoCmd("test", args...)
-	if stderr, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("could not build %s: %v\n%s", pkg, err, string(stderr))
+
+	var key string
+	var cached bool
+	if b.cache != nil {
+		var err error
+		if key, err = b.cache.key(b.env, b.gowork, pkg, flags); err != nil {
+			b.logf("Not caching test binary for %s: %v", pkg, err)
+		} else {
+			cached = b.cache.get(key, testFile)
+		}
+	}
+	if !cached {
+		cmd := b.env.GoCmd("test", append(flags, "-c", pkg, "-o", testFile)...)
+		cmd.Env = append(cmd.Env, workspaceEnv(b.gowork)...)
+		if stderr, err := cmd.CombinedOutput(); err != nil {
+			return false, fmt.Errorf("could not build %s: %v\n%s", pkg, err, string(stderr))
+		}
+		if key != "" {
+			if err := b.cache.put(key, testFile); err != nil {
+				b.logf("Could not cache test binary for %s: %v", pkg, err)
+			}
+			if err := b.cache.trim(time.Now()); err != nil {
+				b.logf("Could not trim test binary cache: %v", err)
+			}
+		}
 	}
 
 	// When a package does not contain any tests, the test
 	// executable is not generated, so it is not included in the
 	// `tests` list.
-	if _, err := os.Stat(testFile); !os.IsNotExist(err) {
-		pkgs, err := lookupPkgs(*env, "", pkg)
-		if err != nil {
-			return fmt.Errorf("failed to look up package %q: %v", pkg, err)
+	if _, err := os.Stat(testFile); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	pkgs, err := lookupPkgs(*b.env, b.gowork, "", pkg)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up package %q: %v", pkg, err)
+	}
+
+	// One directory = one package in standard Go, so
+	// finding the first file's parent directory should
+	// find us the package directory.
+	var dir, moduleRoot string
+	for _, p := range pkgs {
+		if len(p.GoFiles) > 0 {
+			dir = filepath.Dir(p.GoFiles[0])
+			moduleRoot = localModuleRoot(p, b.gowork)
 		}
+	}
+	if dir == "" {
+		return false, fmt.Errorf("could not find package directory for %q", pkg)
+	}
 
-		// One directory = one package in standard Go, so
-		// finding the first file's parent directory should
-		// find us the package directory.
-		var dir string
-		for _, p := range pkgs {
-			if len(p.GoFiles) > 0 {
-				dir = filepath.Dir(p.GoFiles[0])
-			}
+	if moduleRoot != "" {
+		// Mirror the module's layout so that paths relative to the
+		// package directory resolve the same way in the guest.
+		rel, err := filepath.Rel(dir, moduleRoot)
+		if err != nil {
+			return false, err
 		}
-		if dir == "" {
-			return fmt.Errorf("could not find package directory for %q", pkg)
+		moduleDest := filepath.Join(destDir, rel)
+		if r, err := filepath.Rel(b.testDir, moduleDest); err != nil || r == ".." || strings.HasPrefix(r, "../") {
+			return false, fmt.Errorf("module root %s of %q does not fit in test directory", moduleRoot, pkg)
 		}
-
-		// Optimistically copy any files in the pkg's
-		// directory, in case e.g. a testdata dir is there.
-		if err := copyRelativeFiles(dir, destDir); err != nil {
-			return err
+		if err := copyModuleRoot(moduleRoot, moduleDest); err != nil {
+			return false, err
 		}
 	}
-	return nil
+
+	// Optimistically copy any files in the pkg's
+	// directory, in case e.g. a testdata dir is there.
+	if err := copyRelativeFiles(dir, destDir); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Options configures a Go test.
@@ -96,6 +166,40 @@ type Options struct {
 	QEMUOpts    []qemu.Fn
 	Initramfs   []uimage.Modifier
 	TestTimeout time.Duration
+
+	// DebugShell starts an interactive shell in the guest if any test
+	// fails. See WithDebugShell.
+	DebugShell bool
+
+	// TestFlags are passed to each guest test binary, e.g.
+	// -test.count=2. See WithGoTestFlags.
+	TestFlags []string
+
+	// Cgo builds test binaries with cgo enabled. See WithCgo.
+	Cgo bool
+
+	// Wrapper is the guest command that each test binary runs under. See
+	// WithTestWrapper.
+	Wrapper []string
+
+	// SkipTests are patterns of guest tests to skip. See WithSkipTests.
+	SkipTests []string
+
+	// Report reports each guest test result to the host test. If nil,
+	// DefaultReport is used. See WithReportFunc.
+	Report ReportFunc
+
+	// CoverageSummary logs the coverage of each guest package. See
+	// WithCoverageSummary.
+	CoverageSummary bool
+
+	// Progress is called with each guest test event while the VM runs.
+	// See WithProgressFunc.
+	Progress ProgressFunc
+
+	// PrebuiltGuest boots the generic guest initramfs of GuestImage
+	// instead of building one. See WithPrebuiltGuest.
+	PrebuiltGuest bool
 }
 
 // Modifier is a configurator for Options.
@@ -109,6 +213,12 @@ func WithQEMUFn(fn ...qemu.Fn) Modifier {
 	}
 }
 
+// WithKernelArgs appends args to the guest kernel command line, e.g. to run
+// the tests with slub_debug or mitigations=off.
+func WithKernelArgs(args ...string) Modifier {
+	return WithQEMUFn(qemu.WithAppendKernel(args...))
+}
+
 // WithUimage merges o with already appended initramfs build options.
 func WithUimage(mods ...uimage.Modifier) Modifier {
 	return func(_ testing.TB, o *Options) error {
@@ -133,6 +243,18 @@ func WithGoTestTimeout(timeout time.Duration) Modifier {
 	}
 }
 
+// WithDebugShell keeps the VM alive when a guest test fails and serves an
+// interactive gosh shell on a unix domain socket for postmortem inspection.
+// The socket's path is logged at the start of the test.
+//
+// See qemu.WithDebugShell.
+func WithDebugShell() Modifier {
+	return func(t testing.TB, o *Options) error {
+		o.DebugShell = true
+		return nil
+	}
+}
+
 // Run compiles the tests added with WithPackageToTest and runs them in a QEMU
 // VM configured by mods. It collects the test results and provides a pass/fail
 // result of each individual test.
@@ -145,99 +267,131 @@ func WithGoTestTimeout(timeout time.Duration) Modifier {
 //
 // All files and directories in the same directory as the test package will be
 // made available to the test in the guest as well (e.g. testdata/
-// directories).
+// directories). If the package's module is part of a go.work workspace or
+// replaced by a local directory, the whole module is made available, with the
+// same layout relative to the package directory.
 //
 // Coverage from the Go tests is collected if a coverage file name is specified
 // via the VMTEST_GO_PROFILE env var, as well as integration test coverage if
-// VMTEST_GOCOVERDIR is set.
+// VMTEST_GOCOVERDIR is set. The coverage of each Run is appended to
+// VMTEST_GO_PROFILE, so that tests calling Run in parallel can share it. See
+// WithCoverageSummary to log the coverage of each package. Kernel coverage is
+// collected per test binary if VMTEST_KCOV_DIR is set; see
+// qcoverage.CollectKCOV.
+//
+// Compiled test binaries are cached across runs in VMTEST_GO_TEST_CACHE
+// (default: vmtest/gotest in the user's cache directory). Binaries not used
+// for 5 days are removed. Set it to "off" to always recompile.
+//
+// If VMTEST_NULLVM=1, the tests run in a null VM instead of QEMU (see package
+// qnull), as a fast pre-check.
+//
+// If VMTEST_JUNIT_DIR is set, a JUnit XML report of the guest test results is
+// written to it, named after the host test. If VMTEST_GITHUB_ANNOTATIONS is
+// set, failed guest tests are also printed as GitHub Actions ::error::
+// annotations.
+//
+// Run returns the result of each guest test, ordered by package and test name.
+// By default, failed guest tests also fail t; see WithReportFunc to customize.
 //
 //   - TODO: specify test, bench, fuzz filter. Flags for fuzzing.
-func Run(t testing.TB, name string, mods ...Modifier) {
-	qemu.SkipWithoutQEMU(t)
+func Run(t testing.TB, name string, mods ...Modifier) []TestResult {
+	backend := vmBackend(t)
 
-	goOpts := &Options{}
-	for _, mod := range mods {
-		if mod != nil {
-			if err := mod(t, goOpts); err != nil {
-				t.Fatal(err)
-			}
-		}
-	}
-	if len(goOpts.Packages) == 0 {
-		t.Fatal("No packages specified for govmtest")
+	goOpts := parseOptions(t, mods)
+	if err := checkPrebuiltGuest(goOpts); err != nil {
+		t.Fatal(err)
 	}
 
 	sharedDir := testtmp.TempDir(t)
+	saveArtifacts(t, name, sharedDir)
 	vmCoverProfile, ok := os.LookupEnv("VMTEST_GO_PROFILE")
-	if !ok {
+	if !ok && !goOpts.coverageSummary() {
 		t.Log("In-guest Go test coverage is not collected unless VMTEST_GO_PROFILE is set")
 	}
+	cover := len(vmCoverProfile) > 0 || goOpts.coverageSummary()
 
-	// Set up u-root build options.
-	env := golang.Default(golang.DisableCGO(), golang.WithGOARCH(string(qemu.GuestArch())))
-
-	// Statically build tests and add them to the temporary directory.
-	testDir := filepath.Join(sharedDir, "tests")
-
-	// Compile the Go tests. Place the test binaries in a directory that
-	// will be shared with the VM using 9P.
-	for _, pkg := range goOpts.Packages {
-		pkgDir := filepath.Join(testDir, pkg)
-		if err := compileTestAndData(env, pkg, pkgDir, len(vmCoverProfile) > 0); err != nil {
-			t.Fatal(err)
-		}
-	}
+	compiled, libs := compileTests(t, goOpts, sharedDir, cover)
 
 	var uinitArgs []string
-	if len(vmCoverProfile) > 0 {
+	if cover {
 		uinitArgs = append(uinitArgs, "-coverprofile=/mount/9p/gotestdata/coverage.profile")
 	}
 	if goOpts.TestTimeout > 0 {
 		uinitArgs = append(uinitArgs, fmt.Sprintf("-test_timeout=%s", goOpts.TestTimeout))
 	}
+	if len(goOpts.Wrapper) > 0 {
+		uinitArgs = append(uinitArgs, fmt.Sprintf("-wrapper=%s", strings.Join(goOpts.Wrapper, " ")))
+	}
+	if flags := goOpts.testBinaryFlags(); len(flags) > 0 {
+		uinitArgs = append(uinitArgs, append([]string{"--"}, flags...)...)
+	}
 
-	umods := append([]uimage.Modifier{
-		uimage.WithBusyboxCommands(
-			"github.com/u-root/u-root/cmds/core/init",
-			"github.com/hugelgupf/vmtest/vminit/shutdownafter",
-			"github.com/hugelgupf/vmtest/vminit/vmmount",
-			"github.com/hugelgupf/vmtest/vminit/gouinit",
-		),
-		uimage.WithBinaryCommands("cmd/test2json"),
-		uimage.WithInit("init"),
-		uimage.WithUinit("shutdownafter", append([]string{"--", "vmmount", "--", "gouinit"}, uinitArgs...)...),
-	}, goOpts.Initramfs...)
+	cmds := []string{
+		"github.com/u-root/u-root/cmds/core/init",
+		"github.com/hugelgupf/vmtest/vminit/shutdownafter",
+		"github.com/hugelgupf/vmtest/vminit/vmmount",
+		"github.com/hugelgupf/vmtest/vminit/gouinit",
+		"github.com/hugelgupf/vmtest/vminit/kcovexec",
+	}
+	uinitCmd := []string{"--", "vmmount", "--", "gouinit"}
+	var debugFns []qemu.Fn
+	if goOpts.DebugShell {
+		cmds = append(cmds,
+			"github.com/u-root/u-root/cmds/core/gosh",
+			"github.com/hugelgupf/vmtest/vminit/debugsh",
+		)
+		uinitCmd = []string{"--", "vmmount", "--", "debugsh", "--", "gouinit"}
+		debugFns = append(debugFns, qemu.WithDebugShellT(t))
+	}
+	progressFns, waitProgress := streamProgress(t, goOpts, filepath.Join(sharedDir, "results.json"))
+
+	var initramfs qemu.Fn
+	if goOpts.PrebuiltGuest {
+		initramfs = prebuiltGuest(t, sharedDir, uinitArgs)
+	} else {
+		initramfs = quimage.WithUimageT(t, append([]uimage.Modifier{
+			uimage.WithBusyboxCommands(cmds...),
+			uimage.WithInit("init"),
+			uimage.WithUinit("shutdownafter", append(uinitCmd, uinitArgs...)...),
+		}, append(libs, goOpts.Initramfs...)...)...)
+	}
 
 	// Create the initramfs and start the VM.
 	vm := qemu.StartT(t,
 		name,
 		qemu.ArchUseEnvv,
-		append([]qemu.Fn{
-			quimage.WithUimageT(t, umods...),
+		append(append(backend,
+			initramfs,
 			qemu.P9Directory(sharedDir, "gotestdata"),
 			qcoverage.CollectKernelCoverage(t),
+			qcoverage.CollectKCOV(t),
 			qcoverage.ShareGOCOVERDIR(),
+			qcoverage.ShareLLVMProfileDir(),
 			qemu.WithVmtestIdent(),
-		}, goOpts.QEMUOpts...)...)
+		), append(append(debugFns, progressFns...), goOpts.QEMUOpts...)...)...)
 	if err := vm.Wait(); err != nil {
 		t.Errorf("VM exited with %v", err)
 	}
+	waitProgress()
+
+	if len(goOpts.Wrapper) > 0 {
+		saveTraces(t, name, sharedDir)
+	}
 
 	// Collect Go coverage.
 	if len(vmCoverProfile) > 0 {
-		if err := cp.Copy(filepath.Join(sharedDir, "coverage.profile"), vmCoverProfile); err != nil {
-			t.Errorf("Could not copy coverage file: %v", err)
+		if err := qcoverage.AppendGoProfile(filepath.Join(sharedDir, "coverage.profile"), vmCoverProfile); err != nil {
+			t.Errorf("Could not append to coverage file: %v", err)
 		}
 	}
 
-	errors, err := qevent.ReadFile[testevent.ErrorEvent](filepath.Join(sharedDir, "errors.json"))
-	if err != nil {
-		t.Errorf("Reading test events: %v", err)
-	}
-	for _, e := range errors {
-		t.Errorf("Binary %s experienced error: %s", e.Binary, e.Error)
+	if goOpts.coverageSummary() {
+		logCoverageSummary(t, filepath.Join(sharedDir, "coverage.profile"))
 	}
 
+	reportErrors(t, sharedDir)
+
 	tc := json2test.NewTestCollector()
 	events, err := qevent.ReadFile[json2test.TestEvent](filepath.Join(sharedDir, "results.json"))
 	if err != nil {
@@ -246,19 +400,123 @@ func Run(t testing.TB, name string, mods ...Modifier) {
 	for _, event := range events {
 		tc.Handle(event)
 	}
-	// TODO: check that tc.Tests == tests
-	for pkg, test := range tc.Tests {
-		switch test.State {
-		case json2test.StateFail:
-			t.Errorf("Test %v failed:\n%v", pkg, test.FullOutput)
-		case json2test.StateSkip:
-			t.Logf("Test %v skipped", pkg)
-		case json2test.StatePass:
-			// Nothing.
-		default:
-			t.Errorf("Test %v left in state %v:\n%v", pkg, test.State, test.FullOutput)
+	for _, pkg := range compiled {
+		if _, ok := tc.Packages[pkg]; !ok {
+			t.Errorf("Package %s produced no test events (did the test binary crash or fail to start?)", pkg)
+		}
+	}
+	report := goOpts.Report
+	if report == nil {
+		report = DefaultReport
+	}
+	results := testResults(tc)
+	for _, r := range results {
+		report(t, r)
+	}
+	exportResults(t, tc)
+	return results
+}
+
+// vmBackend returns the Fns to run the guest in a null VM if enabled, and
+// otherwise skips t without QEMU.
+func vmBackend(t testing.TB) []qemu.Fn {
+	if qnull.Enabled() {
+		return []qemu.Fn{qnull.WithNullVM()}
+	}
+	qemu.SkipWithoutQEMU(t)
+	return nil
+}
+
+func parseOptions(t testing.TB, mods []Modifier) *Options {
+	goOpts := &Options{}
+	for _, mod := range mods {
+		if mod != nil {
+			if err := mod(t, goOpts); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(goOpts.Packages) == 0 {
+		t.Fatal("No packages specified for govmtest")
+	}
+	return goOpts
+}
+
+// compileTests compiles the Go tests and places the test binaries in
+// sharedDir/tests, a directory that will be shared with the VM using 9P.
+//
+// It returns the names of packages that have a test binary, as the guest
+// reports them in test events, and initramfs options for the shared libraries
+// that the test binaries need.
+func compileTests(t testing.TB, goOpts *Options, sharedDir string, cover bool) ([]string, []uimage.Modifier) {
+	// Set up u-root build options.
+	env := golang.Default(golang.DisableCGO(), golang.WithGOARCH(string(qemu.GuestArch())))
+	if goOpts.Cgo {
+		if string(qemu.GuestArch()) != runtime.GOARCH {
+			t.Fatalf("%v: guest architecture %s, host architecture %s", ErrCgoCrossArch, qemu.GuestArch(), runtime.GOARCH)
+		}
+		env.CgoEnabled = true
+	}
+
+	// Build tests and add them to the temporary directory.
+	gowork, err := goWorkspace(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := openTestCache()
+	if err != nil {
+		t.Logf("Not caching test binaries: %v", err)
+	}
+	b := &testBuilder{
+		env:     env,
+		gowork:  gowork,
+		cache:   cache,
+		testDir: filepath.Join(sharedDir, "tests"),
+		cover:   cover,
+		logf:    t.Logf,
+	}
+	var compiled, binaries []string
+	for _, pkg := range goOpts.Packages {
+		pkgDir := filepath.Join(b.testDir, pkg)
+		ok, err := b.compileTestAndData(pkg, pkgDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			// The guest derives package names from the binary's
+			// path relative to the test directory.
+			compiled = append(compiled, filepath.Clean(pkg))
+			binaries = append(binaries, testBinary(pkg, pkgDir))
 		}
 	}
+
+	if !goOpts.Cgo {
+		return compiled, nil
+	}
+	libs, err := sharedLibraries(binaries...)
+	if err != nil {
+		t.Fatalf("Could not find shared libraries of cgo test binaries: %v", err)
+	}
+	return compiled, []uimage.Modifier{uimage.WithFiles(libs...)}
+}
+
+// saveArtifacts saves guest event and coverage files from sharedDir as test
+// artifacts if the test fails.
+func saveArtifacts(t testing.TB, name, sharedDir string) {
+	for _, f := range []string{"results.json", "errors.json", "coverage.profile"} {
+		testartifacts.CopyOnFailure(t, name+"."+f, filepath.Join(sharedDir, f))
+	}
+}
+
+// reportErrors fails the test for any errors reported by the guest.
+func reportErrors(t testing.TB, sharedDir string) {
+	errors, err := qevent.ReadFile[testevent.ErrorEvent](filepath.Join(sharedDir, "errors.json"))
+	if err != nil {
+		t.Errorf("Reading test events: %v", err)
+	}
+	for _, e := range errors {
+		t.Errorf("Binary %s experienced error: %s", e.Binary, e.Error)
+	}
 }
 
 func copyRelativeFiles(src string, dst string) error {
@@ -0,0 +1,28 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+func TestWithKernelArgs(t *testing.T) {
+	t.Setenv("VMTEST_KERNEL_APPEND", "")
+
+	o := parseOptions(t, []Modifier{
+		WithPackageToTest("foo"),
+		WithKernelArgs("slub_debug", "mitigations=off"),
+		WithKernelArgs("quiet"),
+	})
+	qopts, err := qemu.OptionsFor(qemu.ArchAMD64, append([]qemu.Fn{qemu.WithKernel("./bzImage")}, o.QEMUOpts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "slub_debug mitigations=off quiet"; qopts.KernelArgs != want {
+		t.Errorf("KernelArgs = %q, want %q", qopts.KernelArgs, want)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/internal/testevent"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+	"github.com/hugelgupf/vmtest/qemu/quimage"
+	"github.com/hugelgupf/vmtest/testtmp"
+	"github.com/u-root/mkuimage/uimage"
+)
+
+// ListedTest is a test, benchmark, fuzz test, or example in a package added
+// with WithPackageToTest.
+type ListedTest struct {
+	Package string
+	Name    string
+}
+
+// ListTests compiles the tests added with WithPackageToTest and returns the
+// names of all their tests, benchmarks, fuzz tests, and examples without
+// running them, as reported by -test.list.
+//
+// Test binaries are listed on the host if it can execute them, i.e. if the
+// host is Linux with the guest's architecture. Otherwise, they are listed in
+// a QEMU VM configured by mods.
+//
+// Results are sorted by package, and in source order within a package.
+func ListTests(t testing.TB, name string, mods ...Modifier) []ListedTest {
+	goOpts := parseOptions(t, mods)
+	sharedDir := testtmp.TempDir(t)
+	compiled, libs := compileTests(t, goOpts, sharedDir, false)
+
+	var lists []testevent.TestListEvent
+	if runtime.GOOS == "linux" && string(qemu.GuestArch()) == runtime.GOARCH {
+		lists = listOnHost(t, sharedDir, compiled)
+	} else {
+		lists = listInGuest(t, name, sharedDir, goOpts, libs)
+	}
+
+	sort.SliceStable(lists, func(i, j int) bool {
+		return lists[i].Package < lists[j].Package
+	})
+	var tests []ListedTest
+	for _, l := range lists {
+		for _, n := range l.Names {
+			tests = append(tests, ListedTest{Package: l.Package, Name: n})
+		}
+	}
+	return tests
+}
+
+func listOnHost(t testing.TB, sharedDir string, compiled []string) []testevent.TestListEvent {
+	var lists []testevent.TestListEvent
+	for _, pkg := range compiled {
+		pkgDir := filepath.Join(sharedDir, "tests", pkg)
+		cmd := exec.Command(testBinary(pkg, pkgDir), "-test.list=.")
+		cmd.Dir = pkgDir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("Listing tests of %s failed: %v", pkg, err)
+			continue
+		}
+		lists = append(lists, testevent.TestListEvent{
+			Package: pkg,
+			Names:   strings.Fields(string(out)),
+		})
+	}
+	return lists
+}
+
+func listInGuest(t testing.TB, name, sharedDir string, goOpts *Options, libs []uimage.Modifier) []testevent.TestListEvent {
+	backend := vmBackend(t)
+
+	umods := append([]uimage.Modifier{
+		uimage.WithBusyboxCommands(
+			"github.com/u-root/u-root/cmds/core/init",
+			"github.com/hugelgupf/vmtest/vminit/shutdownafter",
+			"github.com/hugelgupf/vmtest/vminit/vmmount",
+			"github.com/hugelgupf/vmtest/vminit/gouinit",
+		),
+		uimage.WithInit("init"),
+		uimage.WithUinit("shutdownafter", "--", "vmmount", "--", "gouinit", "-list"),
+	}, append(libs, goOpts.Initramfs...)...)
+
+	vm := qemu.StartT(t,
+		name,
+		qemu.ArchUseEnvv,
+		append(append(backend,
+			quimage.WithUimageT(t, umods...),
+			qemu.P9Directory(sharedDir, "gotestdata"),
+			qemu.WithVmtestIdent(),
+		), goOpts.QEMUOpts...)...)
+	if err := vm.Wait(); err != nil {
+		t.Errorf("VM exited with %v", err)
+	}
+
+	reportErrors(t, sharedDir)
+
+	lists, err := qevent.ReadFile[testevent.TestListEvent](filepath.Join(sharedDir, "list.json"))
+	if err != nil {
+		t.Errorf("Reading test lists: %v", err)
+	}
+	return lists
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qartifacts"
+)
+
+// GuestImage is the container image with the prebuilt guest initramfs of
+// WithPrebuiltGuest, at /initramfs_$GOARCH.cpio for each guest architecture.
+const GuestImage = "ghcr.io/hugelgupf/vmtest/guest:main"
+
+// ErrPrebuiltGuest is returned for options that need an initramfs built for
+// the test, used together with WithPrebuiltGuest.
+var ErrPrebuiltGuest = errors.New("option cannot be used with the prebuilt guest initramfs")
+
+// gouinitArgsFile is where gouinit of the prebuilt guest reads its arguments
+// from, relative to the shared directory.
+const gouinitArgsFile = "gouinit.args"
+
+// WithPrebuiltGuest boots the guest with the generic initramfs of GuestImage
+// instead of building one for the test, saving the initramfs build. Test
+// binaries are shared with the guest over 9P either way.
+//
+// The initramfs is fetched like qartifacts.InitramfsFromImage, i.e. from
+// runvmtest's artifact cache or with docker or podman.
+//
+// The initramfs contains init, gosh, and vmtest's vminit commands, but no
+// other commands, so WithUimage, WithDebugShell, WithCgo, and test wrappers
+// (WithTestWrapper, WithStrace, WithPerfRecord) cannot be used.
+func WithPrebuiltGuest() Modifier {
+	return func(_ testing.TB, o *Options) error {
+		o.PrebuiltGuest = true
+		return nil
+	}
+}
+
+// checkPrebuiltGuest returns an error if goOpts asks for a prebuilt guest and
+// options that need a custom initramfs.
+func checkPrebuiltGuest(goOpts *Options) error {
+	if !goOpts.PrebuiltGuest {
+		return nil
+	}
+	switch {
+	case len(goOpts.Wrapper) > 0:
+		// Checked before Initramfs, which WithTestWrapper adds the
+		// wrapper binary to.
+		return fmt.Errorf("%w: WithTestWrapper", ErrPrebuiltGuest)
+	case len(goOpts.Initramfs) > 0:
+		return fmt.Errorf("%w: WithUimage", ErrPrebuiltGuest)
+	case goOpts.DebugShell:
+		return fmt.Errorf("%w: WithDebugShell", ErrPrebuiltGuest)
+	case goOpts.Cgo:
+		return fmt.Errorf("%w: WithCgo", ErrPrebuiltGuest)
+	}
+	return nil
+}
+
+// prebuiltGuest returns the Fn that boots the prebuilt guest initramfs, with
+// gouinit reading args from the shared directory.
+func prebuiltGuest(t testing.TB, sharedDir string, args []string) qemu.Fn {
+	b, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sharedDir, gouinitArgsFile), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return qartifacts.InitramfsFromImage(GuestImage, "/initramfs_"+string(qemu.GuestArch())+".cpio")
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/mkuimage/uimage"
+)
+
+func TestCheckPrebuiltGuest(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		mods   []Modifier
+		errStr string
+	}{
+		{name: "custom", mods: []Modifier{WithUimage(uimage.WithFiles("/etc/hosts"))}},
+		{name: "prebuilt", mods: []Modifier{WithPrebuiltGuest(), WithGoTestTimeout(0)}},
+		{name: "uimage", mods: []Modifier{WithPrebuiltGuest(), WithUimage(uimage.WithFiles("/etc/hosts"))}, errStr: "WithUimage"},
+		{name: "debugsh", mods: []Modifier{WithPrebuiltGuest(), WithDebugShell()}, errStr: "WithDebugShell"},
+		{name: "cgo", mods: []Modifier{WithPrebuiltGuest(), WithCgo()}, errStr: "WithCgo"},
+		{name: "wrapper", mods: []Modifier{WithPrebuiltGuest(), WithTestWrapper("sh", "-c")}, errStr: "WithTestWrapper"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			goOpts := parseOptions(t, append(tt.mods, WithPackageToTest("./...")))
+			err := checkPrebuiltGuest(goOpts)
+			if tt.errStr == "" {
+				if err != nil {
+					t.Errorf("checkPrebuiltGuest = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrPrebuiltGuest) || !strings.Contains(err.Error(), tt.errStr) {
+				t.Errorf("checkPrebuiltGuest = %v, want %v for %s", err, ErrPrebuiltGuest, tt.errStr)
+			}
+		})
+	}
+}
+
+func TestPrebuiltGuestArgs(t *testing.T) {
+	dir := t.TempDir()
+	want := []string{"-test_timeout=1m0s", "--", "-test.count=2"}
+	_ = prebuiltGuest(t, dir, want)
+
+	b, err := os.ReadFile(filepath.Join(dir, gouinitArgsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gouinit args = %v, want %v", got, want)
+	}
+}
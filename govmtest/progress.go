@@ -0,0 +1,100 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/json2test"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+)
+
+// ProgressFunc is called with each guest Go test event as the guest emits it,
+// while the VM is still running.
+type ProgressFunc func(t testing.TB, e json2test.TestEvent)
+
+// WithProgressFunc calls fn with each guest test event as it happens, e.g. to
+// watch long test runs or stop waiting for a VM once a test failed. Results
+// are still reported after the VM exits, see WithReportFunc.
+//
+// Output events are included. Use WithProgressLog to log test starts and
+// results.
+func WithProgressFunc(fn ProgressFunc) Modifier {
+	return func(_ testing.TB, o *Options) error {
+		o.Progress = fn
+		return nil
+	}
+}
+
+// WithProgressLog logs guest tests as they start and finish in the guest,
+// with the guest's timestamps, through t.Logf:
+//
+//	15:04:05.000 === RUN   pkg.TestFoo
+//	15:04:05.120 --- PASS: pkg.TestFoo (0.12s)
+func WithProgressLog() Modifier {
+	return WithProgressFunc(LogProgress)
+}
+
+// LogProgress logs test run, pause, continue, and result events through
+// t.Logf. It is the ProgressFunc of WithProgressLog.
+func LogProgress(t testing.TB, e json2test.TestEvent) {
+	if s := progressLine(e); s != "" {
+		t.Logf("%s", s)
+	}
+}
+
+// progressLine formats e as test2json's input, or returns "" for events that
+// are not about a test starting or finishing.
+func progressLine(e json2test.TestEvent) string {
+	var prefix string
+	switch e.Action {
+	case json2test.Run:
+		prefix = "=== RUN  "
+	case json2test.Pause:
+		prefix = "=== PAUSE"
+	case json2test.Continue:
+		prefix = "=== CONT "
+	case json2test.Pass:
+		prefix = "--- PASS:"
+	case json2test.Fail:
+		prefix = "--- FAIL:"
+	case json2test.Skip:
+		prefix = "--- SKIP:"
+	default:
+		return ""
+	}
+	name := e.Package
+	if e.Test != "" {
+		name += "." + e.Test
+	}
+	s := fmt.Sprintf("%s %s", prefix, name)
+	if e.Action == json2test.Pass || e.Action == json2test.Fail || e.Action == json2test.Skip {
+		s += fmt.Sprintf(" (%.2fs)", e.Elapsed)
+	}
+	if !e.Time.IsZero() {
+		s = e.Time.Format("15:04:05.000") + " " + s
+	}
+	return s
+}
+
+// streamProgress returns Fns that pass the guest test events written to
+// results to goOpts.Progress as they arrive, and a func that waits until
+// all were passed once the VM exited.
+func streamProgress(t testing.TB, goOpts *Options, results string) ([]qemu.Fn, func()) {
+	if goOpts.Progress == nil {
+		return nil, func() {}
+	}
+	events := make(chan json2test.TestEvent)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			goOpts.Progress(t, e)
+		}
+	}()
+	return []qemu.Fn{qevent.TailFile[json2test.TestEvent](results, events)}, func() { <-done }
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/vmtest/json2test"
+)
+
+func TestProgressLine(t *testing.T) {
+	at := time.Date(2024, 1, 2, 15, 4, 5, 120e6, time.UTC)
+	for _, tt := range []struct {
+		e    json2test.TestEvent
+		want string
+	}{
+		{
+			e:    json2test.TestEvent{Time: at, Action: json2test.Run, Package: "p", Test: "TestFoo"},
+			want: "15:04:05.120 === RUN   p.TestFoo",
+		},
+		{
+			e:    json2test.TestEvent{Action: json2test.Fail, Package: "p", Test: "TestFoo/sub", Elapsed: 1.5},
+			want: "--- FAIL: p.TestFoo/sub (1.50s)",
+		},
+		{
+			e:    json2test.TestEvent{Time: at, Action: json2test.Pass, Package: "p", Elapsed: 2},
+			want: "15:04:05.120 --- PASS: p (2.00s)",
+		},
+		{
+			e: json2test.TestEvent{Action: json2test.Output, Package: "p", Test: "TestFoo", Output: "hi\n"},
+		},
+	} {
+		if got := progressLine(tt.e); got != tt.want {
+			t.Errorf("progressLine(%+v) = %q, want %q", tt.e, got, tt.want)
+		}
+	}
+}
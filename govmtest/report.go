@@ -0,0 +1,46 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/json2test"
+)
+
+// exportResults writes guest test results in CI-friendly formats as requested
+// by VMTEST_JUNIT_DIR and VMTEST_GITHUB_ANNOTATIONS.
+func exportResults(t testing.TB, tc *json2test.TestCollector) {
+	if dir := os.Getenv("VMTEST_JUNIT_DIR"); dir != "" {
+		if err := writeJUnitXML(tc, dir, t.Name()); err != nil {
+			t.Errorf("Could not write JUnit XML report: %v", err)
+		}
+	}
+	if len(os.Getenv("VMTEST_GITHUB_ANNOTATIONS")) > 0 {
+		// Workflow commands must start at the beginning of a line, so they
+		// cannot go through t.Log.
+		if err := tc.WriteGitHubAnnotations(os.Stdout); err != nil {
+			t.Errorf("Could not write GitHub annotations: %v", err)
+		}
+	}
+}
+
+func writeJUnitXML(tc *json2test.TestCollector, dir, testName string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, strings.ReplaceAll(testName, "/", "_")+".xml"))
+	if err != nil {
+		return err
+	}
+	if err := tc.WriteJUnitXML(f, testName); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
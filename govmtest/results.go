@@ -0,0 +1,95 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/vmtest/json2test"
+)
+
+// TestState is the final state of a guest test.
+type TestState string
+
+// Test states, as reported by Go tests.
+const (
+	StatePass TestState = TestState(json2test.StatePass)
+	StateFail TestState = TestState(json2test.StateFail)
+	StateSkip TestState = TestState(json2test.StateSkip)
+
+	// StateRunning means that the test never finished, e.g. because the
+	// test binary or the guest crashed.
+	StateRunning TestState = TestState(json2test.StateRunning)
+)
+
+// TestResult is the outcome of one guest test or benchmark.
+type TestResult struct {
+	// Package is the Go package the test belongs to.
+	Package string
+
+	// Name is the test name, e.g. TestFoo or TestFoo/subtest.
+	Name string
+
+	// Benchmark is whether this is a benchmark rather than a test.
+	Benchmark bool
+
+	State   TestState
+	Elapsed time.Duration
+
+	// Output is all output of the test.
+	Output string
+}
+
+// ReportFunc reports a guest test's result to the host test t.
+type ReportFunc func(t testing.TB, r TestResult)
+
+// DefaultReport fails t for guest tests that failed or never finished, and
+// logs skipped tests.
+func DefaultReport(t testing.TB, r TestResult) {
+	switch r.State {
+	case StateFail:
+		t.Errorf("Test %s.%s failed:\n%s", r.Package, r.Name, r.Output)
+	case StateSkip:
+		t.Logf("Test %s.%s skipped", r.Package, r.Name)
+	case StatePass:
+		// Nothing.
+	default:
+		t.Errorf("Test %s.%s left in state %s:\n%s", r.Package, r.Name, r.State, r.Output)
+	}
+}
+
+// WithReportFunc replaces DefaultReport for reporting each guest test result
+// to the host test, e.g. to only log failures of quarantined tests. fn may
+// call DefaultReport for results it has no policy for.
+func WithReportFunc(fn ReportFunc) Modifier {
+	return func(_ testing.TB, o *Options) error {
+		o.Report = fn
+		return nil
+	}
+}
+
+// testResults returns tc's results ordered by package, then test name.
+func testResults(tc *json2test.TestCollector) []TestResult {
+	results := make([]TestResult, 0, len(tc.Tests))
+	for _, test := range tc.Tests {
+		results = append(results, TestResult{
+			Package:   test.Package,
+			Name:      test.Name,
+			Benchmark: test.Kind == json2test.KindBenchmark,
+			State:     TestState(test.State),
+			Elapsed:   time.Duration(test.Elapsed * float64(time.Second)),
+			Output:    test.FullOutput,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Package != results[j].Package {
+			return results[i].Package < results[j].Package
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
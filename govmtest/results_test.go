@@ -0,0 +1,38 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/vmtest/json2test"
+)
+
+func TestTestResults(t *testing.T) {
+	tc := json2test.NewTestCollector()
+	for _, e := range []json2test.TestEvent{
+		{Action: json2test.Run, Package: "b", Test: "TestB"},
+		{Action: json2test.Output, Package: "b", Test: "TestB", Output: "oops\n"},
+		{Action: json2test.Fail, Package: "b", Test: "TestB", Elapsed: 1.5},
+		{Action: json2test.Run, Package: "a", Test: "TestZ"},
+		{Action: json2test.Skip, Package: "a", Test: "TestZ"},
+		{Action: json2test.Run, Package: "a", Test: "BenchmarkA"},
+		{Action: json2test.Benchmark, Package: "a", Test: "BenchmarkA"},
+		{Action: json2test.Pass, Package: "a", Test: "BenchmarkA", Elapsed: 0.25},
+	} {
+		tc.Handle(e)
+	}
+
+	want := []TestResult{
+		{Package: "a", Name: "BenchmarkA", Benchmark: true, State: StatePass, Elapsed: 250 * time.Millisecond},
+		{Package: "a", Name: "TestZ", State: StateSkip},
+		{Package: "b", Name: "TestB", State: StateFail, Elapsed: 1500 * time.Millisecond, Output: "oops\n"},
+	}
+	if got := testResults(tc); !reflect.DeepEqual(got, want) {
+		t.Errorf("testResults =\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/vmtest/json2test"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/testtmp"
+)
+
+// ErrNoQEMUUser is returned when no qemu-user emulator is found for the guest
+// architecture.
+var ErrNoQEMUUser = errors.New("no qemu-user emulator found")
+
+// InUserEnv is set to 1 in the environment of test binaries run by RunUser.
+const InUserEnv = "VMTEST_IN_USER"
+
+// QEMUUser returns the command that runs binaries of arch on the host:
+// VMTEST_QEMU_USER if set, nothing if arch is the host's architecture, or
+// else qemu-$arch (e.g. qemu-aarch64) from $PATH.
+func QEMUUser(arch qemu.Arch) ([]string, error) {
+	if cmd := os.Getenv("VMTEST_QEMU_USER"); cmd != "" {
+		return []string{cmd}, nil
+	}
+	if string(arch) == runtime.GOARCH {
+		return nil, nil
+	}
+	suffix := arch.Env().QEMUArch
+	if suffix == "" {
+		return nil, fmt.Errorf("%w: %s", qemu.ErrUnsupportedArch, arch)
+	}
+	p, err := exec.LookPath("qemu-" + suffix)
+	if err != nil {
+		return nil, fmt.Errorf("%w for %s (install qemu-user or set VMTEST_QEMU_USER): %w", ErrNoQEMUUser, arch, err)
+	}
+	return []string{p}, nil
+}
+
+// RunUser compiles the tests added with WithPackageToTest for the guest
+// architecture (VMTEST_ARCH) and runs each test binary on the host under
+// qemu-user emulation instead of in a VM. See QEMUUser for how the emulator
+// is found; t is skipped if there is none.
+//
+// RunUser is for tests that do not need a guest kernel, e.g. cross-arch unit
+// tests of byte order or alignment, and is much faster than Run. The test
+// binaries run on the host kernel with the host's environment plus
+// VMTEST_IN_USER=1, in a copy of their package directory as in Run.
+// guest.SkipIfNotInVM skips tests.
+//
+// WithGoTestFlags, WithSkipTests, WithGoTestTimeout, WithCgo, and
+// WithReportFunc apply as in Run. The ProgressFunc of WithProgressFunc is
+// called with a test binary's events once it exits. VM options, such as
+// WithQEMUFn, WithUimage, and WithTestWrapper, are ignored, and coverage is
+// not collected.
+//
+// RunUser returns the result of each test, ordered by package and test name.
+func RunUser(t testing.TB, name string, mods ...Modifier) []TestResult {
+	goOpts := parseOptions(t, mods)
+
+	emulator, err := QEMUUser(qemu.GuestArch())
+	if errors.Is(err, ErrNoQEMUUser) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := testtmp.TempDir(t)
+	compiled, _ := compileTests(t, goOpts, dir, false)
+
+	timeout := goOpts.TestTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	// -test.v=test2json goes last, as in gouinit.
+	args := append(append([]string{"-test.bench=.", "-test.run=."}, goOpts.testBinaryFlags()...), "-test.v=test2json")
+
+	tc := json2test.NewTestCollector()
+	for _, pkg := range compiled {
+		bin := testBinary(pkg, filepath.Join(dir, "tests", pkg))
+		out, err := runUserTest(timeout, emulator, bin, args)
+		if err != nil {
+			t.Logf("%s: test %q exited with non-zero status: %v", name, pkg, err)
+		}
+		for _, e := range convertTestOutput(pkg, out, err) {
+			if goOpts.Progress != nil {
+				goOpts.Progress(t, e)
+			}
+			tc.Handle(e)
+		}
+		if _, ok := tc.Packages[pkg]; !ok {
+			t.Errorf("Package %s produced no test events (did the test binary crash or fail to start?)", pkg)
+		}
+	}
+
+	report := goOpts.Report
+	if report == nil {
+		report = DefaultReport
+	}
+	results := testResults(tc)
+	for _, r := range results {
+		report(t, r)
+	}
+	exportResults(t, tc)
+	return results
+}
+
+// runUserTest runs the test binary bin in its directory under emulator and
+// returns its output.
+func runUserTest(timeout time.Duration, emulator []string, bin string, args []string) ([]byte, error) {
+	// Send the kill signal with a 500ms grace period, as gouinit does.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+500*time.Millisecond)
+	defer cancel()
+
+	argv := append(append(append([]string{}, emulator...), bin), args...)
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = filepath.Dir(bin)
+	cmd.Env = append(os.Environ(), InUserEnv+"=1")
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	return out.Bytes(), err
+}
+
+// convertTestOutput converts the -test.v output of pkg's test binary, which
+// exited with runErr, to test events.
+func convertTestOutput(pkg string, out []byte, runErr error) []json2test.TestEvent {
+	var events []json2test.TestEvent
+	c := json2test.NewConverter(pkg, func(e json2test.TestEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	_, _ = c.Write(out)
+	c.Exited(runErr)
+	_ = c.Close()
+	return events
+}
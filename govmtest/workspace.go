@@ -0,0 +1,100 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+	"golang.org/x/tools/go/packages"
+)
+
+// goWorkspace returns the absolute path of the go.work file used by go
+// commands in env, or "" if workspace mode is off.
+func goWorkspace(env *golang.Environ) (string, error) {
+	out, err := env.GoCmd("env", "GOWORK").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not determine Go workspace: %w", err)
+	}
+	gowork := strings.TrimSpace(string(out))
+	if gowork == "off" {
+		return "", nil
+	}
+	return gowork, nil
+}
+
+// workspaceEnv returns environment variables that make test builds use the
+// go.work file gowork regardless of the directory they run in.
+//
+// -mod=mod is not allowed in workspace mode, so it is removed from GOFLAGS.
+func workspaceEnv(gowork string) []string {
+	if gowork == "" {
+		return nil
+	}
+	var flags []string
+	for _, f := range strings.Fields(os.Getenv("GOFLAGS")) {
+		if f != "-mod=mod" && f != "--mod=mod" {
+			flags = append(flags, f)
+		}
+	}
+	return []string{
+		"GOWORK=" + gowork,
+		"GOFLAGS=" + strings.Join(flags, " "),
+	}
+}
+
+// localModuleRoot returns the source directory of p's module if the module is
+// a workspace member or replaced by a local directory, and "" otherwise.
+//
+// Such modules are not in the module cache, so tests may refer to files
+// anywhere in them (e.g. ../testdata) rather than just in the package
+// directory.
+func localModuleRoot(p *packages.Package, gowork string) string {
+	m := p.Module
+	if m == nil {
+		return ""
+	}
+	if m.Replace != nil && m.Replace.Version == "" {
+		return m.Replace.Dir
+	}
+	if gowork != "" && m.Main {
+		return m.Dir
+	}
+	return ""
+}
+
+// copyModuleRoot copies the module rooted at src to dst, skipping VCS
+// metadata and nested modules. It does nothing if dst already contains the
+// module.
+func copyModuleRoot(src, dst string) error {
+	if _, err := os.Stat(filepath.Join(dst, "go.mod")); err == nil {
+		return nil
+	}
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && path != src {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), fi.Mode().Perm())
+		}
+		// Copies regular files only.
+		return copyRelativeFiles(path, filepath.Join(dst, rel))
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestLocalModuleRoot(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		module *packages.Module
+		gowork string
+		want   string
+	}{
+		{
+			name:   "no-module",
+			gowork: "/src/go.work",
+		},
+		{
+			name:   "main-module",
+			module: &packages.Module{Path: "example.com/a", Dir: "/src/a", Main: true},
+		},
+		{
+			name:   "workspace-member",
+			module: &packages.Module{Path: "example.com/a", Dir: "/src/a", Main: true},
+			gowork: "/src/go.work",
+			want:   "/src/a",
+		},
+		{
+			name:   "workspace-dependency",
+			module: &packages.Module{Path: "example.com/b", Version: "v1.0.0", Dir: "/gomodcache/example.com/b@v1.0.0"},
+			gowork: "/src/go.work",
+		},
+		{
+			name: "local-replace",
+			module: &packages.Module{
+				Path:    "example.com/b",
+				Version: "v1.0.0",
+				Replace: &packages.Module{Path: "../b", Dir: "/src/b"},
+			},
+			want: "/src/b",
+		},
+		{
+			name: "version-replace",
+			module: &packages.Module{
+				Path:    "example.com/b",
+				Version: "v1.0.0",
+				Replace: &packages.Module{Path: "example.com/c", Version: "v1.1.0", Dir: "/gomodcache/example.com/c@v1.1.0"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := localModuleRoot(&packages.Package{Module: tt.module}, tt.gowork); got != tt.want {
+				t.Errorf("localModuleRoot = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyModuleRoot(t *testing.T) {
+	src := t.TempDir()
+	for _, f := range []string{"go.mod", "testdata/a.txt", "pkg/pkg.go", ".git/HEAD", "nested/go.mod", "nested/b.txt"} {
+		p := filepath.Join(src, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(t.TempDir(), "example.com/a")
+	if err := copyModuleRoot(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"go.mod", "testdata/a.txt", "pkg/pkg.go"} {
+		if _, err := os.Stat(filepath.Join(dst, f)); err != nil {
+			t.Errorf("%s not copied: %v", f, err)
+		}
+	}
+	for _, f := range []string{".git", "nested"} {
+		if _, err := os.Stat(filepath.Join(dst, f)); !os.IsNotExist(err) {
+			t.Errorf("%s copied, want skipped", f)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/testartifacts"
+	"github.com/u-root/mkuimage/uimage"
+	"github.com/u-root/uio/cp"
+)
+
+// ErrNoWrapper is returned by WithTestWrapper when no command is given.
+var ErrNoWrapper = errors.New("test wrapper command must not be empty")
+
+// WithTestWrapper runs each guest test binary under wrapper, such as a tracer
+// or profiler: the guest runs `wrapper... testbinary testflags...`.
+//
+// wrapper[0] is a host binary, either a path or a name looked up in $PATH. It
+// is added to the initramfs along with its shared libraries, so it must be
+// built for the guest architecture.
+//
+// In the remaining arguments, {output} is replaced with a per-package file in
+// the guest. At the end of the test, these files are saved as the test
+// artifact {name}.traces (see package testartifacts). Arguments must not
+// contain spaces.
+func WithTestWrapper(wrapper ...string) Modifier {
+	return func(_ testing.TB, o *Options) error {
+		if len(wrapper) == 0 || wrapper[0] == "" {
+			return ErrNoWrapper
+		}
+		for _, arg := range wrapper {
+			if strings.ContainsAny(arg, " \t\n") {
+				return fmt.Errorf("test wrapper argument %q must not contain spaces", arg)
+			}
+		}
+		bin, err := exec.LookPath(wrapper[0])
+		if err != nil {
+			return fmt.Errorf("test wrapper: %w", err)
+		}
+
+		guestBin := "/bin/" + filepath.Base(bin)
+		o.Initramfs = append(o.Initramfs, uimage.WithFiles(fmt.Sprintf("%s:%s", bin, guestBin[1:])))
+		o.Wrapper = append([]string{guestBin}, wrapper[1:]...)
+		return nil
+	}
+}
+
+// WithStrace runs each guest test binary under `strace -f`, with additional
+// strace args.
+//
+// See WithTestWrapper for where the traces are saved.
+func WithStrace(args ...string) Modifier {
+	return WithTestWrapper(append([]string{"strace", "-f", "-o", "{output}"}, args...)...)
+}
+
+// WithPerfRecord runs each guest test binary under `perf record`, with
+// additional perf record args (e.g. -g).
+//
+// The guest kernel must support perf events. See WithTestWrapper for where
+// the profiles are saved.
+func WithPerfRecord(args ...string) Modifier {
+	return WithTestWrapper(append([]string{"perf", "record", "-o", "{output}"}, args...)...)
+}
+
+// saveTraces saves the test wrapper output files from sharedDir as a test
+// artifact.
+func saveTraces(t testing.TB, name, sharedDir string) {
+	src := filepath.Join(sharedDir, "traces")
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		t.Logf("Test wrapper produced no output files")
+		return
+	}
+	dst := testartifacts.Path(t, name+".traces")
+	if err := cp.CopyTree(src, dst); err != nil {
+		t.Errorf("Could not save test wrapper output: %v", err)
+		return
+	}
+	t.Logf("Test wrapper output saved in %s", dst)
+}
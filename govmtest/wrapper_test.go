@@ -0,0 +1,58 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package govmtest
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestWithTestWrapper(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skipf("Test requires sh: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		wrapper []string
+		want    []string
+		wantErr error
+	}{
+		{
+			name:    "empty",
+			wantErr: ErrNoWrapper,
+		},
+		{
+			name:    "host-path",
+			wrapper: []string{"sh", "-c", "{output}"},
+			want:    []string{"/bin/sh", "-c", "{output}"},
+		},
+		{
+			name:    "not-found",
+			wrapper: []string{"vmtest-does-not-exist"},
+			wantErr: exec.ErrNotFound,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Options{}
+			err := WithTestWrapper(tt.wrapper...)(t, o)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("WithTestWrapper = %v, want %v", err, tt.wantErr)
+			}
+			if !slices.Equal(o.Wrapper, tt.want) {
+				t.Errorf("Wrapper = %v, want %v", o.Wrapper, tt.want)
+			}
+			if tt.want != nil && len(o.Initramfs) != 1 {
+				t.Errorf("Wrapper binary was not added to the initramfs")
+			}
+		})
+	}
+
+	if err := WithTestWrapper("sh", "-c", "echo hi")(t, &Options{}); err == nil {
+		t.Errorf("WithTestWrapper accepted argument with spaces")
+	}
+}
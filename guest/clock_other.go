@@ -0,0 +1,18 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || openbsd || solaris)
+
+package guest
+
+import "time"
+
+var processStart = time.Now()
+
+// monotonic returns the monotonic time since the process started, as the
+// guest has no CLOCK_MONOTONIC. The host only relies on it increasing
+// steadily.
+func monotonic() (time.Duration, error) {
+	return time.Since(processStart), nil
+}
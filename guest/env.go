@@ -0,0 +1,15 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !freebsd
+
+package guest
+
+import "os"
+
+// kernelEnv returns the value of the kernel command line variable key, which
+// Linux passes to init in its environment.
+func kernelEnv(key string) string {
+	return os.Getenv(key)
+}
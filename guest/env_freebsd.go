@@ -0,0 +1,25 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// kernelEnv returns the value of the variable key from the environment or,
+// if it is not set there, from the kernel environment (kenv(1)), e.g. as set
+// in loader.conf.
+func kernelEnv(key string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	out, err := exec.Command("kenv", "-q", key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
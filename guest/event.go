@@ -5,20 +5,121 @@
 package guest
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hugelgupf/vmtest/internal/eventchannel"
 )
 
+// DefaultEventBuffer is the default number of events an Emitter buffers
+// while the host is busy.
+const DefaultEventBuffer = 1024
+
+// ackTimeout is how long Close waits for the host to acknowledge the final
+// event.
+const ackTimeout = 30 * time.Second
+
+var (
+	// ErrCommandChannelMissingDoneEvent is returned by WaitCommands when
+	// the host did not indicate that no more commands are coming.
+	ErrCommandChannelMissingDoneEvent = errors.New("never received the final host command")
+
+	// ErrEventDropped is returned by Emit when the event buffer is full
+	// and the Emitter was configured with WithDropWhenFull.
+	ErrEventDropped = errors.New("event channel buffer full, event dropped")
+
+	// ErrAckTimeout is returned by Close when the host did not acknowledge
+	// the final event in time.
+	ErrAckTimeout = errors.New("host did not acknowledge the final event channel event")
+)
+
+// EmitterOption configures an Emitter.
+type EmitterOption func(*emitterOptions)
+
+type emitterOptions struct {
+	buffer       int
+	dropWhenFull bool
+	gob          bool
+}
+
+// WithEventBuffer sets the number of events buffered while the host is busy.
+// The default is DefaultEventBuffer.
+func WithEventBuffer(n int) EmitterOption {
+	return func(o *emitterOptions) {
+		o.buffer = n
+	}
+}
+
+// WithGobEncoding encodes events with encoding/gob instead of one JSON object
+// per line. Gob is more compact and faster to decode for high-volume events.
+// The host detects the encoding, so no host configuration is needed.
+//
+// T must be encodable with gob; concrete types of interface values must be
+// registered with gob.Register on both host and guest.
+//
+// For channels opened by name, the host can request gob with qevent.WithGob.
+func WithGobEncoding() EmitterOption {
+	return func(o *emitterOptions) {
+		o.gob = true
+	}
+}
+
+// WithDropWhenFull makes Emit drop events rather than wait when the event
+// buffer is full, so that a slow host does not block the guest. Emit then
+// returns ErrEventDropped, and the host reports the dropped events when the
+// VM exits.
+func WithDropWhenFull() EmitterOption {
+	return func(o *emitterOptions) {
+		o.dropWhenFull = true
+	}
+}
+
 // Emitter is an event channel emitter.
+//
+// Events are numbered and buffered; a separate goroutine writes them to the
+// host. If the channel is readable, the host acknowledges the events it
+// processed.
 type Emitter[T any] struct {
 	file  *os.File
 	w     *io.PipeWriter
 	errCh chan error
+
+	opts emitterOptions
+
+	// mu serializes numbering, encoding, and queueing events.
+	mu       sync.Mutex
+	gob      *gob.Encoder
+	gobBuf   bytes.Buffer
+	seq      uint64
+	queued   uint64
+	queue    chan []byte
+	warnOnce sync.Once
+
+	// writeErr is the first error writing to file, and written is closed
+	// when the writer goroutine exits.
+	writeErr atomic.Pointer[error]
+	written  chan struct{}
+
+	// acked is the sequence number the host last acknowledged. ackNotify
+	// is signaled when it changes, and hostGone is closed when there is
+	// nothing more to read from the host. hostGone is nil for write-only
+	// channels.
+	acked     atomic.Uint64
+	ackNotify chan struct{}
+	hostGone  chan struct{}
+
+	// commandsErr receives the result of processing host commands, if
+	// the channel is bidirectional.
+	commandsErr chan error
 }
 
 // EventChannel opens an event channel to the host over the given device.
@@ -29,14 +130,39 @@ type Emitter[T any] struct {
 //
 // T should be the type of a JSON event being sent, matching the host
 // configuration on qemu.EventChannel reading from this channel.
-func EventChannel[T any](path string) (*Emitter[T], error) {
+func EventChannel[T any](path string, opts ...EmitterOption) (*Emitter[T], error) {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_SYNC, 0o777)
 	if err != nil {
 		return nil, err
 	}
+	return newEmitter[T](f, opts), nil
+}
 
+func newEmitter[T any](f *os.File, opts []EmitterOption) *Emitter[T] {
+	o := emitterOptions{buffer: DefaultEventBuffer}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	emit := &Emitter[T]{
-		file: f,
+		file:    f,
+		opts:    o,
+		queue:   make(chan []byte, max(o.buffer, 1)),
+		written: make(chan struct{}),
+	}
+	go emit.writeQueue()
+	if o.gob {
+		emit.gob = gob.NewEncoder(&emit.gobBuf)
+		emit.queue <- []byte(eventchannel.GobMagic)
+	}
+	// The open event lets the host check that it expects the same event
+	// schema, and correlate its clock with the guest's.
+	open := eventchannel.Event[T]{
+		GuestAction: eventchannel.ActionOpen,
+		Version:     eventchannel.Version,
+		Type:        eventchannel.TypeID[T](),
+	}
+	if b, err := emit.encode(stamp(open)); err == nil {
+		emit.queue <- b
 	}
 
 	r, w := io.Pipe()
@@ -52,7 +178,97 @@ func EventChannel[T any](path string) (*Emitter[T], error) {
 	}()
 	emit.w = w
 	emit.errCh = errCh
-	return emit, nil
+	return emit
+}
+
+// writeQueue writes queued events to the host. After an error, remaining
+// events are discarded.
+func (e *Emitter[T]) writeQueue() {
+	defer close(e.written)
+	for b := range e.queue {
+		if e.writeErr.Load() != nil {
+			continue
+		}
+		if n, err := e.file.Write(b); err != nil {
+			e.writeErr.Store(&err)
+		} else if n != len(b) {
+			err := fmt.Errorf("incomplete write: want %d, sent %d", len(b), n)
+			e.writeErr.Store(&err)
+		}
+	}
+}
+
+// readHost processes acknowledgements and commands sent by the host, calling
+// command for each host command if it is not nil.
+func (e *Emitter[T]) readHost(command func(json.RawMessage) error) {
+	e.ackNotify = make(chan struct{}, 1)
+	e.hostGone = make(chan struct{})
+	if command != nil {
+		e.commandsErr = make(chan error, 1)
+	}
+	go func() {
+		defer close(e.hostGone)
+		var gotDone bool
+		err := eventchannel.ProcessJSONByLine[eventchannel.Command[json.RawMessage]](e.file, func(c eventchannel.Command[json.RawMessage]) {
+			switch c.HostAction {
+			case eventchannel.ActionAck:
+				e.acked.Store(c.Seq)
+				select {
+				case e.ackNotify <- struct{}{}:
+				default:
+				}
+
+			case eventchannel.ActionHostCommand:
+				if command != nil && !gotDone {
+					if err := command(c.Actual); err != nil {
+						log.Printf("Error handling host command: %v", err)
+					}
+				}
+
+			case eventchannel.ActionDone:
+				if command != nil && !gotDone {
+					e.commandsErr <- nil
+				}
+				gotDone = true
+			}
+		})
+		if command != nil && !gotDone {
+			if err == nil {
+				err = ErrCommandChannelMissingDoneEvent
+			}
+			e.commandsErr <- err
+		}
+	}()
+}
+
+// handleCommands calls callback for each host command read from the event
+// channel file, until the host sends the "done" command.
+func handleCommands[T, C any](e *Emitter[T], callback func(C)) {
+	e.readHost(func(b json.RawMessage) error {
+		var c C
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &c); err != nil {
+				return fmt.Errorf("JSON error (command: %s): %w", b, err)
+			}
+		}
+		callback(c)
+		return nil
+	})
+}
+
+// WaitCommands waits until the host has sent all commands and the callbacks
+// for them have returned. It returns immediately for channels that do not
+// receive host commands.
+//
+// WaitCommands must not be called from a command callback.
+func (e *Emitter[T]) WaitCommands() error {
+	if e.commandsErr == nil {
+		return nil
+	}
+	err := <-e.commandsErr
+	// Allow calling WaitCommands again.
+	e.commandsErr <- err
+	return err
 }
 
 // Write writes JSON bytes on the event channel. Write expects events to be
@@ -65,40 +281,256 @@ func (e *Emitter[T]) Write(p []byte) (int, error) {
 }
 
 // Emit emits one T event.
+//
+// Emit returns once the event is buffered. If the buffer is full, Emit waits
+// for the host, or drops the event if the Emitter was configured with
+// WithDropWhenFull. Errors writing earlier events are returned by subsequent
+// calls.
 func (e *Emitter[T]) Emit(t T) error {
 	return e.sendEvent(eventchannel.Event[T]{
 		Actual:      t,
 		GuestAction: eventchannel.ActionGuestEvent,
-	})
+	}, false)
 }
 
-func (e *Emitter[T]) sendEvent(event eventchannel.Event[T]) error {
-	b, err := json.Marshal(event)
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+// Dropped returns the number of events Emit dropped because the buffer was
+// full.
+func (e *Emitter[T]) Dropped() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped()
+}
+
+func (e *Emitter[T]) dropped() uint64 {
+	// Events that made it into the queue are never dropped, and every
+	// event consumes a sequence number.
+	return e.seq - e.queued
+}
+
+func (e *Emitter[T]) sendEvent(event eventchannel.Event[T], wait bool) error {
+	if err := e.writeErr.Load(); err != nil {
+		return *err
 	}
 
-	b = append(b, '\n')
-	if n, err := e.file.Write(b); err != nil {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Only sendEvent adds to the queue, so it cannot fill up meanwhile.
+	full := len(e.queue) == cap(e.queue)
+	if full && e.opts.dropWhenFull && !wait {
+		// The dropped event consumes a sequence number, so that the
+		// host can tell it is missing.
+		e.seq++
+		return fmt.Errorf("%w (event %d)", ErrEventDropped, e.seq)
+	}
+
+	event.Seq = e.seq + 1
+	b, err := e.encode(stamp(event))
+	if err != nil {
 		return err
-	} else if n != len(b) {
-		return fmt.Errorf("incomplete write: want %d, sent %d", len(b), n)
+	}
+	e.seq++
+
+	if full {
+		e.warnOnce.Do(func() {
+			log.Printf("Event channel buffer full, waiting for the host to process events")
+		})
+	}
+	e.queue <- b
+	e.queued++
+	return nil
+}
+
+// stamp sets the guest timestamps of event.
+func stamp[T any](event eventchannel.Event[T]) eventchannel.Event[T] {
+	event.Wall = time.Now().UnixNano()
+	if mono, err := monotonic(); err == nil {
+		event.Mono = mono.Nanoseconds()
+	}
+	return event
+}
+
+// encode encodes event for the host. Callers must hold mu, since gob
+// encodings depend on the events encoded before.
+func (e *Emitter[T]) encode(event eventchannel.Event[T]) ([]byte, error) {
+	if e.gob != nil {
+		e.gobBuf.Reset()
+		if err := e.gob.Encode(event); err != nil {
+			return nil, fmt.Errorf("failed to encode gob: %w", err)
+		}
+		return bytes.Clone(e.gobBuf.Bytes()), nil
+	}
+
+	var v any = event
+	if event.GuestAction != eventchannel.ActionGuestEvent {
+		// JSON does not omit empty structs, and hosts with another
+		// event schema must be able to decode control events.
+		v = eventchannel.Event[json.RawMessage]{
+			GuestAction: event.GuestAction,
+			Seq:         event.Seq,
+			Mono:        event.Mono,
+			Wall:        event.Wall,
+			Version:     event.Version,
+			Type:        event.Type,
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return eventchannel.EncodeLine(b), nil
+}
+
+// waitAck waits until the host acknowledged seq, or until the host is gone.
+func (e *Emitter[T]) waitAck(seq uint64) error {
+	if e.hostGone == nil {
+		return nil
+	}
+	timeout := time.NewTimer(ackTimeout)
+	defer timeout.Stop()
+	for e.acked.Load() < seq {
+		select {
+		case <-e.ackNotify:
+		case <-e.hostGone:
+			return nil
+		case <-timeout.C:
+			return ErrAckTimeout
+		}
 	}
 	return nil
 }
 
 // Close sends the "done" event to assure the host there will be no more events
 // and closes the event channel.
+//
+// For channels the host acknowledges events on, Close waits for the host to
+// process all events.
 func (e *Emitter[T]) Close() error {
 	// Ensure that ActionDone is the last event we send by waiting for
 	// Goroutine to exit first.
 	e.w.Close()
 	err := <-e.errCh
 
-	if werr := e.sendEvent(eventchannel.Event[T]{GuestAction: eventchannel.ActionDone}); werr != nil && err != nil {
+	// The done event carries the last sequence number, so the host can
+	// tell how many events were dropped.
+	if werr := e.sendEvent(eventchannel.Event[T]{GuestAction: eventchannel.ActionDone}, true); werr != nil && err == nil {
 		err = werr
 	}
+	close(e.queue)
+	<-e.written
+	if werr := e.writeErr.Load(); werr != nil && err == nil {
+		err = *werr
+	}
+	if err == nil {
+		e.mu.Lock()
+		seq := e.seq
+		e.mu.Unlock()
+		err = e.waitAck(seq)
+	}
 	_ = e.file.Sync()
 	e.file.Close()
 	return err
 }
+
+// ErrNoVirtioSerial is returned when there is no virtio-serial port with the
+// requested name.
+var ErrNoVirtioSerial = errors.New("no virtio-serial device")
+
+// ErrVsockUnsupported is returned by vsock event channels on guests without
+// vsock support.
+var ErrVsockUnsupported = errors.New("vsock event channels are only supported in Linux guests")
+
+// VirtioSerialDevice looks up the device path for the given virtio-serial
+// name.
+//
+// The name would be configured in the QEMU command-line (or e.g. with
+// qemu.EventChannel). Linux and FreeBSD guests are supported; on other
+// guests, the error wraps ErrNoVirtioSerial.
+//
+// In a null VM, the path of the port's host end is returned.
+func VirtioSerialDevice(name string) (string, error) {
+	if p, ok := os.LookupEnv(eventchannel.NullVMPortEnvPrefix + name); ok {
+		return p, nil
+	}
+	return virtioSerialDevice(name)
+}
+
+// SerialEventChannel opens an event channel to the host over virtio-serial
+// with the given virtio-serial port name.
+//
+// Callers must call Close on Emitter to publish a final "done" event to signal
+// the host no more events are coming. If the "done" event is not published,
+// qemu.EventChannel is configured to return an error on VM exit on the host.
+//
+// T should be the type of a JSON event being sent, matching the host
+// configuration on qemu.EventChannel reading from this channel.
+//
+// The name should match the qemu.EventChannel configuration on the host as
+// well. If the host configured the channel with qevent.WithVsock, the event
+// channel is opened with VsockEventChannel instead.
+//
+// The host acknowledges the events it processed, so Close waits for the host
+// to process all events. Events are gob encoded if the host requested it with
+// qevent.WithGob.
+func SerialEventChannel[T any](name string, opts ...EmitterOption) (*Emitter[T], error) {
+	f, err := openSerial(name)
+	if err != nil {
+		return nil, err
+	}
+	e := newEmitter[T](f, append(hostOptions(name), opts...))
+	e.readHost(nil)
+	return e, nil
+}
+
+// SerialCommandChannel opens a bidirectional event channel to the host like
+// SerialEventChannel, configured on the host with qevent.WithCommands.
+//
+// callback is called for each command C the host sends, in order, on a
+// separate goroutine. Use WaitCommands to wait for the host to finish sending
+// commands. Commands arriving after Close are dropped.
+func SerialCommandChannel[T, C any](name string, callback func(C), opts ...EmitterOption) (*Emitter[T], error) {
+	f, err := openSerial(name)
+	if err != nil {
+		return nil, err
+	}
+	e := newEmitter[T](f, append(hostOptions(name), opts...))
+	handleCommands(e, callback)
+	return e, nil
+}
+
+// hostOptions returns the Emitter options the host requested for the named
+// event channel.
+func hostOptions(name string) []EmitterOption {
+	if kernelEnv(eventchannel.EncodingEnvPrefix+name) == eventchannel.EncodingGob {
+		return []EmitterOption{WithGobEncoding()}
+	}
+	return nil
+}
+
+// openSerial opens the named event channel for reading and writing, over
+// vsock if the host configured it so.
+func openSerial(name string) (*os.File, error) {
+	if _, ok := os.LookupEnv(eventchannel.VsockPortEnvPrefix + name); ok {
+		return dialVsock(name)
+	}
+	dev, err := VirtioSerialDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(dev, os.O_RDWR|os.O_SYNC, 0)
+}
+
+// VsockEventChannel opens an event channel to the host over vsock, configured
+// on the host with qevent.EventChannel and qevent.WithVsock with the given
+// name.
+//
+// Callers must call Close on Emitter to publish a final "done" event to signal
+// the host no more events are coming.
+func VsockEventChannel[T any](name string, opts ...EmitterOption) (*Emitter[T], error) {
+	f, err := dialVsock(name)
+	if err != nil {
+		return nil, err
+	}
+	e := newEmitter[T](f, append(hostOptions(name), opts...))
+	e.readHost(nil)
+	return e, nil
+}
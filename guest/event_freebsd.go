@@ -0,0 +1,26 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FreeBSD's virtio_console driver creates a device for each named port.
+const vtconDir = "/dev/vtcon"
+
+func virtioSerialDevice(name string) (string, error) {
+	dev := filepath.Join(vtconDir, name)
+	if _, err := os.Stat(dev); err != nil {
+		return "", fmt.Errorf("%w with name %s: %w", ErrNoVirtioSerial, name, err)
+	}
+	return dev, nil
+}
+
+func dialVsock(name string) (*os.File, error) {
+	return nil, ErrVsockUnsupported
+}
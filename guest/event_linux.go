@@ -8,17 +8,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/hugelgupf/vmtest/internal/eventchannel"
+	"golang.org/x/sys/unix"
 )
 
 const ports = "/sys/class/virtio-ports"
 
-// VirtioSerialDevice looks up the device path for the given virtio-serial
-// name.
-//
-// The name would be configured in the QEMU command-line (or e.g. with
-// qemu.EventChannel).
-func VirtioSerialDevice(name string) (string, error) {
+func virtioSerialDevice(name string) (string, error) {
 	entries, err := os.ReadDir(ports)
 	if err != nil {
 		return "", err
@@ -33,25 +32,22 @@ func VirtioSerialDevice(name string) (string, error) {
 			return filepath.Join("/dev", entry.Name()), nil
 		}
 	}
-	return "", fmt.Errorf("no virtio-serial device with name %s", name)
+	return "", fmt.Errorf("%w with name %s", ErrNoVirtioSerial, name)
 }
 
-// SerialEventChannel opens an event channel to the host over virtio-serial
-// with the given virtio-serial port name.
-//
-// Callers must call Close on Emitter to publish a final "done" event to signal
-// the host no more events are coming. If the "done" event is not published,
-// qemu.EventChannel is configured to return an error on VM exit on the host.
-//
-// T should be the type of a JSON event being sent, matching the host
-// configuration on qemu.EventChannel reading from this channel.
-//
-// The name should match the qemu.EventChannel configuration on the host as
-// well.
-func SerialEventChannel[T any](name string) (*Emitter[T], error) {
-	dev, err := VirtioSerialDevice(name)
+func dialVsock(name string) (*os.File, error) {
+	env := eventchannel.VsockPortEnvPrefix + name
+	port, err := strconv.ParseUint(os.Getenv(env), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("no vsock event channel with name %s (%s: %w)", name, env, err)
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not create vsock socket: %w", err)
+	}
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_HOST, Port: uint32(port)}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not connect to vsock event channel %s: %w", name, err)
 	}
-	return EventChannel[T](dev)
+	return os.NewFile(uintptr(fd), "vsock:"+name), nil
 }
@@ -0,0 +1,21 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !freebsd
+
+package guest
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func virtioSerialDevice(name string) (string, error) {
+	return "", fmt.Errorf("%w with name %s: virtio-serial ports cannot be looked up on %s", ErrNoVirtioSerial, name, runtime.GOOS)
+}
+
+func dialVsock(name string) (*os.File, error) {
+	return nil, ErrVsockUnsupported
+}
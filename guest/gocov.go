@@ -0,0 +1,94 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hugelgupf/vmtest/internal/testevent"
+)
+
+// goCovChunk is the size of each GOCOVERDIR event, keeping events well below
+// the event channel's line limit once base64-encoded.
+const goCovChunk = 32 * 1024
+
+type chunkWriter struct {
+	e *Emitter[testevent.ChunkEvent]
+}
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += goCovChunk {
+		if err := w.e.Emit(testevent.ChunkEvent{Data: p[i:min(len(p), i+goCovChunk)]}); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// StreamGOCOVERDIR sends the files in GOCOVERDIR as a tar file to the host
+// over the "gocov" virtio-serial port, if qcoverage.StreamGOCOVERDIR set it
+// up.
+//
+// Call it after all commands with coverage have exited, e.g. right before
+// powering off.
+func StreamGOCOVERDIR() {
+	if _, err := VirtioSerialDevice("gocov"); err != nil {
+		return
+	}
+	if err := streamGOCOVERDIR(os.Getenv("GOCOVERDIR")); err != nil {
+		log.Printf("Failed to stream GOCOVERDIR: %v", err)
+	}
+}
+
+func streamGOCOVERDIR(dir string) (err error) {
+	e, err := SerialEventChannel[testevent.ChunkEvent]("gocov")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := e.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if dir == "" {
+		return fmt.Errorf("GOCOVERDIR is not set")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(chunkWriter{e}, goCovChunk)
+	tw := tar.NewWriter(bw)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     entry.Name(),
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(b)),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -12,38 +12,50 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/hugelgupf/vmtest/internal/gcovsource"
 	"github.com/u-root/u-root/pkg/tarutil"
 )
 
-// gcovFilter filters on all files ending with a gcda or gcno extension.
-func gcovFilter(hdr *tar.Header) bool {
-	if hdr.Typeflag == tar.TypeDir {
-		hdr.Mode = 0o770
-		return true
+// gcovFilter filters on all files ending with a gcda or gcno extension in
+// the given kernel source subtrees (all if sources is empty).
+func gcovFilter(sources []string) tarutil.Filter {
+	return func(hdr *tar.Header) bool {
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0o770
+			return true
+		}
+		if !gcovsource.Match(hdr.Name, sources) {
+			return false
+		}
+		if (filepath.Ext(hdr.Name) == ".gcda" && hdr.Typeflag == tar.TypeReg) ||
+			(filepath.Ext(hdr.Name) == ".gcno" && hdr.Typeflag == tar.TypeSymlink) {
+			hdr.Mode = 0o660
+			return true
+		}
+		return false
 	}
-	if (filepath.Ext(hdr.Name) == ".gcda" && hdr.Typeflag == tar.TypeReg) ||
-		(filepath.Ext(hdr.Name) == ".gcno" && hdr.Typeflag == tar.TypeSymlink) {
-		hdr.Mode = 0o660
-		return true
-	}
-	return false
 }
 
 // CollectKernelCoverage saves the kernel coverage report to a tar file.
 //
 // Assumes that the `vmmount` command has been used to mount the kernel
 // coverage 9P shared dir at /mount/9p/kcoverage.
+//
+// If VMTEST_KERNEL_COVERAGE_SOURCES is set, as by
+// qcoverage.CollectKernelCoverage, only coverage of the given comma-separated
+// kernel source subtrees is saved.
 func CollectKernelCoverage() {
 	if _, err := os.Stat("/mount/9p/kcoverage"); os.IsNotExist(err) {
 		log.Printf("Skipping kernel coverage collection as /mount/9p/kcoverage does not exist")
 		return
 	}
-	if err := collectKernelCoverage("/mount/9p/kcoverage/kernel_coverage.tar"); err != nil {
+	sources := gcovsource.Parse(os.Getenv(gcovsource.Env))
+	if err := collectKernelCoverage("/mount/9p/kcoverage/kernel_coverage.tar", sources); err != nil {
 		log.Printf("Failed to collect kernel coverage: %v", err)
 	}
 }
 
-func collectKernelCoverage(filename string) error {
+func collectKernelCoverage(filename string, sources []string) error {
 	gcovDir := "/sys/kernel/debug/gcov"
 	if _, err := os.Stat(gcovDir); os.IsNotExist(err) {
 		return fmt.Errorf("kernel coverage cannot be collected because %q does not exist (is the kernel compiled with CONFIG_GCOV_KERNEL?)", gcovDir)
@@ -56,7 +68,7 @@ func collectKernelCoverage(filename string) error {
 		return err
 	}
 	if err := tarutil.CreateTar(f, []string{strings.TrimLeft(gcovDir, "/")}, &tarutil.Opts{
-		Filters: []tarutil.Filter{gcovFilter},
+		Filters: []tarutil.Filter{gcovFilter(sources)},
 		// Make sure the files are not stored absolute; otherwise, they
 		// become difficult to extract safely.
 		ChangeDirectory: "/",
@@ -0,0 +1,122 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kcovPath = "/sys/kernel/debug/kcov"
+
+	kcovWordSize = int(unsafe.Sizeof(uintptr(0)))
+
+	// KCOV_INIT_TRACE is _IOR('c', 1, unsigned long), KCOV_ENABLE is
+	// _IO('c', 100), and KCOV_DISABLE is _IO('c', 101).
+	kcovInitTrace = 2<<30 | uintptr(kcovWordSize)<<16 | 'c'<<8 | 1
+	kcovEnable    = 'c'<<8 | 100
+
+	kcovTracePC = 0
+
+	// DefaultKCOVEntries is the default number of PCs a KCOV buffer holds.
+	DefaultKCOVEntries = 1 << 20
+)
+
+// KCOV is a buffer of kernel code coverage collected by KCOV (see
+// Documentation/dev-tools/kcov.rst in the kernel source).
+//
+// KCOV only covers the threads it is enabled on. To cover another process,
+// pass File to it and have it call EnableKCOV before executing the program to
+// cover, like the kcovexec command does.
+type KCOV struct {
+	file *os.File
+	area []byte
+}
+
+// OpenKCOV opens a KCOV buffer for entries PCs. The kernel must be compiled
+// with CONFIG_KCOV.
+func OpenKCOV(entries int) (*KCOV, error) {
+	f, err := os.OpenFile(kcovPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open KCOV (is the kernel compiled with CONFIG_KCOV?): %w", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), kcovInitTrace, uintptr(entries)); errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("could not initialize KCOV: %w", errno)
+	}
+	area, err := unix.Mmap(int(f.Fd()), 0, entries*kcovWordSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not map KCOV buffer: %w", err)
+	}
+	return &KCOV{file: f, area: area}, nil
+}
+
+// File is the KCOV file to pass to processes that call EnableKCOV.
+func (k *KCOV) File() *os.File {
+	return k.file
+}
+
+func (k *KCOV) word(i int) uint64 {
+	b := k.area[i*kcovWordSize : (i+1)*kcovWordSize]
+	if kcovWordSize == 4 {
+		return uint64(binary.NativeEndian.Uint32(b))
+	}
+	return binary.NativeEndian.Uint64(b)
+}
+
+// Reset discards the collected PCs.
+func (k *KCOV) Reset() {
+	clear(k.area[:kcovWordSize])
+}
+
+// PCs returns the sorted, unique PCs collected since the last Reset.
+//
+// KCOV records the return address of each coverage callback, so PCs point
+// just after the instrumented call.
+func (k *KCOV) PCs() []uint64 {
+	n := int(k.word(0))
+	if limit := len(k.area)/kcovWordSize - 1; n > limit {
+		n = limit
+	}
+	seen := make(map[uint64]struct{}, n)
+	pcs := make([]uint64, 0, n)
+	for i := 1; i <= n; i++ {
+		pc := k.word(i)
+		if _, ok := seen[pc]; !ok {
+			seen[pc] = struct{}{}
+			pcs = append(pcs, pc)
+		}
+	}
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+	return pcs
+}
+
+// Close unmaps the KCOV buffer and closes its file.
+func (k *KCOV) Close() error {
+	err := unix.Munmap(k.area)
+	if cerr := k.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// EnableKCOV starts collecting coverage of the calling thread into the KCOV
+// buffer opened as fd. Callers must lock the calling goroutine to its thread.
+//
+// Coverage collection continues across execve(2), and stops when the thread
+// exits.
+func EnableKCOV(fd uintptr) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, kcovEnable, kcovTracePC); errno != 0 {
+		return fmt.Errorf("could not enable KCOV: %w", errno)
+	}
+	return nil
+}
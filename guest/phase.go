@@ -0,0 +1,32 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hugelgupf/vmtest/internal/testevent"
+)
+
+// Phase marks the start of the guest phase name, such as "mounts", on the
+// console. The phase ends when the next phase starts or the VM exits.
+//
+// qemu.WithPhaseReport aggregates the phases into a timing breakdown.
+func Phase(name string) {
+	mono, err := monotonic()
+	if err != nil {
+		return
+	}
+	PhaseAt(name, mono)
+}
+
+// PhaseAt marks that the guest phase name started at guest CLOCK_MONOTONIC
+// time mono, i.e. mono after the guest kernel booted. On guests without
+// CLOCK_MONOTONIC, mono is relative to the start of the process instead.
+func PhaseAt(name string, mono time.Duration) {
+	fmt.Fprintf(os.Stderr, "%s %d %s\n", testevent.PhaseMarker, mono.Nanoseconds(), name)
+}
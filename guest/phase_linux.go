@@ -0,0 +1,43 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// userHZ is the unit of process times in /proc, which is fixed for userspace.
+const userHZ = 100
+
+// InitStarted returns the guest CLOCK_MONOTONIC time the init process was
+// started at, i.e. how long the kernel took to boot.
+//
+// Use it with PhaseAt to mark the start of init.
+func InitStarted() (time.Duration, error) {
+	b, err := os.ReadFile("/proc/1/stat")
+	if err != nil {
+		return 0, err
+	}
+	// The command name in parentheses may contain spaces.
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("unexpected /proc/1/stat format %q", b)
+	}
+	// Fields after the command name start at field 3, the state; the
+	// start time is field 22.
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected /proc/1/stat format %q", b)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected /proc/1/stat start time: %w", err)
+	}
+	return time.Duration(ticks) * time.Second / userHZ, nil
+}
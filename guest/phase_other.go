@@ -0,0 +1,18 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package guest
+
+import (
+	"errors"
+	"time"
+)
+
+// InitStarted returns the guest CLOCK_MONOTONIC time the init process was
+// started at. It is only supported on Linux guests.
+func InitStarted() (time.Duration, error) {
+	return 0, errors.ErrUnsupported
+}
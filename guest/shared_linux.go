@@ -7,8 +7,11 @@ package guest
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/hugelgupf/vmtest/internal/mountspec"
 	"github.com/u-root/u-root/pkg/mount"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -21,14 +24,29 @@ const (
 
 // Mount9PDir mounts a directory shared as tag at dir. It creates dir if it
 // does not exist.
+//
+// In a null VM, the shared directory is bind-mounted instead.
 func Mount9PDir(dir, tag string) (*mount.MountPoint, error) {
 	if err := os.MkdirAll(dir, 0o644); err != nil {
 		return nil, err
 	}
 
+	if src := filepath.Join(mountspec.NullVM9PDir, tag); isDir(src) {
+		mp, err := mount.Mount(src, dir, "", "", unix.MS_BIND)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind-mount directory %s: %v", dir, err)
+		}
+		return mp, nil
+	}
+
 	mp, err := mount.Mount(tag, dir, "9p", fmt.Sprintf("9P2000.L,msize=%d", msize9P), 0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to mount directory %s: %v", dir, err)
 	}
 	return mp, nil
 }
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,19 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import "errors"
+
+// ErrPowerOffUnsupported is returned by PowerOff on guests it does not know
+// how to power off.
+var ErrPowerOffUnsupported = errors.New("powering off is not supported")
+
+// PowerOff powers off the guest immediately, without shutting down its
+// services, which makes QEMU exit. It only returns on failure.
+//
+// Linux and FreeBSD guests are supported.
+func PowerOff() error {
+	return powerOff()
+}
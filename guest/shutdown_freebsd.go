@@ -0,0 +1,18 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import "golang.org/x/sys/unix"
+
+// rbPowerOff is RB_POWEROFF from FreeBSD's sys/reboot.h.
+const rbPowerOff = 0x4000
+
+func powerOff() error {
+	unix.Sync()
+	if _, _, errno := unix.Syscall(unix.SYS_REBOOT, rbPowerOff, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
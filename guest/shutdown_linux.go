@@ -0,0 +1,11 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guest
+
+import "golang.org/x/sys/unix"
+
+func powerOff() error {
+	return unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF)
+}
@@ -7,6 +7,8 @@ package guest
 
 import (
 	"os"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -14,8 +16,9 @@ import (
 //
 // The presence of VMTEST_IN_GUEST=1 env var (which can be passed on the
 // kernel commandline, using qemu.WithVmtestIdent) is used to determine this.
+// FreeBSD guests may also set it in the kernel environment (see kenv(1)).
 func SkipIfNotInVM(t testing.TB) {
-	if os.Getenv("VMTEST_IN_GUEST") != "1" {
+	if kernelEnv("VMTEST_IN_GUEST") != "1" {
 		t.Skip("Skipping test -- must be run inside vmtest VM")
 	}
 }
@@ -25,7 +28,40 @@ func SkipIfNotInVM(t testing.TB) {
 // The presence of VMTEST_IN_GUEST=1 env var (which can be passed on the
 // kernel commandline, using qemu.WithVmtestIdent) is used to determine this.
 func SkipIfInVM(t testing.TB) {
-	if os.Getenv("VMTEST_IN_GUEST") != "1" {
+	if kernelEnv("VMTEST_IN_GUEST") != "1" {
 		t.Skip("Skipping test -- must be run inside vmtest VM")
 	}
 }
+
+// SkipIfNoNestedVirt skips the test if it cannot run KVM VMs of its own:
+// /dev/kvm must exist and the CPU must have the vmx or svm feature, as exposed
+// by qemu.WithNestedVirt.
+func SkipIfNoNestedVirt(t testing.TB) {
+	if _, err := os.Stat("/dev/kvm"); err != nil {
+		t.Skipf("Skipping test -- no KVM in the guest: %v", err)
+	}
+	cpuinfo, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		t.Skipf("Skipping test -- could not read CPU features: %v", err)
+	}
+	if !hasCPUFlag(string(cpuinfo), "vmx", "svm") {
+		t.Skip("Skipping test -- guest CPU has neither vmx nor svm")
+	}
+}
+
+// hasCPUFlag returns whether any of the flags lines in /proc/cpuinfo has one
+// of flags.
+func hasCPUFlag(cpuinfo string, flags ...string) bool {
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != "flags" {
+			continue
+		}
+		for _, f := range strings.Fields(value) {
+			if slices.Contains(flags, f) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -7,9 +7,13 @@ package eventchannel
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"reflect"
 )
 
 // Action are the actions a guest can send.
@@ -21,27 +25,214 @@ const (
 
 	// ActionDone is used to signal no more events will be sent.
 	ActionDone Action = "done"
+
+	// ActionOpen is sent by the guest when it opens the channel, to
+	// correlate the guest and host clocks.
+	ActionOpen Action = "open"
+
+	// ActionHostCommand is used for a host command payload.
+	ActionHostCommand Action = "hostcommand"
+
+	// ActionAck is used by the host to acknowledge all guest events up to
+	// and including Seq.
+	ActionAck Action = "ack"
 )
 
+// VsockPortEnvPrefix is the prefix of the guest environment variable holding
+// the host vsock port of a vsock event channel, followed by the channel name.
+const VsockPortEnvPrefix = "VMTEST_EVENT_VSOCK_"
+
+// NullVMPortEnvPrefix is the prefix of the guest environment variable holding
+// the path of a virtio-serial port's host end when the guest runs in a null VM
+// (see package qnull), followed by the port name.
+const NullVMPortEnvPrefix = "VMTEST_NULLVM_PORT_"
+
+// EncodingEnvPrefix is the prefix of the guest environment variable holding
+// the encoding the host requests guest events in, followed by the channel name.
+const EncodingEnvPrefix = "VMTEST_EVENT_ENCODING_"
+
+// EncodingGob is the EncodingEnvPrefix value requesting gob encoded events.
+const EncodingGob = "gob"
+
+// GobMagic starts event streams encoded with encoding/gob rather than as one
+// JSON object per line.
+const GobMagic = "hugelgupf_vmtest_gob\n"
+
 // Event is an event channel event.
+//
+// Guests number events, including the final ActionDone event, starting at 1.
+// Gaps in the sequence are events the guest dropped. Seq is 0 for guests that
+// do not number events.
+//
+// Mono and Wall are the guest's CLOCK_MONOTONIC and wall clock time in
+// nanoseconds when the event was emitted.
+//
+// Version and Type are only set on the ActionOpen event, to the guest's
+// protocol Version and TypeID of T.
 type Event[T any] struct {
 	GuestAction Action `json:"hugelgupf_vmtest_guest_action"`
+	Seq         uint64 `json:"hugelgupf_vmtest_seq,omitempty"`
+	Mono        int64  `json:"hugelgupf_vmtest_mono,omitempty"`
+	Wall        int64  `json:"hugelgupf_vmtest_wall,omitempty"`
+	Version     int    `json:"hugelgupf_vmtest_version,omitempty"`
+	Type        string `json:"hugelgupf_vmtest_type,omitempty"`
 	Actual      T      `json:",omitempty"`
 }
 
-// ProcessJSONByLine reads JSON events from r separated by new lines.
+// Version is the version of the event channel protocol. It must be bumped
+// for changes host and guest cannot interoperate across.
+const Version = 1
+
+// TypeID identifies the event type T across host and guest: the package path
+// and name of named types, and the type literal otherwise.
+func TypeID[T any]() string {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// Command is a host message sent to the guest: a command, or an
+// acknowledgement of guest events. The host sends ActionDone when no more
+// commands are coming.
+type Command[C any] struct {
+	HostAction Action `json:"hugelgupf_vmtest_host_action"`
+	Seq        uint64 `json:"hugelgupf_vmtest_seq,omitempty"`
+	Actual     C      `json:",omitempty"`
+}
+
+// Sequence tracks the sequence numbers of received guest events to detect
+// dropped events.
+type Sequence struct {
+	last    uint64
+	dropped uint64
+}
+
+// Next records the guest event sequence number seq.
+func (s *Sequence) Next(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	if seq > s.last+1 {
+		s.dropped += seq - s.last - 1
+	}
+	if seq > s.last {
+		s.last = seq
+	}
+}
+
+// Last returns the last sequence number received.
+func (s *Sequence) Last() uint64 {
+	return s.last
+}
+
+// Dropped returns the number of events missing from the sequence.
+func (s *Sequence) Dropped() uint64 {
+	return s.dropped
+}
+
+// ErrDecode is returned when an event cannot be decoded.
+var ErrDecode = errors.New("event decoding failed")
+
+// ProcessEvents reads events from r, which are gob encoded if r starts with
+// GobMagic and JSON objects separated by new lines otherwise.
+func ProcessEvents[T any](r io.Reader, callback func(T)) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(GobMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read error: %w", err)
+	}
+	if string(magic) != GobMagic {
+		return ProcessJSONByLine[T](br, callback)
+	}
+	if _, err := br.Discard(len(GobMagic)); err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(br)
+	for {
+		var e T
+		if err := dec.Decode(&e); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: gob error: %w", ErrDecode, err)
+		}
+		callback(e)
+	}
+}
+
+// ChunkSize is the maximum length of JSON lines encoded by EncodeLine. Longer
+// lines are split into chunk lines.
+const ChunkSize = 32 << 10
+
+// MaxEventSize is the maximum length of a JSON line, including lines
+// reassembled from chunks.
+const MaxEventSize = 64 << 20
+
+// chunk is part of a JSON line longer than ChunkSize. More is set on all but
+// the last chunk of the line.
+type chunk struct {
+	Data []byte `json:"hugelgupf_vmtest_chunk"`
+	More bool   `json:"hugelgupf_vmtest_more,omitempty"`
+}
+
+var chunkPrefix = []byte(`{"hugelgupf_vmtest_chunk":`)
+
+// chunkData is how many bytes of a line fit into one chunk line, considering
+// the base64 encoding and JSON envelope.
+const chunkData = (ChunkSize - 64) / 4 * 3
+
+// EncodeLine returns the JSON value b as one or more lines for
+// ProcessJSONByLine.
+func EncodeLine(b []byte) []byte {
+	if len(b) < ChunkSize {
+		return append(b, '\n')
+	}
+	var lines []byte
+	for len(b) > 0 {
+		n := min(len(b), chunkData)
+		c, _ := json.Marshal(chunk{Data: b[:n], More: n < len(b)})
+		lines = append(append(lines, c...), '\n')
+		b = b[n:]
+	}
+	return lines
+}
+
+// ProcessJSONByLine reads JSON events from r separated by new lines. Lines
+// split by EncodeLine are reassembled.
 func ProcessJSONByLine[T any](r io.Reader, callback func(T)) error {
 	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxEventSize)
+	var pending []byte
 	for scanner.Scan() {
 		line := scanner.Bytes()
+		if bytes.HasPrefix(line, chunkPrefix) {
+			var c chunk
+			if err := json.Unmarshal(line, &c); err != nil {
+				return fmt.Errorf("%w: JSON error (chunk: %s): %w", ErrDecode, line, err)
+			}
+			if len(pending)+len(c.Data) > MaxEventSize {
+				return fmt.Errorf("%w: chunked event exceeds %d bytes", ErrDecode, MaxEventSize)
+			}
+			pending = append(pending, c.Data...)
+			if c.More {
+				continue
+			}
+			line, pending = pending, nil
+		}
+
 		var e T
 		if err := json.Unmarshal(line, &e); err != nil {
-			return fmt.Errorf("JSON error (line: %s): %w", line, err)
+			return fmt.Errorf("%w: JSON error (line: %s): %w", ErrDecode, line, err)
 		}
 		callback(e)
 	}
 	if err := scanner.Err(); err != nil {
 		return fmt.Errorf("scanner error: %w", err)
 	}
+	if pending != nil {
+		return fmt.Errorf("%w: incomplete chunked event", ErrDecode)
+	}
 	return nil
 }
@@ -0,0 +1,44 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gcovsource filters kernel gcov files by kernel source subtree,
+// shared by the host's coverage Fns and the guest's coverage collection.
+package gcovsource
+
+import (
+	"strings"
+)
+
+// Env is the kernel command-line env var holding the comma-separated source
+// subtrees to collect kernel coverage of.
+const Env = "VMTEST_KERNEL_COVERAGE_SOURCES"
+
+// Parse parses the value of Env.
+func Parse(s string) []string {
+	var sources []string
+	for _, src := range strings.Split(s, ",") {
+		if src = strings.Trim(src, "/"); src != "" {
+			sources = append(sources, src)
+		}
+	}
+	return sources
+}
+
+// Match returns whether the gcov file at path is in one of the kernel source
+// subtrees sources, e.g. "fs/ext4". A nil sources matches everything.
+//
+// gcov files are named after the kernel build directory, which is unknown
+// here, so a subtree matches wherever it occurs in path.
+func Match(path string, sources []string) bool {
+	if len(sources) == 0 {
+		return true
+	}
+	path = "/" + strings.Trim(path, "/")
+	for _, src := range sources {
+		if strings.Contains(path, "/"+src+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hostres allocates host-global resources, such as TCP ports and the
+// paths of unix sockets and capture files, that VMs started in parallel by
+// one test process must not share.
+package hostres
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+)
+
+// ErrInUse is returned when a resource is claimed that another VM of this
+// process holds.
+var ErrInUse = errors.New("host resource already in use by another VM")
+
+// maxPortTries is how often FreePort asks the kernel for a free port that no
+// VM holds.
+const maxPortTries = 32
+
+// Registry records the resources VMs hold.
+type Registry struct {
+	mu    sync.Mutex
+	ports map[int]struct{}
+	paths map[string]struct{}
+}
+
+// New returns an empty registry.
+func New() *Registry {
+	return &Registry{
+		ports: make(map[int]struct{}),
+		paths: make(map[string]struct{}),
+	}
+}
+
+// Default is the process-wide registry.
+var Default = New()
+
+// ClaimPath claims the file path, e.g. of a unix socket or a PCAP file. The
+// returned func releases it.
+func (r *Registry) ClaimPath(path string) (func(), error) {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.paths[p]; ok {
+		return nil, fmt.Errorf("%w: path %s", ErrInUse, p)
+	}
+	r.paths[p] = struct{}{}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.paths, p)
+	}, nil
+}
+
+// ClaimPort claims the TCP port. The returned func releases it.
+//
+// Ports used outside of this process are not detected.
+func (r *Registry) ClaimPort(port int) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.claimPort(port)
+}
+
+func (r *Registry) claimPort(port int) (func(), error) {
+	if _, ok := r.ports[port]; ok {
+		return nil, fmt.Errorf("%w: TCP port %d", ErrInUse, port)
+	}
+	r.ports[port] = struct{}{}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.ports, port)
+	}, nil
+}
+
+// FreePort claims a TCP port on localhost that is free on the host and not
+// held by another VM. The returned func releases it.
+func (r *Registry) FreePort() (int, func(), error) {
+	for i := 0; i < maxPortTries; i++ {
+		// The port is only free until someone else listens on it, but
+		// the kernel does not hand it out again right away.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, nil, fmt.Errorf("could not find a free TCP port: %w", err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		_ = l.Close()
+
+		r.mu.Lock()
+		release, err := r.claimPort(port)
+		r.mu.Unlock()
+		if err == nil {
+			return port, release, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: no free TCP port after %d tries", ErrInUse, maxPortTries)
+}
+
+// ClaimPath claims path in the Default registry.
+func ClaimPath(path string) (func(), error) {
+	return Default.ClaimPath(path)
+}
+
+// ClaimPort claims port in the Default registry.
+func ClaimPort(port int) (func(), error) {
+	return Default.ClaimPort(port)
+}
+
+// FreePort claims a free TCP port in the Default registry.
+func FreePort() (int, func(), error) {
+	return Default.FreePort()
+}
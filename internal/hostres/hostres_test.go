@@ -0,0 +1,63 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hostres
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaimPath(t *testing.T) {
+	r := New()
+	p := filepath.Join(t.TempDir(), "net.pcap")
+
+	release, err := r.ClaimPath(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ClaimPath(filepath.Join(filepath.Dir(p), ".", "net.pcap")); !errors.Is(err, ErrInUse) {
+		t.Errorf("ClaimPath(same path) = %v, want %v", err, ErrInUse)
+	}
+	release()
+	if release, err := r.ClaimPath(p); err != nil {
+		t.Errorf("ClaimPath after release = %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestClaimPort(t *testing.T) {
+	r := New()
+	release, err := r.ClaimPort(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ClaimPort(1234); !errors.Is(err, ErrInUse) {
+		t.Errorf("ClaimPort(1234) = %v, want %v", err, ErrInUse)
+	}
+	release()
+	if _, err := r.ClaimPort(1234); err != nil {
+		t.Errorf("ClaimPort after release = %v", err)
+	}
+}
+
+func TestFreePort(t *testing.T) {
+	r := New()
+	seen := make(map[int]bool)
+	for i := 0; i < 10; i++ {
+		port, _, err := r.FreePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[port] {
+			t.Errorf("FreePort returned port %d twice", port)
+		}
+		seen[port] = true
+		if _, err := r.ClaimPort(port); !errors.Is(err, ErrInUse) {
+			t.Errorf("ClaimPort(%d) = %v, want %v", port, err, ErrInUse)
+		}
+	}
+}
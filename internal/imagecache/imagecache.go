@@ -0,0 +1,190 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package imagecache exports files from container images with the docker or
+// podman CLI into runvmtest's artifact cache, which it shares with runvmtest.
+//
+// The cache layout must agree with tools/runvmtest/cache.go.
+package imagecache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotCached is returned by Files when files are not cached and no backend
+// is given to export them.
+var ErrNotCached = errors.New("not in the runvmtest cache")
+
+// Dir returns runvmtest's default artifact cache directory.
+func Dir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("could not find user cache directory: %w", err)
+	}
+	return filepath.Join(dir, "vmtest", "runvmtest"), nil
+}
+
+// Key returns the cache key of s, e.g. an image digest.
+func Key(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:16])
+}
+
+// LookupRef returns the digest that ref was resolved to last, if any.
+func LookupRef(cache, ref string) (string, bool) {
+	b, err := os.ReadFile(filepath.Join(cache, "refs", Key(ref)))
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// RecordRef records that ref resolves to digest.
+func RecordRef(cache, ref, digest string) error {
+	dir := filepath.Join(cache, "refs")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".ref-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(digest); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, Key(ref)))
+}
+
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// Files returns the cache directory of ref, in which each of paths in the
+// image is at filepath.Join(dir, path). Files not cached yet are exported
+// from the image with the docker or podman CLI (backend) first.
+//
+// If backend is empty, only cached files are used, and the error wraps
+// ErrNotCached if any is missing.
+func Files(ctx context.Context, backend, ref string, paths ...string) (string, error) {
+	cache, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	if digest, ok := LookupRef(cache, ref); ok {
+		dir := filepath.Join(cache, Key(digest))
+		if allFiles(dir, paths) {
+			now := time.Now()
+			_ = os.Chtimes(dir, now, now)
+			return dir, nil
+		}
+	}
+	if backend == "" {
+		return "", fmt.Errorf("%s is %w %s", ref, ErrNotCached, cache)
+	}
+
+	c := CLI(backend)
+	digest, err := c.Digest(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %w", ref, err)
+	}
+	dir := filepath.Join(cache, Key(digest))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	id, err := c.Run(ctx, "create", ref, "/nonexistent")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _, _ = c.Run(context.Background(), "rm", "-f", id) }()
+
+	for _, path := range paths {
+		if err := c.ExportOnce(ctx, id, path, filepath.Join(dir, path)); err != nil {
+			return "", fmt.Errorf("failed to export %s from %s: %w", path, ref, err)
+		}
+	}
+	if err := RecordRef(cache, ref, digest); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func allFiles(dir string, paths []string) bool {
+	for _, path := range paths {
+		if !isFile(filepath.Join(dir, path)) {
+			return false
+		}
+	}
+	return true
+}
+
+// CLI is the docker or podman CLI.
+type CLI string
+
+// Run runs the CLI with args and returns its trimmed output.
+func (c CLI) Run(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, string(c), args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", c, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Digest pulls ref and returns its digest as runvmtest does.
+func (c CLI) Digest(ctx context.Context, ref string) (string, error) {
+	if _, err := c.Run(ctx, "pull", ref); err != nil {
+		return "", err
+	}
+	out, err := c.Run(ctx, "image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", ref)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if _, digest, ok := strings.Cut(strings.TrimSpace(line), "@"); ok {
+			return digest, nil
+		}
+	}
+	return c.Run(ctx, "image", "inspect", "--format", "{{.Id}}", ref)
+}
+
+// ExportOnce copies path from container id to dst unless dst exists, via a
+// temporary file so that interrupted copies are not mistaken for complete
+// ones.
+func (c CLI) ExportOnce(ctx context.Context, id, path, dst string) error {
+	if isFile(dst) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	out := filepath.Join(tmp, filepath.Base(dst))
+	if _, err := c.Run(ctx, "cp", id+":"+path, out); err != nil {
+		return err
+	}
+	return os.Rename(out, dst)
+}
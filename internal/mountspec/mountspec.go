@@ -0,0 +1,109 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mountspec encodes guest mount table entries as kernel command-line
+// environment variables, shared by host Fns and the vmmount guest command.
+package mountspec
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of kernel command-line env vars holding a mount
+// table entry. The prefix is followed by the entry's index.
+const EnvPrefix = "VMTEST_MOUNT"
+
+// NullVM9PDir is the directory that 9P directories shared with a null VM (see
+// package qnull) are bind-mounted in, each in a directory named after its tag.
+const NullVM9PDir = "/.vmtest-9p"
+
+// ErrInvalidMount is returned when a mount entry is missing required fields.
+var ErrInvalidMount = errors.New("invalid mount table entry")
+
+// Mount is one mount table entry. Its fields are those of qemu.GuestMount.
+type Mount struct {
+	Source  string
+	FSType  string
+	Target  string
+	Options string
+}
+
+// Validate checks that all required fields are set.
+func (m Mount) Validate() error {
+	if m.Source == "" || m.FSType == "" || m.Target == "" {
+		return fmt.Errorf("%w: source, fstype, and target are required (got %#v)", ErrInvalidMount, m)
+	}
+	return nil
+}
+
+// Encode returns the value of the env var describing m.
+//
+// The value is URL query-encoded so that it contains no spaces or quotes,
+// which the kernel command-line cannot hold.
+func (m Mount) Encode() string {
+	v := url.Values{}
+	v.Set("source", m.Source)
+	v.Set("fstype", m.FSType)
+	v.Set("target", m.Target)
+	if m.Options != "" {
+		v.Set("options", m.Options)
+	}
+	return v.Encode()
+}
+
+// Decode parses an env var value produced by Encode.
+func Decode(s string) (Mount, error) {
+	v, err := url.ParseQuery(s)
+	if err != nil {
+		return Mount{}, fmt.Errorf("%w: %v", ErrInvalidMount, err)
+	}
+	m := Mount{
+		Source:  v.Get("source"),
+		FSType:  v.Get("fstype"),
+		Target:  v.Get("target"),
+		Options: v.Get("options"),
+	}
+	if err := m.Validate(); err != nil {
+		return Mount{}, err
+	}
+	return m, nil
+}
+
+// FromEnv returns all mount table entries found in environ (as returned by
+// os.Environ), ordered by their index.
+func FromEnv(environ []string) ([]Mount, error) {
+	type entry struct {
+		idx int
+		m   Mount
+	}
+	var entries []entry
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(key, EnvPrefix) {
+			continue
+		}
+		idx, err := strconv.Atoi(strings.TrimPrefix(key, EnvPrefix))
+		if err != nil {
+			// Some other VMTEST_MOUNT* variable, e.g. VMTEST_MOUNT9P_*.
+			continue
+		}
+		m, err := Decode(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		entries = append(entries, entry{idx, m})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].idx < entries[j].idx })
+
+	mounts := make([]Mount, 0, len(entries))
+	for _, e := range entries {
+		mounts = append(mounts, e.m)
+	}
+	return mounts, nil
+}
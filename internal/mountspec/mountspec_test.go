@@ -0,0 +1,68 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mountspec
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, m := range []Mount{
+		{Source: "tag", FSType: "9p", Target: "/mnt/tag"},
+		{Source: "tag", FSType: "9p", Target: "/mnt/with space", Options: "trans=virtio,version=9p2000.L"},
+		{Source: "a&b=c", FSType: "virtiofs", Target: "/100%", Options: "ro,dax"},
+		{Source: "%41", FSType: "9p", Target: "/x?y#z", Options: "a=b&c"},
+	} {
+		enc := m.Encode()
+		if strings.ContainsAny(enc, " \"'") {
+			t.Errorf("Encode(%#v) = %q, want no spaces or quotes", m, enc)
+		}
+		got, err := Decode(enc)
+		if err != nil {
+			t.Errorf("Decode(%q) = %v", enc, err)
+		} else if got != m {
+			t.Errorf("Decode(Encode(%#v)) = %#v", m, got)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"source=tag&fstype=9p",
+		"source=tag&target=%2Fmnt",
+		"fstype=9p&target=%2Fmnt",
+		"source=tag&fstype=9p&target=%zz",
+		"source=tag;fstype=9p;target=/mnt",
+	} {
+		if _, err := Decode(s); !errors.Is(err, ErrInvalidMount) {
+			t.Errorf("Decode(%q) = %v, want %v", s, err, ErrInvalidMount)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	a := Mount{Source: "a", FSType: "9p", Target: "/a"}
+	b := Mount{Source: "b", FSType: "virtiofs", Target: "/b b", Options: "ro"}
+	got, err := FromEnv([]string{
+		"PATH=/bin",
+		EnvPrefix + "10=" + a.Encode(),
+		EnvPrefix + "9P_tag=tag",
+		EnvPrefix + "2=" + b.Encode(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Mount{b, a}; !slices.Equal(got, want) {
+		t.Errorf("FromEnv = %#v, want %#v", got, want)
+	}
+
+	if _, err := FromEnv([]string{EnvPrefix + "0=source=a"}); !errors.Is(err, ErrInvalidMount) {
+		t.Errorf("FromEnv with invalid entry = %v, want %v", err, ErrInvalidMount)
+	}
+}
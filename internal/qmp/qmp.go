@@ -0,0 +1,179 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qmp is a minimal client for the QEMU Machine Protocol.
+//
+// See https://www.qemu.org/docs/master/interop/qmp-spec.html.
+package qmp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrNoGreeting is returned when the server does not start with a QMP
+// greeting.
+var ErrNoGreeting = errors.New("no QMP greeting from server")
+
+// Error is an error returned by QEMU in response to a command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("QMP error %s: %s", e.Class, e.Desc)
+}
+
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Greeting  *json.RawMessage `json:"QMP"`
+	Event     string           `json:"event"`
+	Data      json.RawMessage  `json:"data"`
+	Timestamp timestamp        `json:"timestamp"`
+	Return    json.RawMessage  `json:"return"`
+	Error     *Error           `json:"error"`
+}
+
+type timestamp struct {
+	Seconds      int64 `json:"seconds"`
+	Microseconds int64 `json:"microseconds"`
+}
+
+// Event is an asynchronous event sent by QEMU, e.g. WATCHDOG.
+type Event struct {
+	// Name is the event name.
+	Name string
+
+	// Data is the event's data, if any.
+	Data json.RawMessage
+
+	// Time is when QEMU emitted the event.
+	Time time.Time
+}
+
+// Client is a QMP connection. It is not safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// Dial connects to the QMP unix socket at path, retrying until ctx is done
+// as QEMU may not have created the socket yet.
+func Dial(ctx context.Context, path string) (*Client, error) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "unix", path)
+		if err == nil {
+			return NewClient(ctx, conn)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// NewClient negotiates capabilities on conn and returns a client using it.
+//
+// The client closes conn when it is closed or when negotiation fails.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c := &Client{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+	var greeting response
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrNoGreeting, err)
+	}
+	if greeting.Greeting == nil {
+		conn.Close()
+		return nil, ErrNoGreeting
+	}
+	if _, err := c.Execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// Execute runs cmd with args, which are marshaled to JSON if non-nil, and
+// returns the command's return value. Asynchronous events are discarded.
+func (c *Client) Execute(cmd string, args any) (json.RawMessage, error) {
+	if err := c.enc.Encode(command{Execute: cmd, Arguments: args}); err != nil {
+		return nil, err
+	}
+	for {
+		var r response
+		if err := c.dec.Decode(&r); err != nil {
+			return nil, err
+		}
+		if r.Event != "" {
+			continue
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		return r.Return, nil
+	}
+}
+
+// HumanMonitorCommand runs a human monitor (HMP) command, such as
+// "info registers", and returns its output.
+func (c *Client) HumanMonitorCommand(cmd string) (string, error) {
+	ret, err := c.Execute("human-monitor-command", map[string]string{"command-line": cmd})
+	if err != nil {
+		return "", err
+	}
+	var out string
+	if err := json.Unmarshal(ret, &out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// ReadEvent waits for the next asynchronous event. Replies to commands are
+// discarded; do not call Execute concurrently.
+func (c *Client) ReadEvent() (*Event, error) {
+	for {
+		var r response
+		if err := c.dec.Decode(&r); err != nil {
+			return nil, err
+		}
+		if r.Event == "" {
+			continue
+		}
+		return &Event{
+			Name: r.Event,
+			Data: r.Data,
+			Time: time.Unix(r.Timestamp.Seconds, r.Timestamp.Microseconds*int64(time.Microsecond)),
+		}, nil
+	}
+}
+
+// SetDeadline sets the read and write deadline of the connection.
+func (c *Client) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeQEMU serves QMP on conn, answering each command with replies[name].
+func fakeQEMU(t *testing.T, conn net.Conn, replies map[string]string) {
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		var cmd command
+		if err := json.Unmarshal(s.Bytes(), &cmd); err != nil {
+			t.Errorf("Invalid command %q: %v", s.Text(), err)
+			return
+		}
+		// Interleave an event, which the client must skip.
+		fmt.Fprintln(conn, `{"event": "RESUME", "timestamp": {}}`)
+		if r, ok := replies[cmd.Execute]; ok {
+			fmt.Fprintln(conn, r)
+		} else {
+			fmt.Fprintln(conn, `{"error": {"class": "CommandNotFound", "desc": "not found"}}`)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeQEMU(t, server, map[string]string{
+		"qmp_capabilities":      `{"return": {}}`,
+		"query-status":          `{"return": {"status": "running", "running": true}}`,
+		"human-monitor-command": `{"return": "RAX=0000000000000000\r\n"}`,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewClient(ctx, client)
+	if err != nil {
+		t.Fatalf("NewClient = %v", err)
+	}
+	defer c.Close()
+
+	ret, err := c.Execute("query-status", nil)
+	if err != nil {
+		t.Fatalf("query-status = %v", err)
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(ret, &status); err != nil || status.Status != "running" {
+		t.Errorf("query-status = %s (%v), want running", ret, err)
+	}
+
+	out, err := c.HumanMonitorCommand("info registers")
+	if want := "RAX=0000000000000000\r\n"; err != nil || out != want {
+		t.Errorf("HumanMonitorCommand = (%q, %v), want %q", out, err, want)
+	}
+
+	var qerr *Error
+	if _, err := c.Execute("query-nonexistent", nil); !errors.As(err, &qerr) || qerr.Class != "CommandNotFound" {
+		t.Errorf("Execute(query-nonexistent) = %v, want CommandNotFound error", err)
+	}
+}
+
+func TestReadEvent(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		fmt.Fprintln(server, `{"QMP": {"version": {}, "capabilities": []}}`)
+		s := bufio.NewScanner(server)
+		s.Scan()
+		fmt.Fprintln(server, `{"return": {}}`)
+		fmt.Fprintln(server, `{"return": {}}`)
+		fmt.Fprintln(server, `{"event": "WATCHDOG", "data": {"action": "reset"}, "timestamp": {"seconds": 1700000000, "microseconds": 500}}`)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewClient(ctx, client)
+	if err != nil {
+		t.Fatalf("NewClient = %v", err)
+	}
+	defer c.Close()
+
+	e, err := c.ReadEvent()
+	if err != nil {
+		t.Fatalf("ReadEvent = %v", err)
+	}
+	if e.Name != "WATCHDOG" || string(e.Data) != `{"action": "reset"}` || !e.Time.Equal(time.Unix(1700000000, 500000)) {
+		t.Errorf("ReadEvent = %+v, want WATCHDOG event", e)
+	}
+	if _, err := c.ReadEvent(); err == nil {
+		t.Errorf("ReadEvent after close = nil error, want error")
+	}
+}
+
+func TestNoGreeting(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		fmt.Fprintln(server, `{"return": {}}`)
+		server.Close()
+	}()
+	if _, err := NewClient(context.Background(), client); !errors.Is(err, ErrNoGreeting) {
+		t.Errorf("NewClient = %v, want %v", err, ErrNoGreeting)
+	}
+}
@@ -6,3 +6,40 @@ type ErrorEvent struct {
 	Binary string
 	Error  string
 }
+
+// BenchmarkEvent is the result of one benchmark run.
+type BenchmarkEvent struct {
+	Package           string
+	Name              string
+	N                 int
+	NsPerOp           float64
+	AllocedBytesPerOp uint64
+	AllocsPerOp       uint64
+	MBPerS            float64
+}
+
+// TestListEvent lists the tests, benchmarks, fuzz tests, and examples of one
+// package, as printed by -test.list.
+type TestListEvent struct {
+	Package string
+	Names   []string
+}
+
+// KCOVEvent holds the kernel PCs covered by one package's test binary, as
+// collected by KCOV.
+type KCOVEvent struct {
+	Package string
+	PCs     []uint64
+}
+
+// ChunkEvent is one chunk of a byte stream, such as a tar file.
+type ChunkEvent struct {
+	Data []byte
+}
+
+// PhaseMarker starts the console line a guest prints to mark the start of a
+// phase, followed by the guest's CLOCK_MONOTONIC time in nanoseconds and the
+// phase name:
+//
+//	VMTEST_PHASE 1234567890 mounts
+const PhaseMarker = "VMTEST_PHASE"
@@ -0,0 +1,221 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2test
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// marker is the byte that precedes framing lines of test binaries run with
+// -test.v=test2json.
+const marker = 0x16
+
+// reports are the prefixes of test result lines, by action.
+var reports = []struct {
+	prefix string
+	action Action
+}{
+	{"--- PASS: ", Pass},
+	{"--- FAIL: ", Fail},
+	{"--- SKIP: ", Skip},
+	{"--- BENCH: ", Benchmark},
+}
+
+// updates are the prefixes of lines about which test is running, by action.
+// "=== NAME" only changes which test the following output belongs to.
+var updates = []struct {
+	prefix string
+	action Action
+}{
+	{"=== RUN ", Run},
+	{"=== PAUSE ", Pause},
+	{"=== CONT ", Continue},
+	{"=== NAME ", ""},
+}
+
+// Converter converts the output of a test binary run with -test.v=test2json
+// to test events, as `go tool test2json -t` does, so that the test2json
+// command is not needed.
+//
+// Only lines starting with the 0x16 marker that -test.v=test2json prints are
+// framing lines, so that test output that looks like one, e.g. a test printing
+// "--- FAIL: TestFoo", is reported as output.
+//
+// Write the binary's output to the Converter, call Exited with the binary's
+// exit error, and Close it to emit the package's final event.
+type Converter struct {
+	pkg   string
+	emit  func(TestEvent) error
+	now   func() time.Time
+	start time.Time
+
+	buf    []byte
+	test   string
+	report []TestEvent
+	result Action
+	err    error
+}
+
+// NewConverter returns a Converter that passes the test events of package pkg
+// to emit.
+func NewConverter(pkg string, emit func(TestEvent) error) *Converter {
+	c := &Converter{
+		pkg:  pkg,
+		emit: emit,
+		now:  time.Now,
+	}
+	c.start = c.now()
+	return c
+}
+
+// Write converts complete lines of p and buffers the rest.
+//
+// Write does not fail, so that the Converter can share a test binary's stdout
+// with other writers; errors emitting events are returned by Close.
+func (c *Converter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			break
+		}
+		c.handleLine(string(c.buf[:i+1]))
+		c.buf = c.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Exited records the exit error of the test binary. A binary that exits
+// non-zero fails its package even if it printed PASS.
+func (c *Converter) Exited(err error) {
+	if err != nil {
+		c.result = Fail
+	} else if c.result == "" {
+		c.result = Pass
+	}
+}
+
+// Close converts buffered output and emits the package's final event. It
+// returns the first error of emit; no events are emitted after one.
+func (c *Converter) Close() error {
+	if len(c.buf) > 0 {
+		c.handleLine(string(c.buf))
+		c.buf = nil
+	}
+	c.flushReport(0)
+	c.test = ""
+	result := c.result
+	if result == "" {
+		// The binary did not print PASS and did not exit cleanly.
+		result = Fail
+	}
+	c.write(TestEvent{
+		Action:  result,
+		Elapsed: c.now().Sub(c.start).Round(time.Millisecond).Seconds(),
+	})
+	return c.err
+}
+
+func (c *Converter) handleLine(line string) {
+	line, framed := strings.CutPrefix(line, string(rune(marker)))
+	if !framed {
+		c.output(line)
+		return
+	}
+	trimmed := strings.TrimRight(line, "\n")
+
+	switch {
+	case trimmed == "PASS" || trimmed == "FAIL" || strings.HasPrefix(trimmed, "FAIL\t"):
+		c.flushReport(0)
+		c.test = ""
+		c.output(line)
+		if trimmed == "PASS" {
+			c.result = Pass
+		} else {
+			c.result = Fail
+		}
+		return
+	}
+
+	for _, u := range updates {
+		name, ok := strings.CutPrefix(trimmed, u.prefix)
+		if !ok {
+			continue
+		}
+		c.flushReport(0)
+		c.test = strings.TrimSpace(name)
+		if u.action == "" {
+			return
+		}
+		c.write(TestEvent{Action: u.action, Test: c.test})
+		c.output(line)
+		return
+	}
+
+	// Reports of subtests are indented by 4 spaces per level, as is their
+	// output that follows the report.
+	indent := 0
+	for strings.HasPrefix(trimmed, "    ") {
+		trimmed = trimmed[4:]
+		indent++
+	}
+	for _, r := range reports {
+		rest, ok := strings.CutPrefix(trimmed, r.prefix)
+		if !ok {
+			continue
+		}
+		name, elapsed := parseReport(rest)
+		c.flushReport(indent)
+		c.report = append(c.report, TestEvent{Action: r.action, Test: name, Elapsed: elapsed})
+		c.test = name
+		c.output(line)
+		return
+	}
+
+	if indent > 0 && indent <= len(c.report) {
+		c.test = c.report[indent-1].Test
+	}
+	c.output(line)
+}
+
+// parseReport parses "TestName (0.01s)" of a result line.
+func parseReport(s string) (string, float64) {
+	name, dur, ok := strings.Cut(s, " (")
+	if !ok {
+		return strings.TrimSpace(s), 0
+	}
+	elapsed, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(dur), "s)"), 64)
+	if err != nil {
+		return name, 0
+	}
+	return name, elapsed
+}
+
+// flushReport emits the results of tests reported at indent depth or deeper.
+// Results are held back until then because output indented below a result
+// line still belongs to its test.
+func (c *Converter) flushReport(depth int) {
+	for len(c.report) > depth {
+		e := c.report[len(c.report)-1]
+		c.report = c.report[:len(c.report)-1]
+		c.write(e)
+	}
+}
+
+func (c *Converter) output(s string) {
+	c.write(TestEvent{Action: Output, Test: c.test, Output: s})
+}
+
+func (c *Converter) write(e TestEvent) {
+	if c.err != nil {
+		return
+	}
+	e.Time = c.now()
+	e.Package = c.pkg
+	c.err = c.emit(e)
+}
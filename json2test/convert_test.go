@@ -0,0 +1,155 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func convert(t *testing.T, exitErr error, chunks ...string) []TestEvent {
+	t.Helper()
+	var events []TestEvent
+	c := NewConverter("p", func(e TestEvent) error {
+		e.Time = time.Time{}
+		events = append(events, e)
+		return nil
+	})
+	c.now = func() time.Time { return time.Unix(0, 0) }
+	c.start = c.now()
+	for _, s := range chunks {
+		if _, err := c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Exited(exitErr)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestConvert(t *testing.T) {
+	got := convert(t, errors.New("exit status 1"),
+		"\x16=== RUN   TestA\n",
+		"\x16=== RUN   TestA/x\n",
+		"    a_test.go:5: hello\n",
+		"\x16=== RUN   TestA/y\n",
+		"\x16--- FAIL: TestA (0.01s)\n",
+		"\x16    --- PASS: TestA/x (0.00s)\n",
+		"\x16    --- FAIL: TestA/y (0.",
+		"01s)\n",
+		"        a_test.go:9: bad\n",
+		"\x16=== RUN   TestB\n",
+		"\x16--- SKIP: TestB (0.00s)\n",
+		"\x16FAIL\n",
+	)
+	want := []TestEvent{
+		{Action: Run, Package: "p", Test: "TestA"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "=== RUN   TestA\n"},
+		{Action: Run, Package: "p", Test: "TestA/x"},
+		{Action: Output, Package: "p", Test: "TestA/x", Output: "=== RUN   TestA/x\n"},
+		{Action: Output, Package: "p", Test: "TestA/x", Output: "    a_test.go:5: hello\n"},
+		{Action: Run, Package: "p", Test: "TestA/y"},
+		{Action: Output, Package: "p", Test: "TestA/y", Output: "=== RUN   TestA/y\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "--- FAIL: TestA (0.01s)\n"},
+		{Action: Output, Package: "p", Test: "TestA/x", Output: "    --- PASS: TestA/x (0.00s)\n"},
+		{Action: Pass, Package: "p", Test: "TestA/x"},
+		{Action: Output, Package: "p", Test: "TestA/y", Output: "    --- FAIL: TestA/y (0.01s)\n"},
+		{Action: Output, Package: "p", Test: "TestA/y", Output: "        a_test.go:9: bad\n"},
+		{Action: Fail, Package: "p", Test: "TestA/y", Elapsed: 0.01},
+		{Action: Fail, Package: "p", Test: "TestA", Elapsed: 0.01},
+		{Action: Run, Package: "p", Test: "TestB"},
+		{Action: Output, Package: "p", Test: "TestB", Output: "=== RUN   TestB\n"},
+		{Action: Output, Package: "p", Test: "TestB", Output: "--- SKIP: TestB (0.00s)\n"},
+		{Action: Skip, Package: "p", Test: "TestB"},
+		{Action: Output, Package: "p", Output: "FAIL\n"},
+		{Action: Fail, Package: "p"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestConvertParallel(t *testing.T) {
+	got := convert(t, nil,
+		"\x16=== RUN   TestA\n",
+		"\x16=== PAUSE TestA\n",
+		"\x16=== CONT  TestA\n",
+		"\x16=== NAME  TestA\n",
+		"    a_test.go:5: hello\n",
+		"\x16--- PASS: TestA (0.50s)\n",
+		"\x16PASS\n",
+	)
+	want := []TestEvent{
+		{Action: Run, Package: "p", Test: "TestA"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "=== RUN   TestA\n"},
+		{Action: Pause, Package: "p", Test: "TestA"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "=== PAUSE TestA\n"},
+		{Action: Continue, Package: "p", Test: "TestA"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "=== CONT  TestA\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "    a_test.go:5: hello\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "--- PASS: TestA (0.50s)\n"},
+		{Action: Pass, Package: "p", Test: "TestA", Elapsed: 0.5},
+		{Action: Output, Package: "p", Output: "PASS\n"},
+		{Action: Pass, Package: "p"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestConvertCrash(t *testing.T) {
+	got := convert(t, errors.New("signal: killed"),
+		"\x16=== RUN   TestA\n",
+		"panic: boom",
+	)
+	want := []TestEvent{
+		{Action: Run, Package: "p", Test: "TestA"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "=== RUN   TestA\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "panic: boom"},
+		{Action: Fail, Package: "p"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events =\n%v\nwant\n%v", got, want)
+	}
+
+	// A collector sees the package fail and the test never finish.
+	tc := collect(got...)
+	if s := tc.PackageResults["p"].State; s != StateFail {
+		t.Errorf("package state = %v, want %v", s, StateFail)
+	}
+	if tc.Tests["p.TestA"].Done() {
+		t.Errorf("TestA done, want not done")
+	}
+}
+
+func TestConvertUnframed(t *testing.T) {
+	// A test printing lines that look like framing lines.
+	got := convert(t, nil,
+		"\x16=== RUN   TestA\n",
+		"--- FAIL: X (0.00s)\n",
+		"=== RUN   Y\n",
+		"FAIL\n",
+		"\x16--- PASS: TestA (0.00s)\n",
+		"\x16PASS\n",
+	)
+	want := []TestEvent{
+		{Action: Run, Package: "p", Test: "TestA"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "=== RUN   TestA\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "--- FAIL: X (0.00s)\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "=== RUN   Y\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "FAIL\n"},
+		{Action: Output, Package: "p", Test: "TestA", Output: "--- PASS: TestA (0.00s)\n"},
+		{Action: Pass, Package: "p", Test: "TestA"},
+		{Action: Output, Package: "p", Output: "PASS\n"},
+		{Action: Pass, Package: "p"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events =\n%v\nwant\n%v", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr,omitempty"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// sortedTests returns all test results ordered by package, then test name.
+//
+// The caller must hold tc.mu.
+func (tc *TestCollector) sortedTests() []*TestResult {
+	tests := make([]*TestResult, 0, len(tc.Tests))
+	for _, t := range tc.Tests {
+		tests = append(tests, t)
+	}
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].Package != tests[j].Package {
+			return tests[i].Package < tests[j].Package
+		}
+		return tests[i].Name < tests[j].Name
+	})
+	return tests
+}
+
+// WriteJUnitXML writes the collected test results to w as a JUnit XML
+// report, with one testsuite per Go package and one testcase per test.
+//
+// name is used as the name of the top-level testsuites element. Tests that
+// never finished (e.g. because the guest crashed) are reported as failures.
+func (tc *TestCollector) WriteJUnitXML(w io.Writer, name string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	suites := make(map[string]*junitTestSuite)
+	var pkgs []string
+	for pkg := range tc.Packages {
+		suites[pkg] = &junitTestSuite{Name: pkg}
+		pkgs = append(pkgs, pkg)
+	}
+
+	report := junitTestSuites{Name: name}
+	var total float64
+	elapsed := make(map[string]float64)
+	for _, t := range tc.sortedTests() {
+		s, ok := suites[t.Package]
+		if !ok {
+			s = &junitTestSuite{Name: t.Package}
+			suites[t.Package] = s
+			pkgs = append(pkgs, t.Package)
+		}
+		tcase := junitTestCase{
+			ClassName: t.Package,
+			Name:      t.Name,
+			Time:      junitTime(t.Elapsed),
+		}
+		switch t.State {
+		case StatePass:
+			if t.Kind == KindBenchmark {
+				tcase.SystemOut = t.FullOutput
+			}
+		case StateSkip:
+			tcase.Skipped = &junitMessage{Message: "skipped", Body: t.FullOutput}
+			s.Skipped++
+		case StateFail:
+			tcase.Failure = &junitMessage{Message: "failed", Body: t.FullOutput}
+			s.Failures++
+		default:
+			tcase.Failure = &junitMessage{Message: fmt.Sprintf("test left in state %q", t.State), Body: t.FullOutput}
+			s.Failures++
+		}
+		s.Tests++
+		s.TestCases = append(s.TestCases, tcase)
+
+		// Subtest time is already included in their parent's.
+		if !strings.Contains(t.Name, "/") {
+			elapsed[t.Package] += t.Elapsed
+			total += t.Elapsed
+		}
+	}
+	sort.Strings(pkgs)
+
+	for _, pkg := range pkgs {
+		s := suites[pkg]
+		s.Time = junitTime(elapsed[pkg])
+		report.Tests += s.Tests
+		report.Failures += s.Failures
+		report.Skipped += s.Skipped
+		report.Suites = append(report.Suites, *s)
+	}
+	report.Time = junitTime(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// escapeAnnotation escapes s for use in a GitHub Actions workflow command.
+func escapeAnnotation(s string, property bool) string {
+	r := []string{"%", "%25", "\r", "%0D", "\n", "%0A"}
+	if property {
+		r = append(r, ":", "%3A", ",", "%2C")
+	}
+	return strings.NewReplacer(r...).Replace(s)
+}
+
+// WriteGitHubAnnotations writes a GitHub Actions ::error:: workflow command
+// to w for each failed test, so that failures show up as annotations on the
+// workflow run.
+func (tc *TestCollector) WriteGitHubAnnotations(w io.Writer) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for _, t := range tc.sortedTests() {
+		if t.State == StatePass || t.State == StateSkip {
+			continue
+		}
+		title := fmt.Sprintf("%s.%s", t.Package, t.Name)
+		msg := strings.TrimRight(t.FullOutput, "\n")
+		if msg == "" {
+			msg = fmt.Sprintf("test left in state %q", t.State)
+		}
+		if _, err := fmt.Fprintf(w, "::error title=%s::%s\n", escapeAnnotation(title, true), escapeAnnotation(msg, false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
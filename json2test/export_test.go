@@ -0,0 +1,83 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func collect(events ...TestEvent) *TestCollector {
+	tc := NewTestCollector()
+	for _, e := range events {
+		tc.Handle(e)
+	}
+	return tc
+}
+
+var events = []TestEvent{
+	{Action: Run, Package: "pkg/a", Test: "TestPass"},
+	{Action: Output, Package: "pkg/a", Test: "TestPass", Output: "=== RUN   TestPass\n"},
+	{Action: Pass, Package: "pkg/a", Test: "TestPass", Elapsed: 1.5},
+	{Action: Run, Package: "pkg/a", Test: "TestFail"},
+	{Action: Output, Package: "pkg/a", Test: "TestFail", Output: "    a_test.go:10: 100% wrong\n"},
+	{Action: Fail, Package: "pkg/a", Test: "TestFail", Elapsed: 0.25},
+	{Action: Run, Package: "pkg/b", Test: "TestSkip"},
+	{Action: Skip, Package: "pkg/b", Test: "TestSkip"},
+	{Action: Run, Package: "pkg/b", Test: "TestHang"},
+	{Action: Output, Package: "pkg/c", Output: "?   \tpkg/c\t[no test files]\n"},
+}
+
+func TestWriteJUnitXML(t *testing.T) {
+	var b strings.Builder
+	if err := collect(events...).WriteJUnitXML(&b, "TestVM"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got junitTestSuites
+	if err := xml.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatalf("Invalid XML: %v\n%s", err, b.String())
+	}
+	if got.Name != "TestVM" || got.Tests != 4 || got.Failures != 2 || got.Skipped != 1 || got.Time != "1.750" {
+		t.Errorf("testsuites = %s %d tests %d failures %d skipped time %s, want TestVM 4 2 1 1.750", got.Name, got.Tests, got.Failures, got.Skipped, got.Time)
+	}
+	if len(got.Suites) != 3 {
+		t.Fatalf("Got %d testsuites, want 3", len(got.Suites))
+	}
+	for i, want := range []string{"pkg/a", "pkg/b", "pkg/c"} {
+		if got.Suites[i].Name != want {
+			t.Errorf("testsuite[%d] = %s, want %s", i, got.Suites[i].Name, want)
+		}
+	}
+
+	a := got.Suites[0].TestCases
+	if len(a) != 2 || a[0].Name != "TestFail" || a[1].Name != "TestPass" {
+		t.Fatalf("pkg/a testcases = %v, want TestFail, TestPass", a)
+	}
+	if a[0].Failure == nil || !strings.Contains(a[0].Failure.Body, "100% wrong") {
+		t.Errorf("TestFail failure = %v, want output", a[0].Failure)
+	}
+	if a[1].Failure != nil || a[1].Time != "1.500" {
+		t.Errorf("TestPass = %v, want passed in 1.500s", a[1])
+	}
+
+	b2 := got.Suites[1].TestCases
+	if len(b2) != 2 || b2[0].Failure == nil || b2[1].Skipped == nil {
+		t.Errorf("pkg/b testcases = %v, want TestHang failed and TestSkip skipped", b2)
+	}
+}
+
+func TestWriteGitHubAnnotations(t *testing.T) {
+	var b strings.Builder
+	if err := collect(events...).WriteGitHubAnnotations(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "::error title=pkg/a.TestFail::    a_test.go:10: 100%25 wrong\n" +
+		"::error title=pkg/b.TestHang::test left in state \"running\"\n"
+	if got := b.String(); got != want {
+		t.Errorf("WriteGitHubAnnotations =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -2,7 +2,14 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package json2test parses Go JSON test output.
+// Package json2test parses Go JSON test output, as produced by `go test -json`
+// and test2json, e.g. the guest test events of govmtest.
+//
+// A TestCollector collects the results of tests, subtests, benchmarks, and
+// packages from the events, and can report them as they finish and export
+// them as JUnit XML or GitHub Actions annotations. A Converter produces the
+// events from a test binary's -test.v=test2json output without the test2json
+// command.
 package json2test
 
 import (
@@ -0,0 +1,260 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2test
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestState are the possible Go test states.
+type TestState string
+
+// These states are taken from Go.
+const (
+	StateSkip    TestState = "skip"
+	StateFail    TestState = "fail"
+	StatePass    TestState = "pass"
+	StatePaused  TestState = "paused"
+	StateRunning TestState = "running"
+)
+
+var actionToState = map[Action]TestState{
+	Skip:     StateSkip,
+	Fail:     StateFail,
+	Pass:     StatePass,
+	Pause:    StatePaused,
+	Run:      StateRunning,
+	Continue: StateRunning,
+}
+
+// TestKind are the Go test types.
+type TestKind int
+
+// The two Go test types, test and benchmark.
+const (
+	KindTest TestKind = iota
+	KindBenchmark
+)
+
+// TestResult is an individual tests' outcome.
+type TestResult struct {
+	Package    string
+	Name       string
+	Kind       TestKind
+	State      TestState
+	FullOutput string
+
+	// Elapsed is the test's run time in seconds, as reported on its
+	// pass, fail, or skip event.
+	Elapsed float64
+
+	// Parent is the name of the test that started this one with t.Run,
+	// or empty for top-level tests.
+	Parent string
+
+	// Subtests are the names of the tests started by this one with t.Run,
+	// in the order they started.
+	Subtests []string
+
+	// Start and End are the times of the test's first and final events,
+	// if the events have times (test2json -t).
+	Start time.Time
+	End   time.Time
+
+	// OutputTruncated is set if FullOutput exceeded the collector's output
+	// limit (see WithMaxOutput). FullOutput then holds the end of the
+	// output.
+	OutputTruncated bool
+}
+
+// Done returns whether the test passed, failed, or was skipped.
+func (t *TestResult) Done() bool {
+	return t.State == StatePass || t.State == StateFail || t.State == StateSkip
+}
+
+// PackageResult is a test package's outcome.
+type PackageResult struct {
+	Name string
+
+	// State is the package's pass or fail state, or empty if the test
+	// binary has not exited (yet).
+	State TestState
+
+	// Elapsed is the run time of the package's test binary in seconds.
+	Elapsed float64
+
+	// OutputTruncated is set if the package's output exceeded the
+	// collector's output limit (see WithMaxOutput).
+	OutputTruncated bool
+}
+
+// TestCollector holds Go test result information.
+type TestCollector struct {
+	mu sync.Mutex
+
+	// Package collects all output for a particular package.
+	Packages map[string]string
+
+	// PackageResults are the outcomes of packages, indexed by package
+	// name.
+	PackageResults map[string]*PackageResult
+
+	// Tests are indexed by fully-qualified packageName.TestName strings.
+	Tests map[string]*TestResult
+
+	maxOutput int
+	resultFn  func(TestResult)
+	packageFn func(PackageResult)
+}
+
+// Option configures a TestCollector.
+type Option func(*TestCollector)
+
+// WithMaxOutput limits the output kept for each test and package to the last
+// n bytes. Output is not limited by default.
+func WithMaxOutput(n int) Option {
+	return func(tc *TestCollector) {
+		tc.maxOutput = n
+	}
+}
+
+// WithResultFunc calls fn with the result of each test as soon as it passes,
+// fails, or is skipped, e.g. to report results while the tests are still
+// running.
+//
+// fn is called from Handle, and must not call the collector.
+func WithResultFunc(fn func(TestResult)) Option {
+	return func(tc *TestCollector) {
+		tc.resultFn = fn
+	}
+}
+
+// WithPackageFunc calls fn with the result of each package as soon as its test
+// binary exits.
+//
+// fn is called from Handle, and must not call the collector.
+func WithPackageFunc(fn func(PackageResult)) Option {
+	return func(tc *TestCollector) {
+		tc.packageFn = fn
+	}
+}
+
+// NewTestCollector returns a TestCollector that collects test results from
+// the events passed to Handle.
+func NewTestCollector(opts ...Option) *TestCollector {
+	tc := &TestCollector{
+		Packages:       make(map[string]string),
+		PackageResults: make(map[string]*PackageResult),
+		Tests:          make(map[string]*TestResult),
+	}
+	for _, opt := range opts {
+		opt(tc)
+	}
+	return tc
+}
+
+// appendOutput appends add to s, keeping only the last max bytes if max is
+// positive. It returns whether output was dropped.
+func appendOutput(s, add string, max int) (string, bool) {
+	s += add
+	if max <= 0 || len(s) <= max {
+		return s, false
+	}
+	return s[len(s)-max:], true
+}
+
+// Handle records the test event e.
+func (tc *TestCollector) Handle(e TestEvent) {
+	tc.mu.Lock()
+	var result *TestResult
+	var pkgResult *PackageResult
+	defer func() {
+		tc.mu.Unlock()
+		if result != nil && tc.resultFn != nil {
+			tc.resultFn(*result)
+		}
+		if pkgResult != nil && tc.packageFn != nil {
+			tc.packageFn(*pkgResult)
+		}
+	}()
+
+	p, ok := tc.PackageResults[e.Package]
+	if !ok {
+		p = &PackageResult{Name: e.Package}
+		tc.PackageResults[e.Package] = p
+	}
+	var truncated bool
+	tc.Packages[e.Package], truncated = appendOutput(tc.Packages[e.Package], e.Output, tc.maxOutput)
+	p.OutputTruncated = p.OutputTruncated || truncated
+
+	if len(e.Test) == 0 {
+		if e.Action == Pass || e.Action == Fail || e.Action == Skip {
+			p.State = actionToState[e.Action]
+			p.Elapsed = e.Elapsed
+			r := *p
+			pkgResult = &r
+		}
+		return
+	}
+
+	testName := fmt.Sprintf("%s.%s", e.Package, e.Test)
+	t, ok := tc.Tests[testName]
+	if !ok {
+		t = &TestResult{
+			Package: e.Package,
+			Name:    e.Test,
+			Kind:    KindTest,
+			Parent:  tc.parent(e.Package, e.Test),
+			Start:   e.Time,
+		}
+		tc.Tests[testName] = t
+		if t.Parent != "" {
+			parent := tc.Tests[fmt.Sprintf("%s.%s", e.Package, t.Parent)]
+			parent.Subtests = append(parent.Subtests, t.Name)
+		}
+	}
+
+	t.FullOutput, truncated = appendOutput(t.FullOutput, e.Output, tc.maxOutput)
+	t.OutputTruncated = t.OutputTruncated || truncated
+
+	switch e.Action {
+	case Benchmark:
+		t.Kind = KindBenchmark
+	case Output:
+	default:
+		s, ok := actionToState[e.Action]
+		if !ok {
+			log.Printf("Unknown action %q in event %v", e.Action, e)
+		}
+		t.State = s
+		if e.Elapsed != 0 {
+			t.Elapsed = e.Elapsed
+		}
+		if t.Done() {
+			t.End = e.Time
+			r := *t
+			r.Subtests = append([]string(nil), t.Subtests...)
+			result = &r
+		}
+	}
+}
+
+// parent returns the name of the longest-named test of pkg that name is a
+// subtest of, or "" if there is none. Subtest names may contain slashes, so
+// the parent cannot be derived from name alone.
+//
+// The caller must hold tc.mu.
+func (tc *TestCollector) parent(pkg, name string) string {
+	for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name[:i], "/") {
+		if _, ok := tc.Tests[fmt.Sprintf("%s.%s", pkg, name[:i])]; ok {
+			return name[:i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2test
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSubtests(t *testing.T) {
+	tc := collect(
+		TestEvent{Action: Run, Package: "p", Test: "TestA"},
+		TestEvent{Action: Run, Package: "p", Test: "TestA/x/y"},
+		TestEvent{Action: Run, Package: "p", Test: "TestA/z"},
+		TestEvent{Action: Run, Package: "p", Test: "TestA/z/sub"},
+		TestEvent{Action: Pass, Package: "p", Test: "TestA/x/y"},
+		TestEvent{Action: Pass, Package: "p", Test: "TestA/z/sub"},
+		TestEvent{Action: Pass, Package: "p", Test: "TestA/z"},
+		TestEvent{Action: Pass, Package: "p", Test: "TestA"},
+	)
+	for _, tt := range []struct {
+		name     string
+		parent   string
+		subtests []string
+	}{
+		{name: "TestA", subtests: []string{"TestA/x/y", "TestA/z"}},
+		{name: "TestA/x/y", parent: "TestA"},
+		{name: "TestA/z", parent: "TestA", subtests: []string{"TestA/z/sub"}},
+		{name: "TestA/z/sub", parent: "TestA/z"},
+	} {
+		r := tc.Tests["p."+tt.name]
+		if r.Parent != tt.parent || !slices.Equal(r.Subtests, tt.subtests) {
+			t.Errorf("%s: parent %q, subtests %v, want %q, %v", tt.name, r.Parent, r.Subtests, tt.parent, tt.subtests)
+		}
+	}
+}
+
+func TestTimes(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Second)
+	tc := collect(
+		TestEvent{Time: start, Action: Run, Package: "p", Test: "TestA"},
+		TestEvent{Time: end, Action: Pass, Package: "p", Test: "TestA", Elapsed: 2},
+		TestEvent{Time: end, Action: Fail, Package: "p", Elapsed: 2.5},
+	)
+	if r := tc.Tests["p.TestA"]; !r.Start.Equal(start) || !r.End.Equal(end) || r.Elapsed != 2 {
+		t.Errorf("TestA ran %v to %v for %vs, want %v to %v for 2s", r.Start, r.End, r.Elapsed, start, end)
+	}
+	if p := tc.PackageResults["p"]; p.State != StateFail || p.Elapsed != 2.5 {
+		t.Errorf("Package p = %s after %vs, want fail after 2.5s", p.State, p.Elapsed)
+	}
+}
+
+func TestMaxOutput(t *testing.T) {
+	tc := NewTestCollector(WithMaxOutput(8))
+	for _, out := range []string{"first line\n", "last\n"} {
+		tc.Handle(TestEvent{Action: Output, Package: "p", Test: "TestA", Output: out})
+	}
+	r := tc.Tests["p.TestA"]
+	if r.FullOutput != "ne\nlast\n" || !r.OutputTruncated {
+		t.Errorf("FullOutput = %q (truncated %t), want %q (truncated)", r.FullOutput, r.OutputTruncated, "ne\nlast\n")
+	}
+	if !tc.PackageResults["p"].OutputTruncated {
+		t.Errorf("Package output not marked truncated")
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	var results []string
+	var packages []string
+	tc := NewTestCollector(
+		WithResultFunc(func(r TestResult) {
+			results = append(results, r.Name+":"+string(r.State))
+		}),
+		WithPackageFunc(func(p PackageResult) {
+			packages = append(packages, p.Name+":"+string(p.State))
+		}),
+	)
+	for _, e := range events {
+		tc.Handle(e)
+	}
+	tc.Handle(TestEvent{Action: Fail, Package: "pkg/a"})
+
+	if want := []string{"TestPass:pass", "TestFail:fail", "TestSkip:skip"}; !slices.Equal(results, want) {
+		t.Errorf("Result callbacks = %v, want %v", results, want)
+	}
+	if want := []string{"pkg/a:fail"}; !slices.Equal(packages, want) {
+		t.Errorf("Package callbacks = %v, want %v", packages, want)
+	}
+}
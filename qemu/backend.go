@@ -0,0 +1,47 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+// Backend is a virtual machine monitor that runs the VM instead of QEMU, such
+// as cloud-hypervisor (see package qch).
+//
+// The backend process is run like QEMU: console I/O is on its stdin, stdout,
+// and stderr, ExtraFiles are passed to it, and the VM exits when it does.
+type Backend interface {
+	// Name is the name of the VMM, e.g. for logs.
+	Name() string
+
+	// Cmdline returns the command line to run the VM of o with, once all
+	// Fns have been applied.
+	Cmdline(o *Options) ([]string, error)
+}
+
+// BackendExitError is implemented by a Backend whose process exit status does
+// not tell whether the VM exited cleanly the way QEMU's does.
+type BackendExitError interface {
+	// ExitError returns the VM's exit error given the error of waiting
+	// for the backend process.
+	ExitError(err error) error
+}
+
+// WithBackend runs the VM with b instead of QEMU.
+//
+// Fns that add QEMU-specific arguments may not be supported by b. StartT does
+// not add its QEMU-specific defaults (QMP-based timeout diagnostics and the
+// QEMU debug log) to VMs with a backend.
+func WithBackend(b Backend) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.Backend = b
+		return nil
+	}
+}
+
+// vmmName returns the name of the VMM running the VM of o.
+func (o *Options) vmmName() string {
+	if o.Backend != nil {
+		return o.Backend.Name()
+	}
+	return "QEMU"
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BootStats are the boot timings of a VM, relative to starting QEMU. Timings
+// that were not measured (yet) are 0.
+type BootStats struct {
+	// FirstOutput is the time to the first console output.
+	FirstOutput time.Duration
+
+	// Booted is the time to the boot complete marker: the console pattern
+	// or the call to BootTimer.MarkBooted.
+	Booted time.Duration
+}
+
+func (s BootStats) String() string {
+	var parts []string
+	if s.FirstOutput > 0 {
+		parts = append(parts, fmt.Sprintf("first console output after %.3fs", s.FirstOutput.Seconds()))
+	}
+	if s.Booted > 0 {
+		parts = append(parts, fmt.Sprintf("booted after %.3fs", s.Booted.Seconds()))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// BootTimer measures the time from starting QEMU to the first console output
+// and to a boot complete marker, to catch regressions of e.g. initramfs size
+// or kernel config in boot time. See WithBootTimer.
+//
+// BootTimer is an io.WriteCloser and reads console output.
+type BootTimer struct {
+	mu          sync.Mutex
+	marker      []byte
+	started     time.Time
+	firstOutput time.Time
+	booted      time.Time
+	// tail is the end of the console output that may be the start of
+	// marker.
+	tail []byte
+}
+
+// NewBootTimer returns a boot timer. Boot is complete when marker appears on
+// the console, e.g. a shell prompt or "Run /init as init process". If marker
+// is empty, boot is complete when MarkBooted is called, e.g. from a
+// qevent.EventChannelCallback when the guest sends a ready event:
+//
+//	bt := qemu.NewBootTimer("")
+//	vm := qemu.StartT(t, "vm", qemu.ArchUseEnvv,
+//		qemu.WithBootTimer(bt),
+//		qevent.EventChannelCallback[Event]("events", func(e Event) error {
+//			if e.Ready {
+//				bt.MarkBooted()
+//			}
+//			return nil
+//		}),
+//	)
+func NewBootTimer(marker string) *BootTimer {
+	return &BootTimer{marker: []byte(marker)}
+}
+
+// Write implements io.Writer.
+func (b *BootTimer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.firstOutput.IsZero() && len(p) > 0 {
+		b.firstOutput = now
+	}
+	if len(b.marker) == 0 || !b.booted.IsZero() {
+		return len(p), nil
+	}
+	buf := append(b.tail, p...)
+	if bytes.Contains(buf, b.marker) {
+		b.booted = now
+		b.tail = nil
+		return len(p), nil
+	}
+	if n := len(b.marker) - 1; len(buf) > n {
+		buf = buf[len(buf)-n:]
+	}
+	b.tail = append(b.tail[:0], buf...)
+	return len(p), nil
+}
+
+// Close implements io.Closer.
+func (b *BootTimer) Close() error {
+	return nil
+}
+
+// MarkBooted marks boot as complete now, unless it was before.
+func (b *BootTimer) MarkBooted() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.booted.IsZero() {
+		b.booted = time.Now()
+	}
+}
+
+func (b *BootTimer) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.started = time.Now()
+}
+
+// Stats returns the boot timings measured so far.
+func (b *BootTimer) Stats() BootStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var s BootStats
+	if b.started.IsZero() {
+		return s
+	}
+	if !b.firstOutput.IsZero() {
+		s.FirstOutput = b.firstOutput.Sub(b.started)
+	}
+	if !b.booted.IsZero() {
+		s.Booted = b.booted.Sub(b.started)
+	}
+	return s
+}
+
+// WithBootTimer measures the VM's boot timings with b. See VM.BootStats.
+//
+// StartT measures the time to the first console output by default, and logs
+// the boot timings when the test is done.
+func WithBootTimer(b *BootTimer) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.BootTimer = b
+		opts.SerialOutput = append(opts.SerialOutput, b)
+		opts.Tasks = append(opts.Tasks, func(ctx context.Context, n *Notifications) error {
+			// Tasks are started right before the guest.
+			b.start()
+			return nil
+		})
+		return nil
+	}
+}
+
+// defaultBootTimer measures boot timings unless a boot timer was configured
+// already.
+func defaultBootTimer() Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.BootTimer != nil {
+			return nil
+		}
+		return WithBootTimer(NewBootTimer(""))(alloc, opts)
+	}
+}
+
+// BootStats returns the boot timings measured so far, or zero timings if no
+// boot timer is configured (see WithBootTimer).
+func (v *VM) BootStats() BootStats {
+	if v.Options.BootTimer == nil {
+		return BootStats{}
+	}
+	return v.Options.BootTimer.Stats()
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBootTimer(t *testing.T) {
+	b := NewBootTimer("Run /init")
+	if s := b.Stats(); s != (BootStats{}) {
+		t.Errorf("Stats before start = %v, want none", s)
+	}
+	b.start()
+	time.Sleep(10 * time.Millisecond)
+	_, _ = io.WriteString(b, "Linux version 6.6\n")
+	s := b.Stats()
+	if s.FirstOutput < 10*time.Millisecond || s.Booted != 0 {
+		t.Errorf("Stats after first output = %+v", s)
+	}
+
+	// The marker is split across writes.
+	_, _ = io.WriteString(b, "Run /i")
+	if s := b.Stats(); s.Booted != 0 {
+		t.Errorf("Booted before marker = %v", s.Booted)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, _ = io.WriteString(b, "nit as init process\n")
+	s = b.Stats()
+	if s.Booted < s.FirstOutput+10*time.Millisecond {
+		t.Errorf("Stats after marker = %+v", s)
+	}
+
+	// Later markers don't change the boot time.
+	_, _ = io.WriteString(b, "Run /init\n")
+	b.MarkBooted()
+	if got := b.Stats(); got != s {
+		t.Errorf("Stats after second marker = %+v, want %+v", got, s)
+	}
+}
+
+func TestBootTimerMarkBooted(t *testing.T) {
+	b := NewBootTimer("")
+	b.start()
+	_, _ = io.WriteString(b, "Run /init\n")
+	if s := b.Stats(); s.Booted != 0 {
+		t.Errorf("Booted without marker = %v", s.Booted)
+	}
+	b.MarkBooted()
+	if s := b.Stats(); s.Booted == 0 || s.String() == "" {
+		t.Errorf("Stats after MarkBooted = %v", s)
+	}
+}
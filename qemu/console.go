@@ -0,0 +1,64 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"strings"
+)
+
+// machineConsoles are the serial console devices of machine types whose
+// console differs from that of their architecture's Env.
+var machineConsoles = map[Arch]map[string]string{
+	ArchRiscv64: {
+		"sifive_u": "ttySIF0",
+	},
+}
+
+// WithConsoleArg sets whether console= with the guest's serial console device
+// is appended to the kernel command line, unless it already has a console=
+// argument. The device is derived from the guest architecture and machine
+// type, e.g. ttyS0 on x86 and ttyAMA0 on arm64 (see Env).
+//
+// Without a console= argument, some kernels print nothing on arm and riscv
+// guests. quimage.WithUimage turns this on; add WithConsoleArg(false) after it
+// to turn it off.
+func WithConsoleArg(enable bool) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.ConsoleArg = enable
+		return nil
+	}
+}
+
+// ConsoleDevice returns the name of the guest kernel's serial console device
+// for the VM's architecture and machine type, e.g. ttyS0.
+func (o *Options) ConsoleDevice() string {
+	e := o.Env()
+	if c, ok := machineConsoles[e.Arch][o.MachineType()]; ok {
+		return c
+	}
+	return e.Console
+}
+
+// kernelArgs returns the kernel command line, with console= added if
+// ConsoleArg is set, a kernel is booted, and it has none.
+func (o *Options) kernelArgs() string {
+	if !o.ConsoleArg || o.Kernel == "" || hasConsoleArg(o.KernelArgs) {
+		return o.KernelArgs
+	}
+	c := o.ConsoleDevice()
+	if c == "" {
+		return o.KernelArgs
+	}
+	return strings.TrimSpace(o.KernelArgs + " console=" + c)
+}
+
+func hasConsoleArg(args string) bool {
+	for _, arg := range strings.Fields(args) {
+		if strings.HasPrefix(arg, "console=") {
+			return true
+		}
+	}
+	return false
+}
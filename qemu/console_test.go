@@ -0,0 +1,88 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestConsoleArg(t *testing.T) {
+	t.Setenv("VMTEST_KERNEL_APPEND", "")
+	for _, tt := range []struct {
+		name string
+		arch Arch
+		fns  []Fn
+		want string
+	}{
+		{
+			name: "off",
+			arch: ArchArm64,
+			fns:  []Fn{WithAppendKernel("quiet")},
+			want: "quiet",
+		},
+		{
+			name: "arm64",
+			arch: ArchArm64,
+			fns:  []Fn{WithConsoleArg(true), WithAppendKernel("quiet")},
+			want: "quiet console=ttyAMA0",
+		},
+		{
+			name: "amd64",
+			arch: ArchAMD64,
+			fns:  []Fn{WithConsoleArg(true)},
+			want: "console=ttyS0",
+		},
+		{
+			name: "sifive_u",
+			arch: ArchRiscv64,
+			fns:  []Fn{WithConsoleArg(true), ArbitraryArgs("-M", "sifive_u")},
+			want: "console=ttySIF0",
+		},
+		{
+			name: "user console",
+			arch: ArchArm,
+			fns:  []Fn{WithConsoleArg(true), WithAppendKernel("console=hvc0")},
+			want: "console=hvc0",
+		},
+		{
+			name: "turned off",
+			arch: ArchArm,
+			fns:  []Fn{WithConsoleArg(true), WithConsoleArg(false), WithAppendKernel("quiet")},
+			want: "quiet",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := OptionsFor(tt.arch, append([]Fn{WithQEMUCommand("qemu"), WithKernel("kernel")}, tt.fns...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args, err := opts.Cmdline()
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := slices.Index(args, "-append")
+			if i < 0 || i+1 >= len(args) || args[i+1] != tt.want {
+				t.Errorf("Cmdline = %v, want -append %q", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsoleArgWithoutKernel(t *testing.T) {
+	t.Setenv("VMTEST_KERNEL", "")
+	t.Setenv("VMTEST_KERNEL_APPEND", "")
+	opts, err := OptionsFor(ArchAMD64, WithQEMUCommand("qemu"), WithConsoleArg(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := opts.Cmdline()
+	if err != nil {
+		t.Fatalf("Cmdline = %v", err)
+	}
+	if slices.Contains(args, "-append") {
+		t.Errorf("Cmdline = %v, want no -append without a kernel", args)
+	}
+}
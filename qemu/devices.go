@@ -5,15 +5,16 @@
 package qemu
 
 import (
-	"bufio"
-	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
-	"sync"
-	"time"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/internal/hostres"
+	"github.com/hugelgupf/vmtest/internal/mountspec"
 )
 
 // ErrInvalidDir is used when no directory is specified for file sharing.
@@ -25,6 +26,9 @@ var ErrInvalidTag = errors.New("no tag specified for 9P file system")
 // ErrIsNotDir is used when the directory specified for file sharing is not a directory.
 var ErrIsNotDir = errors.New("file system sharing requires directory")
 
+// ErrInvalidMount is used when a guest mount is missing a source, fstype, or target.
+var ErrInvalidMount = mountspec.ErrInvalidMount
+
 // IDAllocator is used to ensure no overlapping QEMU option IDs.
 type IDAllocator struct {
 	// maps a prefix to the maximum used suffix number.
@@ -46,9 +50,74 @@ func (a *IDAllocator) ID(prefix string) string {
 	return fmt.Sprintf("%s%d", prefix, idx)
 }
 
+// DeviceOption configures a device added by a device helper such as
+// IDEBlockDevice.
+type DeviceOption func(*deviceOptions)
+
+type deviceOptions struct {
+	bootIndex *int
+}
+
+// WithBootIndex sets the device's bootindex, i.e. its position in the boot
+// order of the firmware (UEFI or SeaBIOS). Devices with lower indices are
+// tried first; devices without a bootindex are tried last.
+//
+// Use it to test boot selection deterministically instead of relying on
+// QEMU's defaults. See also qnetwork.WithBootIndex and WithBootOrder.
+func WithBootIndex(index int) DeviceOption {
+	return func(o *deviceOptions) {
+		o.bootIndex = &index
+	}
+}
+
+// deviceArgs returns the "-device" argument props with the configured device
+// properties appended.
+func deviceArgs(props string, devOpts []DeviceOption) string {
+	var o deviceOptions
+	for _, opt := range devOpts {
+		opt(&o)
+	}
+	if o.bootIndex != nil {
+		props += fmt.Sprintf(",bootindex=%d", *o.bootIndex)
+	}
+	return props
+}
+
+// BootDevice is a device class in the legacy machine boot order.
+type BootDevice string
+
+// Boot devices for WithBootOrder.
+const (
+	BootFloppy  BootDevice = "a"
+	BootDisk    BootDevice = "c"
+	BootCDROM   BootDevice = "d"
+	BootNetwork BootDevice = "n"
+)
+
+// WithBootOrder sets the order in which the firmware tries to boot from
+// device classes. Devices with a bootindex (see WithBootIndex) take
+// precedence.
+//
+// If strict is true, the firmware does not fall back to other devices when
+// none of the given ones boots.
+func WithBootOrder(strict bool, order ...BootDevice) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		var o strings.Builder
+		for _, d := range order {
+			o.WriteString(string(d))
+		}
+		boot := "order=" + o.String()
+		if strict {
+			boot += ",strict=on"
+		}
+		opts.AppendQEMU("-boot", boot)
+		return nil
+	}
+}
+
 // ReadOnlyDirectory adds args that expose a directory as a /dev/sda1 readonly
 // vfat partition in the VM guest.
-func ReadOnlyDirectory(dir string) Fn {
+func ReadOnlyDirectory(dir string, devOpts ...DeviceOption) Fn {
 	return func(alloc *IDAllocator, opts *Options) error {
 		if len(dir) == 0 {
 			return ErrInvalidDir
@@ -70,14 +139,14 @@ func ReadOnlyDirectory(dir string) Fn {
 		opts.AppendQEMU(
 			"-drive", fmt.Sprintf("file=fat:rw:%s,if=none,id=%s", dir, drive),
 			"-device", fmt.Sprintf("ich9-ahci,id=%s", ahci),
-			"-device", fmt.Sprintf("ide-hd,drive=%s,bus=%s.0", drive, ahci),
+			"-device", deviceArgs(fmt.Sprintf("ide-hd,drive=%s,bus=%s.0", drive, ahci), devOpts),
 		)
 		return nil
 	}
 }
 
 // IDEBlockDevice emulates an AHCI/IDE block device.
-func IDEBlockDevice(file string) Fn {
+func IDEBlockDevice(file string, devOpts ...DeviceOption) Fn {
 	return func(alloc *IDAllocator, opts *Options) error {
 		if _, err := os.Stat(file); err != nil {
 			return fmt.Errorf("cannot access file %s to be shared with guest: %w", file, err)
@@ -89,7 +158,7 @@ func IDEBlockDevice(file string) Fn {
 		opts.AppendQEMU(
 			"-drive", fmt.Sprintf("file=%s,if=none,id=%s", file, drive),
 			"-device", fmt.Sprintf("ich9-ahci,id=%s", ahci),
-			"-device", fmt.Sprintf("ide-hd,drive=%s,bus=%s.0", drive, ahci),
+			"-device", deviceArgs(fmt.Sprintf("ide-hd,drive=%s,bus=%s.0", drive, ahci), devOpts),
 		)
 		return nil
 	}
@@ -108,6 +177,11 @@ func IDEBlockDevice(file string) Fn {
 // vmmount command in vminit/vmmount can be used to mount 9P directories passed
 // to the VM this way at /mount/9p/$tag in the guest. See the example in
 // ./examples/shareddir.
+//
+// To have vmmount mount the directory elsewhere, combine P9Directory with
+// WithGuestMount using FSType "9p" and the same tag as Source.
+//
+// 9P directories cannot be shared from Windows hosts.
 func P9Directory(dir string, tag string) Fn {
 	return p9Directory(dir, false, tag)
 }
@@ -130,6 +204,9 @@ func p9Directory(dir string, boot bool, tag string) Fn {
 		if len(tag) == 0 {
 			return ErrInvalidTag
 		}
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("%w: QEMU does not share 9P directories from Windows hosts", ErrUnsupportedHost)
+		}
 		if fi, err := os.Stat(dir); err != nil {
 			return fmt.Errorf("cannot access directory %s to be shared with guest: %w", dir, err)
 		} else if !fi.IsDir() {
@@ -148,13 +225,7 @@ func p9Directory(dir string, boot bool, tag string) Fn {
 		}
 
 		// Expose the temp directory to QEMU
-		var deviceArgs string
-		switch opts.Arch() {
-		case ArchArm:
-			deviceArgs = fmt.Sprintf("virtio-9p-device,fsdev=%s,mount_tag=%s", id, tag)
-		default:
-			deviceArgs = fmt.Sprintf("virtio-9p-pci,fsdev=%s,mount_tag=%s", id, tag)
-		}
+		deviceArgs := fmt.Sprintf("%s,fsdev=%s,mount_tag=%s", opts.Env().VirtioDevice("virtio-9p"), id, tag)
 
 		opts.AppendQEMU(
 			// security_model=mapped-file seems to be the best choice. It gives
@@ -177,10 +248,56 @@ func p9Directory(dir string, boot bool, tag string) Fn {
 	}
 }
 
-// VirtioRandom adds QEMU args that expose a PCI random number generator to the
-// guest VM.
+// GuestMount is a file system to be mounted in the guest by the vmmount
+// command.
+type GuestMount struct {
+	// Source is the device or tag to mount, e.g. a 9P tag.
+	Source string
+
+	// FSType is the file system type, e.g. "9p" or "virtiofs".
+	FSType string
+
+	// Target is the mount point in the guest. It is created if it does
+	// not exist.
+	Target string
+
+	// Options is the comma-separated data passed to mount(2).
+	//
+	// If empty for 9p file systems, vmmount uses virtio transport
+	// defaults.
+	Options string
+}
+
+// WithGuestMount adds a mount table entry to the kernel command-line, which
+// the vmmount command in vminit/vmmount uses to mount file systems before
+// running its command.
+//
+// The entry is added as VMTEST_MOUNT$n=$encoded. Entries are mounted in the
+// order they were added and unmounted in reverse order. The device backing
+// Source must be configured separately, e.g. with P9Directory.
+func WithGuestMount(m GuestMount) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		spec := mountspec.Mount{
+			Source:  m.Source,
+			FSType:  m.FSType,
+			Target:  m.Target,
+			Options: m.Options,
+		}
+		if err := spec.Validate(); err != nil {
+			return err
+		}
+		opts.AppendKernel(fmt.Sprintf("%s=%s", alloc.ID(mountspec.EnvPrefix), spec.Encode()))
+		return nil
+	}
+}
+
+// VirtioRandom adds QEMU args that expose a virtio random number generator to
+// the guest VM.
 func VirtioRandom() Fn {
-	return ArbitraryArgs("-device", "virtio-rng-pci")
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.AppendQEMU("-device", opts.Env().VirtioDevice("virtio-rng"))
+		return nil
+	}
 }
 
 // ArbitraryArgs adds arbitrary arguments to the QEMU command line.
@@ -203,7 +320,8 @@ func WithQEMUArgs(aa ...string) Fn {
 // panics.
 //
 // Linux's default behavior is to hang forever, which is not great test
-// behavior.
+// behavior. For guests that reboot anyway, e.g. on a triple fault, see
+// WithRebootLoopDetection.
 func HaltOnKernelPanic() Fn {
 	return func(alloc *IDAllocator, opts *Options) error {
 		opts.AppendQEMU("-no-reboot")
@@ -212,77 +330,6 @@ func HaltOnKernelPanic() Fn {
 	}
 }
 
-func replaceCtl(str []byte) []byte {
-	for i, c := range str {
-		if c == 9 || c == 10 {
-		} else if c < 32 || c == 127 {
-			str[i] = '~'
-		}
-	}
-	return str
-}
-
-// LinePrinter prints one line to some output.
-type LinePrinter func(line string)
-
-// LogSerialByLine processes serial output from the guest one line at a time
-// and calls callback on each full line.
-func LogSerialByLine(callback LinePrinter) Fn {
-	return func(alloc *IDAllocator, opts *Options) error {
-		r, w := io.Pipe()
-		opts.SerialOutput = append(opts.SerialOutput, w)
-		opts.Tasks = append(opts.Tasks, WaitVMStarted(func(ctx context.Context, n *Notifications) error {
-			s := bufio.NewScanner(r)
-			for s.Scan() {
-				callback(string(replaceCtl(s.Bytes())))
-			}
-			if err := s.Err(); err != nil {
-				return fmt.Errorf("error reading serial from VM: %w", err)
-			}
-			return nil
-		}))
-		return nil
-	}
-}
-
-// TS prefixes line printer output with a timestamp since the first log line.
-//
-// format can be any Time.Format format string. Recommendations are
-// time.TimeOnly or time.DateTime.
-func TS(format string, printer LinePrinter) LinePrinter {
-	return func(line string) {
-		printer(fmt.Sprintf("[%s] %s", time.Now().Format(format), line))
-	}
-}
-
-// DefaultPrint is the default LinePrinter, adding a prefix and relative timestamp.
-func DefaultPrint(prefix string, printer func(fmt string, arg ...any)) LinePrinter {
-	return RelativeTS(Prefix(prefix, PrintLine(printer)))
-}
-
-// RelativeTS prefixes line printer output with "[%06.4fs] " seconds since the
-// first log line.
-func RelativeTS(printer LinePrinter) LinePrinter {
-	start := sync.OnceValue(time.Now)
-	return func(line string) {
-		printer(fmt.Sprintf("[%06.4fs] %s", time.Since(start()).Seconds(), line))
-	}
-}
-
-// PrintLine is a LinePrinter that prints to a standard "formatter" like testing.TB.Logf or fmt.Printf.
-func PrintLine(printer func(fmt string, arg ...any)) LinePrinter {
-	return func(line string) {
-		printer("%s", line)
-	}
-}
-
-// Prefix returns a LinePrinter that prefixes the given LinePrinter with "prefix: ".
-func Prefix(prefix string, printer LinePrinter) LinePrinter {
-	return func(line string) {
-		printer(fmt.Sprintf("%s: %s", prefix, line))
-	}
-}
-
 // ByArch applies only the Fn config function applicable to the VM guest
 // architecture.
 func ByArch(m map[Arch]Fn) Fn {
@@ -329,6 +376,51 @@ func All(fn ...Fn) Fn {
 	}
 }
 
+// WithDebugShell serves a debug shell started by the vminit/debugsh command on
+// the unix domain socket at socketPath.
+//
+// debugsh starts the shell only when the command it wraps fails, keeping the
+// VM alive until the shell exits. Connect to it with e.g.
+//
+//	socat - UNIX-CONNECT:$socketPath
+//
+// The VM timeout still applies, so consider raising it when debugging.
+// socketPath cannot be used by two VMs of a test process at the same time.
+func WithDebugShell(socketPath string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		release, err := hostres.ClaimPath(socketPath)
+		if err != nil {
+			return err
+		}
+		opts.AddRelease(release)
+		id := alloc.ID("debugsh")
+		opts.AppendQEMU(
+			"-device", "virtio-serial",
+			"-device", fmt.Sprintf("virtserialport,chardev=%s,name=debugsh", id),
+			"-chardev", fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off", id, socketPath),
+		)
+		opts.AppendKernel("VMTEST_DEBUG_SHELL=debugsh")
+		return nil
+	}
+}
+
+// WithDebugShellT is WithDebugShell with the socket in a new temporary
+// directory, which is removed when t's test completes. The socket's path is
+// logged.
+func WithDebugShellT(t testing.TB) Fn {
+	// Unix socket paths are limited to ~100 characters, so don't use a
+	// test-named temp dir.
+	dir, err := os.MkdirTemp("", "debugsh-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "debugsh.sock")
+	t.Logf("Debug shell will be served if the guest command fails; connect with: socat - UNIX-CONNECT:%s", socket)
+	return WithDebugShell(socket)
+}
+
 // WithVmtestIdent adds VMTEST_IN_GUEST=1 to kernel commmand-line.
 //
 // Tests may use this env var to identify they are running inside a vmtest
@@ -9,8 +9,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 )
 
 func TestIDAllocator(t *testing.T) {
@@ -74,6 +76,29 @@ func TestDevices(t *testing.T) {
 					"-device", "ide-hd,drive=drive0,bus=ahci0.0"),
 			},
 		},
+		{
+			name: "boot-order",
+			arch: ArchAMD64,
+			fns: []Fn{
+				WithQEMUCommand("qemu"),
+				WithKernel("./foobar"),
+				IDEBlockDevice(emptyFilePath, WithBootIndex(1)),
+				ReadOnlyDirectory(dir, WithBootIndex(0)),
+				WithBootOrder(true, BootNetwork, BootDisk),
+			},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-kernel", "./foobar"),
+				withArg("-drive", fmt.Sprintf("file=%s,if=none,id=drive0", emptyFilePath),
+					"-device", "ich9-ahci,id=ahci0",
+					"-device", "ide-hd,drive=drive0,bus=ahci0.0,bootindex=1"),
+				withArg("-drive", fmt.Sprintf("file=fat:rw:%s,if=none,id=drive1", dir),
+					"-device", "ich9-ahci,id=ahci1",
+					"-device", "ide-hd,drive=drive1,bus=ahci1.0,bootindex=0"),
+				withArg("-boot", "order=nc,strict=on"),
+			},
+		},
 		{
 			name: "9p-missing-dir",
 			arch: ArchAMD64,
@@ -122,6 +147,125 @@ func TestDevices(t *testing.T) {
 			fns:  []Fn{IDEBlockDevice(filepath.Join(t.TempDir(), "non-exist"))},
 			err:  syscall.ENOENT,
 		},
+		{
+			name: "guest-mount",
+			arch: ArchAMD64,
+			fns: []Fn{
+				WithQEMUCommand("qemu"),
+				WithKernel("./foobar"),
+				WithGuestMount(GuestMount{Source: "tag", FSType: "9p", Target: "/mnt/tag"}),
+				WithGuestMount(GuestMount{Source: "fs", FSType: "virtiofs", Target: "/data", Options: "ro,dax"}),
+			},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-kernel", "./foobar"),
+				withArg("-append", "VMTEST_MOUNT0=fstype=9p&source=tag&target=%2Fmnt%2Ftag VMTEST_MOUNT1=fstype=virtiofs&options=ro%2Cdax&source=fs&target=%2Fdata"),
+			},
+		},
+		{
+			name: "guest-mount-missing-target",
+			arch: ArchAMD64,
+			fns:  []Fn{WithGuestMount(GuestMount{Source: "tag", FSType: "9p"})},
+			err:  ErrInvalidMount,
+		},
+		{
+			name: "debug-shell",
+			arch: ArchAMD64,
+			fns:  []Fn{WithQEMUCommand("qemu"), WithKernel("./foobar"), WithDebugShell("/tmp/debugsh.sock")},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-kernel", "./foobar"),
+				withArg("-device", "virtio-serial",
+					"-device", "virtserialport,chardev=debugsh0,name=debugsh",
+					"-chardev", "socket,id=debugsh0,path=/tmp/debugsh.sock,server=on,wait=off"),
+				withArg("-append", "VMTEST_DEBUG_SHELL=debugsh"),
+			},
+		},
+		{
+			name: "qemu-debug-log",
+			arch: ArchAMD64,
+			fns:  []Fn{WithQEMUCommand("qemu"), WithQEMUDebugLog("/tmp/qemu.log"), WithQEMUDebugLog("/tmp/int.log", "int", "cpu_reset")},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-D", "/tmp/qemu.log", "-d", "guest_errors,unimp"),
+				withArg("-D", "/tmp/int.log", "-d", "int,cpu_reset"),
+			},
+		},
+		{
+			name: "random-source",
+			arch: ArchAMD64,
+			fns:  []Fn{WithQEMUCommand("qemu"), WithRandomSource(emptyFilePath)},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-object", fmt.Sprintf("rng-random,id=rng0,filename=%s", emptyFilePath),
+					"-device", "virtio-rng-pci,rng=rng0"),
+			},
+		},
+		{
+			name: "random-source-not-exist",
+			arch: ArchAMD64,
+			fns:  []Fn{WithRandomSource(filepath.Join(t.TempDir(), "non-exist"))},
+			err:  syscall.ENOENT,
+		},
+		{
+			name: "rtc",
+			arch: ArchAMD64,
+			fns: []Fn{
+				WithQEMUCommand("qemu"),
+				WithRTC(time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600)), RTCClockVM),
+				WithRTC(time.Time{}, RTCClockHost),
+			},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-rtc", "base=2020-01-02T02:04:05,clock=vm"),
+				withArg("-rtc", "base=utc,clock=host"),
+			},
+		},
+		{
+			name: "watchdog",
+			arch: ArchAMD64,
+			fns:  []Fn{WithQEMUCommand("qemu"), WithWatchdog(WatchdogI6300ESB, WatchdogPause)},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-device", "i6300esb", "-action", "watchdog=pause"),
+			},
+		},
+		{
+			name: "watchdog-not-x86",
+			arch: ArchArm64,
+			fns:  []Fn{WithWatchdog(WatchdogI6300ESB, WatchdogReset)},
+			err:  ErrUnsupportedArch,
+		},
+		{
+			name: "memory-backend-file",
+			arch: ArchAMD64,
+			fns:  []Fn{WithQEMUCommand("qemu"), WithMemoryBackend(MemoryBackend{Size: "1G", Path: dir, Share: true, Prealloc: true})},
+			want: []cmdlineEqualOpt{
+				withArgv0("qemu"),
+				withArg("-nographic"),
+				withArg("-m", "1G",
+					"-object", fmt.Sprintf("memory-backend-file,id=mem0,mem-path=%s,size=1073741824,share=on,prealloc=on", dir),
+					"-machine", "memory-backend=mem0"),
+			},
+		},
+		{
+			name: "memory-backend-not-a-dir",
+			arch: ArchAMD64,
+			fns:  []Fn{WithMemoryBackend(MemoryBackend{Size: "1G", Path: emptyFilePath})},
+			err:  ErrIsNotDir,
+		},
+		{
+			name: "memory-backend-invalid-size",
+			arch: ArchAMD64,
+			fns:  []Fn{WithMemoryBackend(MemoryBackend{Size: "1X", Path: dir})},
+			err:  ErrInvalidMemorySize,
+		},
 		{
 			name: "by-arch-found",
 			arch: ArchAMD64,
@@ -208,3 +352,29 @@ func TestDevices(t *testing.T) {
 		})
 	}
 }
+
+func TestDebugShellT(t *testing.T) {
+	var dir string
+	t.Run("vm", func(t *testing.T) {
+		opts, err := OptionsFor(ArchAMD64, WithQEMUCommand("qemu"), WithKernel("./foobar"), WithDebugShellT(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var socket string
+		for _, arg := range opts.QEMUArgs {
+			if _, p, ok := strings.Cut(arg, ",path="); ok {
+				socket, _, _ = strings.Cut(p, ",")
+			}
+		}
+		if filepath.Base(socket) != "debugsh.sock" {
+			t.Fatalf("QEMU args %v have no debugsh.sock chardev", opts.QEMUArgs)
+		}
+		dir = filepath.Dir(socket)
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("socket directory: %v", err)
+		}
+	})
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("socket directory %s not removed after test: %v", dir, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hugelgupf/vmtest/internal/qmp"
+)
+
+// DefaultSoftTimeout is how long before VMTimeout StartT gathers
+// diagnostics, if VMTimeout is at least 3 times as long.
+const DefaultSoftTimeout = 15 * time.Second
+
+// diagnosticsConsoleLines is how many lines of console output diagnostics
+// include.
+const diagnosticsConsoleLines = 200
+
+// TimeoutError is returned by VM.Wait when the VM was killed after diagnostics
+// were gathered by a soft timeout (see WithSoftTimeout).
+type TimeoutError struct {
+	// Diagnostics describe the state of the VM shortly before it was
+	// killed.
+	Diagnostics string
+
+	// Err is the error the VM exited with.
+	Err error
+
+	// Dump is the state dump taken before the VM was killed, if
+	// configured with WithFailureDump.
+	Dump *StateDump
+}
+
+func (e *TimeoutError) Error() string {
+	s := fmt.Sprintf("%v; diagnostics gathered before timeout:\n%s", e.Err, e.Diagnostics)
+	if e.Dump != nil {
+		s = strings.TrimSuffix(s, "\n") + "\n" + e.Dump.String()
+	}
+	return s
+}
+
+// Unwrap returns the VM's exit error.
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// WithQMP adds a QMP control socket to the VM in a new temporary directory,
+// unless one was already added.
+func WithQMP() Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.QMPSocket != "" {
+			return nil
+		}
+		path, err := addQMPSocket(opts)
+		if err != nil {
+			return err
+		}
+		opts.QMPSocket = path
+		return nil
+	}
+}
+
+// addQMPSocket adds a QMP monitor on a unix socket in a new temporary
+// directory and returns its path. QEMU serves one client per monitor at a
+// time.
+func addQMPSocket(opts *Options) (string, error) {
+	// Unix socket paths are limited to ~100 bytes, so don't use a test's
+	// temporary directory.
+	dir, err := os.MkdirTemp("", "vmtest-qmp")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "qmp.sock")
+	opts.AppendQEMU("-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", path))
+	opts.Tasks = append(opts.Tasks, Cleanup(func() error {
+		return os.RemoveAll(dir)
+	}))
+	return path, nil
+}
+
+// WithSoftTimeout gathers diagnostics the duration grace before the VM is
+// killed due to VMTimeout, or due to the deadline of the context passed to
+// StartContext.
+// VM.Wait then returns a *TimeoutError containing them.
+//
+// Diagnostics are the VM run state and CPU registers from QMP, and the last
+// console lines after requesting a dump of all kernel tasks with the magic
+// SysRq key t. The SysRq key is sent as a serial break, which requires the
+// serial console to be multiplexed with the QEMU monitor, as -nographic does.
+// Since the kernel log is printed on the console, console lines include the
+// end of dmesg.
+//
+// StartT uses DefaultSoftTimeout unless VMTimeout is shorter than 3 times as
+// long.
+func WithSoftTimeout(grace time.Duration) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.SoftTimeout = grace
+		return WithQMP()(alloc, opts)
+	}
+}
+
+// defaultSoftTimeout uses DefaultSoftTimeout unless a soft timeout was
+// configured already, the VM timeout is too short, or the VM is not run by
+// QEMU.
+func defaultSoftTimeout() Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.SoftTimeout != 0 || opts.VMTimeout < 3*DefaultSoftTimeout || opts.Backend != nil {
+			return nil
+		}
+		return WithSoftTimeout(DefaultSoftTimeout)(alloc, opts)
+	}
+}
+
+// watchSoftTimeout gathers diagnostics SoftTimeout before ctx's deadline,
+// unless the VM exits first.
+func (v *VM) watchSoftTimeout(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok || v.Options.SoftTimeout <= 0 || v.Options.QMPSocket == "" {
+		return
+	}
+	v.softTimeoutDone = make(chan struct{})
+	go func() {
+		defer close(v.softTimeoutDone)
+		timer := time.NewTimer(time.Until(deadline.Add(-v.Options.SoftTimeout)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-v.wait:
+			return
+		}
+		dump := v.dumpState()
+		d := v.gatherDiagnostics(deadline)
+
+		v.waitMu.Lock()
+		v.diagnostics = d
+		v.dump = dump
+		v.waitMu.Unlock()
+	}()
+}
+
+// gatherDiagnostics collects diagnostics. It returns before deadline.
+func (v *VM) gatherDiagnostics(deadline time.Time) string {
+	// Leave some time to record the diagnostics.
+	deadline = deadline.Add(-v.Options.SoftTimeout / 10)
+
+	var s strings.Builder
+	fmt.Fprintf(&s, "=== soft timeout %s before VM timeout ===\n", v.Options.SoftTimeout)
+
+	// Serial break followed by t within 5 seconds is SysRq-t. Ctrl-a b
+	// sends a break on a serial console multiplexed with the monitor.
+	sysrqErr := func() error {
+		if v.Console == nil {
+			return ErrNoConsole
+		}
+		if _, err := v.Console.Send("\x01b"); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		_, err := v.Console.Send("t")
+		return err
+	}()
+	if sysrqErr != nil {
+		fmt.Fprintf(&s, "could not send SysRq-t: %v\n", sysrqErr)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	fmt.Fprintf(&s, "=== QMP ===\n%s", v.qmpDiagnostics(ctx))
+
+	// Give the kernel time to print all tasks.
+	select {
+	case <-ctx.Done():
+	case <-v.wait:
+	}
+
+	if v.Options.Transcript != nil {
+		lines := v.Options.Transcript.Lines()
+		if n := len(lines); n > diagnosticsConsoleLines {
+			lines = lines[n-diagnosticsConsoleLines:]
+		}
+		fmt.Fprintf(&s, "=== last %d console lines ===\n%s", len(lines), formatLines(lines))
+	}
+	return s.String()
+}
+
+func (v *VM) qmpDiagnostics(ctx context.Context) string {
+	c, err := qmp.Dial(ctx, v.Options.QMPSocket)
+	if err != nil {
+		return fmt.Sprintf("could not connect to QMP: %v\n", err)
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+
+	var s strings.Builder
+	if status, err := c.Execute("query-status", nil); err != nil {
+		fmt.Fprintf(&s, "query-status: %v\n", err)
+	} else {
+		fmt.Fprintf(&s, "query-status: %s\n", status)
+	}
+	if regs, err := c.HumanMonitorCommand("info registers -a"); err != nil {
+		fmt.Fprintf(&s, "info registers: %v\n", err)
+	} else {
+		fmt.Fprintf(&s, "info registers:\n%s\n", strings.TrimRight(strings.ReplaceAll(regs, "\r\n", "\n"), "\n"))
+	}
+	return s.String()
+}
+
+// Diagnostics returns diagnostics gathered by a soft timeout, or "" if none
+// were gathered. See WithSoftTimeout.
+func (v *VM) Diagnostics() string {
+	v.waitMu.Lock()
+	defer v.waitMu.Unlock()
+	return v.diagnostics
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveQMP answers QMP commands on l like a running QEMU would.
+func serveQMP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+			s := bufio.NewScanner(conn)
+			for s.Scan() {
+				switch {
+				case strings.Contains(s.Text(), "query-status"):
+					fmt.Fprintln(conn, `{"return": {"status": "running", "running": true}}`)
+				case strings.Contains(s.Text(), "info registers"):
+					fmt.Fprintln(conn, `{"return": "RIP=ffffffff81000000\r\n"}`)
+				default:
+					fmt.Fprintln(conn, `{"return": {}}`)
+				}
+			}
+		}()
+	}
+}
+
+func TestSoftTimeout(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "qmp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveQMP(l)
+
+	vm, err := Start(ArchAMD64,
+		WithQEMUCommand("sleep 30"),
+		WithVMTimeout(4*time.Second),
+		WithTranscript(NewTranscript()),
+		clearArgs(),
+		func(alloc *IDAllocator, opts *Options) error {
+			// Use the fake QMP server rather than WithQMP.
+			opts.SoftTimeout = 2 * time.Second
+			opts.QMPSocket = sock
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start 'VM': %v", err)
+	}
+
+	err = vm.Wait()
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Wait = %v, want TimeoutError", err)
+	}
+	var execErr *exec.ExitError
+	if !errors.As(err, &execErr) {
+		t.Errorf("Wait = %v, want wrapped exec.ExitError", err)
+	}
+	for _, want := range []string{`"status": "running"`, "RIP=ffffffff81000000", "console lines"} {
+		if !strings.Contains(timeoutErr.Diagnostics, want) {
+			t.Errorf("Diagnostics = %q, want %q", timeoutErr.Diagnostics, want)
+		}
+	}
+	if vm.Diagnostics() != timeoutErr.Diagnostics {
+		t.Errorf("VM.Diagnostics = %q, want %q", vm.Diagnostics(), timeoutErr.Diagnostics)
+	}
+}
+
+func TestNoSoftTimeoutOnExit(t *testing.T) {
+	vm, err := Start(ArchAMD64,
+		WithQEMUCommand("sleep 1"),
+		WithVMTimeout(10*time.Second),
+		WithSoftTimeout(5*time.Second),
+		clearArgs(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start 'VM': %v", err)
+	}
+	if err := vm.Wait(); err != nil {
+		t.Errorf("Wait = %v", err)
+	}
+	if d := vm.Diagnostics(); d != "" {
+		t.Errorf("Diagnostics = %q, want none", d)
+	}
+}
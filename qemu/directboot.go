@@ -0,0 +1,167 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// BootProtocol is a protocol to boot an uncompressed kernel with.
+type BootProtocol string
+
+// Boot protocols supported by QEMU's -kernel on x86.
+const (
+	// BootPVH enters the kernel at the entry point given by its
+	// XEN_ELFNOTE_PHYS32_ENTRY ELF note, as Linux vmlinux with CONFIG_PVH
+	// has.
+	BootPVH BootProtocol = "pvh"
+
+	// BootMultiboot boots a 32-bit ELF kernel with a multiboot (version 1)
+	// header.
+	BootMultiboot BootProtocol = "multiboot"
+)
+
+// ErrNoBootProtocol is returned for kernels that can neither be booted with
+// PVH nor multiboot.
+var ErrNoBootProtocol = errors.New("kernel has neither a PVH ELF note nor a multiboot header")
+
+// ErrDirectBootMachine is returned when direct boot is used with a machine type
+// that does not support it.
+var ErrDirectBootMachine = errors.New("PVH and multiboot are only supported by the pc, q35, and microvm machine types")
+
+const (
+	// xenElfnotePhys32Entry is the Xen ELF note type with the PVH entry
+	// point.
+	xenElfnotePhys32Entry = 18
+
+	multibootMagic = 0x1badb002
+
+	// multibootSearch is how far into the kernel the multiboot header
+	// must be.
+	multibootSearch = 8192
+)
+
+// KernelBootProtocol returns the protocol the uncompressed kernel at path can
+// be booted with directly, preferring PVH.
+func KernelBootProtocol(path string) (BootProtocol, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if e, err := elf.NewFile(f); err == nil && hasPVHNote(e) {
+		return BootPVH, nil
+	}
+	if ok, err := hasMultibootHeader(f); err != nil {
+		return "", err
+	} else if ok {
+		return BootMultiboot, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrNoBootProtocol, path)
+}
+
+func hasPVHNote(e *elf.File) bool {
+	for _, p := range e.Progs {
+		if p.Type != elf.PT_NOTE {
+			continue
+		}
+		b, err := io.ReadAll(p.Open())
+		if err != nil {
+			continue
+		}
+		if hasNote(b, e.ByteOrder, "Xen", xenElfnotePhys32Entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNote returns whether the ELF notes in b contain one named name of type
+// typ.
+func hasNote(b []byte, order binary.ByteOrder, name string, typ uint32) bool {
+	align := func(n uint32) uint32 { return (n + 3) &^ 3 }
+	for len(b) >= 12 {
+		namesz, descsz, t := order.Uint32(b), order.Uint32(b[4:]), order.Uint32(b[8:])
+		b = b[12:]
+		if uint64(align(namesz))+uint64(align(descsz)) > uint64(len(b)) {
+			return false
+		}
+		if t == typ && string(bytes.TrimRight(b[:namesz], "\x00")) == name {
+			return true
+		}
+		b = b[align(namesz)+align(descsz):]
+	}
+	return false
+}
+
+func hasMultibootHeader(r io.ReaderAt) (bool, error) {
+	b := make([]byte, multibootSearch)
+	n, err := r.ReadAt(b, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	b = b[:n]
+	for i := 0; i+12 <= len(b); i += 4 {
+		magic := binary.LittleEndian.Uint32(b[i:])
+		flags := binary.LittleEndian.Uint32(b[i+4:])
+		checksum := binary.LittleEndian.Uint32(b[i+8:])
+		if magic == multibootMagic && magic+flags+checksum == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MachineType returns the machine type given with -M or -machine in the QEMU
+// command or arguments, or "" if none is.
+func (o *Options) MachineType() string {
+	args := append(strings.Fields(o.QEMUCommand), o.QEMUArgs...)
+	var machine string
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "-M" && args[i] != "-machine" {
+			continue
+		}
+		for _, p := range strings.Split(args[i+1], ",") {
+			if t, ok := strings.CutPrefix(p, "type="); ok {
+				machine = t
+			} else if !strings.Contains(p, "=") {
+				machine = p
+			}
+		}
+	}
+	return machine
+}
+
+// WithDirectBoot boots the uncompressed kernel vmlinux (e.g. Linux's vmlinux
+// built with CONFIG_PVH) directly via PVH or multiboot, skipping the
+// decompression and real-mode setup of bzImage boot. The protocol is
+// detected from the kernel, see KernelBootProtocol.
+//
+// Direct boot is only supported for amd64 guests on the pc, q35, and microvm
+// machine types, and with KVM as well as TCG. QEMU only boots 32-bit ELF
+// kernels with multiboot.
+func WithDirectBoot(vmlinux string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.Arch() != ArchAMD64 {
+			return fmt.Errorf("%w: direct boot needs amd64, not %s", ErrUnsupportedArch, opts.Arch())
+		}
+		if _, err := KernelBootProtocol(vmlinux); err != nil {
+			return err
+		}
+		if m := opts.MachineType(); m != "" && m != "q35" && m != "microvm" && m != "pc" && !strings.HasPrefix(m, "pc-") {
+			return fmt.Errorf("%w, not %s", ErrDirectBootMachine, m)
+		}
+		opts.Kernel = vmlinux
+		return nil
+	}
+}
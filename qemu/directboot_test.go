@@ -0,0 +1,122 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pvhELF returns a minimal ELF64 file with only a PT_NOTE program header
+// holding a note of type typ named "Xen".
+func pvhELF(typ uint32) []byte {
+	var note bytes.Buffer
+	_ = binary.Write(&note, binary.LittleEndian, []uint32{4, 4, typ})
+	note.WriteString("Xen\x00")
+	_ = binary.Write(&note, binary.LittleEndian, uint32(0x1000000))
+
+	const ehsize, phsize = 64, 56
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, elf.Header64{
+		Ident:     [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)},
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehsize,
+		Ehsize:    ehsize,
+		Phentsize: phsize,
+		Phnum:     1,
+		Shentsize: 64,
+	})
+	_ = binary.Write(&b, binary.LittleEndian, elf.Prog64{
+		Type:   uint32(elf.PT_NOTE),
+		Off:    ehsize + phsize,
+		Filesz: uint64(note.Len()),
+		Memsz:  uint64(note.Len()),
+		Align:  4,
+	})
+	b.Write(note.Bytes())
+	return b.Bytes()
+}
+
+func multibootKernel() []byte {
+	b := make([]byte, 4096)
+	magic, flags := uint32(multibootMagic), uint32(0x3)
+	binary.LittleEndian.PutUint32(b[512:], magic)
+	binary.LittleEndian.PutUint32(b[516:], flags)
+	binary.LittleEndian.PutUint32(b[520:], -(magic + flags))
+	return b
+}
+
+func TestKernelBootProtocol(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name    string
+		content []byte
+		want    BootProtocol
+		err     error
+	}{
+		{name: "pvh", content: pvhELF(xenElfnotePhys32Entry), want: BootPVH},
+		{name: "other-note", content: pvhELF(1), err: ErrNoBootProtocol},
+		{name: "multiboot", content: multibootKernel(), want: BootMultiboot},
+		{name: "bzImage", content: make([]byte, 16384), err: ErrNoBootProtocol},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := KernelBootProtocol(path)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("KernelBootProtocol = (%q, %v), want (%q, %v)", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestWithDirectBoot(t *testing.T) {
+	vmlinux := filepath.Join(t.TempDir(), "vmlinux")
+	if err := os.WriteFile(vmlinux, pvhELF(xenElfnotePhys32Entry), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := OptionsFor(ArchAMD64, WithQEMUCommand("qemu-system-x86_64 -M q35,accel=kvm"), WithDirectBoot(vmlinux))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Kernel != vmlinux {
+		t.Errorf("Kernel = %s, want %s", opts.Kernel, vmlinux)
+	}
+
+	if _, err := OptionsFor(ArchAMD64, WithQEMUArgs("-machine", "type=isapc"), WithDirectBoot(vmlinux)); !errors.Is(err, ErrDirectBootMachine) {
+		t.Errorf("WithDirectBoot(isapc) = %v, want %v", err, ErrDirectBootMachine)
+	}
+	if _, err := OptionsFor(ArchArm64, WithDirectBoot(vmlinux)); !errors.Is(err, ErrUnsupportedArch) {
+		t.Errorf("WithDirectBoot(arm64) = %v, want %v", err, ErrUnsupportedArch)
+	}
+}
+
+func TestMachineType(t *testing.T) {
+	for _, tt := range []struct {
+		cmd  string
+		args []string
+		want string
+	}{
+		{cmd: "qemu-system-x86_64 -m 1G"},
+		{cmd: "qemu-system-aarch64 -machine virt -cpu max", want: "virt"},
+		{cmd: "qemu-system-x86_64 -M q35", args: []string{"-machine", "smm=on,type=pc"}, want: "pc"},
+		{cmd: "qemu-system-x86_64", args: []string{"-machine", "microvm,accel=kvm"}, want: "microvm"},
+	} {
+		o := &Options{QEMUCommand: tt.cmd, QEMUArgs: tt.args}
+		if got := o.MachineType(); got != tt.want {
+			t.Errorf("MachineType(%s %v) = %q, want %q", tt.cmd, tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hugelgupf/vmtest/internal/qmp"
+)
+
+// DefaultFailureDumpConsole is how many bytes of console output a state dump
+// includes unless configured otherwise.
+const DefaultFailureDumpConsole = 64 << 10
+
+// failureDumpTimeout bounds how long taking a state dump may take.
+const failureDumpTimeout = 5 * time.Second
+
+// FailureDump configures state dumps taken when an expectation fails or the VM
+// times out. See WithFailureDump.
+type FailureDump struct {
+	// Dir is the directory dumps are written to. StartT uses the test's
+	// artifacts directory if empty.
+	Dir string
+
+	// ConsoleBytes is how many bytes of the end of the console output are
+	// saved.
+	ConsoleBytes int
+
+	// n counts the dumps taken to name their files.
+	n atomic.Int32
+}
+
+// StateDump is a state dump taken when an expectation failed or the VM timed
+// out. Files that could not be captured are empty, with the reason in Errs.
+type StateDump struct {
+	// Screendump is the path of a screenshot of the VM's display in PPM
+	// format.
+	Screendump string
+
+	// Registers is the path of the output of `info registers -a`.
+	Registers string
+
+	// Console is the path of the end of the console output.
+	Console string
+
+	// Errs are the errors capturing parts of the dump.
+	Errs []error
+}
+
+func (d *StateDump) String() string {
+	var files []string
+	for _, f := range []string{d.Screendump, d.Registers, d.Console} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	s := "state dump: " + strings.Join(files, ", ")
+	if len(files) == 0 {
+		s = "state dump failed"
+	}
+	if err := errors.Join(d.Errs...); err != nil {
+		s += fmt.Sprintf(" (%v)", strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	return s
+}
+
+// WithFailureDump dumps the VM's state into dir when VM.ExpectString or
+// VM.ExpectStringUntil fails, and when the VM times out with a soft timeout
+// (see WithSoftTimeout): a screendump and the CPU registers from QMP, and the
+// last consoleBytes bytes of console output. The returned *ExpectError or
+// *TimeoutError refers to the dump.
+//
+// If dir is empty, StartT uses the test's artifacts directory (see package
+// testartifacts). If consoleBytes is 0, DefaultFailureDumpConsole is used.
+// Console output is read from Options.ConsoleOutputFile, or the transcript if
+// there is none.
+func WithFailureDump(dir string, consoleBytes int) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if consoleBytes == 0 {
+			consoleBytes = DefaultFailureDumpConsole
+		}
+		opts.FailureDump = &FailureDump{Dir: dir, ConsoleBytes: consoleBytes}
+		return WithQMP()(alloc, opts)
+	}
+}
+
+// defaultFailureDumpDir sets the directory of a failure dump configured
+// without one.
+func defaultFailureDumpDir(dir string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.FailureDump != nil && opts.FailureDump.Dir == "" {
+			opts.FailureDump.Dir = dir
+		}
+		return nil
+	}
+}
+
+// dumpState takes a state dump if configured, or returns nil.
+func (v *VM) dumpState() *StateDump {
+	fd := v.Options.FailureDump
+	if fd == nil || fd.Dir == "" {
+		return nil
+	}
+	name := v.Options.Name
+	if name == "" {
+		name = "vm"
+	}
+	prefix := filepath.Join(fd.Dir, fmt.Sprintf("%s.dump%d", name, fd.n.Add(1)))
+
+	d := &StateDump{}
+	if err := os.MkdirAll(fd.Dir, 0o755); err != nil {
+		d.Errs = append(d.Errs, err)
+		return d
+	}
+	if err := os.WriteFile(prefix+".console.log", v.consoleTail(fd.ConsoleBytes), 0o644); err != nil {
+		d.Errs = append(d.Errs, fmt.Errorf("console: %w", err))
+	} else {
+		d.Console = prefix + ".console.log"
+	}
+	if v.Options.QMPSocket == "" {
+		d.Errs = append(d.Errs, errors.New("no QMP socket"))
+		return d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), failureDumpTimeout)
+	defer cancel()
+	c, err := qmp.Dial(ctx, v.Options.QMPSocket)
+	if err != nil {
+		d.Errs = append(d.Errs, fmt.Errorf("could not connect to QMP: %w", err))
+		return d
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(failureDumpTimeout))
+
+	// QEMU writes the screendump itself and needs an absolute path.
+	if path, err := filepath.Abs(prefix + ".ppm"); err != nil {
+		d.Errs = append(d.Errs, fmt.Errorf("screendump: %w", err))
+	} else if _, err := c.Execute("screendump", map[string]string{"filename": path}); err != nil {
+		d.Errs = append(d.Errs, fmt.Errorf("screendump: %w", err))
+	} else {
+		d.Screendump = path
+	}
+
+	if regs, err := c.HumanMonitorCommand("info registers -a"); err != nil {
+		d.Errs = append(d.Errs, fmt.Errorf("info registers: %w", err))
+	} else if err := os.WriteFile(prefix+".registers.txt", []byte(strings.ReplaceAll(regs, "\r\n", "\n")), 0o644); err != nil {
+		d.Errs = append(d.Errs, fmt.Errorf("info registers: %w", err))
+	} else {
+		d.Registers = prefix + ".registers.txt"
+	}
+	return d
+}
+
+// consoleTail returns the last n bytes of console output.
+func (v *VM) consoleTail(n int) []byte {
+	if f, err := os.Open(v.Options.ConsoleOutputFile); err == nil {
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil && fi.Size() > int64(n) {
+			_, _ = f.Seek(-int64(n), io.SeekEnd)
+		}
+		if b, err := io.ReadAll(f); err == nil {
+			return b
+		}
+	}
+	if v.Options.Transcript == nil {
+		return nil
+	}
+	s := v.Options.Transcript.String()
+	if len(s) > n {
+		s = s[len(s)-n:]
+	}
+	return []byte(s)
+}
+
+// expectError returns the error for a failed expectation of s, with a state
+// dump if configured.
+func (v *VM) expectError(s string, err error) error {
+	dump := v.dumpState()
+	if v.Options.Transcript == nil && dump == nil {
+		return err
+	}
+	e := &ExpectError{Want: s, Err: err}
+	if v.Options.Transcript != nil {
+		e = v.Options.Transcript.expectError(s, err)
+	}
+	e.Dump = dump
+	return e
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Netflix/go-expect"
+)
+
+func TestFailureDump(t *testing.T) {
+	c, err := expect.NewConsole()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	dir := t.TempDir()
+	console := filepath.Join(dir, "console.log")
+	if err := os.WriteFile(console, []byte("Booting\nKernel panic\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vm := &VM{Console: c, Options: &Options{
+		Name:              "vm0",
+		ConsoleOutputFile: console,
+		FailureDump:       &FailureDump{Dir: filepath.Join(dir, "dumps"), ConsoleBytes: 13},
+	}}
+
+	err = vm.ExpectStringUntil("login:", 2*expectPollInterval, nil)
+	var ee *ExpectError
+	if !errors.As(err, &ee) || ee.Dump == nil {
+		t.Fatalf("ExpectStringUntil = %v, want *ExpectError with dump", err)
+	}
+	if want := filepath.Join(dir, "dumps", "vm0.dump1.console.log"); ee.Dump.Console != want {
+		t.Errorf("Dump.Console = %q, want %q", ee.Dump.Console, want)
+	}
+	if b, _ := os.ReadFile(ee.Dump.Console); string(b) != "Kernel panic\n" {
+		t.Errorf("Dumped console = %q, want last 13 bytes", b)
+	}
+	// Without QMP, there are no screendump and registers.
+	if ee.Dump.Screendump != "" || ee.Dump.Registers != "" || len(ee.Dump.Errs) == 0 {
+		t.Errorf("Dump = %+v, want only console", ee.Dump)
+	}
+	if !strings.Contains(err.Error(), "state dump: "+ee.Dump.Console) {
+		t.Errorf("Error() = %s, want it to refer to the dump", err)
+	}
+
+	// Without console output file, the transcript is dumped.
+	vm.Options.ConsoleOutputFile = ""
+	vm.Options.Transcript = NewTranscript()
+	_, _ = vm.Options.Transcript.Write([]byte("hello\n"))
+	if err := vm.ExpectStringUntil("login:", time.Millisecond, nil); !errors.As(err, &ee) || ee.Dump == nil {
+		t.Fatalf("ExpectStringUntil = %v, want *ExpectError with dump", err)
+	}
+	if b, _ := os.ReadFile(ee.Dump.Console); !strings.HasSuffix(string(b), "] hello\n") {
+		t.Errorf("Dumped console = %q, want transcript", b)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordedEvent is a guest event persisted to an EventLog.
+type RecordedEvent struct {
+	// Channel is the name of the event channel the event was received on.
+	Channel string `json:"channel"`
+
+	// HostTime is the time the host received the event.
+	HostTime time.Time `json:"host_time"`
+
+	// GuestTime is the guest's wall clock time the event was emitted at,
+	// if the guest stamped it.
+	GuestTime time.Time `json:"guest_time,omitempty"`
+
+	// Event is the JSON-encoded event.
+	Event json.RawMessage `json:"event"`
+}
+
+// EventLog persists the guest events received on all event channels of a VM
+// to a file, one JSON-encoded RecordedEvent per line. See WithEventLog.
+//
+// Use ReplayEvents to read the events back.
+type EventLog struct {
+	path string
+
+	mu  sync.Mutex
+	f   *os.File
+	err error
+}
+
+// NewEventLog returns an event log writing to path. The file is created once
+// the first event is recorded.
+func NewEventLog(path string) *EventLog {
+	return &EventLog{path: path}
+}
+
+// Path is the path of the event log file.
+func (l *EventLog) Path() string {
+	return l.path
+}
+
+// Record appends the event e to the log.
+//
+// Record is safe to call from multiple goroutines. Once an error occurred,
+// Record returns it without recording any further events.
+func (l *EventLog) Record(e RecordedEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not encode event of channel %s: %w", e.Channel, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	if l.f == nil {
+		l.f, l.err = os.Create(l.path)
+		if l.err != nil {
+			return l.err
+		}
+	}
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		l.err = err
+	}
+	return l.err
+}
+
+// Close closes the event log file.
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return l.err
+	}
+	err := l.f.Close()
+	l.f = nil
+	if l.err == nil {
+		l.err = err
+	}
+	return err
+}
+
+// WithEventLog persists the guest events received on all event channels of
+// the VM (see package qevent) to path, one JSON-encoded RecordedEvent per line.
+//
+// The file is closed when VM.Wait returns. Use ReplayEvents to analyze the
+// events offline, e.g. after a failed CI run.
+func WithEventLog(path string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.EventLog = NewEventLog(path)
+		return nil
+	}
+}
+
+func defaultEventLog(path string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.EventLog != nil {
+			return nil
+		}
+		return WithEventLog(path)(alloc, opts)
+	}
+}
+
+// ReplayEvents calls callback with each event persisted to the event log file
+// at path, in the order the events were received.
+//
+// Use qevent.ReplayEvents to decode the events of one channel.
+func ReplayEvents(path string, callback func(RecordedEvent)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var e RecordedEvent
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("could not decode event log %s: %w", path, err)
+		}
+		callback(e)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.events.jsonl")
+	l := NewEventLog(path)
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Event log without events exists: %v", err)
+	}
+
+	now := time.Now().UTC().Round(0)
+	want := []RecordedEvent{
+		{Channel: "a", HostTime: now, Event: json.RawMessage(`{"foo":1}`)},
+		{Channel: "b", HostTime: now, GuestTime: now, Event: json.RawMessage(`"bar"`)},
+	}
+	for _, e := range want {
+		if err := l.Record(e); err != nil {
+			t.Fatalf("Record = %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+
+	var got []RecordedEvent
+	if err := ReplayEvents(path, func(e RecordedEvent) { got = append(got, e) }); err != nil {
+		t.Fatalf("ReplayEvents = %v", err)
+	}
+	for i := range got {
+		got[i].HostTime = got[i].HostTime.UTC()
+		got[i].GuestTime = got[i].GuestTime.UTC()
+	}
+	want[0].GuestTime = want[0].GuestTime.UTC()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReplayEvents = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/Netflix/go-expect"
+)
+
+// ErrExpectStopped is returned by VM.ExpectStringUntil when it was stopped
+// before s appeared.
+var ErrExpectStopped = errors.New("expectation stopped")
+
+// expectPollInterval is how often ExpectStringUntil checks whether it was
+// stopped while the console is idle.
+const expectPollInterval = 50 * time.Millisecond
+
+// ExpectStringUntil waits up to timeout for s to appear on the console, or
+// until stop is closed, whichever comes first. It returns ErrExpectStopped if
+// stop was closed first.
+//
+// Unlike an ExpectString call in another goroutine, ExpectStringUntil stops
+// reading the console as soon as it is stopped, so that a following Expect
+// call sees all subsequent output.
+//
+// If s does not appear in time or the VM exits, the error is an *ExpectError
+// as in ExpectString.
+func (v *VM) ExpectStringUntil(s string, timeout time.Duration, stop <-chan struct{}) error {
+	if v.Console == nil {
+		return ErrNoConsole
+	}
+	m := &untilMatcher{s: s, stop: stop}
+	deadline := time.Now().Add(timeout)
+	for {
+		poll := time.Until(deadline)
+		if poll > expectPollInterval {
+			poll = expectPollInterval
+		}
+		_, err := v.Console.Expect(func(opts *expect.ExpectOpts) error {
+			opts.Matchers = append(opts.Matchers, m)
+			return nil
+		}, expect.WithTimeout(poll))
+		switch {
+		case m.stopped:
+			return ErrExpectStopped
+		case err == nil:
+			return nil
+		case errors.Is(err, os.ErrDeadlineExceeded) && time.Now().Before(deadline):
+			m.carryOver()
+			continue
+		}
+		return v.expectError(s, err)
+	}
+}
+
+// untilMatcher is an expect.Matcher for ExpectStringUntil that matches s
+// across several Expect calls and stop.
+type untilMatcher struct {
+	s    string
+	stop <-chan struct{}
+
+	// carry is the end of the output of previous Expect calls that may be
+	// the start of s.
+	carry []byte
+	buf   *bytes.Buffer
+
+	stopped bool
+}
+
+func (m *untilMatcher) isStopped() bool {
+	select {
+	case <-m.stop:
+		m.stopped = true
+	default:
+	}
+	return m.stopped
+}
+
+// Match implements expect.Matcher.
+func (m *untilMatcher) Match(v any) bool {
+	buf, ok := v.(*bytes.Buffer)
+	if !ok {
+		// A read error or timeout.
+		return m.isStopped()
+	}
+	m.buf = buf
+	b := buf.Bytes()
+	if len(b) < len(m.s) {
+		b = append(append([]byte(nil), m.carry...), b...)
+	}
+	if bytes.HasSuffix(b, []byte(m.s)) {
+		return true
+	}
+	return m.isStopped()
+}
+
+// carryOver keeps the end of the last Expect call's output for the next one.
+func (m *untilMatcher) carryOver() {
+	if m.buf == nil {
+		return
+	}
+	b := append(m.carry, m.buf.Bytes()...)
+	if n := len(m.s) - 1; len(b) > n {
+		b = b[len(b)-n:]
+	}
+	m.carry = append([]byte(nil), b...)
+	m.buf = nil
+}
+
+// Criteria implements expect.Matcher.
+func (m *untilMatcher) Criteria() any {
+	return []string{m.s}
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package qemu
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Netflix/go-expect"
+)
+
+func TestExpectStringUntil(t *testing.T) {
+	c, err := expect.NewConsole()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	vm := &VM{Console: c, Options: &Options{}}
+
+	// The string is split across idle polls.
+	go func() {
+		_, _ = io.WriteString(c.Tty(), "booting hel")
+		time.Sleep(3 * expectPollInterval)
+		_, _ = io.WriteString(c.Tty(), "lo world\n")
+	}()
+	if err := vm.ExpectStringUntil("hello", 5*time.Second, nil); err != nil {
+		t.Errorf("ExpectStringUntil = %v, want nil", err)
+	}
+	// Output after the match was not consumed.
+	if err := vm.ExpectStringUntil("world", 5*time.Second, nil); err != nil {
+		t.Errorf("ExpectStringUntil after match = %v, want nil", err)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := vm.ExpectStringUntil("never", 5*time.Second, stop); !errors.Is(err, ErrExpectStopped) {
+		t.Errorf("ExpectStringUntil stopped = %v, want %v", err, ErrExpectStopped)
+	}
+
+	vm.Options.Transcript = NewTranscript()
+	var ee *ExpectError
+	if err := vm.ExpectStringUntil("never", 2*expectPollInterval, nil); !errors.As(err, &ee) {
+		t.Errorf("ExpectStringUntil timeout = %v, want *ExpectError", err)
+	}
+}
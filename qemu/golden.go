@@ -0,0 +1,167 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// UpdateGoldenEnv is the env var that makes ExpectGolden write golden files
+// instead of comparing against them when set.
+const UpdateGoldenEnv = "VMTEST_UPDATE_GOLDEN"
+
+// Normalizer rewrites a console line before it is compared against a golden
+// file, e.g. to remove output that differs between runs.
+type Normalizer func(line string) string
+
+// ReplaceRegexp returns a Normalizer that replaces matches of re with repl,
+// as in regexp.ReplaceAllString.
+func ReplaceRegexp(re *regexp.Regexp, repl string) Normalizer {
+	return func(line string) string {
+		return re.ReplaceAllString(line, repl)
+	}
+}
+
+// DefaultNormalizers make common run-to-run differences in boot output
+// comparable: kernel timestamps, addresses, and durations.
+var DefaultNormalizers = []Normalizer{
+	ReplaceRegexp(regexp.MustCompile(`^\[\s*\d+\.\d+\]`), "[TIME]"),
+	ReplaceRegexp(regexp.MustCompile(`0x[0-9a-fA-F]+`), "0xADDR"),
+	ReplaceRegexp(regexp.MustCompile(`\b[0-9a-f]{8,16}\b`), "ADDR"),
+	ReplaceRegexp(regexp.MustCompile(`\b\d+(\.\d+)?(ns|us|µs|ms|s)\b`), "DURATION"),
+	strings.TrimSpace,
+}
+
+func normalize(lines []TranscriptLine, norms []Normalizer) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		s := l.Text
+		for _, n := range norms {
+			s = n(s)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// ExpectGolden waits for vm to exit and compares its console output against
+// goldenFile, failing t with a line diff if they differ.
+//
+// Each line is rewritten by DefaultNormalizers and then by norms before
+// comparison. The golden file contains normalized lines.
+//
+// If the VMTEST_UPDATE_GOLDEN env var is set, e.g.
+//
+//	VMTEST_UPDATE_GOLDEN=1 go test ./...
+//
+// the golden file is written instead.
+//
+// vm must record a transcript that kept all console output, as StartT's
+// default transcript does for up to DefaultTranscriptLines lines (see
+// WithTranscript). ExpectGolden returns the error of vm.Wait, as some tests
+// expect the guest to fail.
+func ExpectGolden(t testing.TB, vm *VM, goldenFile string, norms ...Normalizer) error {
+	t.Helper()
+
+	if vm.Options.Transcript == nil {
+		t.Fatalf("ExpectGolden requires a console transcript (see WithTranscript)")
+	}
+	err := vm.Wait()
+
+	if n := vm.Options.Transcript.Dropped(); n > 0 {
+		t.Fatalf("Console transcript dropped %d lines; ExpectGolden needs a transcript without limits (see WithTranscript)", n)
+	}
+	got := normalize(vm.Options.Transcript.Lines(), append(DefaultNormalizers[:len(DefaultNormalizers):len(DefaultNormalizers)], norms...))
+	if len(os.Getenv(UpdateGoldenEnv)) > 0 {
+		if err := os.MkdirAll(filepath.Dir(goldenFile), 0o755); err != nil {
+			t.Fatalf("Could not create golden file directory: %v", err)
+		}
+		if err := os.WriteFile(goldenFile, []byte(strings.Join(got, "\n")+"\n"), 0o644); err != nil {
+			t.Fatalf("Could not update golden file: %v", err)
+		}
+		t.Logf("Updated golden file %s", goldenFile)
+		return err
+	}
+
+	b, rerr := os.ReadFile(goldenFile)
+	if rerr != nil {
+		t.Errorf("Could not read golden file (set %s=1 to create it): %v", UpdateGoldenEnv, rerr)
+		return err
+	}
+	want := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if d := lineDiff(want, got); d != "" {
+		t.Errorf("Console output differs from %s (-want +got; set %s=1 to accept):\n%s", goldenFile, UpdateGoldenEnv, d)
+	}
+	return err
+}
+
+// maxDiffCells bounds the memory used by lineDiff's LCS table.
+const maxDiffCells = 4 << 20
+
+// lineDiff returns a diff of want and got with unchanged lines elided, or ""
+// if they are equal.
+func lineDiff(want, got []string) string {
+	// Trim the common prefix and suffix.
+	pre := 0
+	for pre < len(want) && pre < len(got) && want[pre] == got[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(want)-pre && suf < len(got)-pre && want[len(want)-1-suf] == got[len(got)-1-suf] {
+		suf++
+	}
+	if pre == len(want) && pre == len(got) {
+		return ""
+	}
+	w, g := want[pre:len(want)-suf], got[pre:len(got)-suf]
+
+	var s strings.Builder
+	fmt.Fprintf(&s, "@@ line %d @@\n", pre+1)
+	if (len(w)+1)*(len(g)+1) > maxDiffCells {
+		for _, l := range w {
+			fmt.Fprintf(&s, "-%s\n", l)
+		}
+		for _, l := range g {
+			fmt.Fprintf(&s, "+%s\n", l)
+		}
+		return s.String()
+	}
+
+	// lcs[i][j] is the LCS length of w[i:] and g[j:].
+	lcs := make([][]int, len(w)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(g)+1)
+	}
+	for i := len(w) - 1; i >= 0; i-- {
+		for j := len(g) - 1; j >= 0; j-- {
+			if w[i] == g[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(w) || j < len(g) {
+		switch {
+		case i < len(w) && j < len(g) && w[i] == g[j]:
+			fmt.Fprintf(&s, " %s\n", w[i])
+			i++
+			j++
+		case i < len(w) && (j == len(g) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&s, "-%s\n", w[i])
+			i++
+		default:
+			fmt.Fprintf(&s, "+%s\n", g[j])
+			j++
+		}
+	}
+	return s.String()
+}
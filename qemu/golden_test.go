@@ -0,0 +1,68 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	lines := []TranscriptLine{
+		{Text: "[    0.123456] Linux version 6.6.0 (builder@host)  "},
+		{Text: "[   12.000001] RIP: 0010:do_thing+0x1c/0x40 at ffff888003c1e000"},
+		{Text: "--- PASS: TestFoo (0.25s)"},
+		{Text: "host abc-1234"},
+	}
+	norms := append(DefaultNormalizers, ReplaceRegexp(regexp.MustCompile(`abc-\d+`), "HOST"))
+	want := []string{
+		"[TIME] Linux version 6.6.0 (builder@host)",
+		"[TIME] RIP: 0010:do_thing+0xADDR/0xADDR at ADDR",
+		"--- PASS: TestFoo (DURATION)",
+		"host HOST",
+	}
+	if got := normalize(lines, norms); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("normalize =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		want, got []string
+		diff      string
+	}{
+		{
+			name: "equal",
+			want: []string{"a", "b"},
+			got:  []string{"a", "b"},
+		},
+		{
+			name: "changed",
+			want: []string{"a", "b", "c", "d"},
+			got:  []string{"a", "x", "c", "d"},
+			diff: "@@ line 2 @@\n-b\n+x\n",
+		},
+		{
+			name: "inserted-and-removed",
+			want: []string{"boot", "one", "two", "done"},
+			got:  []string{"boot", "two", "three", "done"},
+			diff: "@@ line 2 @@\n-one\n two\n+three\n",
+		},
+		{
+			name: "appended",
+			want: []string{"a"},
+			got:  []string{"a", "panic"},
+			diff: "@@ line 2 @@\n+panic\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lineDiff(tt.want, tt.got); got != tt.diff {
+				t.Errorf("lineDiff =\n%s\nwant\n%s", got, tt.diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"encoding/binary"
+)
+
+// VirtioTransport is how virtio devices are attached to a guest.
+type VirtioTransport string
+
+// Virtio transports, as used in QEMU's device names.
+const (
+	// VirtioPCI attaches virtio devices to the PCI bus, e.g.
+	// virtio-9p-pci.
+	VirtioPCI VirtioTransport = "pci"
+
+	// VirtioMMIO attaches virtio devices as memory-mapped devices, e.g.
+	// virtio-9p-device.
+	VirtioMMIO VirtioTransport = "device"
+)
+
+// Env describes the guests of an architecture as vmtest runs them, i.e. with
+// the machine types runvmtest configures.
+type Env struct {
+	Arch Arch
+
+	// QEMUArch is the suffix of the QEMU system and user emulators, e.g.
+	// x86_64 for qemu-system-x86_64.
+	QEMUArch string
+
+	// ByteOrder is the guest's byte order.
+	ByteOrder binary.ByteOrder
+
+	// Console is the name of the guest kernel's serial console device,
+	// e.g. ttyS0 for console=ttyS0.
+	Console string
+
+	// Machine is the default machine type used for the guest, e.g. virt.
+	Machine string
+
+	// Virtio is how virtio devices are attached.
+	Virtio VirtioTransport
+}
+
+// guestEnvs are the environments of the supported guest architectures.
+var guestEnvs = map[Arch]Env{
+	ArchAMD64: {
+		QEMUArch:  "x86_64",
+		ByteOrder: binary.LittleEndian,
+		Console:   "ttyS0",
+		Machine:   "pc",
+		Virtio:    VirtioPCI,
+	},
+	ArchI386: {
+		QEMUArch:  "i386",
+		ByteOrder: binary.LittleEndian,
+		Console:   "ttyS0",
+		Machine:   "pc",
+		Virtio:    VirtioPCI,
+	},
+	ArchArm64: {
+		QEMUArch:  "aarch64",
+		ByteOrder: binary.LittleEndian,
+		Console:   "ttyAMA0",
+		Machine:   "virt",
+		Virtio:    VirtioPCI,
+	},
+	ArchArm: {
+		QEMUArch:  "arm",
+		ByteOrder: binary.LittleEndian,
+		Console:   "ttyAMA0",
+		Machine:   "virt",
+		Virtio:    VirtioMMIO,
+	},
+	ArchRiscv64: {
+		QEMUArch:  "riscv64",
+		ByteOrder: binary.LittleEndian,
+		Console:   "ttyS0",
+		Machine:   "virt",
+		Virtio:    VirtioPCI,
+	},
+}
+
+// Env returns the environment of guests of architecture a.
+//
+// For unsupported architectures, only Arch is set, and virtio devices are
+// attached via PCI.
+func (a Arch) Env() Env {
+	e, ok := guestEnvs[a]
+	if !ok {
+		e.Virtio = VirtioPCI
+	}
+	e.Arch = a
+	return e
+}
+
+// GuestEnv returns the environment of the guest architecture under test (see
+// GuestArch).
+func GuestEnv() Env {
+	return GuestArch().Env()
+}
+
+// Env returns the environment of the VM's guest architecture.
+func (o *Options) Env() Env {
+	return o.Arch().Env()
+}
+
+// VirtioDevice returns the QEMU device name of the virtio device base for the
+// guest's transport, e.g. virtio-9p-pci or virtio-9p-device for virtio-9p.
+func (e Env) VirtioDevice(base string) string {
+	return base + "-" + string(e.Virtio)
+}
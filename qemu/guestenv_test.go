@@ -0,0 +1,52 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGuestEnv(t *testing.T) {
+	for _, arch := range SupportedArches {
+		e := arch.Env()
+		if e.Arch != arch || e.QEMUArch == "" || e.ByteOrder == nil || e.Console == "" || e.Machine == "" || e.Virtio == "" {
+			t.Errorf("%s.Env() = %+v, want all fields set", arch, e)
+		}
+	}
+
+	t.Setenv("VMTEST_ARCH", "arm")
+	if got := GuestEnv(); got.Arch != ArchArm || got.Console != "ttyAMA0" {
+		t.Errorf("GuestEnv() = %+v, want arm with ttyAMA0", got)
+	}
+
+	if got := Arch("mips").Env(); got.Arch != "mips" || got.QEMUArch != "" || got.Virtio != VirtioPCI {
+		t.Errorf("mips.Env() = %+v, want only Arch and PCI transport", got)
+	}
+}
+
+func TestVirtioDevice(t *testing.T) {
+	for _, tt := range []struct {
+		arch Arch
+		want string
+	}{
+		{ArchAMD64, "virtio-9p-pci"},
+		{ArchArm64, "virtio-9p-pci"},
+		{ArchRiscv64, "virtio-9p-pci"},
+		{ArchArm, "virtio-9p-device"},
+	} {
+		opts, err := OptionsFor(tt.arch, P9Directory(t.TempDir(), "tag"), VirtioRandom())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.ContainsFunc(opts.QEMUArgs, func(arg string) bool { return strings.HasPrefix(arg, tt.want+",") }) {
+			t.Errorf("%s: QEMU args %v, want %s", tt.arch, opts.QEMUArgs, tt.want)
+		}
+		if !slices.Contains(opts.QEMUArgs, tt.arch.Env().VirtioDevice("virtio-rng")) {
+			t.Errorf("%s: QEMU args %v, want %s", tt.arch, opts.QEMUArgs, tt.arch.Env().VirtioDevice("virtio-rng"))
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package qemu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Netflix/go-expect"
+)
+
+func newConsole() (*expect.Console, error) {
+	return expect.NewConsole()
+}
+
+// quoteArg quotes arg for a POSIX shell if it contains whitespace.
+func quoteArg(arg string) string {
+	if strings.ContainsAny(arg, " \t\n") {
+		return fmt.Sprintf("'%s'", arg)
+	}
+	return arg
+}
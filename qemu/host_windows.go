@@ -0,0 +1,22 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"syscall"
+
+	"github.com/Netflix/go-expect"
+)
+
+// newConsole returns no console: go-expect consoles are ptys, which Windows
+// does not have. The VM's output only goes to SerialOutput.
+func newConsole() (*expect.Console, error) {
+	return nil, nil
+}
+
+// quoteArg quotes arg for cmd.exe and PowerShell.
+func quoteArg(arg string) string {
+	return syscall.EscapeArg(arg)
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Netflix/go-expect"
+	"golang.org/x/term"
+)
+
+// WithHostConsole connects the VM's console to the terminal of the program
+// that started it, to explore a VM interactively with the same options a test
+// uses, e.g. with `go run ./myvm`:
+//
+//	vm, err := qemu.Start(qemu.ArchUseEnvv, qemu.WithHostConsole())
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if err := vm.Wait(); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Console output is copied to stdout, and stdin is sent to the guest. If stdin
+// is a terminal, it is in raw mode while the VM runs, so that keys such as
+// Ctrl-C reach the guest, and the size of the VM's console follows the
+// terminal's. Leave by shutting down the guest or with QEMU's escape keys,
+// e.g. Ctrl-A X with -nographic.
+//
+// Expect calls, SerialOutput, and transcripts see the console output as
+// without WithHostConsole. Under go test, whose stdin and stdout belong to the
+// go command, WithHostConsole does nothing.
+func WithHostConsole() Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.HostConsole = !testing.Testing()
+		return nil
+	}
+}
+
+// hostConsole is the terminal of the program a VM's console is connected to.
+type hostConsole struct {
+	restore    func()
+	stopResize func()
+}
+
+// attachHostConsole connects the console c to stdin and puts stdin into raw
+// mode if it is a terminal. On hosts without ptys, c is nil and the caller
+// uses stdin as QEMU's stdin.
+func attachHostConsole(c *expect.Console) (*hostConsole, error) {
+	h := &hostConsole{restore: func() {}, stopResize: func() {}}
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return nil, fmt.Errorf("host console: %w", err)
+		}
+		h.restore = func() { _ = term.Restore(fd, state) }
+		if c != nil {
+			h.stopResize = watchResize(c.Tty())
+		}
+	}
+	if c != nil {
+		// Stops on the first key press after the VM exited, when
+		// writing to the console fails.
+		go func() { _, _ = io.Copy(c, os.Stdin) }()
+	}
+	return h, nil
+}
+
+// close restores the terminal.
+func (h *hostConsole) close() {
+	h.stopResize()
+	h.restore()
+}
@@ -0,0 +1,15 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+
+package qemu
+
+import "os"
+
+// watchResize does nothing: there is no pty whose size could follow the
+// terminal's.
+func watchResize(tty *os.File) func() {
+	return func() {}
+}
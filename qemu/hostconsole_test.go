@@ -0,0 +1,17 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import "testing"
+
+func TestHostConsoleUnderGoTest(t *testing.T) {
+	opts, err := OptionsFor(ArchAMD64, WithQEMUCommand("qemu"), WithHostConsole())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.HostConsole {
+		t.Errorf("HostConsole = true under go test, want false")
+	}
+}
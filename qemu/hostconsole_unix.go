@@ -0,0 +1,37 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package qemu
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// watchResize sets the size of tty to that of stdin now and whenever stdin's
+// terminal is resized, until the returned function is called.
+func watchResize(tty *os.File) func() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, unix.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			_ = pty.InheritSize(os.Stdin, tty)
+			select {
+			case <-sig:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"time"
+)
+
+// DefaultEchoTimeout is how long SendLine and TypeSlowly wait for the guest
+// to echo input.
+const DefaultEchoTimeout = 10 * time.Second
+
+// InputOption configures SendLine and TypeSlowly.
+type InputOption func(*inputOptions)
+
+type inputOptions struct {
+	echo        bool
+	echoTimeout time.Duration
+}
+
+// NoEcho does not wait for the guest to echo input, e.g. for password
+// prompts or bootloader menus that do not echo.
+func NoEcho() InputOption {
+	return func(o *inputOptions) {
+		o.echo = false
+	}
+}
+
+// WithEchoTimeout waits up to timeout for the guest to echo input instead of
+// DefaultEchoTimeout.
+func WithEchoTimeout(timeout time.Duration) InputOption {
+	return func(o *inputOptions) {
+		o.echoTimeout = timeout
+	}
+}
+
+func parseInputOptions(opts []InputOption) inputOptions {
+	o := inputOptions{echo: true, echoTimeout: DefaultEchoTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// SendLine types s followed by Enter (a carriage return, as a terminal sends
+// it) on the console, e.g. to answer a login prompt.
+//
+// SendLine then waits for the guest to echo s, so that the echoed input does
+// not satisfy a following ExpectString, e.g. of a command's output that
+// appears in the command itself. Use NoEcho for input the guest does not
+// echo. If s is not echoed in time, the error is an *ExpectError as in
+// ExpectString.
+func (v *VM) SendLine(s string, opts ...InputOption) error {
+	if v.Console == nil {
+		return ErrNoConsole
+	}
+	o := parseInputOptions(opts)
+	if _, err := v.Console.Send(s + "\r"); err != nil {
+		return err
+	}
+	return v.waitEcho(s, o)
+}
+
+// TypeSlowly types s on the console one character at a time, pausing delay
+// after each, for guests that drop input arriving too fast, such as
+// firmware and bootloader menus. Unlike SendLine, no Enter is added.
+//
+// TypeSlowly then waits for the guest to echo s, as SendLine does.
+func (v *VM) TypeSlowly(s string, delay time.Duration, opts ...InputOption) error {
+	if v.Console == nil {
+		return ErrNoConsole
+	}
+	o := parseInputOptions(opts)
+	for _, r := range s {
+		if _, err := v.Console.Send(string(r)); err != nil {
+			return err
+		}
+		time.Sleep(delay)
+	}
+	return v.waitEcho(s, o)
+}
+
+func (v *VM) waitEcho(s string, o inputOptions) error {
+	if !o.echo || s == "" {
+		return nil
+	}
+	return v.ExpectStringUntil(s, o.echoTimeout, nil)
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package qemu
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Netflix/go-expect"
+)
+
+func TestSendLine(t *testing.T) {
+	c, err := expect.NewConsole()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	vm := &VM{Console: c, Options: &Options{}}
+
+	// The pty echoes input and turns the carriage return into a newline,
+	// as a guest's serial console does.
+	guest := bufio.NewReader(c.Tty())
+	if err := vm.SendLine("root"); err != nil {
+		t.Fatalf("SendLine = %v", err)
+	}
+	if line, err := guest.ReadString('\n'); err != nil || line != "root\n" {
+		t.Errorf("Guest read %q, %v, want root", line, err)
+	}
+
+	go func() { _, _ = io.WriteString(c.Tty(), "root\n# ") }()
+	// Output following the echo is seen by the next expectation.
+	if err := vm.ExpectStringUntil("root\r\n#", 5*time.Second, nil); err != nil {
+		t.Errorf("Expect output after SendLine = %v", err)
+	}
+
+	if err := vm.TypeSlowly("ls\r", time.Millisecond); err != nil {
+		t.Fatalf("TypeSlowly = %v", err)
+	}
+	if line, err := guest.ReadString('\n'); err != nil || line != "ls\n" {
+		t.Errorf("Guest read %q, %v, want ls", line, err)
+	}
+
+	if err := vm.SendLine("secret", NoEcho()); err != nil {
+		t.Errorf("SendLine(NoEcho) = %v", err)
+	}
+	if line, err := guest.ReadString('\n'); err != nil || line != "secret\n" {
+		t.Errorf("Guest read %q, %v, want secret", line, err)
+	}
+
+	vm.Console = nil
+	if err := vm.SendLine("root"); !errors.Is(err, ErrNoConsole) {
+		t.Errorf("SendLine without console = %v, want %v", err, ErrNoConsole)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// ErrInvalidIsolation is returned for invalid HostIsolation settings.
+var ErrInvalidIsolation = errors.New("invalid host isolation")
+
+// HostIsolation restricts the host resources the QEMU process uses. See
+// WithHostIsolation.
+type HostIsolation struct {
+	// CPUs are the host CPUs that QEMU and all its threads, including
+	// vCPU threads, run on, like taskset -c. All CPUs are used if empty.
+	CPUs []int
+
+	// Nice is the niceness QEMU runs with, from -20 (highest priority) to
+	// 19, like nice -n. Negative values need privileges.
+	Nice int
+}
+
+// WithHostIsolation pins the QEMU process to host CPUs and sets its
+// niceness, so that in-guest benchmarks (see govmtest.RunBenchmarks) produce
+// stable numbers on shared machines, e.g. by pinning each of a VM's vCPUs to
+// a dedicated host CPU:
+//
+//	qemu.ArbitraryArgs("-smp", "2"),
+//	qemu.WithHostIsolation(qemu.HostIsolation{CPUs: []int{2, 3}}),
+//
+// The settings are applied when QEMU starts, so that all threads QEMU
+// creates inherit them. Only Linux hosts are supported.
+func WithHostIsolation(h HostIsolation) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		for _, cpu := range h.CPUs {
+			if cpu < 0 {
+				return fmt.Errorf("%w: CPU %d", ErrInvalidIsolation, cpu)
+			}
+		}
+		if h.Nice < -20 || h.Nice > 19 {
+			return fmt.Errorf("%w: niceness %d is not in [-20, 19]", ErrInvalidIsolation, h.Nice)
+		}
+		opts.HostIsolation = &h
+		return nil
+	}
+}
+
+// startCmd starts cmd with isolation h, if set.
+func startCmd(cmd *exec.Cmd, h *HostIsolation) error {
+	if h == nil || (len(h.CPUs) == 0 && h.Nice == 0) {
+		return cmd.Start()
+	}
+	return startIsolated(cmd, h)
+}
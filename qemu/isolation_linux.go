@@ -0,0 +1,45 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// startIsolated starts cmd from a thread with h's CPU affinity and
+// niceness, which the child process inherits.
+//
+// Niceness cannot be lowered again without privileges, so the thread is
+// thrown away afterwards by exiting the goroutine without unlocking it.
+func startIsolated(cmd *exec.Cmd, h *HostIsolation) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errCh <- func() error {
+			if len(h.CPUs) > 0 {
+				var set unix.CPUSet
+				for _, cpu := range h.CPUs {
+					set.Set(cpu)
+				}
+				if err := unix.SchedSetaffinity(0, &set); err != nil {
+					return fmt.Errorf("%w: could not pin to CPUs %v: %w", ErrInvalidIsolation, h.CPUs, err)
+				}
+			}
+			if h.Nice != 0 {
+				// On Linux, niceness is per thread; 0 is the calling
+				// thread.
+				if err := unix.Setpriority(unix.PRIO_PROCESS, 0, h.Nice); err != nil {
+					return fmt.Errorf("%w: could not set niceness %d: %w", ErrInvalidIsolation, h.Nice, err)
+				}
+			}
+			return cmd.Start()
+		}()
+	}()
+	return <-errCh
+}
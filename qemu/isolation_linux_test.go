@@ -0,0 +1,44 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestStartIsolated(t *testing.T) {
+	h := &HostIsolation{CPUs: []int{0}, Nice: 5}
+
+	var out bytes.Buffer
+	cmd := exec.Command("cat", "/proc/self/status", "/proc/self/stat")
+	cmd.Stdout = &out
+	if err := startCmd(cmd, h); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Cpus_allowed_list:\t0\n") {
+		t.Errorf("Child is not pinned to CPU 0:\n%s", out.String())
+	}
+	// The niceness is the 19th field of /proc/self/stat, which is the 17th
+	// after the command name.
+	_, stat, _ := strings.Cut(out.String(), ") ")
+	if fields := strings.Fields(stat); len(fields) < 17 || fields[16] != "5" {
+		t.Errorf("Child niceness is not 5: %s", stat)
+	}
+}
+
+func TestWithHostIsolation(t *testing.T) {
+	for _, h := range []HostIsolation{{CPUs: []int{-1}}, {Nice: 20}, {Nice: -21}} {
+		if _, err := OptionsFor(ArchAMD64, WithHostIsolation(h)); !errors.Is(err, ErrInvalidIsolation) {
+			t.Errorf("WithHostIsolation(%+v) = %v, want %v", h, err, ErrInvalidIsolation)
+		}
+	}
+}
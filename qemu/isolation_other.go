@@ -0,0 +1,16 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package qemu
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func startIsolated(cmd *exec.Cmd, h *HostIsolation) error {
+	return fmt.Errorf("%w: host isolation needs a Linux host", ErrUnsupportedHost)
+}
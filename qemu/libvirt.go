@@ -0,0 +1,239 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// libvirtArch are the libvirt names of guest architectures.
+var libvirtArch = map[Arch]string{
+	ArchAMD64:   "x86_64",
+	ArchI386:    "i686",
+	ArchArm64:   "aarch64",
+	ArchArm:     "armv7l",
+	ArchRiscv64: "riscv64",
+}
+
+type libvirtDomain struct {
+	XMLName xml.Name       `xml:"domain"`
+	Type    string         `xml:"type,attr"`
+	QEMUNS  string         `xml:"xmlns:qemu,attr"`
+	Name    string         `xml:"name"`
+	Memory  libvirtMemory  `xml:"memory"`
+	VCPU    int            `xml:"vcpu"`
+	OS      libvirtOS      `xml:"os"`
+	Devices libvirtDevices `xml:"devices"`
+	QEMU    *libvirtQEMU   `xml:"qemu:commandline,omitempty"`
+}
+
+type libvirtQEMU struct {
+	Args []libvirtArg `xml:"qemu:arg"`
+}
+
+type libvirtMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value string `xml:",chardata"`
+}
+
+type libvirtOS struct {
+	Type    libvirtOSType `xml:"type"`
+	Kernel  string        `xml:"kernel,omitempty"`
+	Initrd  string        `xml:"initrd,omitempty"`
+	Cmdline string        `xml:"cmdline,omitempty"`
+}
+
+type libvirtOSType struct {
+	Arch    string `xml:"arch,attr"`
+	Machine string `xml:"machine,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+type libvirtDevices struct {
+	Emulator string         `xml:"emulator"`
+	Serial   libvirtCharDev `xml:"serial"`
+	Console  libvirtCharDev `xml:"console"`
+}
+
+type libvirtCharDev struct {
+	Type string `xml:"type,attr"`
+}
+
+type libvirtArg struct {
+	Value string `xml:"value,attr"`
+}
+
+// LibvirtXML renders the VM as a libvirt domain definition, e.g. to reproduce
+// a failing configuration interactively with virt-manager or
+// `virsh create vm.xml`.
+//
+// The QEMU binary, kernel, initramfs, kernel args, memory size (-m), CPU
+// count (-smp), machine type, and KVM acceleration are translated to libvirt
+// elements; the serial port becomes a pty. All other QEMU arguments are passed
+// through as a qemu:commandline. Tasks, serial output consumers, and
+// arguments referring to ExtraFiles (e.g. /proc/self/fd paths) do not carry
+// over.
+func (o *Options) LibvirtXML() (string, error) {
+	if o.Backend != nil {
+		return "", fmt.Errorf("VM is run by %s, not QEMU", o.Backend.Name())
+	}
+	fields := strings.Fields(o.QEMUCommand)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no QEMU command set")
+	}
+	arch, ok := libvirtArch[o.Arch()]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedArch, o.Arch())
+	}
+	if len(o.KernelArgs) != 0 && len(o.Kernel) == 0 {
+		return "", ErrKernelRequiredForArgs
+	}
+	emulator := fields[0]
+	if p, err := exec.LookPath(emulator); err == nil {
+		emulator = p
+	}
+	name := o.Name
+	if name == "" {
+		name = "vmtest"
+	}
+	d := libvirtDomain{
+		Type:   "qemu",
+		QEMUNS: "http://libvirt.org/schemas/domain/qemu/1.0",
+		Name:   name,
+		// QEMU's default memory size.
+		Memory: libvirtMemory{Unit: "MiB", Value: "128"},
+		VCPU:   1,
+		OS: libvirtOS{
+			Type:    libvirtOSType{Arch: arch, Machine: o.MachineType(), Value: "hvm"},
+			Kernel:  o.Kernel,
+			Initrd:  o.Initramfs,
+			Cmdline: o.kernelArgs(),
+		},
+		Devices: libvirtDevices{
+			Emulator: emulator,
+			Serial:   libvirtCharDev{Type: "pty"},
+			Console:  libvirtCharDev{Type: "pty"},
+		},
+	}
+
+	var passthrough []libvirtArg
+	args := append(fields[1:], o.QEMUArgs...)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var value string
+		if i+1 < len(args) {
+			value = args[i+1]
+		}
+		switch arg {
+		case "-nographic":
+			// libvirt adds the serial console itself.
+		case "-enable-kvm":
+			d.Type = "kvm"
+		case "-accel":
+			if a, _, _ := strings.Cut(value, ","); a == "kvm" {
+				d.Type = "kvm"
+			} else {
+				passthrough = append(passthrough, libvirtArg{arg}, libvirtArg{value})
+			}
+			i++
+		case "-m":
+			unit, size, err := libvirtMemorySize(value)
+			if err != nil {
+				return "", err
+			}
+			d.Memory = libvirtMemory{Unit: unit, Value: size}
+			i++
+		case "-smp":
+			n, err := smpCPUs(value)
+			if err != nil {
+				return "", err
+			}
+			d.VCPU = n
+			i++
+		case "-M", "-machine":
+			// The machine type is in the os element, and libvirt
+			// chooses the accelerator.
+			var props []string
+			for _, p := range strings.Split(value, ",") {
+				if p == "accel=kvm" {
+					d.Type = "kvm"
+				} else if strings.Contains(p, "=") && !strings.HasPrefix(p, "type=") && !strings.HasPrefix(p, "accel=") {
+					props = append(props, p)
+				}
+			}
+			if len(props) > 0 {
+				passthrough = append(passthrough, libvirtArg{"-machine"}, libvirtArg{strings.Join(props, ",")})
+			}
+			i++
+		default:
+			passthrough = append(passthrough, libvirtArg{arg})
+		}
+	}
+
+	if len(passthrough) > 0 {
+		d.QEMU = &libvirtQEMU{Args: passthrough}
+	}
+
+	b, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+// libvirtMemorySize converts the value of QEMU's -m to a libvirt memory unit
+// and size.
+func libvirtMemorySize(m string) (string, string, error) {
+	for _, p := range strings.Split(m, ",") {
+		if s, ok := strings.CutPrefix(p, "size="); ok {
+			m = s
+			break
+		} else if !strings.Contains(p, "=") {
+			m = p
+			break
+		}
+	}
+	unit := "MiB"
+	if n := len(m); n > 0 {
+		switch strings.ToUpper(m[n-1:]) {
+		case "K":
+			unit = "KiB"
+		case "M":
+			unit = "MiB"
+		case "G":
+			unit = "GiB"
+		case "T":
+			unit = "TiB"
+		}
+		m = strings.TrimRight(m, "KkMmGgTt")
+	}
+	if _, err := strconv.ParseUint(m, 10, 64); err != nil {
+		return "", "", fmt.Errorf("invalid QEMU memory size -m %s", m)
+	}
+	return unit, m, nil
+}
+
+// smpCPUs returns the CPU count in the value of QEMU's -smp.
+func smpCPUs(smp string) (int, error) {
+	for _, p := range strings.Split(smp, ",") {
+		s, ok := strings.CutPrefix(p, "cpus=")
+		if !ok && strings.Contains(p, "=") {
+			continue
+		}
+		if !ok {
+			s = p
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid QEMU CPU count -smp %s", smp)
+		}
+		return n, nil
+	}
+	return 1, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLibvirtXML(t *testing.T) {
+	t.Setenv("VMTEST_QEMU_APPEND", "")
+	opts, err := OptionsFor(ArchAMD64,
+		WithQEMUCommand("/usr/bin/qemu-system-x86_64 -enable-kvm -m 1G"),
+		WithKernel("/boot/bzImage"),
+		WithInitramfs("/tmp/initramfs.cpio"),
+		WithAppendKernel("console=ttyS0"),
+		ArbitraryArgs("-smp", "cpus=4,sockets=1", "-machine", "q35,accel=kvm,smm=on", "-device", "virtio-rng-pci"),
+		func(_ *IDAllocator, opts *Options) error {
+			opts.Name = "vm0"
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := opts.LibvirtXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<domain type="kvm" xmlns:qemu="http://libvirt.org/schemas/domain/qemu/1.0">
+  <name>vm0</name>
+  <memory unit="GiB">1</memory>
+  <vcpu>4</vcpu>
+  <os>
+    <type arch="x86_64" machine="q35">hvm</type>
+    <kernel>/boot/bzImage</kernel>
+    <initrd>/tmp/initramfs.cpio</initrd>
+    <cmdline>console=ttyS0</cmdline>
+  </os>
+  <devices>
+    <emulator>/usr/bin/qemu-system-x86_64</emulator>
+    <serial type="pty"></serial>
+    <console type="pty"></console>
+  </devices>
+  <qemu:commandline>
+    <qemu:arg value="-machine"></qemu:arg>
+    <qemu:arg value="smm=on"></qemu:arg>
+    <qemu:arg value="-device"></qemu:arg>
+    <qemu:arg value="virtio-rng-pci"></qemu:arg>
+  </qemu:commandline>
+</domain>
+`
+	if got != want {
+		t.Errorf("LibvirtXML =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLibvirtXMLDefaults(t *testing.T) {
+	t.Setenv("VMTEST_QEMU_APPEND", "")
+	opts, err := OptionsFor(ArchArm64, WithQEMUCommand("qemu-system-aarch64-nonexistent"), WithKernel("Image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := opts.LibvirtXML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<domain type="qemu"`,
+		`<name>vmtest</name>`,
+		`<memory unit="MiB">128</memory>`,
+		`<vcpu>1</vcpu>`,
+		`<type arch="aarch64">hvm</type>`,
+		`<emulator>qemu-system-aarch64-nonexistent</emulator>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("LibvirtXML = %s, want %s", got, want)
+		}
+	}
+	if strings.Contains(got, "qemu:commandline") {
+		t.Errorf("LibvirtXML = %s, want no QEMU args", got)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinePrinter prints one line to some output.
+//
+// LinePrinters compose into a pipeline: each of the functions below that take
+// a LinePrinter returns one that processes a line and passes it on, e.g.
+//
+//	LogSerialByLine(SkipJSON(Tee(WriteLines(f), DefaultPrint("vm", t.Logf))))
+type LinePrinter func(line string)
+
+// LogSerialByLine processes serial output from the guest one line at a time
+// and calls callback on each full line, with ANSI escape sequences removed
+// and other control characters replaced (see StripANSI and ReplaceCtl).
+//
+// To process the raw lines instead, use WithSerialOutput(LineWriter(callback)).
+func LogSerialByLine(callback LinePrinter) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		r, w := io.Pipe()
+		opts.SerialOutput = append(opts.SerialOutput, w)
+		printer := StripANSI(ReplaceCtl(callback))
+		opts.Tasks = append(opts.Tasks, WaitVMStarted(func(ctx context.Context, n *Notifications) error {
+			s := bufio.NewScanner(r)
+			for s.Scan() {
+				printer(s.Text())
+			}
+			if err := s.Err(); err != nil {
+				return fmt.Errorf("error reading serial from VM: %w", err)
+			}
+			return nil
+		}))
+		return nil
+	}
+}
+
+// LineWriter returns a writer that calls printer on each line written to it,
+// without the line ending. Close calls printer on the last line if it does
+// not end in a newline.
+//
+// Use it to send any output, e.g. of a host command, through a pipeline.
+func LineWriter(printer LinePrinter) io.WriteCloser {
+	return &lineWriter{printer: printer}
+}
+
+type lineWriter struct {
+	mu      sync.Mutex
+	buf     []byte
+	printer LinePrinter
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.printer(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+}
+
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.printer(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
+
+func replaceCtl(str []byte) []byte {
+	for i, c := range str {
+		if c == 9 || c == 10 {
+		} else if c < 32 || c == 127 {
+			str[i] = '~'
+		}
+	}
+	return str
+}
+
+// ReplaceCtl replaces control characters other than tab with "~", so that
+// they cannot garble the terminal or log they are printed to.
+func ReplaceCtl(printer LinePrinter) LinePrinter {
+	return func(line string) {
+		printer(string(replaceCtl([]byte(line))))
+	}
+}
+
+// ansiEscape matches ANSI CSI sequences (e.g. colors and cursor movement),
+// OSC sequences (e.g. terminal titles), and other two-byte escapes.
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// StripANSI removes ANSI escape sequences, such as colors, from lines. Use it
+// before ReplaceCtl, which would otherwise replace their escape character.
+func StripANSI(printer LinePrinter) LinePrinter {
+	return func(line string) {
+		printer(ansiEscape.ReplaceAllString(line, ""))
+	}
+}
+
+// SkipJSON drops lines that are JSON objects, e.g. test2json events that
+// a guest echoes on its console.
+func SkipJSON(printer LinePrinter) LinePrinter {
+	return func(line string) {
+		if l := strings.TrimSpace(line); strings.HasPrefix(l, "{") && strings.HasSuffix(l, "}") {
+			return
+		}
+		printer(line)
+	}
+}
+
+// Tee calls each of printers on every line, e.g. to print lines and also
+// write them to a file with WriteLines.
+func Tee(printers ...LinePrinter) LinePrinter {
+	return func(line string) {
+		for _, p := range printers {
+			p(line)
+		}
+	}
+}
+
+// WriteLines is a LinePrinter that writes each line to w, followed by a
+// newline. Write errors are ignored.
+func WriteLines(w io.Writer) LinePrinter {
+	return func(line string) {
+		_, _ = io.WriteString(w, line+"\n")
+	}
+}
+
+// TS prefixes line printer output with a timestamp since the first log line.
+//
+// format can be any Time.Format format string. Recommendations are
+// time.TimeOnly or time.DateTime.
+func TS(format string, printer LinePrinter) LinePrinter {
+	return func(line string) {
+		printer(fmt.Sprintf("[%s] %s", time.Now().Format(format), line))
+	}
+}
+
+// DefaultPrint is the default LinePrinter, adding a prefix and relative timestamp.
+func DefaultPrint(prefix string, printer func(fmt string, arg ...any)) LinePrinter {
+	return RelativeTS(Prefix(prefix, PrintLine(printer)))
+}
+
+// RelativeTS prefixes line printer output with "[%06.4fs] " seconds since the
+// first log line.
+func RelativeTS(printer LinePrinter) LinePrinter {
+	start := sync.OnceValue(time.Now)
+	return func(line string) {
+		printer(fmt.Sprintf("[%06.4fs] %s", time.Since(start()).Seconds(), line))
+	}
+}
+
+// PrintLine is a LinePrinter that prints to a standard "formatter" like testing.TB.Logf or fmt.Printf.
+func PrintLine(printer func(fmt string, arg ...any)) LinePrinter {
+	return func(line string) {
+		printer("%s", line)
+	}
+}
+
+// Prefix returns a LinePrinter that prefixes the given LinePrinter with "prefix: ".
+func Prefix(prefix string, printer LinePrinter) LinePrinter {
+	return func(line string) {
+		printer(fmt.Sprintf("%s: %s", prefix, line))
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLinePipeline(t *testing.T) {
+	var got []string
+	collect := func(line string) { got = append(got, line) }
+
+	var file strings.Builder
+	w := LineWriter(StripANSI(ReplaceCtl(SkipJSON(Tee(WriteLines(&file), Prefix("vm", collect))))))
+	for _, s := range []string{
+		"\x1b[1;32mgreen\x1b[0m text\r\n",
+		"{\"Action\":\"pass\"}\n",
+		"bell\x07\tand tab\npar",
+		"tial\n\x1b]0;title\x07last",
+	} {
+		if _, err := fmt.Fprint(w, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"vm: green text", "vm: bell~\tand tab", "vm: partial", "vm: last"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Lines = %q, want %q", got, want)
+	}
+	if want := "green text\nbell~\tand tab\npartial\nlast\n"; file.String() != want {
+		t.Errorf("Written lines = %q, want %q", file.String(), want)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidMemorySize is returned for memory sizes that are not a number
+// with an optional K, M, G, or T suffix.
+var ErrInvalidMemorySize = errors.New("invalid memory size")
+
+// ErrNoHugepages is returned when the host does not have enough free
+// hugepages for the guest's memory.
+var ErrNoHugepages = errors.New("not enough free hugepages")
+
+// DefaultHugepagePath is where hugetlbfs is commonly mounted.
+const DefaultHugepagePath = "/dev/hugepages"
+
+// MemoryBackend configures the memory backing guest RAM. See
+// WithMemoryBackend.
+type MemoryBackend struct {
+	// Size is the size of guest RAM as for QEMU's -m, e.g. "1G". A size
+	// without suffix is in MiB.
+	Size string
+
+	// Hugepages backs guest RAM with hugepages from the hugetlbfs mounted
+	// at Path, or DefaultHugepagePath if Path is empty.
+	Hugepages bool
+
+	// Path is the directory that guest RAM is backed by files in, e.g.
+	// /dev/shm. If empty and Hugepages is false, anonymous memory (memfd)
+	// is used.
+	Path string
+
+	// Share maps guest RAM shared, so that other processes, such as
+	// vhost-user backends and virtiofsd with DAX, can access it.
+	Share bool
+
+	// Prealloc allocates all guest RAM when the VM starts, so that the
+	// guest does not fail later when the host runs out of (huge) pages.
+	Prealloc bool
+}
+
+// WithMemoryBackend sets the guest's RAM size and what backs it, e.g.
+// hugepages or shared memory as needed by vhost-user devices and virtiofs
+// DAX:
+//
+//	qemu.WithMemoryBackend(qemu.MemoryBackend{Size: "1G", Hugepages: true, Share: true, Prealloc: true})
+//
+// Hugepages are validated against the host: the hugetlbfs must be mounted,
+// and enough hugepages free (see /proc/sys/vm/nr_hugepages). Hugepages and
+// memfd are only supported on Linux hosts.
+func WithMemoryBackend(mb MemoryBackend) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		size, err := parseMemorySize(mb.Size)
+		if err != nil {
+			return err
+		}
+
+		id := alloc.ID("mem")
+		var props []string
+		switch {
+		case mb.Hugepages:
+			if runtime.GOOS != "linux" {
+				return fmt.Errorf("%w: hugepages need a Linux host", ErrUnsupportedHost)
+			}
+			path := mb.Path
+			if path == "" {
+				path = DefaultHugepagePath
+			}
+			if err := checkHugepages("/proc/meminfo", "/proc/mounts", path, size); err != nil {
+				return err
+			}
+			props = []string{"memory-backend-file", "id=" + id, "mem-path=" + path}
+
+		case mb.Path != "":
+			if fi, err := os.Stat(mb.Path); err != nil {
+				return err
+			} else if !fi.IsDir() {
+				return fmt.Errorf("%w: %s", ErrIsNotDir, mb.Path)
+			}
+			props = []string{"memory-backend-file", "id=" + id, "mem-path=" + mb.Path}
+
+		default:
+			if runtime.GOOS != "linux" {
+				return fmt.Errorf("%w: memfd memory needs a Linux host; set MemoryBackend.Path", ErrUnsupportedHost)
+			}
+			props = []string{"memory-backend-memfd", "id=" + id}
+		}
+		props = append(props, fmt.Sprintf("size=%d", size))
+		if mb.Share {
+			props = append(props, "share=on")
+		}
+		if mb.Prealloc {
+			props = append(props, "prealloc=on")
+		}
+		opts.AppendQEMU(
+			"-m", mb.Size,
+			"-object", strings.Join(props, ","),
+			"-machine", "memory-backend="+id,
+		)
+		return nil
+	}
+}
+
+// parseMemorySize returns the size in bytes of s as QEMU's -m parses it: a
+// number with an optional K, M, G, or T suffix, in MiB by default.
+func parseMemorySize(s string) (int64, error) {
+	shift := 20
+	num := s
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			shift, num = 10, s[:n-1]
+		case "M":
+			shift, num = 20, s[:n-1]
+		case "G":
+			shift, num = 30, s[:n-1]
+		case "T":
+			shift, num = 40, s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v <= 0 || v > 1<<(63-shift) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMemorySize, s)
+	}
+	return v << shift, nil
+}
+
+// checkHugepages checks that a hugetlbfs is mounted at path according to
+// mounts, and that meminfo lists enough free hugepages for size bytes.
+func checkHugepages(meminfo, mounts, path string, size int64) error {
+	mounted, err := isHugetlbfs(mounts, path)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("%w: no hugetlbfs mounted at %s (mount -t hugetlbfs none %s)", ErrNoHugepages, path, path)
+	}
+
+	info, err := readMeminfo(meminfo)
+	if err != nil {
+		return err
+	}
+	pageKB, ok := info["Hugepagesize"]
+	if !ok || pageKB == 0 {
+		return fmt.Errorf("%w: host kernel has no hugepage support", ErrNoHugepages)
+	}
+	pageSize := pageKB << 10
+	need := (size + pageSize - 1) / pageSize
+	if free := info["HugePages_Free"]; free < need {
+		return fmt.Errorf("%w: need %d free %d kB hugepages for %d MiB of guest memory, have %d (reserve more with: echo %d | sudo tee /proc/sys/vm/nr_hugepages)",
+			ErrNoHugepages, need, pageKB, size>>20, free, info["HugePages_Total"]+need-free)
+	}
+	return nil
+}
+
+func isHugetlbfs(mounts, path string) (bool, error) {
+	f, err := os.Open(mounts)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	path = filepath.Clean(path)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 3 && fields[2] == "hugetlbfs" && filepath.Clean(fields[1]) == path {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// readMeminfo returns the numeric values of /proc/meminfo, in kB where
+// meminfo has units.
+func readMeminfo(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := map[string]int64{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		key, value, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			info[key] = v
+		}
+	}
+	return info, s.Err()
+}
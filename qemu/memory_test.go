@@ -0,0 +1,60 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMemorySize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+		err  error
+	}{
+		{in: "512", want: 512 << 20},
+		{in: "512M", want: 512 << 20},
+		{in: "2g", want: 2 << 30},
+		{in: "64K", want: 64 << 10},
+		{in: "1T", want: 1 << 40},
+		{in: "", err: ErrInvalidMemorySize},
+		{in: "G", err: ErrInvalidMemorySize},
+		{in: "-1G", err: ErrInvalidMemorySize},
+		{in: "1.5G", err: ErrInvalidMemorySize},
+	} {
+		got, err := parseMemorySize(tt.in)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("parseMemorySize(%q) = %d, %v, want %d, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCheckHugepages(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	mounts := write("mounts", "proc /proc proc rw 0 0\nhugetlbfs /dev/hugepages hugetlbfs rw,pagesize=2M 0 0\n")
+	meminfo := write("meminfo", "MemTotal:       16000000 kB\nHugePages_Total:     600\nHugePages_Free:      512\nHugepagesize:       2048 kB\n")
+
+	if err := checkHugepages(meminfo, mounts, "/dev/hugepages/", 1<<30); err != nil {
+		t.Errorf("checkHugepages(1G) = %v, want nil", err)
+	}
+	err := checkHugepages(meminfo, mounts, "/dev/hugepages", 2<<30)
+	if !errors.Is(err, ErrNoHugepages) || !strings.Contains(err.Error(), "need 1024 free 2048 kB hugepages for 2048 MiB of guest memory, have 512 (reserve more with: echo 1112 |") {
+		t.Errorf("checkHugepages(2G) = %v, want %v with details", err, ErrNoHugepages)
+	}
+	if err := checkHugepages(meminfo, mounts, "/mnt/huge", 1<<20); !errors.Is(err, ErrNoHugepages) || !strings.Contains(err.Error(), "no hugetlbfs mounted at /mnt/huge") {
+		t.Errorf("checkHugepages(/mnt/huge) = %v, want %v", err, ErrNoHugepages)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ErrNoNestedVirt is returned when the host cannot run VMs inside KVM guests.
+var ErrNoNestedVirt = errors.New("host does not support nested virtualization")
+
+// nestedModules are the KVM modules with a nested parameter and the CPU
+// feature exposed to guests when it is on.
+var nestedModules = []struct {
+	module  string
+	feature string
+}{
+	{"kvm_intel", "vmx"},
+	{"kvm_amd", "svm"},
+}
+
+// NestedVirtFeature returns the CPU virtualization feature, vmx or svm, that
+// the host's KVM can expose to guests for nested virtualization.
+//
+// The error wraps ErrNoNestedVirt if /dev/kvm is not usable or neither the
+// kvm_intel nor the kvm_amd module has nested virtualization enabled.
+func NestedVirtFeature() (string, error) {
+	if _, err := os.Stat("/dev/kvm"); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrNoNestedVirt, err)
+	}
+	return nestedVirtFeature("/sys/module")
+}
+
+func nestedVirtFeature(sysModule string) (string, error) {
+	for _, m := range nestedModules {
+		b, err := os.ReadFile(filepath.Join(sysModule, m.module, "parameters", "nested"))
+		if err != nil {
+			continue
+		}
+		if v := strings.TrimSpace(string(b)); v == "Y" || v == "1" {
+			return m.feature, nil
+		}
+		return "", fmt.Errorf("%w: %s is loaded with nested=%s", ErrNoNestedVirt, m.module, strings.TrimSpace(string(b)))
+	}
+	return "", fmt.Errorf("%w: neither kvm_intel nor kvm_amd is loaded", ErrNoNestedVirt)
+}
+
+// WithNestedVirt lets the guest run its own KVM VMs: the VM runs with KVM
+// and the host CPU model, with vmx or svm (see NestedVirtFeature) exposed and
+// KVM not hidden from the guest.
+//
+// Nested virtualization is only supported for amd64 guests. Use
+// SkipWithoutNestedVirt to skip tests on hosts without it, and
+// guest.SkipIfNoNestedVirt in the guest.
+func WithNestedVirt() Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.Arch() != ArchAMD64 {
+			return fmt.Errorf("%w: nested virtualization needs amd64, not %s", ErrUnsupportedArch, opts.Arch())
+		}
+		feature, err := NestedVirtFeature()
+		if err != nil {
+			return err
+		}
+		opts.AppendQEMU("-enable-kvm", "-cpu", "host,+"+feature+",kvm=on")
+		return nil
+	}
+}
+
+// SkipWithoutNestedVirt skips the test if the guest is not amd64 or the host
+// does not support nested virtualization.
+func SkipWithoutNestedVirt(tb testing.TB) {
+	SkipIfNotArch(tb, ArchAMD64)
+	if _, err := NestedVirtFeature(); err != nil {
+		tb.Skipf("Skipping test: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNestedVirtFeature(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		modules map[string]string
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "intel",
+			modules: map[string]string{"kvm_intel": "Y\n"},
+			want:    "vmx",
+		},
+		{
+			name:    "amd",
+			modules: map[string]string{"kvm_amd": "1\n"},
+			want:    "svm",
+		},
+		{
+			name:    "disabled",
+			modules: map[string]string{"kvm_intel": "N\n"},
+			wantErr: ErrNoNestedVirt,
+		},
+		{
+			name:    "no-kvm",
+			wantErr: ErrNoNestedVirt,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for m, v := range tt.modules {
+				p := filepath.Join(dir, m, "parameters")
+				if err := os.MkdirAll(p, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(p, "nested"), []byte(v), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := nestedVirtFeature(dir)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("nestedVirtFeature = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("nestedVirtFeature = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
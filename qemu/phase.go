@@ -0,0 +1,217 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hugelgupf/vmtest/internal/testevent"
+)
+
+// Phase is a phase of a VM run, such as kernel boot or a package's tests.
+type Phase struct {
+	Name string
+
+	// Start is the time since the VM was started.
+	Start time.Duration
+
+	Duration time.Duration
+}
+
+// Phase names that PhaseReport adds to the guest's phases.
+const (
+	// PhaseFirmware is the time from starting QEMU to the guest kernel
+	// booting, i.e. QEMU, firmware, and boot loader.
+	PhaseFirmware = "firmware"
+
+	// PhaseKernel is the time from the guest kernel booting to the first
+	// guest phase.
+	PhaseKernel = "kernel"
+)
+
+type phaseMarker struct {
+	name string
+	mono time.Duration
+}
+
+// PhaseReport aggregates the phase markers a guest prints with guest.Phase
+// into a timing breakdown of the VM run, e.g. kernel boot, init, mounts, and
+// each package's tests. See WithPhaseReport.
+//
+// PhaseReport is an io.WriteCloser and reads the markers from serial output.
+type PhaseReport struct {
+	mu      sync.Mutex
+	started time.Time
+	exited  time.Time
+	// boot is the host time at guest monotonic time 0, derived from the
+	// time the first marker was received.
+	boot    time.Time
+	markers []phaseMarker
+	partial []byte
+}
+
+// NewPhaseReport returns an empty phase report.
+func NewPhaseReport() *PhaseReport {
+	return &PhaseReport{}
+}
+
+// Write implements io.Writer.
+func (r *PhaseReport) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for b := p; len(b) > 0; {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			r.partial = append(r.partial, b...)
+			break
+		}
+		r.partial = append(r.partial, b[:i]...)
+		r.line(string(r.partial), now)
+		r.partial = r.partial[:0]
+		b = b[i+1:]
+	}
+	return len(p), nil
+}
+
+// line records the phase marker in line, if any, received at host time
+// received.
+func (r *PhaseReport) line(line string, received time.Time) {
+	_, marker, ok := strings.Cut(line, testevent.PhaseMarker+" ")
+	if !ok {
+		return
+	}
+	mono, name, ok := strings.Cut(strings.TrimRight(marker, "\r"), " ")
+	ns, err := strconv.ParseInt(mono, 10, 64)
+	if !ok || err != nil || name == "" {
+		return
+	}
+	if r.boot.IsZero() {
+		r.boot = received.Add(-time.Duration(ns))
+		if !r.started.IsZero() && r.boot.Before(r.started) {
+			r.boot = r.started
+		}
+	}
+	r.markers = append(r.markers, phaseMarker{name: name, mono: time.Duration(ns)})
+}
+
+// Close implements io.Closer.
+func (r *PhaseReport) Close() error {
+	return nil
+}
+
+func (r *PhaseReport) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started = time.Now()
+}
+
+func (r *PhaseReport) exit() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exited = time.Now()
+}
+
+// Phases returns the phases of the VM run so far, in order. The last guest
+// phase ends when the VM exits; until then, it has no duration.
+//
+// Without guest phase markers, Phases returns no phases.
+func (r *PhaseReport) Phases() []Phase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.markers) == 0 {
+		return nil
+	}
+	// Times since the VM was started.
+	var boot, end time.Duration
+	if !r.started.IsZero() {
+		boot = r.boot.Sub(r.started)
+		if !r.exited.IsZero() {
+			end = r.exited.Sub(r.started)
+		}
+	}
+
+	var phases []Phase
+	if boot > 0 {
+		phases = append(phases, Phase{Name: PhaseFirmware, Duration: boot})
+	}
+	phases = append(phases, Phase{Name: PhaseKernel, Start: boot, Duration: r.markers[0].mono})
+	for i, m := range r.markers {
+		p := Phase{Name: m.name, Start: boot + m.mono}
+		if i+1 < len(r.markers) {
+			p.Duration = r.markers[i+1].mono - m.mono
+		} else if end > p.Start {
+			p.Duration = end - p.Start
+		}
+		phases = append(phases, p)
+	}
+	return phases
+}
+
+// String returns a table of the phases with their durations and share of the
+// total time.
+func (r *PhaseReport) String() string {
+	phases := r.Phases()
+	var total time.Duration
+	width := 0
+	for _, p := range phases {
+		total += p.Duration
+		width = max(width, len(p.Name))
+	}
+
+	var s strings.Builder
+	for _, p := range phases {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(p.Duration) / float64(total)
+		}
+		fmt.Fprintf(&s, "%-*s %10.3fs %5.1f%%\n", width, p.Name, p.Duration.Seconds(), share)
+	}
+	if len(phases) > 0 {
+		fmt.Fprintf(&s, "%-*s %10.3fs\n", width, "total", total.Seconds())
+	}
+	return s.String()
+}
+
+// WithPhaseReport aggregates the phase markers the guest prints with
+// guest.Phase into r.
+//
+// StartT records a phase report by default and logs it when the test is done.
+func WithPhaseReport(r *PhaseReport) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.PhaseReport = r
+		opts.SerialOutput = append(opts.SerialOutput, r)
+		opts.Tasks = append(opts.Tasks, func(ctx context.Context, n *Notifications) error {
+			// Tasks are started right before the guest.
+			r.start()
+			select {
+			case <-ctx.Done():
+			case <-n.VMExited:
+			}
+			r.exit()
+			return nil
+		})
+		return nil
+	}
+}
+
+// defaultPhaseReport records a phase report unless one was configured
+// already.
+func defaultPhaseReport() Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.PhaseReport != nil {
+			return nil
+		}
+		return WithPhaseReport(NewPhaseReport())(alloc, opts)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseReport(t *testing.T) {
+	r := NewPhaseReport()
+	if s := r.String(); s != "" {
+		t.Errorf("String without markers = %q, want empty", s)
+	}
+
+	r.start()
+	for _, s := range []string{
+		"[    0.1] Linux version 6.6\r\n",
+		"2024/01/01 VMTEST_PHASE 1000000000 init\r\n",
+		"VMTEST_PHASE 1500000000 mou",
+		"nts\nVMTEST_PHASE bogus\n",
+		"VMTEST_PHASE 4000000000 test pkg/foo\n",
+	} {
+		if _, err := io.WriteString(r, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make the guest boot 1s after the VM start, and exit 5s after.
+	r.started = r.boot.Add(-time.Second)
+	r.exited = r.started.Add(6 * time.Second)
+
+	want := []Phase{
+		{Name: PhaseFirmware, Duration: time.Second},
+		{Name: PhaseKernel, Start: time.Second, Duration: time.Second},
+		{Name: "init", Start: 2 * time.Second, Duration: 500 * time.Millisecond},
+		{Name: "mounts", Start: 2500 * time.Millisecond, Duration: 2500 * time.Millisecond},
+		{Name: "test pkg/foo", Start: 5 * time.Second, Duration: time.Second},
+	}
+	if got := r.Phases(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Phases = %v, want %v", got, want)
+	}
+	s := r.String()
+	for _, line := range []string{"kernel            1.000s  16.7%\n", "test pkg/foo      1.000s  16.7%\n", "total             6.000s\n"} {
+		if !strings.Contains(s, line) {
+			t.Errorf("String = %q, want line %q", s, line)
+		}
+	}
+}
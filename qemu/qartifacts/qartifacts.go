@@ -0,0 +1,127 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qartifacts provides VM artifacts, such as kernels, from container
+// images as qemu.Fns, so that tests do not need the runvmtest wrapper to fetch
+// them.
+//
+// Files are exported from images with the docker or podman CLI and cached in
+// runvmtest's artifact cache, which this shares with runvmtest: artifacts that
+// runvmtest fetched before are used without calling the CLI, and vice versa.
+package qartifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hugelgupf/vmtest/internal/imagecache"
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// ErrNoKernelPath is returned by KernelFromImage for guest architectures
+// without a default kernel path.
+var ErrNoKernelPath = errors.New("no default kernel path for guest architecture; use WithPath")
+
+// ErrNotCached is returned when a file is not cached and no backend is
+// configured to fetch it.
+var ErrNotCached = imagecache.ErrNotCached
+
+// kernelPaths are the kernel paths in runvmtest's default kernel images,
+// e.g. ghcr.io/hugelgupf/vmtest/kernel-amd64:main.
+var kernelPaths = map[qemu.Arch]string{
+	qemu.ArchAMD64:   "/bzImage",
+	qemu.ArchArm64:   "/Image",
+	qemu.ArchRiscv64: "/Image",
+}
+
+// Option configures how artifacts are fetched.
+type Option func(*options)
+
+type options struct {
+	backend string
+	path    string
+}
+
+// WithBackend fetches images with the docker or podman CLI at backend. If
+// backend is empty, only cached artifacts are used.
+//
+// The default is $RUNVMTEST_BACKEND if it is docker or podman, or else docker.
+func WithBackend(backend string) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithPath is the path of the artifact in the image.
+func WithPath(path string) Option {
+	return func(o *options) {
+		o.path = path
+	}
+}
+
+func parseOptions(opts []Option) options {
+	o := options{backend: "docker"}
+	if b := os.Getenv("RUNVMTEST_BACKEND"); b == "docker" || b == "podman" {
+		o.backend = b
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// File returns the local path of the file at path in the container image ref,
+// fetching it into the cache first if it is not cached yet.
+func File(ctx context.Context, ref, path string, opts ...Option) (string, error) {
+	o := parseOptions(opts)
+	dir, err := imagecache.Files(ctx, o.backend, ref, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path), nil
+}
+
+// KernelFromImage boots the kernel from the container image ref, e.g.
+// ghcr.io/hugelgupf/vmtest/kernel-amd64:main:
+//
+//	vm := qemu.StartT(t, "vm", qemu.ArchUseEnvv,
+//		qartifacts.KernelFromImage("ghcr.io/hugelgupf/vmtest/kernel-"+string(qemu.GuestArch())+":main"),
+//	)
+//
+// The kernel is at /bzImage in the image for amd64 guests, and /Image for
+// arm64 and riscv64 guests, as in runvmtest's kernel images, unless given
+// by WithPath.
+func KernelFromImage(ref string, opts ...Option) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, qopts *qemu.Options) error {
+		o := parseOptions(opts)
+		path := o.path
+		if path == "" {
+			var ok bool
+			if path, ok = kernelPaths[qopts.Arch()]; !ok {
+				return fmt.Errorf("%w: %s", ErrNoKernelPath, qopts.Arch())
+			}
+		}
+		kernel, err := File(context.Background(), ref, path, WithBackend(o.backend))
+		if err != nil {
+			return fmt.Errorf("could not fetch kernel from %s: %w", ref, err)
+		}
+		qopts.Kernel = kernel
+		return nil
+	}
+}
+
+// InitramfsFromImage uses the initramfs at path in the container image ref.
+func InitramfsFromImage(ref, path string, opts ...Option) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, qopts *qemu.Options) error {
+		initramfs, err := File(context.Background(), ref, path, opts...)
+		if err != nil {
+			return fmt.Errorf("could not fetch initramfs from %s: %w", ref, err)
+		}
+		qopts.Initramfs = initramfs
+		return nil
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qartifacts
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/internal/imagecache"
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+const testImage = "ghcr.io/hugelgupf/vmtest/kernel-amd64:main"
+
+func TestKernelFromImageCached(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	cache, err := imagecache.Dir()
+	if err != nil || !strings.HasPrefix(cache, os.Getenv("XDG_CACHE_HOME")) {
+		t.Skipf("User cache directory %s is not in XDG_CACHE_HOME", cache)
+	}
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, KernelFromImage(testImage, WithBackend(""))); !errors.Is(err, ErrNotCached) {
+		t.Errorf("KernelFromImage without cache = %v, want %v", err, ErrNotCached)
+	}
+
+	// As runvmtest caches the image.
+	dir := filepath.Join(cache, imagecache.Key("sha256:1234"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bzImage"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := imagecache.RecordRef(cache, testImage, "sha256:1234"); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, KernelFromImage(testImage, WithBackend("")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "bzImage"); opts.Kernel != want {
+		t.Errorf("Kernel = %s, want %s", opts.Kernel, want)
+	}
+
+	// A path that is not cached.
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, InitramfsFromImage(testImage, "/initramfs.cpio", WithBackend(""))); !errors.Is(err, ErrNotCached) {
+		t.Errorf("InitramfsFromImage not cached = %v, want %v", err, ErrNotCached)
+	}
+}
+
+func TestKernelFromImageNoPath(t *testing.T) {
+	if _, err := qemu.OptionsFor(qemu.ArchArm, KernelFromImage(testImage)); !errors.Is(err, ErrNoKernelPath) {
+		t.Errorf("KernelFromImage(arm) = %v, want %v", err, ErrNoKernelPath)
+	}
+}
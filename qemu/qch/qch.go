@@ -0,0 +1,220 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qch runs vmtest VMs with cloud-hypervisor instead of QEMU.
+//
+// Tests written against the qemu API can run their guest with a second VMM by
+// adding WithCloudHypervisor:
+//
+//	vm := qemu.StartT(t, "vm", qemu.ArchUseEnvv,
+//		qch.WithCloudHypervisor(qch.WithMemory("1G")),
+//		qemu.WithAppendKernel("console=ttyS0"),
+//	)
+//
+// Kernel, Initramfs, KernelArgs, SerialOutput, Tasks, and ExtraFiles of
+// qemu.Options are used as with QEMU. Fns that add QEMU arguments (e.g.
+// qemu.ReadOnlyDirectory or qnetwork devices) are not supported; use the
+// options of this package to add devices instead.
+//
+// cloud-hypervisor only boots uncompressed kernels: on amd64, a vmlinux with
+// CONFIG_PVH; on arm64, an Image.
+package qch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// Errors returned by WithCloudHypervisor, Backend.Cmdline, and Remote.
+var (
+	// ErrQEMUArgs is returned when QEMU arguments were added to a VM run
+	// by cloud-hypervisor.
+	ErrQEMUArgs = errors.New("QEMU arguments are not supported by cloud-hypervisor")
+
+	// ErrNoKernel is returned when no kernel is set, as cloud-hypervisor
+	// has no firmware to boot without one by default.
+	ErrNoKernel = errors.New("cloud-hypervisor needs a kernel")
+
+	// ErrNotCloudHypervisor is returned by Remote for VMs not run by
+	// cloud-hypervisor.
+	ErrNotCloudHypervisor = errors.New("VM is not run by cloud-hypervisor")
+)
+
+// Backend is the cloud-hypervisor qemu.Backend.
+type Backend struct {
+	// Command is the cloud-hypervisor binary and additional args.
+	//
+	// If empty, the VMTEST_CLOUD_HYPERVISOR env var or else
+	// cloud-hypervisor is used.
+	Command string
+
+	// CPUs is the number of vCPUs to boot. If 0, 1 is used.
+	CPUs int
+
+	// Memory is the guest memory size, e.g. 512M. If empty, 512M is used.
+	Memory string
+
+	// Disks are the values of --disk, e.g. path=disk.img,readonly=on.
+	Disks []string
+
+	// Args are additional cloud-hypervisor arguments.
+	Args []string
+
+	// APISocket is the path of the VM's API socket, used by ch-remote.
+	APISocket string
+}
+
+// Option configures Backend.
+type Option func(*Backend)
+
+// WithCommand sets the cloud-hypervisor binary and additional args.
+func WithCommand(cmd string) Option {
+	return func(b *Backend) {
+		b.Command = cmd
+	}
+}
+
+// WithCPUs sets the number of vCPUs.
+func WithCPUs(n int) Option {
+	return func(b *Backend) {
+		b.CPUs = n
+	}
+}
+
+// WithMemory sets the guest memory size, e.g. 1G.
+func WithMemory(size string) Option {
+	return func(b *Backend) {
+		b.Memory = size
+	}
+}
+
+// WithDisk adds the disk image at path as a virtio-blk device.
+func WithDisk(path string, readonly bool) Option {
+	return func(b *Backend) {
+		d := "path=" + path
+		if readonly {
+			d += ",readonly=on"
+		}
+		b.Disks = append(b.Disks, d)
+	}
+}
+
+// WithArgs adds arbitrary cloud-hypervisor arguments.
+func WithArgs(args ...string) Option {
+	return func(b *Backend) {
+		b.Args = append(b.Args, args...)
+	}
+}
+
+// WithCloudHypervisor runs the VM with cloud-hypervisor instead of QEMU,
+// supported for amd64 and arm64 guests.
+//
+// It drops the QEMU arguments added so far, such as VMTEST_QEMU_APPEND, so it
+// should be the first Fn.
+func WithCloudHypervisor(chOpts ...Option) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		if a := opts.Arch(); a != qemu.ArchAMD64 && a != qemu.ArchArm64 {
+			return fmt.Errorf("%w: cloud-hypervisor supports amd64 and arm64, not %s", qemu.ErrUnsupportedArch, a)
+		}
+		b := &Backend{}
+		for _, o := range chOpts {
+			o(b)
+		}
+		// Unix socket paths are limited to ~100 bytes, so don't use a
+		// test's temporary directory.
+		dir, err := os.MkdirTemp("", "vmtest-ch")
+		if err != nil {
+			return err
+		}
+		b.APISocket = filepath.Join(dir, "api.sock")
+		opts.Tasks = append(opts.Tasks, qemu.Cleanup(func() error {
+			return os.RemoveAll(dir)
+		}))
+		opts.QEMUArgs = nil
+		return qemu.WithBackend(b)(alloc, opts)
+	}
+}
+
+// Name implements qemu.Backend.
+func (b *Backend) Name() string {
+	return "cloud-hypervisor"
+}
+
+// Cmdline implements qemu.Backend.
+func (b *Backend) Cmdline(o *qemu.Options) ([]string, error) {
+	if len(o.QEMUArgs) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrQEMUArgs, strings.Join(o.QEMUArgs, " "))
+	}
+	if o.Kernel == "" {
+		return nil, ErrNoKernel
+	}
+
+	cmd := b.Command
+	if cmd == "" {
+		cmd = os.Getenv("VMTEST_CLOUD_HYPERVISOR")
+	}
+	if cmd == "" {
+		cmd = "cloud-hypervisor"
+	}
+	cpus := b.CPUs
+	if cpus == 0 {
+		cpus = 1
+	}
+	mem := b.Memory
+	if mem == "" {
+		mem = "512M"
+	}
+
+	args := append(strings.Fields(cmd),
+		"--kernel", o.Kernel,
+		"--cpus", fmt.Sprintf("boot=%d", cpus),
+		"--memory", "size="+mem,
+		// Serial output goes to stdout like QEMU's -nographic.
+		"--serial", "tty",
+		"--console", "off",
+	)
+	if o.KernelArgs != "" {
+		args = append(args, "--cmdline", o.KernelArgs)
+	}
+	if o.Initramfs != "" {
+		args = append(args, "--initramfs", o.Initramfs)
+	}
+	if len(b.Disks) > 0 {
+		args = append(append(args, "--disk"), b.Disks...)
+	}
+	if b.APISocket != "" {
+		args = append(args, "--api-socket", "path="+b.APISocket)
+	}
+	return append(args, b.Args...), nil
+}
+
+// Remote runs ch-remote (or VMTEST_CH_REMOTE) with args against the API
+// socket of vm, e.g. "pause", "resume", "info", or "power-button", and returns
+// its output. It is the counterpart of QEMU's QMP.
+func Remote(ctx context.Context, vm *qemu.VM, args ...string) (string, error) {
+	b, ok := vm.Options.Backend.(*Backend)
+	if !ok || b.APISocket == "" {
+		return "", ErrNotCloudHypervisor
+	}
+	remote := os.Getenv("VMTEST_CH_REMOTE")
+	if remote == "" {
+		remote = "ch-remote"
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, remote, append([]string{"--api-socket", b.APISocket}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ch-remote %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
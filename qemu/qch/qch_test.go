@@ -0,0 +1,128 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+func writeScript(t *testing.T, name, script string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCmdline(t *testing.T) {
+	t.Setenv("VMTEST_QEMU_APPEND", "-m 1G")
+	t.Setenv("VMTEST_CLOUD_HYPERVISOR", "ch --seccomp false")
+
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64,
+		WithCloudHypervisor(WithCPUs(2), WithDisk("disk.img", true), WithArgs("-v")),
+		qemu.WithKernel("vmlinux"),
+		qemu.WithInitramfs("initramfs.cpio"),
+		qemu.WithAppendKernel("console=ttyS0"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := opts.Backend.(*Backend)
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(b.APISocket)) })
+
+	args, err := opts.Cmdline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ch", "--seccomp", "false",
+		"--kernel", "vmlinux",
+		"--cpus", "boot=2",
+		"--memory", "size=512M",
+		"--serial", "tty",
+		"--console", "off",
+		"--cmdline", "console=ttyS0",
+		"--initramfs", "initramfs.cpio",
+		"--disk", "path=disk.img,readonly=on",
+		"--api-socket", "path=" + b.APISocket,
+		"-v",
+	}
+	if got, want := strings.Join(args, " "), strings.Join(want, " "); got != want {
+		t.Errorf("Cmdline = %s, want %s", got, want)
+	}
+}
+
+func TestCmdlineErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		fns  []qemu.Fn
+		want error
+	}{
+		{
+			name: "qemu-args",
+			fns:  []qemu.Fn{WithCloudHypervisor(), qemu.WithKernel("vmlinux"), qemu.ArbitraryArgs("-m", "1G")},
+			want: ErrQEMUArgs,
+		},
+		{
+			name: "no-kernel",
+			fns:  []qemu.Fn{qemu.WithKernel(""), WithCloudHypervisor()},
+			want: ErrNoKernel,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := qemu.OptionsFor(qemu.ArchAMD64, tt.fns...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := opts.Cmdline(); !errors.Is(err, tt.want) {
+				t.Errorf("Cmdline = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := qemu.OptionsFor(qemu.ArchRiscv64, WithCloudHypervisor()); !errors.Is(err, qemu.ErrUnsupportedArch) {
+		t.Errorf("OptionsFor(riscv64) = %v, want %v", err, qemu.ErrUnsupportedArch)
+	}
+}
+
+func TestStart(t *testing.T) {
+	ch := writeScript(t, "cloud-hypervisor", `echo "booted $2"`)
+	t.Setenv("VMTEST_CH_REMOTE", writeScript(t, "ch-remote", `echo "$@"`))
+
+	vm, err := qemu.Start(qemu.ArchAMD64,
+		WithCloudHypervisor(WithCommand(ch)),
+		qemu.WithKernel("vmlinux"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Console.ExpectString("booted vmlinux"); err != nil {
+		t.Error(err)
+	}
+	out, err := Remote(context.Background(), vm, "info")
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "--api-socket " + vm.Options.Backend.(*Backend).APISocket + " info\n"; out != want {
+		t.Errorf("Remote = %q, want %q", out, want)
+	}
+	if err := vm.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoteNotCloudHypervisor(t *testing.T) {
+	if _, err := Remote(context.Background(), &qemu.VM{Options: &qemu.Options{}}, "info"); !errors.Is(err, ErrNotCloudHypervisor) {
+		t.Errorf("Remote = %v, want %v", err, ErrNotCloudHypervisor)
+	}
+}
@@ -6,12 +6,20 @@
 package qcoverage
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/hugelgupf/vmtest/internal/gcovsource"
+	"github.com/hugelgupf/vmtest/internal/testevent"
 	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
 	"github.com/hugelgupf/vmtest/testtmp"
 )
 
@@ -21,23 +29,121 @@ import (
 // Use the vmmount command to mount the directory before calling any commands
 // that should have GOCOVERDIR coverage, or mount a virtio-9p directory with
 // tag "gocov" at /mount/9p/gocov.
+//
+// Each VM shares its own directory, whose files are moved to
+// VMTEST_GOCOVERDIR when the VM exits, so that VMs running in parallel do not
+// overwrite each other's coverage.
+//
+// If VMTEST_GOCOVERDIR_STREAM is set as well, the guest streams coverage to
+// the host instead; see StreamGOCOVERDIR.
 func ShareGOCOVERDIR() qemu.Fn {
 	goCov := os.Getenv("VMTEST_GOCOVERDIR")
 	if goCov == "" {
 		return nil
 	}
-	return qemu.All(
-		qemu.P9Directory(goCov, "gocov"),
-		qemu.WithAppendKernel("GOCOVERDIR=/mount/9p/gocov"),
-	)
+	if os.Getenv("VMTEST_GOCOVERDIR_STREAM") != "" {
+		return StreamGOCOVERDIR()
+	}
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		vmDir, err := newOutputDir(filepath.Join(goCov, vmDirs), opts.Name)
+		if err != nil {
+			return err
+		}
+		return qemu.All(
+			qemu.P9Directory(vmDir, "gocov"),
+			qemu.WithAppendKernel("GOCOVERDIR=/mount/9p/gocov"),
+			qemu.WithTask(qemu.Cleanup(func() error {
+				if err := mergeGOCOVERDIR(vmDir, goCov); err != nil {
+					return fmt.Errorf("error saving GOCOVERDIR: %w", err)
+				}
+				return nil
+			})),
+		)(alloc, opts)
+	}
+}
+
+// StreamGOCOVERDIR collects the guest's GOCOVERDIR into VMTEST_GOCOVERDIR if
+// it's available in the environment, without a shared directory.
+//
+// GOCOVERDIR is a directory in the guest's initramfs. Before powering off,
+// the guest sends its files over an event channel with guest.StreamGOCOVERDIR
+// (as the shutdownafter command does), so that coverage does not depend on a
+// writable 9P share being synced before shutdown.
+func StreamGOCOVERDIR() qemu.Fn {
+	goCov := os.Getenv("VMTEST_GOCOVERDIR")
+	if goCov == "" {
+		return nil
+	}
+
+	events := make(chan testevent.ChunkEvent)
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		return qemu.All(
+			qemu.WithAppendKernel("GOCOVERDIR=/gocov"),
+			qevent.EventChannel[testevent.ChunkEvent]("gocov", events),
+			qemu.WithTask(func(ctx context.Context, n *qemu.Notifications) error {
+				var b bytes.Buffer
+				for e := range events {
+					b.Write(e.Data)
+				}
+				if b.Len() == 0 {
+					return nil
+				}
+				vmDir, err := newOutputDir(filepath.Join(goCov, vmDirs), opts.Name)
+				if err != nil {
+					return err
+				}
+				if err := extractGOCOVERDIR(&b, vmDir); err != nil {
+					return fmt.Errorf("error saving GOCOVERDIR: %w", err)
+				}
+				if err := mergeGOCOVERDIR(vmDir, goCov); err != nil {
+					return fmt.Errorf("error saving GOCOVERDIR: %w", err)
+				}
+				return nil
+			}),
+		)(alloc, opts)
+	}
+}
+
+// extractGOCOVERDIR extracts the GOCOVERDIR files in the tar file r into dir.
+func extractGOCOVERDIR(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || name == ".." || name == string(filepath.Separator) {
+			continue
+		}
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
 }
 
 // CollectKernelCoverage collects kernel coverage files for each test to
-// VMTEST_KERNEL_COVERAGE_DIR/{testName}/{instance}, where instance is a number
-// starting at 0.
+// VMTEST_KERNEL_COVERAGE_DIR/{testName}/{vmName}-{n}, where n is the lowest
+// number starting at 0 not taken by another VM of the same name.
+//
+// Only coverage of the kernel source subtrees given as sources (e.g.
+// "fs/ext4") is collected, or of those in the comma-separated
+// VMTEST_KERNEL_COVERAGE_SOURCES if no sources are given. If neither is set,
+// coverage of the whole kernel is collected.
 //
 // If VMTEST_KERNEL_COVERAGE_DIR is empty, collection is skipped.
-func CollectKernelCoverage(tb testing.TB) qemu.Fn {
+func CollectKernelCoverage(tb testing.TB, sources ...string) qemu.Fn {
 	if os.Getenv("VMTEST_KERNEL_COVERAGE_DIR") == "" {
 		tb.Logf("Skipping kernel coverage collection since VMTEST_KERNEL_COVERAGE_DIR is not set")
 		return nil
@@ -48,23 +154,28 @@ func CollectKernelCoverage(tb testing.TB) qemu.Fn {
 		tb.Fatalf("Could not create VMTEST_KERNEL_COVERAGE_DIR: %v", err)
 	}
 
+	if len(sources) == 0 {
+		sources = gcovsource.Parse(os.Getenv(gcovsource.Env))
+	}
+
 	sharedDir := testtmp.TempDir(tb)
-	return qemu.All(
-		qemu.P9Directory(sharedDir, "kcoverage"),
-		qemu.WithTask(qemu.Cleanup(func() error {
-			if err := saveCoverage(tb, filepath.Join(sharedDir, "kernel_coverage.tar"), coverageDir); err != nil {
-				return fmt.Errorf("error saving kernel coverage: %v", err)
-			}
-			return nil
-		})),
-	)
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		if len(sources) > 0 {
+			opts.AppendKernel(fmt.Sprintf("%s=%s", gcovsource.Env, strings.Join(sources, ",")))
+		}
+		return qemu.All(
+			qemu.P9Directory(sharedDir, "kcoverage"),
+			qemu.WithTask(qemu.Cleanup(func() error {
+				if err := saveCoverage(tb, filepath.Join(sharedDir, kernelCoverageFile), coverageDir, opts.Name); err != nil {
+					return fmt.Errorf("error saving kernel coverage: %v", err)
+				}
+				return nil
+			})),
+		)(alloc, opts)
+	}
 }
 
-// Keeps track of the number of instances per test so we do not overlap
-// coverage reports.
-var instance = map[string]int{}
-
-func saveCoverage(tb testing.TB, coverageFile, coverageDir string) error {
+func saveCoverage(tb testing.TB, coverageFile, coverageDir, vmName string) error {
 	// Coverage may not have been collected, for example if the kernel is
 	// not built with CONFIG_GCOV_KERNEL.
 	if fi, err := os.Stat(coverageFile); err != nil {
@@ -74,9 +185,8 @@ func saveCoverage(tb testing.TB, coverageFile, coverageDir string) error {
 	}
 
 	// Move coverage to common directory.
-	uniqueCoveragePath := filepath.Join(coverageDir, tb.Name(), fmt.Sprintf("%d", instance[tb.Name()]))
-	instance[tb.Name()]++
-	if err := os.MkdirAll(uniqueCoveragePath, 0o770); err != nil {
+	uniqueCoveragePath, err := newOutputDir(filepath.Join(coverageDir, tb.Name()), vmName)
+	if err != nil {
 		return err
 	}
 
@@ -0,0 +1,60 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractGOCOVERDIR(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for name, content := range map[string]string{
+		"covmeta.abc":         "meta",
+		"covcounters.abc.1.2": "counters",
+		"../escape":           "evil",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "gocov")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Meta-data files from earlier runs are overwritten.
+	if err := os.WriteFile(filepath.Join(dir, "covmeta.abc"), []byte("meta"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractGOCOVERDIR(&b, dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"covmeta.abc":         "meta",
+		"covcounters.abc.1.2": "counters",
+		"escape":              "evil",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		} else if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape")); err == nil {
+		t.Errorf("extractGOCOVERDIR wrote outside of dir")
+	}
+}
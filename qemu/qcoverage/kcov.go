@@ -0,0 +1,183 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"bufio"
+	"context"
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/internal/testevent"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+)
+
+// CollectKCOV collects the kernel PCs covered by each guest test binary with
+// KCOV to VMTEST_KCOV_DIR/{testName}/{vmName}-{n}/{package}.pcs. Unlike
+// CollectKernelCoverage, it works with any kernel built with CONFIG_KCOV,
+// which need not be a gcov kernel.
+//
+// If VMTEST_VMLINUX is set to the guest kernel's vmlinux, the PCs are also
+// symbolized to the source lines in {package}.lines. KASLR is disabled in the
+// guest so that PCs match vmlinux.
+//
+// Coverage is collected by gouinit, i.e. with govmtest. Only the initial
+// thread of each test binary is covered, so the coverage is a sample of the
+// kernel code a test exercised.
+//
+// If VMTEST_KCOV_DIR is empty, collection is skipped.
+func CollectKCOV(tb testing.TB) qemu.Fn {
+	coverageDir := os.Getenv("VMTEST_KCOV_DIR")
+	if coverageDir == "" {
+		tb.Logf("Skipping KCOV coverage collection since VMTEST_KCOV_DIR is not set")
+		return nil
+	}
+	vmlinux := os.Getenv("VMTEST_VMLINUX")
+
+	events := make(chan testevent.KCOVEvent)
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		return qemu.All(
+			qemu.WithAppendKernel("nokaslr"),
+			qevent.EventChannel[testevent.KCOVEvent]("kcov", events),
+			qemu.WithTask(func(ctx context.Context, n *qemu.Notifications) error {
+				pcs := make(map[string][]uint64)
+				for e := range events {
+					pcs[e.Package] = append(pcs[e.Package], e.PCs...)
+				}
+				if err := saveKCOV(tb, pcs, coverageDir, opts.Name, vmlinux); err != nil {
+					return fmt.Errorf("error saving KCOV coverage: %w", err)
+				}
+				return nil
+			}),
+		)(alloc, opts)
+	}
+}
+
+func saveKCOV(tb testing.TB, pcs map[string][]uint64, coverageDir, vmName, vmlinux string) error {
+	if len(pcs) == 0 {
+		tb.Logf("No KCOV coverage was collected")
+		return nil
+	}
+
+	dir, err := newOutputDir(filepath.Join(coverageDir, tb.Name()), vmName)
+	if err != nil {
+		return err
+	}
+	for pkg, p := range pcs {
+		base := filepath.Join(dir, pkg)
+		if err := os.MkdirAll(filepath.Dir(base), 0o770); err != nil {
+			return err
+		}
+		if err := writeLines(base+".pcs", len(p), func(i int) string { return fmt.Sprintf("%#x", p[i]) }); err != nil {
+			return err
+		}
+		if vmlinux == "" {
+			continue
+		}
+		lines, err := SymbolizeKCOV(vmlinux, p)
+		if err != nil {
+			return err
+		}
+		if err := writeLines(base+".lines", len(lines), func(i int) string { return lines[i].String() }); err != nil {
+			return err
+		}
+	}
+	tb.Logf("KCOV coverage for this test: %s", dir)
+	return nil
+}
+
+func writeLines(path string, n int, line func(int) string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i := 0; i < n; i++ {
+		fmt.Fprintln(w, line(i))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SourceLine is a line of source code.
+type SourceLine struct {
+	File string
+	Line int
+}
+
+// String returns "file:line".
+func (l SourceLine) String() string {
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// SymbolizeKCOV returns the source lines the KCOV PCs pcs are in, as given by
+// the DWARF line tables of vmlinux. Lines are sorted and unique. PCs without
+// line information are skipped.
+func SymbolizeKCOV(vmlinux string, pcs []uint64) ([]SourceLine, error) {
+	f, err := elf.Open(vmlinux)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", vmlinux, err)
+	}
+
+	r := d.Reader()
+	lineReaders := make(map[dwarf.Offset]*dwarf.LineReader)
+	seen := make(map[SourceLine]struct{})
+	for _, pc := range pcs {
+		// KCOV records the return address of the coverage callback;
+		// look up the call instead.
+		pc--
+
+		cu, err := r.SeekPC(pc)
+		if errors.Is(err, dwarf.ErrUnknownPC) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", vmlinux, err)
+		}
+		lr, ok := lineReaders[cu.Offset]
+		if !ok {
+			if lr, err = d.LineReader(cu); err != nil {
+				return nil, fmt.Errorf("%s: %w", vmlinux, err)
+			}
+			lineReaders[cu.Offset] = lr
+		}
+		if lr == nil {
+			continue
+		}
+		var e dwarf.LineEntry
+		if err := lr.SeekPC(pc, &e); errors.Is(err, dwarf.ErrUnknownPC) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", vmlinux, err)
+		}
+		seen[SourceLine{File: e.File.Name, Line: e.Line}] = struct{}{}
+	}
+
+	lines := make([]SourceLine, 0, len(seen))
+	for l := range seen {
+		lines = append(lines, l)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].File != lines[j].File {
+			return lines[i].File < lines[j].File
+		}
+		return lines[i].Line < lines[j].Line
+	})
+	return lines, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSymbolizeKCOV(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binaries are not ELF files")
+	}
+	// Test binaries are stripped of DWARF, so build one that isn't.
+	exe := filepath.Join(t.TempDir(), "hello")
+	if out, err := exec.Command("go", "build", "-o", exe, "./testdata/hello").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syms, err := f.Symbols()
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pc uint64
+	for _, s := range syms {
+		if s.Name == "main.main" {
+			pc = s.Value
+		}
+	}
+	if pc == 0 {
+		t.Fatal("no main.main symbol")
+	}
+
+	// Like KCOV, point just after the start of the function.
+	lines, err := SymbolizeKCOV(exe, []uint64{pc + 1, pc + 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || filepath.Base(lines[0].File) != "main.go" {
+		t.Errorf("SymbolizeKCOV = %v, want one line in main.go", lines)
+	}
+}
+
+func TestSaveKCOV(t *testing.T) {
+	dir := t.TempDir()
+	pcs := map[string][]uint64{
+		"github.com/foo/bar": {0xffffffff81000010, 0xffffffff81000020},
+	}
+	if err := saveKCOV(t, pcs, dir, "vm", ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, t.Name(), "vm-0", "github.com/foo/bar.pcs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0xffffffff81000010\n0xffffffff81000020\n"; string(got) != want {
+		t.Errorf("PCs = %q, want %q", got, want)
+	}
+}
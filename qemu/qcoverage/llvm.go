@@ -0,0 +1,87 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// ErrNoLLVMProfiles is returned when there are no LLVM raw profiles to merge.
+var ErrNoLLVMProfiles = errors.New("no LLVM raw profiles found")
+
+// ShareLLVMProfileDir collects the raw profiles of clang-instrumented
+// (-fprofile-instr-generate -fcoverage-mapping) guest binaries to
+// VMTEST_LLVM_PROFILE_DIR/{vmName}-{n} if VMTEST_LLVM_PROFILE_DIR is set.
+//
+// LLVM_PROFILE_FILE is set in the guest so that each process writes its
+// own profile to the directory, mounted at /mount/9p/llvmprof by the vmmount
+// command. Use MergeLLVMProfiles to merge all profiles on the host.
+func ShareLLVMProfileDir() qemu.Fn {
+	profileDir := os.Getenv("VMTEST_LLVM_PROFILE_DIR")
+	if profileDir == "" {
+		return nil
+	}
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		vmDir, err := newOutputDir(profileDir, opts.Name)
+		if err != nil {
+			return err
+		}
+		return qemu.All(
+			qemu.P9Directory(vmDir, "llvmprof"),
+			// %p is the process ID, %m the binary's signature.
+			qemu.WithAppendKernel("LLVM_PROFILE_FILE=/mount/9p/llvmprof/%p-%m.profraw"),
+		)(alloc, opts)
+	}
+}
+
+// LLVMProfiles returns all raw profiles collected by ShareLLVMProfileDir in
+// profileDir, i.e. VMTEST_LLVM_PROFILE_DIR.
+func LLVMProfiles(profileDir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(profileDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && filepath.Ext(path) == ".profraw" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// MergeLLVMProfiles merges all raw profiles collected by ShareLLVMProfileDir in
+// profileDir into the indexed profile output, for use with llvm-cov.
+//
+// llvmProfdata is the llvm-profdata executable. It defaults to llvm-profdata
+// in $PATH.
+func MergeLLVMProfiles(ctx context.Context, profileDir, output, llvmProfdata string) error {
+	if llvmProfdata == "" {
+		llvmProfdata = "llvm-profdata"
+	}
+	files, err := LLVMProfiles(profileDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%w in %s", ErrNoLLVMProfiles, profileDir)
+	}
+	if err := run(ctx, llvmProfdata, append([]string{"merge", "-sparse", "-o", output}, files...)...); err != nil {
+		return fmt.Errorf("could not merge LLVM profiles: %w", err)
+	}
+	return nil
+}
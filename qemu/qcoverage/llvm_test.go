@@ -0,0 +1,56 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeProfdata concatenates the profiles given to merge into the output.
+const fakeProfdata = `#!/bin/sh
+[ "$1" = merge ] && [ "$2" = -sparse ] && [ "$3" = -o ] || exit 1
+out="$4"
+shift 4
+cat "$@" > "$out"
+`
+
+func TestMergeLLVMProfiles(t *testing.T) {
+	dir := t.TempDir()
+	profdata := filepath.Join(dir, "llvm-profdata")
+	if err := os.WriteFile(profdata, []byte(fakeProfdata), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	profileDir := filepath.Join(dir, "profiles")
+	for path, content := range map[string]string{
+		"vm-0/10-123.profraw": "a\n",
+		"vm-1/10-123.profraw": "b\n",
+		"vm-1/other":          "c\n",
+	} {
+		path = filepath.Join(profileDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := filepath.Join(dir, "merged.profdata")
+	if err := MergeLLVMProfiles(context.Background(), profileDir, output, profdata); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(output); err != nil || string(b) != "a\nb\n" {
+		t.Errorf("Merged profile = (%q, %v), want %q", b, err, "a\nb\n")
+	}
+
+	if err := MergeLLVMProfiles(context.Background(), t.TempDir(), output, profdata); !errors.Is(err, ErrNoLLVMProfiles) {
+		t.Errorf("MergeLLVMProfiles = %v, want %v", err, ErrNoLLVMProfiles)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// vmDirs is the directory in VMTEST_GOCOVERDIR that holds the GOCOVERDIR of
+// each running VM. go tool covdata ignores it.
+const vmDirs = ".vms"
+
+// newOutputDir creates a directory in parent for the outputs of the VM
+// vmName, named {vmName}-{n} with the lowest n not taken yet.
+//
+// Creating the directory is atomic, so VMs of parallel tests never share one,
+// even in different processes.
+func newOutputDir(parent, vmName string) (string, error) {
+	if vmName == "" {
+		vmName = "vm"
+	}
+	if err := os.MkdirAll(parent, 0o770); err != nil {
+		return "", err
+	}
+	for n := 0; ; n++ {
+		dir := filepath.Join(parent, fmt.Sprintf("%s-%d", vmName, n))
+		if err := os.Mkdir(dir, 0o770); err == nil {
+			return dir, nil
+		} else if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+	}
+}
+
+// counterFile returns the i'th alternative name for the GOCOVERDIR counter
+// file name, covcounters.{hash}.{pid}.{nanotime}, by adding i to nanotime.
+//
+// Guests boot alike, so counter files of different VMs may have the same name.
+func counterFile(name string, i uint64) (string, bool) {
+	dot := strings.LastIndex(name, ".")
+	t, err := strconv.ParseUint(name[dot+1:], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	return name[:dot+1] + strconv.FormatUint(t+i, 10), true
+}
+
+// mergeGOCOVERDIR moves the GOCOVERDIR files in src to dst and removes src.
+//
+// Meta-data files of the same binary have the same name and contents in
+// every run, so existing ones are replaced. Counter files are renamed if
+// their name is taken.
+func mergeGOCOVERDIR(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		from := filepath.Join(src, e.Name())
+		if !strings.HasPrefix(e.Name(), "covcounters.") {
+			if err := os.Rename(from, filepath.Join(dst, e.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		for i := uint64(0); ; i++ {
+			name, ok := counterFile(e.Name(), i)
+			if !ok {
+				return fmt.Errorf("unexpected GOCOVERDIR counter file name %q", e.Name())
+			}
+			// Unlike rename, link does not replace existing files.
+			if err := os.Link(from, filepath.Join(dst, name)); errors.Is(err, os.ErrExist) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := os.Remove(from); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return os.Remove(src)
+}
+
+var profileMu sync.Mutex
+
+// AppendGoProfile appends the Go coverage profile src to dst, dropping the
+// mode line of src if dst already has content. VMs of parallel tests can
+// thereby write to the same profile.
+func AppendGoProfile(src, dst string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if fi, err := f.Stat(); err != nil {
+		f.Close()
+		return err
+	} else if fi.Size() > 0 && bytes.HasPrefix(b, []byte("mode: ")) {
+		if _, rest, ok := bytes.Cut(b, []byte("\n")); ok {
+			b = rest
+		} else {
+			b = nil
+		}
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
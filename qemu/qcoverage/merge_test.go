@@ -0,0 +1,105 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewOutputDir(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "TestFoo")
+	for _, want := range []string{"vm-0", "vm-1"} {
+		dir, err := newOutputDir(parent, "vm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filepath.Base(dir); got != want {
+			t.Errorf("newOutputDir = %s, want %s", got, want)
+		}
+	}
+	if dir, err := newOutputDir(parent, ""); err != nil || filepath.Base(dir) != "vm-2" {
+		t.Errorf("newOutputDir = %s, %v, want vm-2", dir, err)
+	}
+}
+
+func TestMergeGOCOVERDIR(t *testing.T) {
+	dst := t.TempDir()
+	for _, vm := range []string{"a", "b"} {
+		src := filepath.Join(dst, vmDirs, vm)
+		if err := os.MkdirAll(src, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		// Both VMs write files of the same name.
+		for name, content := range map[string]string{
+			"covmeta.abc":          "meta",
+			"covcounters.abc.1.10": vm,
+		} {
+			if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mergeGOCOVERDIR(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Errorf("mergeGOCOVERDIR did not remove %s", src)
+		}
+	}
+
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			b, err := os.ReadFile(filepath.Join(dst, e.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[e.Name()] = string(b)
+		}
+	}
+	want := map[string]string{
+		"covmeta.abc":          "meta",
+		"covcounters.abc.1.10": "a",
+		"covcounters.abc.1.11": "b",
+	}
+	if len(got) != len(want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s = %q, want %q", name, got[name], content)
+		}
+	}
+}
+
+func TestAppendGoProfile(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "coverage.profile")
+	var srcs []string
+	for i, content := range []string{"mode: atomic\nfoo.go:1.1,2.2 1 1\n", "mode: atomic\nbar.go:1.1,2.2 1 0\n"} {
+		src := filepath.Join(dir, string(rune('a'+i)))
+		if err := os.WriteFile(src, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, src)
+	}
+	for _, src := range srcs {
+		if err := AppendGoProfile(src, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "mode: atomic\nfoo.go:1.1,2.2 1 1\nbar.go:1.1,2.2 1 0\n"; string(got) != want {
+		t.Errorf("profile = %q, want %q", got, want)
+	}
+}
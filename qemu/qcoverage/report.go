@@ -0,0 +1,284 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hugelgupf/vmtest/internal/gcovsource"
+	"github.com/u-root/u-root/pkg/upath"
+)
+
+// kernelCoverageFile is the name of the files saved by CollectKernelCoverage.
+const kernelCoverageFile = "kernel_coverage.tar"
+
+// gcovRoot is where the kernel's gcov files are in kernel coverage files.
+const gcovRoot = "sys/kernel/debug/gcov"
+
+// ErrNoKernelCoverage is returned when there is no kernel coverage to report.
+var ErrNoKernelCoverage = errors.New("no kernel coverage files found")
+
+// KernelCoverageFiles returns all kernel coverage files saved by
+// CollectKernelCoverage in coverageDir, i.e. VMTEST_KERNEL_COVERAGE_DIR.
+func KernelCoverageFiles(coverageDir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(coverageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && d.Name() == kernelCoverageFile {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ExtractKernelCoverage extracts the kernel coverage file tarPath into outDir,
+// runs gcov on it with outDir as working directory, and returns the directory
+// with the .gcda files.
+//
+// The .gcno files are symlinks into the kernel build directory, as in the
+// guest's debugfs. If kernelSrc is set, they are pointed to the same files in
+// the kernel source/build tree kernelSrc instead, for kernels built
+// elsewhere. gcov reads the sources at the paths the kernel was built with.
+//
+// gcov is the gcov executable in $PATH, or $GCOV if set, e.g. for kernels
+// built with a cross compiler.
+func ExtractKernelCoverage(tarPath, kernelSrc, outDir string) (string, error) {
+	gcovDir, err := extractKernelCoverage(tarPath, outDir, kernelSrc, nil)
+	if err != nil {
+		return "", err
+	}
+	gcov := os.Getenv("GCOV")
+	if gcov == "" {
+		gcov = "gcov"
+	}
+	if err := runGcov(context.Background(), gcov, gcovDir, outDir); err != nil {
+		return "", err
+	}
+	return gcovDir, nil
+}
+
+// runGcov runs gcov on the .gcda files in gcovDir in the working directory
+// outDir, one gcov invocation per directory.
+func runGcov(ctx context.Context, gcov, gcovDir, outDir string) error {
+	gcda := make(map[string][]string)
+	if err := filepath.WalkDir(gcovDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && filepath.Ext(path) == ".gcda" {
+			gcda[filepath.Dir(path)] = append(gcda[filepath.Dir(path)], d.Name())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	dirs := make([]string, 0, len(gcda))
+	for dir := range gcda {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		// -p keeps files of the same name in different directories apart.
+		cmd := exec.CommandContext(ctx, gcov, append([]string{"-p", "-o", dir}, gcda[dir]...)...)
+		cmd.Dir = outDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("gcov of %s: %w\n%s", dir, err, out)
+		}
+	}
+	return nil
+}
+
+// relink returns the path of the symlink target link in kernelSrc: link with
+// as many leading directories removed as needed to be found in kernelSrc.
+func relink(link, kernelSrc string) string {
+	parts := strings.Split(strings.TrimPrefix(filepath.Clean(link), "/"), "/")
+	for i := range parts {
+		p := filepath.Join(append([]string{kernelSrc}, parts[i:]...)...)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return link
+}
+
+// extractKernelCoverage extracts tarFile into dir like ExtractKernelCoverage,
+// only extracting the files of the kernel source subtrees sources (all if
+// sources is empty).
+func extractKernelCoverage(tarFile, dir, kernelSrc string, sources []string) (string, error) {
+	f, err := os.Open(tarFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Symlinks are created last so that no file is written through one.
+	var symlinks []*tar.Header
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", tarFile, err)
+		}
+		if hdr.Typeflag != tar.TypeDir && !gcovsource.Match(hdr.Name, sources) {
+			continue
+		}
+		path, err := upath.SafeFilepathJoin(dir, hdr.Name)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", tarFile, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return "", err
+			}
+			if err := writeFile(path, tr); err != nil {
+				return "", err
+			}
+		case tar.TypeSymlink:
+			symlinks = append(symlinks, hdr)
+		}
+	}
+	for _, hdr := range symlinks {
+		path, _ := upath.SafeFilepathJoin(dir, hdr.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", err
+		}
+		link := hdr.Linkname
+		if kernelSrc != "" {
+			link = relink(link, kernelSrc)
+		}
+		if err := os.Symlink(link, path); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, gcovRoot), nil
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReportOptions configures KernelReport.
+type ReportOptions struct {
+	// HTMLDir, if set, is where genhtml writes an HTML report.
+	HTMLDir string
+
+	// LCOVArgs are additional arguments to lcov --capture, e.g.
+	// --gcov-tool for kernels built with a cross compiler.
+	LCOVArgs []string
+
+	// KernelSource, if set, is the kernel source/build tree to read .gcno
+	// files from, if not at the path the kernel was built in. See
+	// ExtractKernelCoverage.
+	KernelSource string
+
+	// Sources, if set, limits the report to these kernel source subtrees,
+	// e.g. "fs/ext4". See CollectKernelCoverage.
+	Sources []string
+
+	// LCOV and GenHTML are the lcov and genhtml executables. They default
+	// to lcov and genhtml in $PATH.
+	LCOV    string
+	GenHTML string
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w\n%s", name, strings.Join(args, " "), err, out.String())
+	}
+	return nil
+}
+
+// KernelReport merges all kernel coverage saved by CollectKernelCoverage in
+// coverageDir, i.e. VMTEST_KERNEL_COVERAGE_DIR, into the lcov tracefile info,
+// and optionally an HTML report.
+//
+// It requires lcov (and genhtml for HTML), and the kernel build directory at
+// the path the kernel was built in or at KernelSource.
+func KernelReport(ctx context.Context, coverageDir, info string, opts ReportOptions) error {
+	lcov, genhtml := opts.LCOV, opts.GenHTML
+	if lcov == "" {
+		lcov = "lcov"
+	}
+	if genhtml == "" {
+		genhtml = "genhtml"
+	}
+
+	files, err := KernelCoverageFiles(coverageDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%w in %s", ErrNoKernelCoverage, coverageDir)
+	}
+
+	tmp, err := os.MkdirTemp("", "vmtest-kernel-coverage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	merge := []string{"--output-file", info}
+	for i, f := range files {
+		dir := filepath.Join(tmp, fmt.Sprintf("%d", i))
+		gcov, err := extractKernelCoverage(f, dir, opts.KernelSource, opts.Sources)
+		if err != nil {
+			return err
+		}
+		tracefile := dir + ".info"
+		args := append([]string{"--capture", "--directory", gcov, "--output-file", tracefile}, opts.LCOVArgs...)
+		if err := run(ctx, lcov, args...); err != nil {
+			return fmt.Errorf("could not read coverage of %s: %w", f, err)
+		}
+		merge = append(merge, "--add-tracefile", tracefile)
+	}
+	if err := run(ctx, lcov, merge...); err != nil {
+		return fmt.Errorf("could not merge kernel coverage: %w", err)
+	}
+
+	if opts.HTMLDir != "" {
+		if err := run(ctx, genhtml, info, "--output-directory", opts.HTMLDir); err != nil {
+			return fmt.Errorf("could not generate HTML report: %w", err)
+		}
+	}
+	return nil
+}
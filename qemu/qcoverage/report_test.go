@@ -0,0 +1,167 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qcoverage
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeLCOV writes the .gcda files it captures to the tracefile, and merges
+// tracefiles by concatenating them.
+const fakeLCOV = `#!/bin/sh
+echo "$@" >> "$LOG"
+out=
+dir=
+add=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--output-file) out="$2"; shift ;;
+	--directory) dir="$2"; shift ;;
+	--add-tracefile) add="$add $2"; shift ;;
+	esac
+	shift
+done
+if [ -n "$dir" ]; then
+	(cd "$dir" && find . -name '*.gcda' -exec cat {} \;) > "$out"
+else
+	cat $add > "$out"
+fi
+`
+
+// fakeGcov writes its args to fork.c.gcov.
+const fakeGcov = `#!/bin/sh
+echo "$@" > fork.c.gcov
+`
+
+const fakeGenHTML = `#!/bin/sh
+mkdir -p "$3" && cp "$1" "$3/index.html"
+`
+
+func writeKernelCoverage(t *testing.T, path, gcda string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, hdr := range []*tar.Header{
+		{Name: "sys/kernel/debug/gcov/build/kernel/", Typeflag: tar.TypeDir, Mode: 0o770},
+		{Name: "sys/kernel/debug/gcov/build/kernel/fork.gcda", Typeflag: tar.TypeReg, Mode: 0o660, Size: int64(len(gcda))},
+		{Name: "sys/kernel/debug/gcov/build/kernel/fork.gcno", Typeflag: tar.TypeSymlink, Linkname: "/build/kernel/fork.gcno"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(gcda)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKernelReport(t *testing.T) {
+	dir := t.TempDir()
+	lcov := filepath.Join(dir, "lcov")
+	genhtml := filepath.Join(dir, "genhtml")
+	if err := os.WriteFile(lcov, []byte(fakeLCOV), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(genhtml, []byte(fakeGenHTML), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LOG", filepath.Join(dir, "log"))
+
+	coverageDir := filepath.Join(dir, "coverage")
+	writeKernelCoverage(t, filepath.Join(coverageDir, "TestA", "0", kernelCoverageFile), "a\n")
+	writeKernelCoverage(t, filepath.Join(coverageDir, "TestB", "vm", "0", kernelCoverageFile), "b\n")
+
+	files, err := KernelCoverageFiles(coverageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("KernelCoverageFiles = %v, want 2 files", files)
+	}
+
+	// The kernel was built in /build, but is now in kernelSrc.
+	kernelSrc := filepath.Join(dir, "linux")
+	if err := os.MkdirAll(filepath.Join(kernelSrc, "kernel"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(kernelSrc, "kernel", "fork.gcno"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gcovTool := filepath.Join(dir, "gcov")
+	if err := os.WriteFile(gcovTool, []byte(fakeGcov), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GCOV", gcovTool)
+	extracted := filepath.Join(dir, "extracted")
+	gcov, err := ExtractKernelCoverage(files[0], kernelSrc, extracted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(kernelSrc, "kernel", "fork.gcno")
+	if target, err := os.Readlink(filepath.Join(gcov, "build/kernel/fork.gcno")); err != nil || target != want {
+		t.Errorf("fork.gcno = (%s, %v), want symlink to %s", target, err, want)
+	}
+	if b, err := os.ReadFile(filepath.Join(extracted, "fork.c.gcov")); err != nil || string(b) != "-p -o "+filepath.Join(gcov, "build/kernel")+" fork.gcda\n" {
+		t.Errorf("gcov output = (%q, %v), want gcov run on fork.gcda", b, err)
+	}
+
+	info := filepath.Join(dir, "kernel.info")
+	html := filepath.Join(dir, "html")
+	if err := KernelReport(context.Background(), coverageDir, info, ReportOptions{
+		HTMLDir:  html,
+		LCOVArgs: []string{"--gcov-tool", "aarch64-linux-gnu-gcov"},
+		LCOV:     lcov,
+		GenHTML:  genhtml,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(html, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "a\nb\n"; got != want {
+		t.Errorf("Merged coverage = %q, want %q", got, want)
+	}
+	log, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "--gcov-tool aarch64-linux-gnu-gcov") {
+		t.Errorf("lcov was not called with LCOVArgs: %s", log)
+	}
+
+	// The coverage files only have coverage of kernel/.
+	if err := KernelReport(context.Background(), coverageDir, info, ReportOptions{
+		Sources: []string{"mm"},
+		LCOV:    lcov,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(info); err != nil || len(b) != 0 {
+		t.Errorf("Coverage of mm = (%q, %v), want none", b, err)
+	}
+
+	if err := KernelReport(context.Background(), t.TempDir(), info, ReportOptions{LCOV: lcov}); !errors.Is(err, ErrNoKernelCoverage) {
+		t.Errorf("KernelReport = %v, want %v", err, ErrNoKernelCoverage)
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command hello is an ELF binary with DWARF line tables for tests.
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("hello")
+}
@@ -19,6 +19,8 @@
 //	VMTEST_KERNEL_APPEND (always added to kernel args)
 //	VMTEST_INITRAMFS (used when Options.Initramfs is empty)
 //	VMTEST_TIMEOUT (used when Options.VMTimeout is empty)
+//	VMTEST_ARTIFACTS_DIR (StartT saves console and QEMU logs here)
+//	VMTEST_UPDATE_GOLDEN (ExpectGolden writes golden files instead)
 package qemu
 
 import (
@@ -37,6 +39,7 @@ import (
 	"time"
 
 	"github.com/Netflix/go-expect"
+	"github.com/hugelgupf/vmtest/testartifacts"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -49,6 +52,14 @@ var ErrUnsupportedArch = errors.New("unsupported guest architecture specified --
 // ErrInvalidTimeout is returned when VMTEST_TIMEOUT could not be parsed.
 var ErrInvalidTimeout = errors.New("could not parse VMTEST_TIMEOUT")
 
+// ErrUnsupportedHost is returned by options that are not supported on the
+// host OS, e.g. 9P shares on Windows hosts.
+var ErrUnsupportedHost = errors.New("not supported on this host OS")
+
+// ErrNoConsole is returned when interacting with the console of a VM that has
+// none. VMs started on Windows hosts have no console.
+var ErrNoConsole = errors.New("VM has no console")
+
 // Arch is the QEMU guest architecture.
 type Arch string
 
@@ -145,6 +156,58 @@ func WithSerialOutput(w ...io.WriteCloser) Fn {
 	}
 }
 
+// WithConsoleOutputFile writes the raw console output to the file at path as
+// it arrives. Unlike t.Logf output, it survives the test process being killed,
+// e.g. by the go test -timeout.
+//
+// StartT writes console output to a file by default (see StartT).
+func WithConsoleOutputFile(path string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		opts.ConsoleOutputFile = path
+		opts.SerialOutput = append(opts.SerialOutput, f)
+		return nil
+	}
+}
+
+// defaultConsoleOutputFile writes console output to path unless a console
+// output file was configured already.
+func defaultConsoleOutputFile(path string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.ConsoleOutputFile != "" {
+			return nil
+		}
+		return WithConsoleOutputFile(path)(alloc, opts)
+	}
+}
+
+// WithQEMUDebugLog writes QEMU's debug log to path. items are the QEMU log
+// items to enable (see `qemu-system-x86_64 -d help`); if empty, guest_errors
+// and unimp are logged.
+func WithQEMUDebugLog(path string, items ...string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if len(items) == 0 {
+			items = []string{"guest_errors", "unimp"}
+		}
+		opts.AppendQEMU("-D", path, "-d", strings.Join(items, ","))
+		return nil
+	}
+}
+
+// defaultQEMUDebugLog writes QEMU's debug log to path unless the VM is run by
+// a Backend.
+func defaultQEMUDebugLog(path string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.Backend != nil {
+			return nil
+		}
+		return WithQEMUDebugLog(path)(alloc, opts)
+	}
+}
+
 // WithVMTimeout is a timeout for the QEMU guest subprocess.
 func WithVMTimeout(timeout time.Duration) Fn {
 	return func(alloc *IDAllocator, opts *Options) error {
@@ -158,7 +221,9 @@ func WithVMTimeout(timeout time.Duration) Fn {
 // Task goroutines are started right before the guest is started.
 //
 // VM.Wait waits for all tasks to complete before returning an error. Errors
-// produced by tasks are returned by VM.Wait.
+// produced by tasks are returned by VM.Wait. A task returning an error while
+// the guest is still running cancels the VM, e.g. to abort a misbehaving guest
+// early.
 //
 // A task is expected to exit either when ctx is canceled or when the QEMU
 // subprocess exits. When the context is canceled, the QEMU subprocess is
@@ -200,6 +265,7 @@ func OptionsFor(arch Arch, fns ...Fn) (*Options, error) {
 	for _, f := range fns {
 		if f != nil {
 			if err := f(alloc, o); err != nil {
+				o.Release()
 				return nil, err
 			}
 		}
@@ -239,18 +305,85 @@ func StartContext(ctx context.Context, arch Arch, fns ...Fn) (*VM, error) {
 // vm.Wait() was called by the end of the test, as it is required to drain
 // console output.
 //
+// Unless WithConsoleOutputFile is given, the raw console output is written to
+// <name>.console.log in the test's artifacts directory, which is a testtmp
+// directory if VMTEST_ARTIFACTS_DIR is not set.
+//
+// A console transcript is recorded for VM.ExpectString unless one is given
+// with WithTranscript. Diagnostics are gathered DefaultSoftTimeout before the
+// VM times out, unless configured with WithSoftTimeout. State dumps of
+// WithFailureDump go to the test's artifacts directory unless it is given
+// another directory.
+//
+// The phase timing of the VM is logged if the guest marks phases with
+// guest.Phase (see WithPhaseReport), as are its boot timings (see
+// WithBootTimer).
+//
+// If VMTEST_ARTIFACTS_DIR is set, the timestamped transcript, QEMU debug log,
+// phase timing, guest events (unless WithEventLog is given), timeout
+// diagnostics, and command line (also as libvirt domain XML, see
+// Options.LibvirtXML) of the VM are saved as test artifacts named
+// after the VM (see package testartifacts).
+//
 // SerialOutput will be relayed only if VM.Wait is also called some time after
 // the VM starts.
 func StartT(t testing.TB, name string, arch Arch, fns ...Fn) *VM {
+	fns = append([]Fn{func(_ *IDAllocator, opts *Options) error {
+		opts.Name = name
+		return nil
+	}}, fns...)
 	fns = append(fns,
 		LogSerialByLine(DefaultPrint(name, t.Logf)),
+		defaultTranscript(),
+		defaultPhaseReport(),
+		defaultBootTimer(),
+		defaultSoftTimeout(),
+		defaultConsoleOutputFile(testartifacts.Path(t, name+".console.log")),
+		defaultFailureDumpDir(testartifacts.Dir(t)),
 	)
+	if testartifacts.Enabled() {
+		fns = append(fns,
+			defaultQEMUDebugLog(testartifacts.Path(t, name+".qemu.log")),
+			defaultEventLog(testartifacts.Path(t, name+".events.jsonl")),
+		)
+	}
 	vm, err := Start(arch, fns...)
 	if err != nil {
-		t.Fatalf("Failed to start QEMU VM %s: %v", name, err)
+		t.Fatalf("Failed to start VM %s: %v", name, err)
 	}
+	t.Logf("Raw console output of %s: %s", name, vm.Options.ConsoleOutputFile)
 	t.Cleanup(func() {
-		t.Logf("QEMU command line to reproduce %s:\n%s", name, vm.CmdlineQuoted())
+		t.Logf("%s command line to reproduce %s:\n%s", vm.Options.vmmName(), name, vm.CmdlineQuoted())
+		phases := vm.Options.PhaseReport.String()
+		if phases != "" {
+			t.Logf("Phase timing of %s:\n%s", name, phases)
+		}
+		if stats := vm.BootStats().String(); stats != "" {
+			t.Logf("Boot timing of %s: %s", name, stats)
+		}
+		if testartifacts.Enabled() {
+			if err := os.WriteFile(testartifacts.Path(t, name+".cmdline"), []byte(vm.CmdlineQuoted()+"\n"), 0o644); err != nil {
+				t.Logf("Could not save command line of %s: %v", name, err)
+			}
+			if x, err := vm.Options.LibvirtXML(); err == nil {
+				if err := os.WriteFile(testartifacts.Path(t, name+".libvirt.xml"), []byte(x), 0o644); err != nil {
+					t.Logf("Could not save libvirt domain XML of %s: %v", name, err)
+				}
+			}
+			if err := os.WriteFile(testartifacts.Path(t, name+".transcript.log"), []byte(vm.Options.Transcript.String()), 0o644); err != nil {
+				t.Logf("Could not save console transcript of %s: %v", name, err)
+			}
+			if phases != "" {
+				if err := os.WriteFile(testartifacts.Path(t, name+".phases.txt"), []byte(phases), 0o644); err != nil {
+					t.Logf("Could not save phase timing of %s: %v", name, err)
+				}
+			}
+			if d := vm.Diagnostics(); d != "" {
+				if err := os.WriteFile(testartifacts.Path(t, name+".diagnostics.log"), []byte(d), 0o644); err != nil {
+					t.Logf("Could not save timeout diagnostics of %s: %v", name, err)
+				}
+			}
+		}
 	})
 	t.Cleanup(func() {
 		if !vm.Waited() {
@@ -262,6 +395,10 @@ func StartT(t testing.TB, name string, arch Arch, fns ...Fn) *VM {
 
 // Options are VM start-up parameters.
 type Options struct {
+	// Name is the name of the VM as given to StartT, e.g. for naming
+	// per-VM outputs. It may be empty.
+	Name string
+
 	// arch is the QEMU architecture used.
 	//
 	// Some device decisions are made based on the architecture.
@@ -288,9 +425,26 @@ type Options struct {
 	// VMTEST_KERNEL_APPEND env var will always be prepended.
 	KernelArgs string
 
+	// ConsoleArg appends console= for the guest's serial console to
+	// KernelArgs when QEMU starts, unless KernelArgs has one. See
+	// WithConsoleArg.
+	ConsoleArg bool
+
 	// Where to send serial output.
 	SerialOutput []io.WriteCloser
 
+	// HostConsole connects the console to the terminal of the program
+	// that starts the VM. See WithHostConsole.
+	HostConsole bool
+
+	// ConsoleOutputFile is the path of a file that raw console output is
+	// written to, if any. See WithConsoleOutputFile.
+	ConsoleOutputFile string
+
+	// Transcript records console output for VM.ExpectString errors. See
+	// WithTranscript.
+	Transcript *Transcript
+
 	// Tasks are goroutines running alongside the guest.
 	//
 	// Task goroutines are started right before the guest is started.
@@ -309,8 +463,63 @@ type Options struct {
 	// VMTimeout is a timeout for the QEMU subprocess.
 	VMTimeout time.Duration
 
+	// SoftTimeout is how long before the VM times out diagnostics are
+	// gathered. See WithSoftTimeout.
+	SoftTimeout time.Duration
+
+	// QMPSocket is the path of the VM's QMP unix socket, if any. See
+	// WithQMP.
+	QMPSocket string
+
+	// PhaseReport aggregates guest phase markers, if set. See
+	// WithPhaseReport.
+	PhaseReport *PhaseReport
+
+	// BootTimer measures boot timings, if set. See WithBootTimer.
+	BootTimer *BootTimer
+
+	// EventLog persists the guest events of all event channels, if set.
+	// See WithEventLog.
+	EventLog *EventLog
+
+	// HostIsolation restricts the host CPUs and priority of the QEMU
+	// process, if set. See WithHostIsolation.
+	HostIsolation *HostIsolation
+
+	// FailureDump configures state dumps on failed expectations and
+	// timeouts, if set. See WithFailureDump.
+	FailureDump *FailureDump
+
 	// ExtraFiles are extra files passed to QEMU on start.
 	ExtraFiles []*os.File
+
+	// Backend runs the VM instead of QEMU, if set. See WithBackend.
+	Backend Backend
+
+	releaseMu sync.Mutex
+	releases  []func()
+}
+
+// AddRelease adds a function that frees a host resource claimed for the VM,
+// e.g. a host port. It runs once, when the VM exits or when OptionsFor or
+// Start fail.
+func (o *Options) AddRelease(release func()) {
+	o.releaseMu.Lock()
+	defer o.releaseMu.Unlock()
+	o.releases = append(o.releases, release)
+}
+
+// Release runs the functions added with AddRelease that have not run yet.
+//
+// Start and VM.Wait call Release; call it for Options that are never started.
+func (o *Options) Release() {
+	o.releaseMu.Lock()
+	releases := o.releases
+	o.releases = nil
+	o.releaseMu.Unlock()
+	for _, release := range releases {
+		release()
+	}
 }
 
 // AddFile adds the file to the QEMU process and returns the FD it will be in
@@ -388,16 +597,40 @@ func (o *Options) Arch() Arch {
 //
 // SerialOutput will be relayed only if VM.Wait is also called some time after
 // the VM starts.
+//
+// If the VM cannot be started, the host resources claimed for it are released
+// (see AddRelease).
 func (o *Options) Start(ctx context.Context) (*VM, error) {
+	vm, err := o.start(ctx)
+	if err != nil {
+		o.Release()
+	}
+	return vm, err
+}
+
+func (o *Options) start(ctx context.Context) (*VM, error) {
 	cmdline, err := o.Cmdline()
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := expect.NewConsole()
+	if runtime.GOOS == "windows" && len(o.ExtraFiles) > 0 {
+		return nil, fmt.Errorf("%w: options that pass files to the VM, e.g. event channels and debug logs, need a Unix host", ErrUnsupportedHost)
+	}
+
+	c, err := newConsole()
 	if err != nil {
 		return nil, err
 	}
+	var host *hostConsole
+	if o.HostConsole {
+		if host, err = attachHostConsole(c); err != nil {
+			if c != nil {
+				c.Close()
+			}
+			return nil, err
+		}
+	}
 
 	var cancel context.CancelFunc
 	if o.VMTimeout != 0 {
@@ -410,32 +643,53 @@ func (o *Options) Start(ctx context.Context) (*VM, error) {
 		Console: c,
 		cmdline: cmdline,
 		cancel:  cancel,
+		host:    host,
 	}
 	for _, task := range o.Tasks {
 		// Capture the var... Go stuff.
 		task := task
 		n := newNotifications()
 		vm.taskWG.Go(func() error {
-			return task(ctx, n)
+			err := task(ctx, n)
+			if err != nil {
+				vm.taskFailed(ctx, err)
+			}
+			return err
 		})
 		vm.notifs = append(vm.notifs, n)
 	}
 
-	writers := []io.Writer{c.Tty()}
+	var writers []io.Writer
+	if c != nil {
+		writers = append(writers, c.Tty())
+	}
 	for _, serial := range o.SerialOutput {
 		writers = append(writers, serial)
 	}
 	cmd := exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
-	cmd.Stdin = c.Tty()
+	if c != nil {
+		cmd.Stdin = c.Tty()
+	}
+	if vm.host != nil {
+		writers = append(writers, os.Stdout)
+		if c == nil {
+			cmd.Stdin = os.Stdin
+		}
+	}
 	cmd.Stdout = io.MultiWriter(writers...)
 	cmd.Stderr = io.MultiWriter(writers...)
 	cmd.ExtraFiles = o.ExtraFiles
-	if err := cmd.Start(); err != nil {
+	if err := startCmd(cmd, o.HostIsolation); err != nil {
 		// Cancel tasks.
 		cancel()
+		if vm.host != nil {
+			vm.host.close()
+		}
 
 		// Unblock tasks that may depend on these files.
-		vm.Console.Close()
+		if vm.Console != nil {
+			vm.Console.Close()
+		}
 		for _, w := range vm.Options.SerialOutput {
 			w.Close()
 		}
@@ -454,27 +708,50 @@ func (o *Options) Start(ctx context.Context) (*VM, error) {
 	vm.notifs.vmStarted()
 	vm.cmd = cmd
 	vm.wait = make(chan struct{})
+	vm.watchSoftTimeout(ctx)
 
 	// A goroutine to wait on exit, as we need to close Console.Tty() to
 	// unblock any waiting Expect calls.
 	go func() {
 		err := vm.cmd.Wait()
+		if b, ok := o.Backend.(BackendExitError); ok {
+			err = b.ExitError(err)
+		}
 		vm.notifs.vmExited(err)
+		o.Release()
+		if vm.host != nil {
+			vm.host.close()
+		}
 
 		// Close the pts end of the tty to unblock any potential
 		// readers on ptm (i.e. Expect calls).
 		//
 		// Don't call vm.Console.Close() as that also closes the ptm,
 		// which a blocking Expect call may still expect to read from.
-		vm.Console.Tty().Close()
+		if vm.Console != nil {
+			vm.Console.Tty().Close()
+		}
 		vm.waitMu.Lock()
 		vm.waitErr = err
+		vm.exited = true
 		vm.waitMu.Unlock()
 		close(vm.wait)
 	}()
 	return vm, nil
 }
 
+// taskFailed cancels the VM if a task failed with err while the VM was still
+// running and not canceled yet.
+func (v *VM) taskFailed(ctx context.Context, err error) {
+	v.waitMu.Lock()
+	defer v.waitMu.Unlock()
+	if v.exited || v.taskErr != nil || ctx.Err() != nil {
+		return
+	}
+	v.taskErr = err
+	v.cancel()
+}
+
 func (o *Options) setArch(arch Arch) error {
 	if arch == ArchUseEnvv {
 		arch = GuestArch()
@@ -504,9 +781,13 @@ func (o *Options) AppendQEMU(s ...string) {
 	o.QEMUArgs = append(o.QEMUArgs, s...)
 }
 
-// Cmdline returns the command line arguments used to start QEMU. These
-// arguments are derived from the given QEMU struct.
+// Cmdline returns the command line arguments used to start QEMU, or the
+// Backend if set. These arguments are derived from the given QEMU struct.
 func (o *Options) Cmdline() ([]string, error) {
+	if o.Backend != nil {
+		return o.Backend.Cmdline(o)
+	}
+
 	var args []string
 
 	// QEMU binary + initial args (may have been supplied via VMTEST_QEMU).
@@ -517,8 +798,8 @@ func (o *Options) Cmdline() ([]string, error) {
 
 	if len(o.Kernel) > 0 {
 		args = append(args, "-kernel", o.Kernel)
-		if len(o.KernelArgs) != 0 {
-			args = append(args, "-append", o.KernelArgs)
+		if kernelArgs := o.kernelArgs(); len(kernelArgs) != 0 {
+			args = append(args, "-append", kernelArgs)
 		}
 	} else if len(o.KernelArgs) != 0 {
 		return nil, ErrKernelRequiredForArgs
@@ -534,6 +815,9 @@ func (o *Options) Cmdline() ([]string, error) {
 // VM is a running QEMU virtual machine.
 type VM struct {
 	// Console provides in/output to the QEMU subprocess.
+	//
+	// Console is nil on Windows hosts, which have no ptys. Use
+	// SerialOutput, e.g. LogSerialByLine, to read the VM's output there.
 	Console *expect.Console
 
 	// Options are the options that were used to start the VM.
@@ -556,6 +840,18 @@ type VM struct {
 	waitMu     sync.Mutex
 	waitErr    error
 	waitCalled atomic.Bool
+	exited     bool
+	// taskErr is the error of the task that canceled the VM, if any.
+	taskErr error
+
+	// softTimeoutDone is closed once diagnostics have been gathered, or
+	// were not needed.
+	softTimeoutDone chan struct{}
+	diagnostics     string
+	dump            *StateDump
+
+	// host is the terminal the console is connected to, if any.
+	host *hostConsole
 }
 
 // Cmdline is the command-line the VM was started with.
@@ -600,16 +896,29 @@ func (v *VM) Wait() error {
 	// execution.
 	//
 	// Therefore, drain! EOF should happen when the guest exits.
-	_, _ = v.Console.ExpectEOF()
+	if v.Console != nil {
+		_, _ = v.Console.ExpectEOF()
+	}
 
 	<-v.wait
 
+	if v.softTimeoutDone != nil {
+		<-v.softTimeoutDone
+	}
 	v.waitMu.Lock()
 	err := v.waitErr
+	if v.taskErr != nil {
+		// The VM was killed because of the task.
+		err = v.taskErr
+	} else if err != nil && v.diagnostics != "" {
+		err = &TimeoutError{Diagnostics: v.diagnostics, Err: err, Dump: v.dump}
+	}
 	v.waitMu.Unlock()
 
 	// Close everything but the pts (which was already closed).
-	v.Console.Close()
+	if v.Console != nil {
+		v.Console.Close()
+	}
 	for _, w := range v.Options.SerialOutput {
 		w.Close()
 	}
@@ -619,6 +928,11 @@ func (v *VM) Wait() error {
 	if werr := v.taskWG.Wait(); werr != nil && err == nil {
 		err = werr
 	}
+	if v.Options.EventLog != nil {
+		if lerr := v.Options.EventLog.Close(); lerr != nil && err == nil {
+			err = fmt.Errorf("could not write event log: %w", lerr)
+		}
+	}
 	return err
 }
 
@@ -627,11 +941,7 @@ func (v *VM) Wait() error {
 func (v *VM) CmdlineQuoted() string {
 	args := make([]string, len(v.cmdline))
 	for i, arg := range v.cmdline {
-		if strings.ContainsAny(arg, " \t\n") {
-			args[i] = fmt.Sprintf("'%s'", arg)
-		} else {
-			args[i] = arg
-		}
+		args[i] = quoteArg(arg)
 	}
 	return strings.Join(args, " ")
 }
@@ -659,7 +969,7 @@ func (n notifications) closeAll() {
 }
 
 // SkipWithoutQEMU skips the test when the QEMU environment variable is not
-// set.
+// set. Use SkipUnless to also require KVM, a QEMU version, or devices.
 func SkipWithoutQEMU(tb testing.TB) {
 	if _, ok := os.LookupEnv("VMTEST_QEMU"); !ok {
 		tb.Skip("Skipping QEMU test as VMTEST_QEMU is not set")
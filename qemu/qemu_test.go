@@ -392,6 +392,28 @@ func TestTaskCanceledVMExits(t *testing.T) {
 	}
 }
 
+func TestTaskErrorCancelsVM(t *testing.T) {
+	errInvalid := errors.New("invalid guest event")
+	start := time.Now()
+	vm, err := Start(ArchAMD64,
+		WithQEMUCommand("sleep 60"),
+		clearArgs(),
+		WithTask(WaitVMStarted(func(ctx context.Context, n *Notifications) error {
+			return errInvalid
+		})),
+	)
+	if err != nil {
+		t.Fatalf("Subprocess failed to start: %v", err)
+	}
+
+	if err := vm.Wait(); !errors.Is(err, errInvalid) {
+		t.Errorf("Wait = %v, want %v", err, errInvalid)
+	}
+	if d := time.Since(start); d > 30*time.Second {
+		t.Errorf("VM ran for %v after the task failed", d)
+	}
+}
+
 func TestStartFails(t *testing.T) {
 	_, err := Start(ArchAMD64,
 		WithQEMUCommand("sleep 2"),
@@ -567,3 +589,28 @@ func TestStartTNotWait(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestConsoleOutputFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	vm, err := Start(ArchAMD64,
+		WithQEMUCommand("echo hello console"),
+		WithConsoleOutputFile(path),
+		clearArgs(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start 'VM': %v", err)
+	}
+	if err := vm.Wait(); err != nil {
+		t.Fatalf("Wait = %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "hello console\n"; got != want {
+		t.Errorf("console output file = %q, want %q", got, want)
+	}
+	if vm.Options.ConsoleOutputFile != path {
+		t.Errorf("ConsoleOutputFile = %q, want %q", vm.Options.ConsoleOutputFile, path)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hugelgupf/vmtest/internal/eventchannel"
+)
+
+// WithCommands sends the commands received on commands to the guest, in order,
+// making the event channel bidirectional. Once commands is closed, the guest is
+// told that no more commands are coming.
+//
+// Use guest.SerialCommandChannel with the same name and command type C in the
+// guest to receive the commands.
+//
+// Commands still pending when the guest closes the event channel are not
+// sent.
+func WithCommands[C any](commands <-chan C) Option {
+	return func(o *channelOptions) {
+		o.commands = func(ctx context.Context, h *hostSender) error {
+			return sendCommands(ctx, h, commands)
+		}
+	}
+}
+
+func sendCommands[C any](ctx context.Context, h *hostSender, commands <-chan C) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-h.stop:
+			return nil
+		case c, ok := <-commands:
+			if !ok {
+				return h.send(eventchannel.Command[C]{HostAction: eventchannel.ActionDone})
+			}
+			if err := h.send(eventchannel.Command[C]{HostAction: eventchannel.ActionHostCommand, Actual: c}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// hostSender writes acknowledgements and host commands to the guest while
+// the guest processes events.
+type hostSender struct {
+	mu   sync.Mutex
+	w    io.Writer
+	stop chan struct{}
+
+	acked     atomic.Uint64
+	ackNotify chan struct{}
+
+	wg  sync.WaitGroup
+	err error
+}
+
+// startHost starts acknowledging guest events and sending the configured
+// host commands, if any, on w.
+//
+// Call stopSending once the guest is done with the channel, before closing w,
+// and wait after closing w.
+func (o channelOptions) startHost(ctx context.Context, w io.Writer) *hostSender {
+	h := &hostSender{
+		w:         w,
+		stop:      make(chan struct{}),
+		ackNotify: make(chan struct{}, 1),
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.sendAcks(ctx)
+	}()
+	if o.commands != nil {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.err = o.commands(ctx, h)
+		}()
+	}
+	return h
+}
+
+// send writes v as one JSON line.
+func (h *hostSender) send(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.w.Write(eventchannel.EncodeLine(b)); err != nil {
+		select {
+		case <-h.stop:
+			// The guest is gone.
+			return nil
+		default:
+			return fmt.Errorf("could not write to guest: %w", err)
+		}
+	}
+	return nil
+}
+
+// ack acknowledges all guest events up to seq. It does not block; if the
+// guest is slow to read, acknowledgements are coalesced.
+func (h *hostSender) ack(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	h.acked.Store(seq)
+	select {
+	case h.ackNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *hostSender) sendAcks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.stop:
+			return
+		case <-h.ackNotify:
+			// Guests that do not read the channel never see
+			// acknowledgements, so errors are not fatal.
+			_ = h.send(eventchannel.Command[json.RawMessage]{
+				HostAction: eventchannel.ActionAck,
+				Seq:        h.acked.Load(),
+			})
+		}
+	}
+}
+
+func (h *hostSender) stopSending() {
+	close(h.stop)
+}
+
+func (h *hostSender) wait() error {
+	h.wg.Wait()
+	return h.err
+}
@@ -7,11 +7,14 @@ package qevent
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/hugelgupf/vmtest/internal/eventchannel"
@@ -43,6 +46,55 @@ func (c ptmClosedErrorConverter) Read(p []byte) (int, error) {
 // event is not received.
 var ErrEventChannelMissingDoneEvent = errors.New("never received the final event channel event (did you call Close() on the guest event channel emitter?)")
 
+// ErrEventsDropped is returned when the guest dropped events because the host
+// did not process them fast enough (see guest.WithDropWhenFull).
+var ErrEventsDropped = errors.New("guest dropped events")
+
+// ErrSchemaMismatch is returned when the guest emits events of another type or
+// event channel protocol version than the host expects, e.g. because host and
+// guest were built with different vmtest versions.
+var ErrSchemaMismatch = errors.New("event schema mismatch")
+
+// ErrVsockUnsupported is returned by WithVsock event channels on hosts without
+// vsock support.
+var ErrVsockUnsupported = errors.New("vsock event channels are only supported on Linux hosts")
+
+// Option configures an event channel.
+type Option func(*channelOptions)
+
+type channelOptions struct {
+	vsock    bool
+	gob      bool
+	commands func(ctx context.Context, h *hostSender) error
+	metrics  *Metrics
+	summary  func(format string, args ...any)
+}
+
+// WithVsock connects the event channel over vsock instead of virtio-serial,
+// e.g. for guests without virtio-serial or when many channels are needed.
+//
+// The VM gets a vhost-vsock device, so the host needs access to
+// /dev/vhost-vsock. guest.SerialEventChannel with the same name connects over
+// vsock as well.
+func WithVsock() Option {
+	return func(o *channelOptions) {
+		o.vsock = true
+	}
+}
+
+// WithGob requests the guest to encode events with encoding/gob rather than
+// as one JSON object per line, which is more compact and faster to decode for
+// high-volume events. guest.SerialEventChannel honors the request; T must be
+// encodable with gob.
+//
+// Host readers detect the encoding, so guests may also use gob without it (see
+// guest.WithGobEncoding).
+func WithGob() Option {
+	return func(o *channelOptions) {
+		o.gob = true
+	}
+}
+
 // EventChannel adds a virtio-serial-backed channel between host and guest to
 // send JSON events (T).
 //
@@ -56,12 +108,79 @@ var ErrEventChannelMissingDoneEvent = errors.New("never received the final event
 // event.)
 //
 // If the channel is blocking, guest event processing is blocked as well.
-func EventChannel[T any](name string, events chan<- T) qemu.Fn {
+func EventChannel[T any](name string, events chan<- T, chOpts ...Option) qemu.Fn {
+	return eventChannel(name, sink[T]{
+		send:  func(e TimedEvent[T]) { events <- e.Event },
+		close: func() { close(events) },
+	}, chOpts)
+}
+
+// sink receives the guest events of an event channel.
+type sink[T any] struct {
+	send  func(TimedEvent[T])
+	close func()
+}
+
+func eventChannel[T any](name string, events sink[T], chOpts []Option) qemu.Fn {
+	var o channelOptions
+	for _, opt := range chOpts {
+		opt(&o)
+	}
+	if o.metrics == nil {
+		o.metrics = new(Metrics)
+	}
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		events := recordEvents(name, events, opts.EventLog)
+		fn := serialChannel(name, events, o)
+		if o.vsock {
+			fn = vsockChannel(name, events, o)
+		}
+		if o.gob {
+			fn = qemu.All(
+				qemu.WithAppendKernel(eventchannel.EncodingEnvPrefix+name+"="+eventchannel.EncodingGob),
+				fn,
+			)
+		}
+		return fn(alloc, opts)
+	}
+}
+
+// recordEvents persists the events sent to events to log, if not nil.
+//
+// Errors writing the log are returned by VM.Wait.
+func recordEvents[T any](name string, events sink[T], log *qemu.EventLog) sink[T] {
+	if log == nil {
+		return events
+	}
+	return sink[T]{
+		send: func(e TimedEvent[T]) {
+			b, err := json.Marshal(e.Event)
+			if err == nil {
+				_ = log.Record(qemu.RecordedEvent{
+					Channel:   name,
+					HostTime:  e.HostTime,
+					GuestTime: e.GuestTime,
+					Event:     b,
+				})
+			}
+			events.send(e)
+		},
+		close: events.close,
+	}
+}
+
+func serialChannel[T any](name string, events sink[T], o channelOptions) qemu.Fn {
 	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
 		pipeID := alloc.ID("pipe")
 
 		ptm, pts, err := pty.Open()
-		if err != nil {
+		if errors.Is(err, pty.ErrUnsupported) {
+			return fmt.Errorf("%w: serial event channels need a pty", qemu.ErrUnsupportedHost)
+		} else if err != nil {
+			return err
+		}
+		// The host writes acknowledgements and commands to the guest.
+		if err := makeRaw(pts); err != nil {
 			return err
 		}
 		fd := opts.AddFile(pts)
@@ -71,7 +190,6 @@ func EventChannel[T any](name string, events chan<- T) qemu.Fn {
 			"-chardev", fmt.Sprintf("pipe,id=%s,path=/proc/self/fd/%d", pipeID, fd),
 		)
 
-		var gotDone bool
 		opts.Tasks = append(opts.Tasks, qemu.WaitVMStarted(func(ctx context.Context, n *qemu.Notifications) error {
 			// Close ptm if it isn't already closed due to the VM
 			// exiting.
@@ -80,40 +198,109 @@ func EventChannel[T any](name string, events chan<- T) qemu.Fn {
 			// Close write-end on parent side.
 			pts.Close()
 
-			err := eventchannel.ProcessJSONByLine[eventchannel.Event[T]](ptmClosedErrorConverter{ptm}, func(c eventchannel.Event[T]) {
-				switch c.GuestAction {
-				case eventchannel.ActionGuestEvent:
-					events <- c.Actual
-
-				case eventchannel.ActionDone:
-					close(events)
-					gotDone = true
-				}
-			})
-			if err != nil {
-				if !gotDone {
-					close(events)
-				}
-				return err
-			}
-			if !gotDone {
-				close(events)
-				return ErrEventChannelMissingDoneEvent
+			h := o.startHost(ctx, ptm)
+			err := processEvents(ptmClosedErrorConverter{ptm}, events, h.ack, o.metrics)
+			h.stopSending()
+			ptm.Close()
+			if herr := h.wait(); err == nil {
+				err = herr
 			}
-			return nil
+			o.summarize(name)
+			return err
 		}))
 		return nil
 	}
 }
 
+// processEvents sends the guest events read from r to events, and closes
+// events when the guest is done or r is. Each event is acknowledged once it
+// was sent.
+func processEvents[T any](r io.Reader, events sink[T], ack func(seq uint64), m *Metrics) error {
+	r = countingReader{r, &m.bytes}
+	var gotDone bool
+	var seq eventchannel.Sequence
+	var clock clockCorrelation
+	var schemaErr error
+	err := eventchannel.ProcessEvents[eventchannel.Event[T]](r, func(c eventchannel.Event[T]) {
+		switch c.GuestAction {
+		case eventchannel.ActionOpen:
+			if err := checkSchema(c); err != nil && schemaErr == nil {
+				schemaErr = err
+			}
+			clock.open(c.Mono, time.Now())
+
+		case eventchannel.ActionGuestEvent:
+			seq.Next(c.Seq)
+			m.events.Add(1)
+			// Events of another schema do not mean what T means.
+			if schemaErr == nil {
+				events.send(timedEvent(&clock, c, time.Now()))
+			}
+			ack(c.Seq)
+
+		case eventchannel.ActionDone:
+			seq.Next(c.Seq)
+			events.close()
+			gotDone = true
+			ack(c.Seq)
+		}
+	})
+	if !gotDone {
+		events.close()
+	}
+	m.dropped.Store(seq.Dropped())
+	if errors.Is(err, eventchannel.ErrDecode) {
+		m.decodeErrors.Add(1)
+	}
+	// Decoding errors are likely due to the schema mismatch.
+	if schemaErr != nil {
+		return schemaErr
+	}
+	if err != nil {
+		return err
+	}
+	if !gotDone {
+		return ErrEventChannelMissingDoneEvent
+	}
+	return droppedError(seq)
+}
+
+// checkSchema returns an error if the guest's open event c announces another
+// protocol version or event type than T.
+//
+// Only struct types are compared, so that hosts may decode events of any type
+// into e.g. a map or json.RawMessage.
+func checkSchema[T any](c eventchannel.Event[T]) error {
+	if c.Version != eventchannel.Version {
+		return fmt.Errorf("%w: guest uses event channel protocol version %d, host uses version %d", ErrSchemaMismatch, c.Version, eventchannel.Version)
+	}
+	want := eventchannel.TypeID[T]()
+	if c.Type != want && reflect.TypeOf((*T)(nil)).Elem().Kind() == reflect.Struct {
+		return fmt.Errorf("%w: guest emits %s events, host expects %s", ErrSchemaMismatch, c.Type, want)
+	}
+	return nil
+}
+
+// droppedError returns an error if the guest dropped events. The last
+// sequence number is that of the done event.
+func droppedError(seq eventchannel.Sequence) error {
+	if n := seq.Dropped(); n > 0 {
+		return fmt.Errorf("%w: %d of %d events", ErrEventsDropped, n, seq.Last()-1)
+	}
+	return nil
+}
+
 // EventChannelCallback adds a virtio-serial-backed channel between host and
 // guest to send JSON events (T).
 //
 // Use guest.SerialEventChannel with the same name to get access to the emitter
 // in the guest.
 //
-// When a guest event occurs, the callback is called.
-func EventChannelCallback[T any](name string, callback func(T)) qemu.Fn {
+// When a guest event occurs, the callback is called. If the callback returns
+// an error, no more events are passed to it and the VM is canceled; VM.Wait
+// returns the error. Host-side validation of events can thereby abort a
+// misbehaving guest early.
+func EventChannelCallback[T any](name string, callback func(T) error, chOpts ...Option) qemu.Fn {
 	ch := make(chan T)
 	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
 		opts.Tasks = append(opts.Tasks, func(ctx context.Context, n *qemu.Notifications) error {
@@ -126,16 +313,29 @@ func EventChannelCallback[T any](name string, callback func(T)) qemu.Fn {
 					if !ok {
 						return nil
 					}
-					callback(e)
+					if err := callback(e); err != nil {
+						// Unblock the event channel until the
+						// VM is gone.
+						go func() {
+							for range ch {
+							}
+						}()
+						return fmt.Errorf("event channel %s: %w", name, err)
+					}
 				}
 			}
 		})
-		return EventChannel[T](name, ch)(alloc, opts)
+		return EventChannel[T](name, ch, chOpts...)(alloc, opts)
 	}
 }
 
 // ReadFile reads events from a file that was written to using
 // guest.EventChannel.
+//
+// If the guest dropped events, ReadFile returns the remaining events and an
+// error wrapping ErrEventsDropped.
+//
+// Use TailFile to receive the events while the VM runs.
 func ReadFile[T any](path string) ([]T, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -145,8 +345,16 @@ func ReadFile[T any](path string) ([]T, error) {
 
 	var t []T
 	var gotDone bool
-	err = eventchannel.ProcessJSONByLine[eventchannel.Event[T]](f, func(c eventchannel.Event[T]) {
+	var seq eventchannel.Sequence
+	var schemaErr error
+	err = eventchannel.ProcessEvents[eventchannel.Event[T]](f, func(c eventchannel.Event[T]) {
+		seq.Next(c.Seq)
 		switch c.GuestAction {
+		case eventchannel.ActionOpen:
+			if err := checkSchema(c); err != nil && schemaErr == nil {
+				schemaErr = err
+			}
+
 		case eventchannel.ActionGuestEvent:
 			t = append(t, c.Actual)
 
@@ -154,11 +362,39 @@ func ReadFile[T any](path string) ([]T, error) {
 			gotDone = true
 		}
 	})
+	if schemaErr != nil {
+		return nil, schemaErr
+	}
 	if err != nil {
 		return nil, err
 	}
 	if !gotDone {
 		return nil, ErrEventChannelMissingDoneEvent
 	}
-	return t, nil
+	return t, droppedError(seq)
+}
+
+// ReplayEvents calls callback with each event of the event channel name
+// persisted to the event log file at path (see qemu.WithEventLog), e.g. to run
+// an EventChannelCallback callback again offline.
+//
+// Replay stops at the first error returned by callback, which ReplayEvents
+// returns.
+func ReplayEvents[T any](path, name string, callback func(T) error) error {
+	var replayErr error
+	err := qemu.ReplayEvents(path, func(e qemu.RecordedEvent) {
+		if e.Channel != name || replayErr != nil {
+			return
+		}
+		var t T
+		if err := json.Unmarshal(e.Event, &t); err != nil {
+			replayErr = fmt.Errorf("%w: event of channel %s: %w", eventchannel.ErrDecode, name, err)
+			return
+		}
+		replayErr = callback(t)
+	})
+	if err != nil {
+		return err
+	}
+	return replayErr
 }
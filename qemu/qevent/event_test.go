@@ -2,16 +2,21 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package qevent
+package qevent_test
 
 import (
 	"errors"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/hugelgupf/vmtest/guest"
 	"github.com/hugelgupf/vmtest/qemu"
 	"github.com/hugelgupf/vmtest/qemu/qcoverage"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
 	"github.com/hugelgupf/vmtest/qemu/quimage"
 	"github.com/hugelgupf/vmtest/tests/cmds/eventemitter/event"
 	"github.com/u-root/mkuimage/uimage"
@@ -35,7 +40,7 @@ func TestEventChannel(t *testing.T) {
 			),
 		),
 		qemu.LogSerialByLine(qemu.DefaultPrint("vm", t.Logf)),
-		EventChannel[event.Event]("test", events),
+		qevent.EventChannel[event.Event]("test", events),
 		qcoverage.ShareGOCOVERDIR(),
 	)
 	if err != nil {
@@ -82,7 +87,7 @@ func TestEventChannelErrorWithoutDoneEvent(t *testing.T) {
 			),
 		),
 		qemu.LogSerialByLine(qemu.DefaultPrint("vm", t.Logf)),
-		EventChannel[event.Event]("test", events),
+		qevent.EventChannel[event.Event]("test", events),
 		qcoverage.ShareGOCOVERDIR(),
 	)
 	if err != nil {
@@ -99,7 +104,7 @@ func TestEventChannelErrorWithoutDoneEvent(t *testing.T) {
 		wg.Done()
 	}()
 
-	want := ErrEventChannelMissingDoneEvent
+	want := qevent.ErrEventChannelMissingDoneEvent
 	if err := vm.Wait(); !errors.Is(err, want) {
 		t.Fatalf("VM.Wait =  %v, want %v", err, want)
 	}
@@ -124,8 +129,9 @@ func TestEventChannelCallback(t *testing.T) {
 			),
 		),
 		qemu.LogSerialByLine(qemu.DefaultPrint("vm", t.Logf)),
-		EventChannelCallback[event.Event]("test", func(e event.Event) {
+		qevent.EventChannelCallback[event.Event]("test", func(e event.Event) error {
 			events = append(events, e)
+			return nil
 		}),
 		qcoverage.ShareGOCOVERDIR(),
 	)
@@ -161,10 +167,271 @@ func TestEventChannelCallbackDoesNotHang(t *testing.T) {
 		qemu.WithQEMUCommand(filepath.Join(t.TempDir(), "qemu")),
 
 		// Make sure this doesn't hang if process is never started.
-		EventChannelCallback[event.Event]("test", func(e event.Event) {}),
+		qevent.EventChannelCallback[event.Event]("test", func(e event.Event) error { return nil }),
 	)
 
 	if !errors.Is(err, unix.ENOENT) {
 		t.Fatalf("Failed to start VM: %v", err)
 	}
 }
+
+func TestEventChannelCommands(t *testing.T) {
+	events := make(chan event.Event)
+	commands := make(chan event.Command)
+	vm, err := qemu.Start(
+		qemu.ArchUseEnvv,
+		quimage.WithUimageT(t,
+			uimage.WithInit("init"),
+			uimage.WithUinit("shutdownafter", "--", "vmmount", "--", "eventemitter", "-commands"),
+			uimage.WithBusyboxCommands(
+				"github.com/u-root/u-root/cmds/core/init",
+				"github.com/hugelgupf/vmtest/vminit/shutdownafter",
+				"github.com/hugelgupf/vmtest/vminit/vmmount",
+			),
+			uimage.WithCoveredCommands(
+				"github.com/hugelgupf/vmtest/tests/cmds/eventemitter",
+			),
+		),
+		qemu.LogSerialByLine(qemu.DefaultPrint("vm", t.Logf)),
+		qevent.EventChannel[event.Event]("test", events, qevent.WithCommands(commands)),
+		qcoverage.ShareGOCOVERDIR(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start VM: %v", err)
+	}
+	t.Logf("cmdline: %#v", vm.CmdlineQuoted())
+
+	// Send each command only after the previous one was echoed.
+	for i := 0; i < 10; i++ {
+		commands <- event.Command{ID: i}
+		if e, ok := <-events; !ok {
+			t.Fatalf("Event channel closed before command %d was echoed", i)
+		} else if e.ID != i {
+			t.Errorf("Echo of command %d has ID %d", i, e.ID)
+		}
+	}
+	close(commands)
+	for e := range events {
+		t.Errorf("Unexpected event %v", e)
+	}
+
+	if _, err := vm.Console.ExpectString("TEST PASSED"); err != nil {
+		t.Errorf("Error expecting TEST PASSED: %v", err)
+	}
+
+	if err := vm.Wait(); err != nil {
+		t.Fatalf("Error waiting for VM to exit: %v", err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	e, err := guest.EventChannel[event.Event](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := e.Emit(event.Event{ID: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := qevent.ReadFile[event.Event](path)
+	if err != nil {
+		t.Fatalf("ReadFile = %v", err)
+	}
+	if len(events) != 100 {
+		t.Fatalf("ReadFile got %d events, want 100", len(events))
+	}
+	for i, e := range events {
+		if e.ID != i {
+			t.Errorf("The %dth event has ID %d, want %d", i+1, e.ID, i)
+		}
+	}
+}
+
+func TestReadFileDroppedEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	// Events 2 and 4 were dropped; 5 is the done event.
+	content := `{"hugelgupf_vmtest_guest_action":"guestevent","hugelgupf_vmtest_seq":1,"Actual":{"ID":0}}
+{"hugelgupf_vmtest_guest_action":"guestevent","hugelgupf_vmtest_seq":3,"Actual":{"ID":2}}
+{"hugelgupf_vmtest_guest_action":"done","hugelgupf_vmtest_seq":5}
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := qevent.ReadFile[event.Event](path)
+	if !errors.Is(err, qevent.ErrEventsDropped) {
+		t.Errorf("ReadFile = %v, want %v", err, qevent.ErrEventsDropped)
+	}
+	if len(events) != 2 {
+		t.Errorf("ReadFile got %d events, want 2", len(events))
+	}
+}
+
+func TestReadFileGob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.gob")
+	e, err := guest.EventChannel[event.Event](path, guest.WithGobEncoding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := e.Emit(event.Event{ID: i, String: strings.Repeat("a", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := qevent.ReadFile[event.Event](path)
+	if err != nil {
+		t.Fatalf("ReadFile = %v", err)
+	}
+	if len(events) != 1000 {
+		t.Fatalf("ReadFile got %d events, want 1000", len(events))
+	}
+	for i, e := range events {
+		if e.ID != i || len(e.String) != i {
+			t.Errorf("The %dth event is %v, want ID %d", i+1, e, i)
+		}
+	}
+}
+
+func TestTimedEventChannel(t *testing.T) {
+	events := make(chan qevent.TimedEvent[event.Event])
+	start := time.Now()
+	vm, err := qemu.Start(
+		qemu.ArchUseEnvv,
+		quimage.WithUimageT(t,
+			uimage.WithInit("init"),
+			uimage.WithUinit("shutdownafter", "--", "vmmount", "--", "eventemitter"),
+			uimage.WithBusyboxCommands(
+				"github.com/u-root/u-root/cmds/core/init",
+				"github.com/hugelgupf/vmtest/vminit/shutdownafter",
+				"github.com/hugelgupf/vmtest/vminit/vmmount",
+			),
+			uimage.WithCoveredCommands(
+				"github.com/hugelgupf/vmtest/tests/cmds/eventemitter",
+			),
+		),
+		qemu.LogSerialByLine(qemu.DefaultPrint("vm", t.Logf)),
+		qevent.TimedEventChannel[event.Event]("test", events),
+		qcoverage.ShareGOCOVERDIR(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start VM: %v", err)
+	}
+
+	var last qevent.TimedEvent[event.Event]
+	for e := range events {
+		if e.GuestMonotonic < last.GuestMonotonic {
+			t.Errorf("Event %d has guest monotonic time %v before that of the previous event (%v)", e.Event.ID, e.GuestMonotonic, last.GuestMonotonic)
+		}
+		if e.HostTime.Before(start) || e.HostTime.After(time.Now()) {
+			t.Errorf("Event %d has host time %v, want between %v and now", e.Event.ID, e.HostTime, start)
+		}
+		last = e
+	}
+	if last.Event.ID != 999 {
+		t.Errorf("Last event ID = %d, want 999", last.Event.ID)
+	}
+
+	if err := vm.Wait(); err != nil {
+		t.Fatalf("Error waiting for VM to exit: %v", err)
+	}
+}
+
+func TestReadFileSchemaMismatch(t *testing.T) {
+	type otherEvent struct {
+		ID string
+	}
+
+	for _, tt := range []struct {
+		name  string
+		write func(path string) error
+	}{
+		{
+			name: "type",
+			write: func(path string) error {
+				e, err := guest.EventChannel[otherEvent](path)
+				if err != nil {
+					return err
+				}
+				if err := e.Emit(otherEvent{ID: "foo"}); err != nil {
+					return err
+				}
+				return e.Close()
+			},
+		},
+		{
+			name: "version",
+			write: func(path string) error {
+				content := `{"hugelgupf_vmtest_guest_action":"open","hugelgupf_vmtest_version":1000,"hugelgupf_vmtest_type":"github.com/hugelgupf/vmtest/tests/cmds/eventemitter/event.Event"}
+{"hugelgupf_vmtest_guest_action":"done"}
+`
+				return os.WriteFile(path, []byte(content), 0o644)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.json")
+			if err := tt.write(path); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := qevent.ReadFile[event.Event](path); !errors.Is(err, qevent.ErrSchemaMismatch) {
+				t.Errorf("ReadFile = %v, want %v", err, qevent.ErrSchemaMismatch)
+			}
+		})
+	}
+
+	// Events of any type can be decoded into a map.
+	path := filepath.Join(t.TempDir(), "events.json")
+	e, err := guest.EventChannel[otherEvent](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Emit(otherEvent{ID: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if events, err := qevent.ReadFile[map[string]any](path); err != nil || len(events) != 1 {
+		t.Errorf("ReadFile = %v, %v, want 1 event", events, err)
+	}
+}
+
+func TestReadFileLargeEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	e, err := guest.EventChannel[event.Event](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("0123456789abcdef", 1<<16)
+	for i := 0; i < 3; i++ {
+		if err := e.Emit(event.Event{ID: i, String: large[:len(large)>>i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := qevent.ReadFile[event.Event](path)
+	if err != nil {
+		t.Fatalf("ReadFile = %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("ReadFile got %d events, want 3", len(events))
+	}
+	for i, e := range events {
+		if e.ID != i || e.String != large[:len(large)>>i] {
+			t.Errorf("The %dth event has ID %d and a %d byte string, want ID %d and %d bytes", i+1, e.ID, len(e.String), i, len(large)>>i)
+		}
+	}
+}
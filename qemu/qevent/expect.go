@@ -0,0 +1,86 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// Expectation is what ExpectJSONEvent saw. Usually only one of Console and
+// Event is set; both are if they happened at about the same time.
+type Expectation[T any] struct {
+	// Console is true if the console pattern appeared.
+	Console bool
+
+	// Event is the matching event, if one was received.
+	Event *T
+}
+
+// ExpectJSONEvent waits up to timeout for whichever comes first: s appearing
+// on vm's console, or an event on events for which match returns true. A nil
+// match matches any event.
+//
+// Events that do not match are dropped. Once ExpectJSONEvent returns, it no
+// longer reads the console or events, so that subsequent calls to
+// VM.ExpectString or ExpectJSONEvent see all later output and events.
+//
+// Use it with an EventChannel, e.g. to wait for either a guest's "panic"
+// console message or its test-done event:
+//
+//	got, err := qevent.ExpectJSONEvent(vm, "Kernel panic", events, func(e Event) bool {
+//		return e.Done
+//	}, 30*time.Second)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	if got.Console {
+//		t.Fatal("kernel panicked")
+//	}
+//
+// If neither appears in time or the VM exits, the error is a
+// *qemu.ExpectError as returned by VM.ExpectString.
+func ExpectJSONEvent[T any](vm *qemu.VM, s string, events <-chan T, match func(T) bool, timeout time.Duration) (*Expectation[T], error) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var got *Expectation[T]
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for events != nil {
+			select {
+			case <-done:
+				return
+			case e, ok := <-events:
+				if !ok {
+					events = nil
+				} else if match == nil || match(e) {
+					got = &Expectation[T]{Event: &e}
+					close(stop)
+					return
+				}
+			}
+		}
+	}()
+
+	err := vm.ExpectStringUntil(s, timeout, stop)
+	close(done)
+	wg.Wait()
+	switch {
+	case errors.Is(err, qemu.ErrExpectStopped):
+		return got, nil
+	case err != nil:
+		return nil, err
+	}
+	if got == nil {
+		got = &Expectation[T]{}
+	}
+	got.Console = true
+	return got, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package qevent
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Netflix/go-expect"
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+func TestExpectJSONEvent(t *testing.T) {
+	c, err := expect.NewConsole()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	vm := &qemu.VM{Console: c, Options: &qemu.Options{}}
+
+	events := make(chan int, 3)
+	events <- 1
+	events <- 2
+	got, err := ExpectJSONEvent(vm, "panic", events, func(e int) bool { return e == 2 }, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Console || got.Event == nil || *got.Event != 2 {
+		t.Errorf("ExpectJSONEvent = %+v, want event 2", got)
+	}
+
+	_, _ = io.WriteString(c.Tty(), "Kernel panic\n")
+	got, err = ExpectJSONEvent(vm, "panic", events, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Console || got.Event != nil {
+		t.Errorf("ExpectJSONEvent = %+v, want console match", got)
+	}
+
+	close(events)
+	if _, err := ExpectJSONEvent(vm, "panic", events, nil, 100*time.Millisecond); err == nil {
+		t.Errorf("ExpectJSONEvent without output or events = nil, want timeout error")
+	}
+}
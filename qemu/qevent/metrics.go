@@ -0,0 +1,81 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Metrics counts the traffic of an event channel. Metrics may be read while
+// the VM runs; once VM.Wait returned, they are final.
+type Metrics struct {
+	events       atomic.Uint64
+	dropped      atomic.Uint64
+	decodeErrors atomic.Uint64
+	bytes        atomic.Uint64
+}
+
+// Events returns the number of guest events received.
+func (m *Metrics) Events() uint64 {
+	return m.events.Load()
+}
+
+// Dropped returns the number of events the guest dropped (see
+// ErrEventsDropped).
+func (m *Metrics) Dropped() uint64 {
+	return m.dropped.Load()
+}
+
+// DecodeErrors returns the number of guest messages that could not be
+// decoded.
+func (m *Metrics) DecodeErrors() uint64 {
+	return m.decodeErrors.Load()
+}
+
+// Bytes returns the number of bytes read from the guest.
+func (m *Metrics) Bytes() uint64 {
+	return m.bytes.Load()
+}
+
+// String summarizes the metrics.
+func (m *Metrics) String() string {
+	return fmt.Sprintf("%d events (%d dropped), %d bytes, %d decode errors", m.Events(), m.Dropped(), m.Bytes(), m.DecodeErrors())
+}
+
+// WithMetrics counts the traffic of the event channel in m.
+func WithMetrics(m *Metrics) Option {
+	return func(o *channelOptions) {
+		o.metrics = m
+	}
+}
+
+// WithSummary calls logf with a summary of the channel's metrics once the
+// guest is done with the channel, e.g. with testing.TB.Logf.
+func WithSummary(logf func(format string, args ...any)) Option {
+	return func(o *channelOptions) {
+		o.summary = logf
+	}
+}
+
+// summarize logs the metrics of channel name, if requested.
+func (o channelOptions) summarize(name string) {
+	if o.summary != nil {
+		o.summary("Event channel %s: %s", name, o.metrics)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// tailPollInterval is how often TailFile checks for new events.
+const tailPollInterval = 50 * time.Millisecond
+
+// TailFile streams the events a guest writes to the host file path using
+// guest.EventChannel while the VM runs, e.g. to a file in a shared 9P
+// directory. Unlike ReadFile, events are sent on events as they arrive, for
+// tests that react to guest progress.
+//
+// The file need not exist before the guest creates it. events is closed when
+// the guest indicates that no more events are coming or the VM exits. If the
+// guest exits without indicating that no more events are coming, the VM exit
+// will return an error.
+//
+// Of the options, only WithMetrics and WithSummary apply.
+func TailFile[T any](path string, events chan<- T, chOpts ...Option) qemu.Fn {
+	var o channelOptions
+	for _, opt := range chOpts {
+		opt(&o)
+	}
+	if o.metrics == nil {
+		o.metrics = new(Metrics)
+	}
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		s := recordEvents(path, sink[T]{
+			send:  func(e TimedEvent[T]) { events <- e.Event },
+			close: func() { close(events) },
+		}, opts.EventLog)
+		return qemu.WithTask(func(ctx context.Context, n *qemu.Notifications) error {
+			r := &tailReader{
+				ctx:    ctx,
+				path:   path,
+				exited: n.VMExited,
+			}
+			defer r.Close()
+			err := processEvents(r, s, func(uint64) {}, o.metrics)
+			o.summarize(path)
+			return err
+		})(alloc, opts)
+	}
+}
+
+// tailReader reads a file that is being appended to, until the VM exits.
+type tailReader struct {
+	ctx    context.Context
+	path   string
+	exited <-chan error
+
+	f *os.File
+	// last is set once the VM exited; the file is then read to its end
+	// one last time.
+	last bool
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		if t.f == nil {
+			f, err := os.Open(t.path)
+			if err == nil {
+				t.f = f
+				continue
+			} else if !errors.Is(err, os.ErrNotExist) || t.last {
+				return 0, err
+			}
+		} else if n, err := t.f.Read(p); n > 0 || !errors.Is(err, io.EOF) {
+			return n, err
+		} else if t.last {
+			return 0, io.EOF
+		}
+
+		select {
+		case <-t.exited:
+			t.last = true
+		case <-t.ctx.Done():
+			t.last = true
+		case <-time.After(tailPollInterval):
+		}
+	}
+}
+
+// Close closes the file, if it was opened.
+func (t *tailReader) Close() error {
+	if t.f == nil {
+		return nil
+	}
+	return t.f.Close()
+}
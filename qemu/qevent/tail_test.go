@@ -0,0 +1,175 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/guest"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+	"github.com/hugelgupf/vmtest/tests/cmds/eventemitter/event"
+)
+
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	events := make(chan event.Event)
+	var m qevent.Metrics
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, qevent.TailFile[event.Event](path, events, qevent.WithMetrics(&m), qevent.WithSummary(t.Logf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &qemu.Notifications{
+		VMStarted: make(chan struct{}),
+		VMExited:  make(chan error, 1),
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- opts.Tasks[0](context.Background(), n)
+	}()
+
+	// The "guest" waits for the host to see each event before emitting
+	// the next.
+	e, err := guest.EventChannel[event.Event](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := e.Emit(event.Event{ID: i}); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-events; got.ID != i {
+			t.Errorf("Event %d has ID %d", i, got.ID)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := <-events; ok {
+		t.Errorf("Unexpected event %v after done", got)
+	}
+
+	n.VMExited <- nil
+	close(n.VMExited)
+	if err := <-errCh; err != nil {
+		t.Errorf("TailFile task = %v", err)
+	}
+	if m.Events() != 10 || m.Dropped() != 0 || m.DecodeErrors() != 0 {
+		t.Errorf("Metrics = %v, want 10 events", &m)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if m.Bytes() != uint64(fi.Size()) {
+		t.Errorf("Metrics = %v, want %d bytes", &m, fi.Size())
+	}
+}
+
+func TestTailFileDecodeError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	if err := os.WriteFile(path, []byte("not json\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan event.Event)
+	var m qevent.Metrics
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, qevent.TailFile[event.Event](path, events, qevent.WithMetrics(&m)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &qemu.Notifications{
+		VMStarted: make(chan struct{}),
+		VMExited:  make(chan error, 1),
+	}
+	n.VMExited <- nil
+	close(n.VMExited)
+	if err := opts.Tasks[0](context.Background(), n); err == nil {
+		t.Errorf("TailFile task = nil, want decoding error")
+	}
+	if m.DecodeErrors() != 1 {
+		t.Errorf("Metrics = %v, want 1 decode error", &m)
+	}
+}
+
+func TestTailFileWithoutDoneEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	events := make(chan event.Event, 1)
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, qevent.TailFile[event.Event](path, events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &qemu.Notifications{
+		VMStarted: make(chan struct{}),
+		VMExited:  make(chan error, 1),
+	}
+
+	// The guest exits without closing the channel.
+	if err := os.WriteFile(path, []byte(`{"hugelgupf_vmtest_guest_action":"guestevent","Actual":{"ID":1}}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n.VMExited <- nil
+	close(n.VMExited)
+
+	if err := opts.Tasks[0](context.Background(), n); err != qevent.ErrEventChannelMissingDoneEvent {
+		t.Errorf("TailFile task = %v, want %v", err, qevent.ErrEventChannelMissingDoneEvent)
+	}
+	if got := <-events; got.ID != 1 {
+		t.Errorf("Event has ID %d, want 1", got.ID)
+	}
+}
+
+func TestTailFileEventLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.json")
+	e, err := guest.EventChannel[event.Event](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := e.Emit(event.Event{ID: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logPath := filepath.Join(dir, "vm.events.jsonl")
+	events := make(chan event.Event, 3)
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, qemu.WithEventLog(logPath), qevent.TailFile[event.Event](path, events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &qemu.Notifications{
+		VMStarted: make(chan struct{}),
+		VMExited:  make(chan error, 1),
+	}
+	n.VMExited <- nil
+	close(n.VMExited)
+	if err := opts.Tasks[0](context.Background(), n); err != nil {
+		t.Fatalf("TailFile task = %v", err)
+	}
+	if err := opts.EventLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int
+	if err := qevent.ReplayEvents[event.Event](logPath, path, func(e event.Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReplayEvents = %v", err)
+	}
+	if len(ids) != 3 || ids[0] != 0 || ids[2] != 2 {
+		t.Errorf("Replayed events %v, want IDs 0 to 2", ids)
+	}
+	if err := qevent.ReplayEvents[event.Event](logPath, "other", func(e event.Event) error {
+		t.Errorf("Unexpected event %v of other channel", e)
+		return nil
+	}); err != nil {
+		t.Errorf("ReplayEvents(other) = %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"os"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// makeRaw is never called on Windows, which has no ptys.
+func makeRaw(*os.File) error {
+	return qemu.ErrUnsupportedHost
+}
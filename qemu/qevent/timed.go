@@ -0,0 +1,75 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"time"
+
+	"github.com/hugelgupf/vmtest/internal/eventchannel"
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// TimedEvent is a guest event with the time it was emitted at.
+type TimedEvent[T any] struct {
+	Event T
+
+	// GuestTime is the guest's wall clock time.
+	GuestTime time.Time
+
+	// GuestMonotonic is the guest's CLOCK_MONOTONIC time, i.e. roughly the
+	// time since the guest booted, as in kernel log timestamps.
+	GuestMonotonic time.Duration
+
+	// HostTime is the host time, derived from GuestMonotonic and the time
+	// the host received the guest's first message on the channel.
+	//
+	// HostTime is later than the actual host time by the latency of that
+	// first message, usually well below a millisecond. It is the time the
+	// host received the event if the guest did not stamp events.
+	HostTime time.Time
+}
+
+// TimedEventChannel is like EventChannel, but sends guest events with their
+// guest and host-adjusted timestamps, so that they can be correlated with
+// serial output and host task logs.
+func TimedEventChannel[T any](name string, events chan<- TimedEvent[T], chOpts ...Option) qemu.Fn {
+	return eventChannel(name, sink[T]{
+		send:  func(e TimedEvent[T]) { events <- e },
+		close: func() { close(events) },
+	}, chOpts)
+}
+
+// clockCorrelation maps guest monotonic timestamps to host time.
+type clockCorrelation struct {
+	// boot is the host time at guest monotonic time 0.
+	boot time.Time
+}
+
+// open correlates the clocks with the guest's first message, stamped with
+// guest monotonic time mono and received at host time received.
+func (c *clockCorrelation) open(mono int64, received time.Time) {
+	if mono > 0 && c.boot.IsZero() {
+		c.boot = received.Add(-time.Duration(mono))
+	}
+}
+
+// timedEvent returns the timestamps of guest event e received at host time
+// received.
+func timedEvent[T any](c *clockCorrelation, e eventchannel.Event[T], received time.Time) TimedEvent[T] {
+	t := TimedEvent[T]{
+		Event:    e.Actual,
+		HostTime: received,
+	}
+	if e.Wall != 0 {
+		t.GuestTime = time.Unix(0, e.Wall)
+	}
+	if e.Mono != 0 {
+		t.GuestMonotonic = time.Duration(e.Mono)
+		if !c.boot.IsZero() {
+			t.HostTime = c.boot.Add(t.GuestMonotonic)
+		}
+	}
+	return t
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/vmtest/internal/eventchannel"
+)
+
+func TestTimedEvent(t *testing.T) {
+	host := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var c clockCorrelation
+	// Without the guest's open event, the receive time is used.
+	e := timedEvent(&c, eventchannel.Event[int]{Actual: 1}, host)
+	if !e.HostTime.Equal(host) || !e.GuestTime.IsZero() || e.GuestMonotonic != 0 {
+		t.Errorf("Unstamped event = %+v, want host time %v", e, host)
+	}
+
+	// The guest opened the channel 3s after booting.
+	c.open(int64(3*time.Second), host)
+	guestWall := time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)
+	e = timedEvent(&c, eventchannel.Event[int]{
+		Actual: 2,
+		Mono:   int64(5 * time.Second),
+		Wall:   guestWall.UnixNano(),
+	}, host.Add(time.Minute))
+	if want := host.Add(2 * time.Second); !e.HostTime.Equal(want) {
+		t.Errorf("HostTime = %v, want %v", e.HostTime, want)
+	}
+	if !e.GuestTime.Equal(guestWall) {
+		t.Errorf("GuestTime = %v, want %v", e.GuestTime, guestWall)
+	}
+	if e.GuestMonotonic != 5*time.Second || e.Event != 2 {
+		t.Errorf("Event = %+v, want event 2 at 5s", e)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/hugelgupf/vmtest/internal/eventchannel"
+	"github.com/hugelgupf/vmtest/qemu"
+	"golang.org/x/sys/unix"
+)
+
+var cidCounter atomic.Uint32
+
+// guestCID returns a vsock context ID for a new VM. CIDs must be unique on
+// the host, so they are derived from the process ID. 0-2 are reserved.
+func guestCID() uint32 {
+	return 3 + uint32(os.Getpid())<<10 + cidCounter.Add(1)%(1<<10)
+}
+
+func vsockChannel[T any](name string, events sink[T], o channelOptions) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		ln, port, err := listenVsock()
+		if err != nil {
+			return fmt.Errorf("could not listen on vsock for event channel %s: %w", name, err)
+		}
+
+		// All vsock event channels share one device.
+		if alloc.ID("vsock") == "vsock0" {
+			opts.AppendQEMU("-device", fmt.Sprintf("%s,guest-cid=%d", opts.Env().VirtioDevice("vhost-vsock"), guestCID()))
+		}
+		opts.AppendKernel(fmt.Sprintf("%s%s=%d", eventchannel.VsockPortEnvPrefix, name, port))
+
+		opts.Tasks = append(opts.Tasks, qemu.WaitVMStarted(func(ctx context.Context, n *qemu.Notifications) error {
+			// Close the listener once the VM exits, so that accept
+			// returns if the guest never connected.
+			closed := make(chan struct{})
+			defer close(closed)
+			go func() {
+				select {
+				case <-ctx.Done():
+				case <-n.VMExited:
+				case <-closed:
+				}
+				ln.Close()
+			}()
+
+			conn, err := acceptVsock(ln)
+			if err != nil {
+				events.close()
+				return ErrEventChannelMissingDoneEvent
+			}
+			defer conn.Close()
+
+			h := o.startHost(ctx, conn)
+			err = processEvents(connResetErrorConverter{conn}, events, h.ack, o.metrics)
+			h.stopSending()
+			conn.Close()
+			if herr := h.wait(); err == nil {
+				err = herr
+			}
+			o.summarize(name)
+			return err
+		}))
+		return nil
+	}
+}
+
+// connResetErrorConverter converts the connection reset of the guest exiting
+// without closing the connection to EOF.
+type connResetErrorConverter struct {
+	r io.Reader
+}
+
+func (c connResetErrorConverter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if errors.Is(err, unix.ECONNRESET) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// listenVsock listens on a free vsock port of the host.
+func listenVsock() (*os.File, uint32, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: unix.VMADDR_PORT_ANY}); err != nil {
+		unix.Close(fd)
+		return nil, 0, err
+	}
+	if err := unix.Listen(fd, 1); err != nil {
+		unix.Close(fd)
+		return nil, 0, err
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, 0, err
+	}
+	return os.NewFile(uintptr(fd), "vsock"), sa.(*unix.SockaddrVM).Port, nil
+}
+
+// acceptVsock accepts one connection on ln. It returns an error if ln is
+// closed before.
+func acceptVsock(ln *os.File) (*os.File, error) {
+	rc, err := ln.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var nfd int
+	var aerr error
+	if err := rc.Read(func(fd uintptr) bool {
+		nfd, _, aerr = unix.Accept4(int(fd), unix.SOCK_CLOEXEC)
+		return aerr != unix.EAGAIN
+	}); err != nil {
+		return nil, err
+	}
+	if aerr != nil {
+		return nil, aerr
+	}
+	return os.NewFile(uintptr(nfd), "vsock"), nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qevent_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qcoverage"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+	"github.com/hugelgupf/vmtest/qemu/quimage"
+	"github.com/hugelgupf/vmtest/tests/cmds/eventemitter/event"
+	"github.com/u-root/mkuimage/uimage"
+	"golang.org/x/sys/unix"
+)
+
+func skipWithoutVsock(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skipf("vsock is not available: %v", err)
+	}
+	unix.Close(fd)
+}
+
+func TestVsockOptions(t *testing.T) {
+	skipWithoutVsock(t)
+
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64,
+		qemu.WithKernel("foo"),
+		qevent.EventChannel[event.Event]("foo", make(chan event.Event), qevent.WithVsock()),
+		qevent.EventChannel[event.Event]("bar", make(chan event.Event), qevent.WithVsock()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var devices int
+	for _, arg := range opts.QEMUArgs {
+		if strings.HasPrefix(arg, "vhost-vsock-pci,") {
+			devices++
+		}
+	}
+	if devices != 1 {
+		t.Errorf("QEMU args %v have %d vhost-vsock-pci devices, want 1", opts.QEMUArgs, devices)
+	}
+	for _, name := range []string{"foo", "bar"} {
+		if !strings.Contains(opts.KernelArgs, "VMTEST_EVENT_VSOCK_"+name+"=") {
+			t.Errorf("Kernel args %q do not contain the port of event channel %s", opts.KernelArgs, name)
+		}
+	}
+}
+
+func TestEventChannelVsock(t *testing.T) {
+	skipWithoutVsock(t)
+	if f, err := os.OpenFile("/dev/vhost-vsock", os.O_RDWR, 0); err != nil {
+		t.Skipf("vhost-vsock is not available: %v", err)
+	} else {
+		f.Close()
+	}
+
+	events := make(chan event.Event)
+	vm, err := qemu.Start(
+		qemu.ArchUseEnvv,
+		quimage.WithUimageT(t,
+			uimage.WithInit("init"),
+			uimage.WithUinit("shutdownafter", "--", "vmmount", "--", "eventemitter"),
+			uimage.WithBusyboxCommands(
+				"github.com/u-root/u-root/cmds/core/init",
+				"github.com/hugelgupf/vmtest/vminit/shutdownafter",
+				"github.com/hugelgupf/vmtest/vminit/vmmount",
+			),
+			uimage.WithCoveredCommands(
+				"github.com/hugelgupf/vmtest/tests/cmds/eventemitter",
+			),
+		),
+		qemu.LogSerialByLine(qemu.DefaultPrint("vm", t.Logf)),
+		qevent.EventChannel[event.Event]("test", events, qevent.WithVsock()),
+		qcoverage.ShareGOCOVERDIR(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start VM: %v", err)
+	}
+	t.Logf("cmdline: %#v", vm.CmdlineQuoted())
+
+	// Expect event IDs 0 through 999, in order.
+	i := 0
+	for e := range events {
+		if e.ID != i {
+			t.Errorf("The %dth event has ID %d, want %d", i+1, e.ID, i)
+		}
+		i++
+	}
+	if i != 1000 {
+		t.Errorf("Expected last event ID to be 1000, got %d", i)
+	}
+
+	if _, err := vm.Console.ExpectString("TEST PASSED"); err != nil {
+		t.Errorf("Error expecting TEST PASSED: %v", err)
+	}
+
+	if err := vm.Wait(); err != nil {
+		t.Fatalf("Error waiting for VM to exit: %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package qevent
+
+import (
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+func vsockChannel[T any](name string, events sink[T], o channelOptions) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		return ErrVsockUnsupported
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qfirmware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/testartifacts"
+)
+
+// debugconPort is the I/O port that OVMF debug builds and SeaBIOS write debug
+// output to.
+const debugconPort = "0x402"
+
+// WithDebugLog writes the firmware's debug output, i.e. what OVMF debug builds
+// and SeaBIOS write to I/O port 0x402, to w rather than dropping it. The guest
+// console is not affected. w is closed when the VM exits.
+//
+// Only amd64 guests have the isa-debugcon device.
+func WithDebugLog(w io.WriteCloser) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		if opts.Arch() != qemu.ArchAMD64 {
+			return fmt.Errorf("%w: firmware debug log needs amd64, not %s", qemu.ErrUnsupportedArch, opts.Arch())
+		}
+		id := alloc.ID("debugcon")
+
+		r, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		fd := opts.AddFile(pw)
+		opts.AppendQEMU(
+			"-chardev", fmt.Sprintf("file,id=%s,path=/proc/self/fd/%d", id, fd),
+			"-device", fmt.Sprintf("isa-debugcon,iobase=%s,chardev=%s", debugconPort, id),
+		)
+		opts.Tasks = append(opts.Tasks, qemu.WaitVMStarted(func(ctx context.Context, n *qemu.Notifications) error {
+			defer r.Close()
+			defer w.Close()
+
+			// Close write-end on parent side, so reading ends when
+			// QEMU exits.
+			pw.Close()
+
+			if _, err := io.Copy(w, r); err != nil {
+				return fmt.Errorf("could not write firmware debug log: %w", err)
+			}
+			return nil
+		}))
+		return nil
+	}
+}
+
+// WithDebugLogFile writes the firmware's debug output to the file at path.
+// See WithDebugLog.
+func WithDebugLogFile(path string) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := WithDebugLog(f)(alloc, opts); err != nil {
+			f.Close()
+			return err
+		}
+		return nil
+	}
+}
+
+// WithDebugLogT writes the firmware's debug output to {vmName}.firmware.log in
+// the test's artifacts directory (see package testartifacts), so that it is
+// kept when the test fails. See WithDebugLog.
+func WithDebugLogT(t testing.TB) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		name := opts.Name
+		if name == "" {
+			name = "vm"
+		}
+		return WithDebugLogFile(testartifacts.Path(t, name+".firmware.log"))(alloc, opts)
+	}
+}
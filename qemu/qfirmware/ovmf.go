@@ -0,0 +1,135 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qfirmware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hugelgupf/vmtest/internal/imagecache"
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// OVMFImage is the container image with OVMF_CODE.fd and OVMF_VARS.fd that
+// runvmtest sets VMTEST_OVMF_CODE and VMTEST_OVMF_VARS from.
+const OVMFImage = "ghcr.io/hugelgupf/vmtest/ovmf:main"
+
+// Paths of the OVMF files in OVMFImage.
+const (
+	ovmfImageCode = "/OVMF_CODE.fd"
+	ovmfImageVars = "/OVMF_VARS.fd"
+)
+
+// ovmfPaths are the code and vars files installed by common distro OVMF
+// packages, by guest architecture, in order of preference.
+var ovmfPaths = map[qemu.Arch][][2]string{
+	qemu.ArchAMD64: {
+		// Debian, Ubuntu.
+		{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		// Fedora, RHEL.
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+		// Arch Linux.
+		{"/usr/share/edk2/x64/OVMF_CODE.4m.fd", "/usr/share/edk2/x64/OVMF_VARS.4m.fd"},
+		{"/usr/share/edk2-ovmf/x64/OVMF_CODE.fd", "/usr/share/edk2-ovmf/x64/OVMF_VARS.fd"},
+		// openSUSE.
+		{"/usr/share/qemu/ovmf-x86_64-code.bin", "/usr/share/qemu/ovmf-x86_64-vars.bin"},
+		// Nix.
+		{"/run/libvirt/nix-ovmf/OVMF_CODE.fd", "/run/libvirt/nix-ovmf/OVMF_VARS.fd"},
+	},
+	qemu.ArchArm64: {
+		// Debian, Ubuntu.
+		{"/usr/share/AAVMF/AAVMF_CODE.fd", "/usr/share/AAVMF/AAVMF_VARS.fd"},
+		// Fedora, RHEL.
+		{"/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+		// Arch Linux.
+		{"/usr/share/edk2/aarch64/QEMU_CODE.fd", "/usr/share/edk2/aarch64/QEMU_VARS.fd"},
+	},
+}
+
+// FindOVMF returns the OVMF code and vars files for guests of arch: those in
+// VMTEST_OVMF_CODE and VMTEST_OVMF_VARS if set, or else the first ones
+// installed in a common distro location.
+//
+// If none are found, the error wraps ErrNoOVMF and lists the locations
+// searched.
+func FindOVMF(arch qemu.Arch) (string, string, error) {
+	code, vars := os.Getenv("VMTEST_OVMF_CODE"), os.Getenv("VMTEST_OVMF_VARS")
+	if code != "" && vars != "" {
+		return code, vars, nil
+	}
+	var searched []string
+	for _, p := range ovmfPaths[arch] {
+		if isFile(p[0]) && isFile(p[1]) {
+			return p[0], p[1], nil
+		}
+		searched = append(searched, p[0])
+	}
+	if len(searched) == 0 {
+		return "", "", fmt.Errorf("%w; no known OVMF locations for %s", ErrNoOVMF, arch)
+	}
+	return "", "", fmt.Errorf("%w; none found in %s", ErrNoOVMF, strings.Join(searched, ", "))
+}
+
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// OVMFOption configures WithDefaultOVMF and WithOVMF.
+type OVMFOption func(*ovmfOptions)
+
+type ovmfOptions struct {
+	download string
+	varsFile string
+}
+
+// WithVarsFile makes the VM use the writable vars file at path as its UEFI
+// variable store (NVRAM) instead of a throw-away copy of the OVMF vars. If
+// path does not exist, it is created from the OVMF vars.
+//
+// Pass the same path to several VMs started one after the other to test UEFI
+// variable persistence, e.g. boot entries or SetVariable across reboots. VMs
+// running at the same time must not share a vars file.
+func WithVarsFile(path string) OVMFOption {
+	return func(o *ovmfOptions) {
+		o.varsFile = path
+	}
+}
+
+// WithDownloadFallback downloads OVMF from OVMFImage with the docker or podman
+// CLI (backend) if FindOVMF finds none. Only amd64 guests are supported.
+//
+// Downloads are kept in runvmtest's artifact cache, which this shares with
+// runvmtest: OVMF that runvmtest downloaded before is used without backend,
+// and runvmtest uses OVMF downloaded here.
+func WithDownloadFallback(backend string) OVMFOption {
+	return func(o *ovmfOptions) {
+		o.download = backend
+	}
+}
+
+// ErrOVMFDownloadUnsupported is returned when OVMF cannot be downloaded for
+// the guest architecture.
+var ErrOVMFDownloadUnsupported = errors.New("OVMF can only be downloaded for amd64 guests")
+
+// DownloadOVMF returns OVMF_CODE.fd and OVMF_VARS.fd of OVMFImage from
+// runvmtest's artifact cache, exporting them with the docker or podman CLI
+// (backend) first if they are not cached yet.
+//
+// If backend is empty, only cached files are returned.
+func DownloadOVMF(ctx context.Context, backend string) (string, string, error) {
+	dir, err := imagecache.Files(ctx, backend, OVMFImage, ovmfImageCode, ovmfImageVars)
+	if errors.Is(err, imagecache.ErrNotCached) {
+		return "", "", fmt.Errorf("%w; %w", ErrNoOVMF, err)
+	} else if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, ovmfImageCode), filepath.Join(dir, ovmfImageVars), nil
+}
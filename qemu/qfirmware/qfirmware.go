@@ -7,29 +7,78 @@
 package qfirmware
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/hugelgupf/vmtest/qemu"
 )
 
-// WithDefaultOVMF sets the QEMU arguments for enabling UEFI with OVMF firmware.
+// ErrNoOVMF is returned when the OVMF firmware paths are neither given, nor
+// set in the environment, nor found on the host.
+var ErrNoOVMF = errors.New("OVMF code and vars files must be given, set in VMTEST_OVMF_CODE and VMTEST_OVMF_VARS, or installed")
+
+// ErrFirmwareMachine is returned when the machine type does not support UEFI
+// firmware in pflash.
+var ErrFirmwareMachine = errors.New("arm64 UEFI firmware needs the virt machine type")
+
+// armPflashSize is the size of each of the two pflash devices of the arm64
+// virt machine. QEMU only accepts images of exactly this size.
+const armPflashSize = 64 << 20
+
+// WithDefaultOVMF sets the QEMU arguments for enabling UEFI with OVMF firmware
+// found by FindOVMF, or downloaded if configured with WithDownloadFallback.
+// arm64 guests get AAVMF; see WithOVMF.
 //
 // OVMF requires the VM to be run with atleast 1 GB of memory and an machine type with smm turned on.
 //
 //	qemu.ArbitraryArgs("-m", "2G", "-machine", "type=q35,smm=on")
-func WithDefaultOVMF() qemu.Fn {
-	return WithOVMF("", "")
+func WithDefaultOVMF(ovmfOpts ...OVMFOption) qemu.Fn {
+	var o ovmfOptions
+	for _, opt := range ovmfOpts {
+		opt(&o)
+	}
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		code, vars, err := FindOVMF(opts.Arch())
+		if err != nil && o.download != "" {
+			if opts.Arch() != qemu.ArchAMD64 {
+				return fmt.Errorf("%w, not %s", ErrOVMFDownloadUnsupported, opts.Arch())
+			}
+			code, vars, err = DownloadOVMF(context.Background(), o.download)
+		}
+		if err != nil {
+			return err
+		}
+		return WithOVMF(code, vars, ovmfOpts...)(alloc, opts)
+	}
 }
 
 // WithOVMF sets the QEMU arguments for enabling UEFI with OVMF firmware.
 //
 // ovmfCode and ovmfVars are substituted by VMTEST_OVMF_CODE and VMTEST_OVMF_VARS if empty.
+// runvmtest sets both for amd64. If both are empty and not set either, OVMF is
+// searched for as in WithDefaultOVMF.
+//
+// The VM uses a copy of ovmfVars, as the guest writes to it and ovmfVars may
+// be shared between VMs. The copy is removed when the VM exits; use
+// WithVarsFile to keep UEFI variables across VMs.
 //
 // OVMF requires the VM to be run with atleast 1 GB of memory and an machine type with msm turned on.
 //
 //	qemu.ArbitraryArgs("-m", "2G", "-machine", "type=q35,smm=on")
-func WithOVMF(ovmfCode, ovmfVars string) qemu.Fn {
+//
+// For arm64 guests, ovmfCode and ovmfVars are the AAVMF (ARM64 EDK2) code and
+// vars files, e.g. AAVMF_CODE.fd and AAVMF_VARS.fd. The machine type must be
+// virt. Images smaller than the virt machine's 64 MiB pflash devices, such as
+// QEMU_EFI.fd, are padded.
+func WithOVMF(ovmfCode, ovmfVars string, ovmfOpts ...OVMFOption) qemu.Fn {
+	var o ovmfOptions
+	for _, opt := range ovmfOpts {
+		opt(&o)
+	}
 	if ovmfCode == "" {
 		ovmfCode = os.Getenv("VMTEST_OVMF_CODE")
 	}
@@ -37,10 +86,114 @@ func WithOVMF(ovmfCode, ovmfVars string) qemu.Fn {
 		ovmfVars = os.Getenv("VMTEST_OVMF_VARS")
 	}
 	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		if ovmfCode == "" && ovmfVars == "" {
+			return WithDefaultOVMF(ovmfOpts...)(alloc, opts)
+		}
+		if ovmfCode == "" || ovmfVars == "" {
+			return ErrNoOVMF
+		}
+		if !isFile(ovmfCode) {
+			return fmt.Errorf("%w; OVMF code file %s does not exist", ErrNoOVMF, ovmfCode)
+		}
+		var size int64
+		if opts.Arch() == qemu.ArchArm64 {
+			if m := opts.MachineType(); m != "virt" && !strings.HasPrefix(m, "virt-") {
+				return fmt.Errorf("%w, not %q", ErrFirmwareMachine, m)
+			}
+			size = armPflashSize
+		}
+
+		code := ovmfCode
+		if size > 0 {
+			padded, err := needsPadding(ovmfCode, size)
+			if err != nil {
+				return err
+			}
+			if padded {
+				if code, err = copyToTemp(ovmfCode, size); err != nil {
+					return fmt.Errorf("could not pad firmware code: %w", err)
+				}
+				opts.Tasks = append(opts.Tasks, qemu.Cleanup(func() error {
+					return os.Remove(code)
+				}))
+			}
+		}
+		vars := o.varsFile
+		if vars == "" {
+			var err error
+			if vars, err = copyToTemp(ovmfVars, size); err != nil {
+				return fmt.Errorf("could not copy OVMF vars: %w", err)
+			}
+			opts.Tasks = append(opts.Tasks, qemu.Cleanup(func() error {
+				return os.Remove(vars)
+			}))
+		} else if err := initVarsFile(ovmfVars, vars, size); err != nil {
+			return fmt.Errorf("could not create vars file: %w", err)
+		}
 		opts.AppendQEMU(
-			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,file=%s,readonly=on", ovmfCode),
-			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", ovmfVars),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,file=%s,readonly=on", code),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", vars),
 		)
 		return nil
 	}
 }
+
+// initVarsFile creates the vars file path from the OVMF vars unless it
+// exists.
+func initVarsFile(ovmfVars, path string, size int64) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	tmp, err := copyToTemp(ovmfVars, size)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	b, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// needsPadding returns whether the firmware image at path is smaller than the
+// pflash device size.
+func needsPadding(path string, size int64) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() > size {
+		return false, fmt.Errorf("firmware image %s is larger than the %d MiB pflash device", path, size>>20)
+	}
+	return fi.Size() < size, nil
+}
+
+// copyToTemp copies the file at path to a temporary file, padded with zeros
+// to size if it is smaller.
+func copyToTemp(path string, size int64) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp("", "vmtest-firmware-*.fd")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(dst, src)
+	if err == nil && n < size {
+		err = dst.Truncate(size)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
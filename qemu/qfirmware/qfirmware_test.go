@@ -0,0 +1,233 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qfirmware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/internal/imagecache"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/testartifacts"
+)
+
+func TestWithOVMF(t *testing.T) {
+	dir := t.TempDir()
+	code := filepath.Join(dir, "OVMF_CODE.fd")
+	vars := filepath.Join(dir, "OVMF_VARS.fd")
+	if err := os.WriteFile(code, []byte("code"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vars, []byte("vars"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, WithOVMF(code, vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(opts.QEMUArgs, " ")
+	if want := "if=pflash,format=raw,unit=0,file=" + code + ",readonly=on"; !strings.Contains(args, want) {
+		t.Errorf("QEMU args = %s, want %s", args, want)
+	}
+	if strings.Contains(args, "file="+vars) {
+		t.Errorf("QEMU args = %s, want copy of %s", args, vars)
+	}
+	_, copied, ok := strings.Cut(args, "unit=1,file=")
+	if !ok {
+		t.Fatalf("QEMU args = %s, want vars drive", args)
+	}
+	if b, err := os.ReadFile(copied); err != nil || string(b) != "vars" {
+		t.Errorf("copy of vars = (%q, %v), want vars", b, err)
+	}
+	os.Remove(copied)
+}
+
+// setOVMFPaths makes FindOVMF search paths instead of the host's distro
+// locations.
+func TestWithVarsFile(t *testing.T) {
+	dir := t.TempDir()
+	code := filepath.Join(dir, "OVMF_CODE.fd")
+	vars := filepath.Join(dir, "OVMF_VARS.fd")
+	if err := os.WriteFile(code, []byte("code"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vars, []byte("vars"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	nvram := filepath.Join(dir, "nvram.fd")
+
+	for i, want := range []string{"vars", "changed"} {
+		opts, err := qemu.OptionsFor(qemu.ArchAMD64, WithOVMF(code, vars, WithVarsFile(nvram)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := strings.Join(opts.QEMUArgs, " "); !strings.Contains(args, "unit=1,file="+nvram) {
+			t.Errorf("VM %d: QEMU args = %s, want vars drive %s", i, args, nvram)
+		}
+		if b, err := os.ReadFile(nvram); err != nil || string(b) != want {
+			t.Errorf("VM %d: vars file = (%q, %v), want %s", i, b, err, want)
+		}
+		// What the guest wrote to the vars must be seen by the next VM.
+		if err := os.WriteFile(nvram, []byte("changed"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func setOVMFPaths(t *testing.T, paths map[qemu.Arch][][2]string) {
+	old := ovmfPaths
+	ovmfPaths = paths
+	t.Cleanup(func() { ovmfPaths = old })
+	t.Setenv("VMTEST_OVMF_CODE", "")
+	t.Setenv("VMTEST_OVMF_VARS", "")
+}
+
+func TestWithOVMFMissing(t *testing.T) {
+	setOVMFPaths(t, map[qemu.Arch][][2]string{qemu.ArchAMD64: {{"/nonexistent/OVMF_CODE.fd", "/nonexistent/OVMF_VARS.fd"}}})
+	_, err := qemu.OptionsFor(qemu.ArchAMD64, WithDefaultOVMF())
+	if !errors.Is(err, ErrNoOVMF) {
+		t.Errorf("WithDefaultOVMF = %v, want %v", err, ErrNoOVMF)
+	} else if !strings.Contains(err.Error(), "/nonexistent/OVMF_CODE.fd") {
+		t.Errorf("WithDefaultOVMF = %v, want searched locations", err)
+	}
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, WithOVMF("", "")); !errors.Is(err, ErrNoOVMF) {
+		t.Errorf("WithOVMF = %v, want %v", err, ErrNoOVMF)
+	}
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, WithOVMF("/nonexistent/OVMF_CODE.fd", "/nonexistent/OVMF_VARS.fd")); !errors.Is(err, ErrNoOVMF) {
+		t.Errorf("WithOVMF(nonexistent) = %v, want %v", err, ErrNoOVMF)
+	}
+	if _, err := qemu.OptionsFor(qemu.ArchArm, WithDefaultOVMF(WithDownloadFallback("docker"))); !errors.Is(err, ErrOVMFDownloadUnsupported) {
+		t.Errorf("WithDefaultOVMF(arm) = %v, want %v", err, ErrOVMFDownloadUnsupported)
+	}
+}
+
+func TestFindOVMF(t *testing.T) {
+	dir := t.TempDir()
+	code := filepath.Join(dir, "OVMF_CODE.fd")
+	vars := filepath.Join(dir, "OVMF_VARS.fd")
+	for _, path := range []string{code, vars} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setOVMFPaths(t, map[qemu.Arch][][2]string{qemu.ArchAMD64: {
+		{filepath.Join(dir, "OVMF_CODE_4M.fd"), filepath.Join(dir, "OVMF_VARS_4M.fd")},
+		{code, vars},
+	}})
+
+	if c, v, err := FindOVMF(qemu.ArchAMD64); err != nil || c != code || v != vars {
+		t.Errorf("FindOVMF = (%s, %s, %v), want (%s, %s, nil)", c, v, err, code, vars)
+	}
+	if _, _, err := FindOVMF(qemu.ArchArm64); !errors.Is(err, ErrNoOVMF) {
+		t.Errorf("FindOVMF(arm64) = %v, want %v", err, ErrNoOVMF)
+	}
+
+	t.Setenv("VMTEST_OVMF_CODE", "/env/code")
+	t.Setenv("VMTEST_OVMF_VARS", "/env/vars")
+	if c, v, err := FindOVMF(qemu.ArchAMD64); err != nil || c != "/env/code" || v != "/env/vars" {
+		t.Errorf("FindOVMF = (%s, %s, %v), want env vars", c, v, err)
+	}
+}
+
+func TestDownloadOVMFCached(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	cache, err := imagecache.Dir()
+	if err != nil || !strings.HasPrefix(cache, os.Getenv("XDG_CACHE_HOME")) {
+		t.Skipf("User cache directory %s is not in XDG_CACHE_HOME", cache)
+	}
+	if _, _, err := DownloadOVMF(context.Background(), ""); !errors.Is(err, ErrNoOVMF) {
+		t.Errorf("DownloadOVMF without cache = %v, want %v", err, ErrNoOVMF)
+	}
+
+	// As runvmtest caches OVMFImage.
+	dir := filepath.Join(cache, imagecache.Key("sha256:1234"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{ovmfImageCode, ovmfImageVars} {
+		if err := os.WriteFile(filepath.Join(dir, path), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := imagecache.RecordRef(cache, OVMFImage, "sha256:1234"); err != nil {
+		t.Fatal(err)
+	}
+	code, vars, err := DownloadOVMF(context.Background(), "")
+	if err != nil || code != filepath.Join(dir, "OVMF_CODE.fd") || vars != filepath.Join(dir, "OVMF_VARS.fd") {
+		t.Errorf("DownloadOVMF = (%s, %s, %v), want cached files in %s", code, vars, err, dir)
+	}
+}
+
+func TestWithOVMFArm64(t *testing.T) {
+	dir := t.TempDir()
+	code := filepath.Join(dir, "QEMU_EFI.fd")
+	vars := filepath.Join(dir, "QEMU_VARS.fd")
+	for _, path := range []string{code, vars} {
+		if err := os.WriteFile(path, []byte("firmware"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := qemu.OptionsFor(qemu.ArchArm64, qemu.WithQEMUCommand("qemu-system-aarch64 -M raspi3b"), WithOVMF(code, vars)); !errors.Is(err, ErrFirmwareMachine) {
+		t.Errorf("WithOVMF(raspi3b) = %v, want %v", err, ErrFirmwareMachine)
+	}
+
+	opts, err := qemu.OptionsFor(qemu.ArchArm64, qemu.WithQEMUCommand("qemu-system-aarch64 -machine virt -cpu max"), WithOVMF(code, vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(opts.QEMUArgs, " ")
+	for _, unit := range []string{"unit=0,file=", "unit=1,file="} {
+		_, rest, ok := strings.Cut(args, unit)
+		if !ok {
+			t.Fatalf("QEMU args = %s, want %s", args, unit)
+		}
+		path, _, _ := strings.Cut(rest, ",")
+		path, _, _ = strings.Cut(path, " ")
+		if path == code || path == vars {
+			t.Errorf("QEMU args = %s, want padded copy of %s", args, path)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Size() != armPflashSize {
+			t.Errorf("Padded firmware %s = (%v, %v), want %d bytes", path, fi, err, armPflashSize)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestWithDebugLogT(t *testing.T) {
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, WithDebugLogT(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(opts.QEMUArgs, " ")
+	if want := "-device isa-debugcon,iobase=0x402,chardev=debugcon0"; !strings.Contains(args, want) {
+		t.Errorf("QEMU args = %s, want %s", args, want)
+	}
+	if len(opts.ExtraFiles) != 1 {
+		t.Fatalf("ExtraFiles = %v, want debugcon pipe", opts.ExtraFiles)
+	}
+
+	// Play QEMU.
+	if _, err := opts.ExtraFiles[0].WriteString("BdsDxe: loading Boot0001\n"); err != nil {
+		t.Fatal(err)
+	}
+	n := &qemu.Notifications{VMStarted: make(chan struct{}), VMExited: make(chan error, 1)}
+	close(n.VMStarted)
+	if err := opts.Tasks[0](context.Background(), n); err != nil {
+		t.Fatalf("Debug log task = %v", err)
+	}
+	if b, err := os.ReadFile(testartifacts.Path(t, "vm.firmware.log")); err != nil || string(b) != "BdsDxe: loading Boot0001\n" {
+		t.Errorf("Firmware log = (%q, %v), want debug output", b, err)
+	}
+
+	if _, err := qemu.OptionsFor(qemu.ArchArm64, WithDebugLog(nil)); !errors.Is(err, qemu.ErrUnsupportedArch) {
+		t.Errorf("WithDebugLog(arm64) = %v, want %v", err, qemu.ErrUnsupportedArch)
+	}
+}
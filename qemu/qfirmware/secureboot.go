@@ -0,0 +1,199 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qfirmware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// ErrSecureBootTool is returned when a tool needed for Secure Boot testing is
+// not installed.
+var ErrSecureBootTool = errors.New("Secure Boot tool not found")
+
+// TestKeyOwner is the owner GUID of the keys enrolled by EnrollKeys.
+const TestKeyOwner = "39a1460c-8b3e-4c7f-9b5e-0d8c4b1a7e21"
+
+// SecureBootKey is a key pair in PEM files.
+type SecureBootKey struct {
+	// Cert is the path of the PEM-encoded self-signed certificate.
+	Cert string
+
+	// Key is the path of the PEM-encoded private key.
+	Key string
+}
+
+// SecureBootKeys are the keys of a Secure Boot key hierarchy: the platform
+// key, key exchange key, and signature database key. Binaries signed with DB
+// are allowed to boot once the keys are enrolled.
+type SecureBootKeys struct {
+	PK  SecureBootKey
+	KEK SecureBootKey
+	DB  SecureBootKey
+}
+
+// GenerateSecureBootKeys generates test keys in dir, named {pk,kek,db}.crt and
+// {pk,kek,db}.key.
+//
+// The keys are throw-away RSA 2048 keys, as accepted by OVMF.
+func GenerateSecureBootKeys(dir string) (*SecureBootKeys, error) {
+	var keys SecureBootKeys
+	for _, k := range []struct {
+		name string
+		key  *SecureBootKey
+	}{
+		{"pk", &keys.PK},
+		{"kek", &keys.KEK},
+		{"db", &keys.DB},
+	} {
+		var err error
+		if *k.key, err = generateKey(dir, k.name); err != nil {
+			return nil, fmt.Errorf("could not generate %s key: %w", k.name, err)
+		}
+	}
+	return &keys, nil
+}
+
+func generateKey(dir, name string) (SecureBootKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return SecureBootKey{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return SecureBootKey{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "vmtest Secure Boot test " + strings.ToUpper(name)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return SecureBootKey{}, err
+	}
+
+	k := SecureBootKey{
+		Cert: filepath.Join(dir, name+".crt"),
+		Key:  filepath.Join(dir, name+".key"),
+	}
+	if err := os.WriteFile(k.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return SecureBootKey{}, err
+	}
+	if err := os.WriteFile(k.Key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600); err != nil {
+		return SecureBootKey{}, err
+	}
+	return k, nil
+}
+
+// tool returns the path of the tool name, or the one set in env.
+func tool(name, env string) (string, error) {
+	if p := os.Getenv(env); p != "" {
+		return p, nil
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s (install it or set %s): %w", ErrSecureBootTool, name, env, err)
+	}
+	return p, nil
+}
+
+func runTool(ctx context.Context, name, env string, args ...string) error {
+	p, err := tool(name, env)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, p, args...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// EnrollKeys writes a copy of the OVMF vars file vars to out with keys
+// enrolled and Secure Boot enabled, using virt-fw-vars from virt-firmware
+// (or VMTEST_VIRT_FW_VARS).
+func EnrollKeys(ctx context.Context, vars, out string, keys *SecureBootKeys) error {
+	return runTool(ctx, "virt-fw-vars", "VMTEST_VIRT_FW_VARS",
+		"--input", vars,
+		"--output", out,
+		"--set-pk", TestKeyOwner, keys.PK.Cert,
+		"--add-kek", TestKeyOwner, keys.KEK.Cert,
+		"--add-db", TestKeyOwner, keys.DB.Cert,
+		"--secure-boot",
+	)
+}
+
+// SignEFI signs the EFI binary in, e.g. a kernel with EFI stub or a boot
+// loader, with key and writes it to out, using sbsign from sbsigntools (or
+// VMTEST_SBSIGN).
+//
+// Sign with keys.DB to make the binary bootable with keys enrolled.
+func SignEFI(ctx context.Context, key SecureBootKey, in, out string) error {
+	return runTool(ctx, "sbsign", "VMTEST_SBSIGN",
+		"--key", key.Key,
+		"--cert", key.Cert,
+		"--output", out,
+		in,
+	)
+}
+
+// WithSecureBoot boots the VM with UEFI Secure Boot enforced: keys are
+// enrolled into a copy of ovmfVars (see EnrollKeys), and only binaries signed
+// with keys.DB (see SignEFI) are allowed to boot.
+//
+// ovmfCode and ovmfVars are found as in WithOVMF if empty. ovmfCode must be a
+// Secure Boot build of OVMF that requires SMM, e.g. OVMF_CODE.secboot.fd.
+// The machine type must have SMM turned on:
+//
+//	qemu.ArbitraryArgs("-m", "2G", "-machine", "type=q35,smm=on")
+func WithSecureBoot(ovmfCode, ovmfVars string, keys *SecureBootKeys) qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		code, vars := ovmfCode, ovmfVars
+		if code == "" && vars == "" {
+			var err error
+			if code, vars, err = FindOVMF(opts.Arch()); err != nil {
+				return err
+			}
+		}
+		dir, err := os.MkdirTemp("", "vmtest-ovmf-secboot-")
+		if err != nil {
+			return err
+		}
+		enrolled := filepath.Join(dir, "OVMF_VARS.fd")
+		if err := EnrollKeys(context.Background(), vars, enrolled, keys); err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("could not enroll Secure Boot keys: %w", err)
+		}
+		opts.Tasks = append(opts.Tasks, qemu.Cleanup(func() error {
+			return os.RemoveAll(dir)
+		}))
+		// WithOVMF copies the enrolled vars again; the VM may change
+		// them.
+		opts.AppendQEMU("-global", "driver=cfi.pflash01,property=secure,value=on")
+		return WithOVMF(code, enrolled)(alloc, opts)
+	}
+}
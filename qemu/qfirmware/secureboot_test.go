@@ -0,0 +1,88 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qfirmware
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+func TestGenerateSecureBootKeys(t *testing.T) {
+	keys, err := GenerateSecureBootKeys(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []SecureBootKey{keys.PK, keys.KEK, keys.DB} {
+		if _, err := tls.LoadX509KeyPair(k.Cert, k.Key); err != nil {
+			t.Errorf("Key %s is not a valid key pair: %v", k.Cert, err)
+		}
+	}
+}
+
+// fakeVirtFWVars copies --input to --output.
+const fakeVirtFWVars = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	--input) in="$2"; shift;;
+	--output) out="$2"; shift;;
+	esac
+	shift
+done
+cp "$in" "$out"
+`
+
+func TestWithSecureBoot(t *testing.T) {
+	dir := t.TempDir()
+	code := filepath.Join(dir, "OVMF_CODE.secboot.fd")
+	vars := filepath.Join(dir, "OVMF_VARS.fd")
+	tool := filepath.Join(dir, "virt-fw-vars")
+	for path, content := range map[string]string{code: "code", vars: "vars", tool: fakeVirtFWVars} {
+		if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("VMTEST_VIRT_FW_VARS", tool)
+
+	keys, err := GenerateSecureBootKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, WithSecureBoot(code, vars, keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(opts.QEMUArgs, " ")
+	for _, want := range []string{
+		"-global driver=cfi.pflash01,property=secure,value=on",
+		"if=pflash,format=raw,unit=0,file=" + code + ",readonly=on",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("QEMU args = %s, want %s", args, want)
+		}
+	}
+	for _, task := range opts.Tasks {
+		n := &qemu.Notifications{VMStarted: make(chan struct{}), VMExited: make(chan error, 1)}
+		n.VMExited <- nil
+		close(n.VMExited)
+		if err := task(context.Background(), n); err != nil {
+			t.Errorf("Cleanup = %v", err)
+		}
+	}
+}
+
+func TestSecureBootToolMissing(t *testing.T) {
+	t.Setenv("VMTEST_SBSIGN", "")
+	t.Setenv("PATH", t.TempDir())
+	if err := SignEFI(context.Background(), SecureBootKey{}, "in.efi", "out.efi"); !errors.Is(err, ErrSecureBootTool) {
+		t.Errorf("SignEFI = %v, want %v", err, ErrSecureBootTool)
+	}
+}
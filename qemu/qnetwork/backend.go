@@ -10,6 +10,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/hugelgupf/vmtest/internal/hostres"
 	"github.com/hugelgupf/vmtest/qemu"
 )
 
@@ -116,6 +117,38 @@ func HostNetwork(cidr string, mods ...NetDevModifier[UserBackend]) qemu.Fn {
 	return New(mods...)
 }
 
+// WithHostForward forwards TCP connections to *hostPort on the host's
+// localhost to guestPort in the guest.
+//
+// If *hostPort is 0 when WithHostForward is called, a free port is picked
+// each time the VM's options are built (e.g. by qemu.Start) and stored in
+// *hostPort, so that VMs started in parallel do not collide. A modifier used
+// for several VMs picks a port for each, but *hostPort only holds the last
+// one, so use a hostPort per VM to know each VM's port.
+//
+// Otherwise, the port cannot be forwarded by two VMs of a test process at the
+// same time.
+func WithHostForward(guestPort int, hostPort *int) NetDevModifier[UserBackend] {
+	pick := *hostPort == 0
+	return func(netdevID string, alloc *qemu.IDAllocator, opts *qemu.Options, nd *NetDevice[UserBackend]) error {
+		port := *hostPort
+		var release func()
+		var err error
+		if pick {
+			port, release, err = hostres.FreePort()
+		} else {
+			release, err = hostres.ClaimPort(port)
+		}
+		if err != nil {
+			return err
+		}
+		opts.AddRelease(release)
+		*hostPort = port
+		nd.Backend.Args = append(nd.Backend.Args, fmt.Sprintf("hostfwd=tcp:127.0.0.1:%d-:%d", port, guestPort))
+		return nil
+	}
+}
+
 // SocketBackend is a Unix domain socket backend.
 type SocketBackend struct {
 	Server     bool
@@ -0,0 +1,79 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qnetwork
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+// WithTFTP serves the files in dir to the guest over TFTP from the user
+// network's host address.
+func WithTFTP(dir string) Modifier[UserBackend] {
+	return WithUserArg("tftp=" + dir)
+}
+
+// WithBootFile makes the user network's DHCP server point the guest's
+// network boot firmware at bootfile, a file served with WithTFTP or a URL for
+// iPXE.
+func WithBootFile(bootfile string) Modifier[UserBackend] {
+	return WithUserArg("bootfile=" + bootfile)
+}
+
+// IPXEScriptName is the name of the script written by WithIPXEScript.
+const IPXEScriptName = "boot.ipxe"
+
+// WithIPXEScript writes the iPXE script (without the #!ipxe line) to
+// IPXEScriptName in tftpDir and serves it as the boot file with WithTFTP.
+//
+// QEMU's built-in option ROMs for e1000 and virtio-net are iPXE, which runs
+// the script, e.g. on the 10.0.2.0/24 network, whose host address is
+// 10.0.2.2:
+//
+//	kernel tftp://10.0.2.2/bzImage console=ttyS0
+//	initrd tftp://10.0.2.2/initramfs.cpio
+//	boot
+func WithIPXEScript(tftpDir, script string) Modifier[UserBackend] {
+	return func(b *UserBackend) error {
+		s := "#!ipxe\n" + strings.TrimLeft(script, "\n")
+		if err := os.WriteFile(filepath.Join(tftpDir, IPXEScriptName), []byte(s), 0o644); err != nil {
+			return fmt.Errorf("could not write iPXE script: %w", err)
+		}
+		b.Args = append(b.Args, "tftp="+tftpDir, "bootfile="+IPXEScriptName)
+		return nil
+	}
+}
+
+// WithROMFile replaces the NIC's built-in option ROM with the one at path,
+// e.g. an iPXE ROM built with an embedded script.
+func WithROMFile(path string) DeviceModifier {
+	return func(d *Device) error {
+		d.Args = append(d.Args, "romfile="+path)
+		return nil
+	}
+}
+
+// NetBoot creates a user-backed net device with the given CIDR that the guest
+// firmware boots from first.
+//
+// Use backend modifiers such as WithTFTP and WithBootFile or WithIPXEScript to
+// serve the boot files, and WithROMFile to use a custom iPXE ROM.
+//
+// NetBoot unsets the kernel, initramfs, and kernel args (e.g. from
+// VMTEST_KERNEL), as QEMU would boot the kernel instead of the network.
+func NetBoot(cidr string, mods ...NetDevModifier[UserBackend]) qemu.Fn {
+	mods = append([]NetDevModifier[UserBackend]{
+		WithDevice[UserBackend](WithBootIndex(0)),
+	}, mods...)
+	network := HostNetwork(cidr, mods...)
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		opts.Kernel, opts.Initramfs, opts.KernelArgs = "", "", ""
+		return network(alloc, opts)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qnetwork
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+func TestNetBoot(t *testing.T) {
+	t.Setenv("VMTEST_KERNEL", "bzImage")
+	t.Setenv("VMTEST_KERNEL_APPEND", "console=ttyS0")
+
+	dir := t.TempDir()
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, NetBoot("192.168.0.0/24",
+		WithUser(WithIPXEScript(dir, "\nchain tftp://192.168.0.2/kernel\n")),
+		WithDevice[UserBackend](WithROMFile("/ipxe.rom")),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Kernel != "" || opts.KernelArgs != "" {
+		t.Errorf("Kernel, KernelArgs = %q, %q, want none", opts.Kernel, opts.KernelArgs)
+	}
+
+	args := strings.Join(opts.QEMUArgs, " ")
+	for _, want := range []string{
+		",tftp=" + dir + ",bootfile=" + IPXEScriptName,
+		",bootindex=0,romfile=/ipxe.rom",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("QEMU args = %s, want %s", args, want)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, IPXEScriptName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#!ipxe\nchain tftp://192.168.0.2/kernel\n"; string(b) != want {
+		t.Errorf("iPXE script = %q, want %q", b, want)
+	}
+}
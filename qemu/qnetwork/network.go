@@ -16,6 +16,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/hugelgupf/vmtest/internal/hostres"
 	"github.com/hugelgupf/vmtest/qemu"
 )
 
@@ -74,6 +75,12 @@ func New[B Backend](mods ...NetDevModifier[B]) qemu.Fn {
 		if err := nd.Backend.Validate(); err != nil {
 			return err
 		}
+		// Servers create the socket, clients connect to it.
+		if b, ok := any(nd.Backend).(SocketBackend); ok && b.Server {
+			if err := claimPath(opts, b.UnixSocket); err != nil {
+				return err
+			}
+		}
 		opts.AppendQEMU(nd.Cmdline(netdevID)...)
 		return nil
 	}
@@ -108,6 +115,15 @@ func WithMAC(mac net.HardwareAddr) DeviceModifier {
 	}
 }
 
+// WithBootIndex sets the NIC's bootindex, e.g. to test network boot before
+// disks. See qemu.WithBootIndex.
+func WithBootIndex(index int) DeviceModifier {
+	return func(d *Device) error {
+		d.Args = append(d.Args, fmt.Sprintf("bootindex=%d", index))
+		return nil
+	}
+}
+
 // DevArgs returns the arg to "-device".
 func (d *Device) DevArgs(id string) string {
 	s := append([]string{string(d.NIC), "netdev=" + id, fmt.Sprintf("mac=%s", d.MAC)}, d.Args...)
@@ -196,8 +212,15 @@ func (n *InterVM) NewVM(mods ...NetDevModifier[SocketBackend]) qemu.Fn {
 }
 
 // WithPCAP captures network traffic and saves it to outputFile.
+//
+// To collect the capture with a test's other artifacts, use
+// testartifacts.Path(t, "net.pcap") as outputFile. Two VMs of a test process
+// cannot capture to the same outputFile at the same time.
 func WithPCAP[B Backend](outputFile string) NetDevModifier[B] {
 	return func(netdevID string, alloc *qemu.IDAllocator, opts *qemu.Options, nd *NetDevice[B]) error {
+		if err := claimPath(opts, outputFile); err != nil {
+			return err
+		}
 		nd.ExtraArgs = append(nd.ExtraArgs,
 			"-object",
 			fmt.Sprintf("filter-dump,id=%s,netdev=%s,file=%s", alloc.ID("filter"), netdevID, outputFile),
@@ -205,3 +228,14 @@ func WithPCAP[B Backend](outputFile string) NetDevModifier[B] {
 		return nil
 	}
 }
+
+// claimPath claims path for the VM until it exits, so that VMs started in
+// parallel do not overwrite each other's files.
+func claimPath(opts *qemu.Options, path string) error {
+	release, err := hostres.ClaimPath(path)
+	if err != nil {
+		return err
+	}
+	opts.AddRelease(release)
+	return nil
+}
@@ -7,10 +7,12 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"testing/fstest"
 	"time"
 
+	"github.com/hugelgupf/vmtest/internal/hostres"
 	"github.com/hugelgupf/vmtest/qemu"
 	"github.com/hugelgupf/vmtest/scriptvm"
 	"github.com/u-root/mkuimage/uimage"
@@ -262,6 +264,91 @@ func TestCIDRFail(t *testing.T) {
 	}
 }
 
+func TestBootIndex(t *testing.T) {
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithDevice[UserBackend](WithBootIndex(0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, arg := range opts.QEMUArgs {
+		if strings.HasPrefix(arg, string(NICE1000)) {
+			found = strings.HasSuffix(arg, ",bootindex=0")
+		}
+	}
+	if !found {
+		t.Errorf("QEMU args = %v, want NIC with bootindex=0", opts.QEMUArgs)
+	}
+}
+
+func TestHostForward(t *testing.T) {
+	var a, b int
+	optsA, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithHostForward(22, &a)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithHostForward(22, &b))); err != nil {
+		t.Fatal(err)
+	}
+	if a == 0 || a == b {
+		t.Errorf("Host ports = %d, %d, want two different free ports", a, b)
+	}
+	want := fmt.Sprintf("hostfwd=tcp:127.0.0.1:%d-:22", a)
+	if !strings.Contains(strings.Join(optsA.QEMUArgs, " "), want) {
+		t.Errorf("QEMU args = %v, want %s", optsA.QEMUArgs, want)
+	}
+
+	// The same port cannot be forwarded twice.
+	c := a
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithHostForward(22, &c))); !errors.Is(err, hostres.ErrInUse) {
+		t.Errorf("WithHostForward(port in use) = %v, want %v", err, hostres.ErrInUse)
+	}
+}
+
+func TestHostForwardReused(t *testing.T) {
+	var port int
+	fwd := WithHostForward(22, &port)
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", fwd)); err != nil {
+		t.Fatal(err)
+	}
+	first := port
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", fwd)); err != nil {
+		t.Fatalf("Reused WithHostForward = %v, want nil", err)
+	}
+	if port == first {
+		t.Errorf("Reused WithHostForward picked port %d twice", port)
+	}
+}
+
+func TestPCAPInUse(t *testing.T) {
+	pcap := filepath.Join(t.TempDir(), "net.pcap")
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithPCAP[UserBackend](pcap))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithPCAP[UserBackend](pcap))); !errors.Is(err, hostres.ErrInUse) {
+		t.Errorf("WithPCAP(file in use) = %v, want %v", err, hostres.ErrInUse)
+	}
+}
+
+func TestPCAPReleased(t *testing.T) {
+	pcap := filepath.Join(t.TempDir(), "net.pcap")
+	fail := func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		return os.ErrInvalid
+	}
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithPCAP[UserBackend](pcap)), fail); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("OptionsFor = %v, want %v", err, os.ErrInvalid)
+	}
+	// The claim of the failed VM was released.
+	opts, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithPCAP[UserBackend](pcap)))
+	if err != nil {
+		t.Fatalf("OptionsFor after failure = %v, want nil", err)
+	}
+
+	opts.Release()
+	if _, err := qemu.OptionsFor(qemu.ArchAMD64, HostNetwork("192.168.0.0/24", WithPCAP[UserBackend](pcap))); err != nil {
+		t.Errorf("OptionsFor after Release = %v, want nil", err)
+	}
+}
+
 func TestUserIPv6(t *testing.T) {
 	fs := fstest.MapFS{
 		"hello": &fstest.MapFile{
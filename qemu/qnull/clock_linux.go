@@ -0,0 +1,32 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qnull
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// clockArgs returns unshare arguments for a time namespace whose monotonic
+// and boot time clocks start about now, so that the guest appears to have
+// just booted, e.g. for phase timing.
+func clockArgs() []string {
+	args := []string{"--time"}
+	for _, c := range []struct {
+		flag string
+		id   int32
+	}{
+		{"--monotonic", unix.CLOCK_MONOTONIC},
+		{"--boottime", unix.CLOCK_BOOTTIME},
+	} {
+		var ts unix.Timespec
+		if err := unix.ClockGettime(c.id, &ts); err != nil {
+			return nil
+		}
+		args = append(args, fmt.Sprintf("%s=-%d", c.flag, ts.Sec))
+	}
+	return args
+}
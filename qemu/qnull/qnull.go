@@ -0,0 +1,264 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qnull runs the guest workload of a VM in Linux namespaces on the
+// host instead of in QEMU: a "null VM".
+//
+// The initramfs is extracted into a directory that the guest's init runs in,
+// chrooted, in new user, mount, PID, network, UTS, IPC, and time namespaces.
+// There is no kernel: kernel args of the form key=value become the environment
+// of init, and powering off ends the PID namespace.
+//
+// Null VMs start in milliseconds, which makes them a fast pre-check of the
+// guest workload before running it in a real VM. See Enabled for running
+// scriptvm and govmtest tests in null VMs.
+//
+// Of the QEMU devices, null VMs support 9P directories (qemu.P9Directory),
+// which are bind-mounted by guest.Mount9PDir, and virtio-serial event channels
+// (qevent.EventChannel). Other QEMU arguments are ignored. The guest must use
+// the host's architecture and see the host's kernel, and the host needs
+// unshare, mount, and chroot from util-linux and unprivileged user namespaces.
+package qnull
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hugelgupf/vmtest/internal/eventchannel"
+	"github.com/hugelgupf/vmtest/internal/mountspec"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+// ErrNoInitramfs is returned when a null VM has no initramfs to run.
+var ErrNoInitramfs = errors.New("null VM needs an initramfs")
+
+// ErrUnsupportedHost is returned when null VMs are started on a host other
+// than Linux.
+var ErrUnsupportedHost = errors.New("null VMs are only supported on Linux hosts")
+
+// Enabled returns whether VMTEST_NULLVM is set to 1, which makes scriptvm and
+// govmtest run their guests in null VMs, and without VMTEST_QEMU.
+func Enabled() bool {
+	return os.Getenv("VMTEST_NULLVM") == "1"
+}
+
+// devices are the host devices available in null VMs.
+var devices = []string{"null", "zero", "full", "random", "urandom"}
+
+// Backend is the null VM qemu.Backend.
+type Backend struct {
+	// Root is the directory the initramfs is extracted into.
+	Root string
+
+	extracted bool
+}
+
+// WithNullVM runs the VM's initramfs in namespaces on the host instead of in
+// QEMU.
+func WithNullVM() qemu.Fn {
+	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		if runtime.GOOS != "linux" {
+			return ErrUnsupportedHost
+		}
+		if arch := opts.Arch(); string(arch) != runtime.GOARCH {
+			return fmt.Errorf("%w: null VMs run host architecture %s guests, not %s", qemu.ErrUnsupportedArch, runtime.GOARCH, arch)
+		}
+		dir, err := os.MkdirTemp("", "vmtest-null-")
+		if err != nil {
+			return err
+		}
+		opts.Tasks = append(opts.Tasks, qemu.Cleanup(func() error {
+			return removeAll(dir)
+		}))
+		return qemu.WithBackend(&Backend{Root: dir})(alloc, opts)
+	}
+}
+
+// removeAll removes dir even if the initramfs had read-only directories.
+func removeAll(dir string) error {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(path, 0o755)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// Name implements qemu.Backend.
+func (b *Backend) Name() string {
+	return "null VM"
+}
+
+// Cmdline implements qemu.Backend. It extracts the initramfs into Root the
+// first time it is called.
+func (b *Backend) Cmdline(o *qemu.Options) ([]string, error) {
+	if o.Initramfs == "" {
+		return nil, ErrNoInitramfs
+	}
+	if !b.extracted {
+		if err := extract(o.Initramfs, b.Root); err != nil {
+			return nil, fmt.Errorf("could not extract initramfs %s: %w", o.Initramfs, err)
+		}
+		b.extracted = true
+	}
+
+	chroot, err := exec.LookPath("chroot")
+	if err != nil {
+		return nil, err
+	}
+	dirs, ports := qemuDevices(o.QEMUArgs)
+
+	// The script runs as PID 1 in the namespaces, then becomes init.
+	script := []string{
+		"set -e",
+		"mount -t tmpfs tmpfs " + quote(filepath.Join(b.Root, "dev")),
+	}
+	for _, dev := range devices {
+		d := quote(filepath.Join(b.Root, "dev", dev))
+		script = append(script, fmt.Sprintf("touch %s && mount --bind /dev/%s %s", d, dev, d))
+	}
+	env := kernelEnv(o.KernelArgs)
+	for _, tag := range sortedKeys(dirs) {
+		d := quote(filepath.Join(b.Root, mountspec.NullVM9PDir, tag))
+		script = append(script, fmt.Sprintf("mkdir -p %s && mount --bind %s %s", d, quote(dirs[tag]), d))
+	}
+	for _, name := range sortedKeys(ports) {
+		env = append(env, eventchannel.NullVMPortEnvPrefix+name+"="+ports[name])
+	}
+	init := []string{"exec", "env", "-i"}
+	for _, e := range env {
+		init = append(init, quote(e))
+	}
+	init = append(init, quote(chroot), quote(b.Root), "/init")
+	script = append(script, strings.Join(init, " "))
+
+	args := []string{"unshare", "--user", "--map-root-user", "--mount", "--pid", "--net", "--uts", "--ipc"}
+	args = append(args, clockArgs()...)
+	return append(args,
+		"--fork", "--kill-child", "--mount-proc="+filepath.Join(b.Root, "proc"),
+		"sh", "-c", strings.Join(script, "\n"),
+	), nil
+}
+
+// ExitError implements qemu.BackendExitError: the PID namespace ends with
+// SIGINT when init powers off, and with SIGHUP when it reboots.
+func (b *Backend) ExitError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() && (ws.Signal() == syscall.SIGINT || ws.Signal() == syscall.SIGHUP) {
+			return nil
+		}
+	}
+	return err
+}
+
+func extract(initramfs, root string) error {
+	f, err := os.Open(initramfs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := cpio.ForEachRecord(cpio.Newc.Reader(f), func(r cpio.Record) error {
+		return cpio.CreateFileInRoot(r, root, false)
+	}); err != nil {
+		return err
+	}
+	for _, d := range []string{"dev", "proc"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qemuDevices returns the 9P directories by tag and the host ends of
+// virtio-serial ports by name configured in QEMU args.
+func qemuDevices(args []string) (map[string]string, map[string]string) {
+	fsdevs := map[string]string{}
+	chardevs := map[string]string{}
+	dirs := map[string]string{}
+	ports := map[string]string{}
+	var devs []map[string]string
+	for i := 0; i+1 < len(args); i++ {
+		kind, props := deviceProps(args[i+1])
+		switch args[i] {
+		case "-fsdev":
+			if kind == "local" {
+				fsdevs[props["id"]] = props["path"]
+			}
+		case "-chardev":
+			if kind == "pipe" {
+				chardevs[props["id"]] = props["path"]
+			}
+		case "-device":
+			props["driver"] = kind
+			devs = append(devs, props)
+		default:
+			continue
+		}
+		i++
+	}
+	for _, d := range devs {
+		switch d["driver"] {
+		case "virtio-9p-pci", "virtio-9p-device":
+			if path, ok := fsdevs[d["fsdev"]]; ok && d["mount_tag"] != "/dev/root" {
+				dirs[d["mount_tag"]] = path
+			}
+		case "virtserialport":
+			if path, ok := chardevs[d["chardev"]]; ok {
+				ports[d["name"]] = path
+			}
+		}
+	}
+	return dirs, ports
+}
+
+// deviceProps splits a QEMU device option into its kind and properties.
+func deviceProps(s string) (string, map[string]string) {
+	kind, rest, _ := strings.Cut(s, ",")
+	props := map[string]string{}
+	for _, p := range strings.Split(rest, ",") {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			props[k] = v
+		}
+	}
+	return kind, props
+}
+
+// kernelEnv returns the kernel args that Linux would pass to init as
+// environment variables.
+func kernelEnv(args string) []string {
+	var env []string
+	for _, a := range strings.Fields(args) {
+		if k, _, ok := strings.Cut(a, "="); ok && k != "" && !strings.Contains(k, ".") {
+			env = append(env, a)
+		}
+	}
+	return env
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quote quotes s for sh.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
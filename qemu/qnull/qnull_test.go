@@ -0,0 +1,122 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qnull
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+	"github.com/u-root/u-root/pkg/cpio"
+)
+
+func TestQEMUDevices(t *testing.T) {
+	dirs, ports := qemuDevices([]string{
+		"-nographic",
+		"-fsdev", "local,id=fsdev0,path=/tmp/shared,security_model=mapped-file",
+		"-device", "virtio-9p-pci,fsdev=fsdev0,mount_tag=shared",
+		"-fsdev", "local,id=rootdrv,path=/tmp/root,security_model=mapped-file",
+		"-device", "virtio-9p-pci,fsdev=rootdrv,mount_tag=/dev/root",
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=pipe0,name=events",
+		"-chardev", "pipe,id=pipe0,path=/proc/self/fd/3",
+		"-chardev", "socket,id=sock0,path=/tmp/sock,server=on,wait=off",
+		"-device", "virtserialport,chardev=sock0,name=debugsh",
+	})
+	if want := map[string]string{"shared": "/tmp/shared"}; !mapsEqual(dirs, want) {
+		t.Errorf("9P directories = %v, want %v", dirs, want)
+	}
+	if want := map[string]string{"events": "/proc/self/fd/3"}; !mapsEqual(ports, want) {
+		t.Errorf("serial ports = %v, want %v", ports, want)
+	}
+}
+
+func mapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKernelEnv(t *testing.T) {
+	got := strings.Join(kernelEnv("console=ttyS0 quiet VMTEST_IN_GUEST=1 uroot.uinitcmd=x =y"), " ")
+	if want := "console=ttyS0 VMTEST_IN_GUEST=1"; got != want {
+		t.Errorf("kernelEnv = %s, want %s", got, want)
+	}
+}
+
+// initramfs builds an initramfs with testdata/nullinit as init.
+func initramfs(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "init")
+	cmd := exec.Command("go", "build", "-o", bin, "./testdata/nullinit")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Could not build init: %v\n%s", err, out)
+	}
+	b, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "initramfs.cpio")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := cpio.Newc.Writer(f)
+	if err := cpio.WriteRecordsAndDirs(w, []cpio.Record{cpio.StaticFile("init", string(b), 0o755)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNullVM(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("null VMs need a Linux host")
+	}
+	if err := exec.Command("unshare", "--user", "--map-root-user", "--mount", "--pid", "--fork", "true").Run(); err != nil {
+		t.Skipf("Unprivileged user namespaces are not available: %v", err)
+	}
+
+	shared := t.TempDir()
+	events := make(chan map[string]string, 1)
+	vm := qemu.StartT(t, "null", qemu.ArchUseEnvv,
+		WithNullVM(),
+		qemu.WithInitramfs(initramfs(t)),
+		qemu.WithKernel(""),
+		qemu.WithAppendKernel("GREETING=hello"),
+		qemu.P9Directory(shared, "shared"),
+		qevent.EventChannel[map[string]string]("events", events),
+	)
+	if _, err := vm.Console.ExpectString("NULLVM PASSED"); err != nil {
+		t.Error(err)
+	}
+	if err := vm.Wait(); err != nil {
+		t.Errorf("VM exited with %v", err)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(shared, "out")); err != nil || string(b) != "hello" {
+		t.Errorf("Shared file = (%q, %v), want hello", b, err)
+	}
+	if e := <-events; e["greeting"] != "hello" {
+		t.Errorf("Event = %v, want hello", e)
+	}
+}
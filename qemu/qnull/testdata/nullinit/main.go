@@ -0,0 +1,43 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command nullinit is the init of the null VM in TestNullVM.
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hugelgupf/vmtest/guest"
+	"golang.org/x/sys/unix"
+)
+
+func run() error {
+	if _, err := guest.Mount9PDir("/shared", "shared"); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join("/shared", "out"), []byte(os.Getenv("GREETING")), 0o644); err != nil {
+		return err
+	}
+	e, err := guest.SerialEventChannel[map[string]string]("events")
+	if err != nil {
+		return err
+	}
+	if err := e.Emit(map[string]string{"greeting": os.Getenv("GREETING")}); err != nil {
+		return err
+	}
+	return e.Close()
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Printf("Failed: %v", err)
+	} else {
+		log.Printf("NULLVM PASSED")
+	}
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
+		log.Fatalf("Failed to power off: %v", err)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qscenario starts a group of VMs that talk to each other, such as a
+// server and its clients.
+//
+// A Scenario declares named VMs, the inter-VM networks they are attached to,
+// the host directories they share, which VMs must be ready before others
+// start, and how to tell that a VM is ready. Scenario.Start validates the
+// whole scenario, then boots the VMs in dependency order and stops any VMs
+// still running when the test ends.
+//
+//	s := qscenario.New(t)
+//	s.AddShare("www", dir)
+//	s.AddVM("server", qscenario.Script(serverScript, serverMods...),
+//		qscenario.OnNetwork("lan"),
+//		qscenario.Mount("www"),
+//		qscenario.ReadyWhen(qscenario.ConsoleMatches("Listening on")),
+//	)
+//	s.AddVM("client", qscenario.Script(clientScript, clientMods...),
+//		qscenario.OnNetwork("lan"),
+//		qscenario.After("server"),
+//	)
+//	vms := s.Start()
+//	if err := vms["client"].Wait(); err != nil { ... }
+package qscenario
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+	"github.com/hugelgupf/vmtest/qemu/qnetwork"
+	"github.com/hugelgupf/vmtest/scriptvm"
+)
+
+// Errors returned for invalid scenarios.
+var (
+	ErrUnknownVM      = errors.New("unknown VM")
+	ErrDuplicateVM    = errors.New("duplicate VM name")
+	ErrDependencies   = errors.New("VM dependencies form a cycle")
+	ErrVMNotReady     = errors.New("VM did not become ready")
+	ErrVMExitedEarly  = errors.New("VM exited before it became ready")
+	ErrUnknownShare   = errors.New("unknown share")
+	ErrDuplicateShare = errors.New("duplicate share name")
+)
+
+// DefaultReadyTimeout is how long Start waits for a VM's readiness probe.
+const DefaultReadyTimeout = 2 * time.Minute
+
+// StartFunc starts a VM named name with additional QEMU options fns, which
+// the scenario uses to attach networks and readiness probes. StartFunc must
+// fail t if the VM cannot be started.
+type StartFunc func(t testing.TB, name string, fns ...qemu.Fn) *qemu.VM
+
+// QEMU returns a StartFunc that starts a VM with qemu.StartT.
+func QEMU(arch qemu.Arch, fns ...qemu.Fn) StartFunc {
+	return func(t testing.TB, name string, extra ...qemu.Fn) *qemu.VM {
+		return qemu.StartT(t, name, arch, append(fns, extra...)...)
+	}
+}
+
+// Script returns a StartFunc that starts a VM running script with
+// scriptvm.Start.
+func Script(script string, mods ...scriptvm.Modifier) StartFunc {
+	return func(t testing.TB, name string, extra ...qemu.Fn) *qemu.VM {
+		return scriptvm.Start(t, name, script, append(mods, scriptvm.WithQEMUFn(extra...))...)
+	}
+}
+
+// Probe tells when a VM is ready for dependent VMs to start.
+type Probe struct {
+	// fn is added to the VM's options.
+	fn qemu.Fn
+
+	// wait blocks until the VM is ready, ctx is done, or exited is closed.
+	wait func(ctx context.Context, vm *qemu.VM, exited <-chan struct{}) error
+}
+
+// ConsoleMatches is ready when s appears on the VM's console.
+//
+// If s does not appear in time, the error explains which console line came
+// closest (see qemu.ExpectError).
+func ConsoleMatches(s string) Probe {
+	return Probe{
+		wait: func(ctx context.Context, vm *qemu.VM, exited <-chan struct{}) error {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				deadline = time.Now().Add(DefaultReadyTimeout)
+			}
+			err := vm.ExpectStringUntil(s, time.Until(deadline), exited)
+			if errors.Is(err, qemu.ErrExpectStopped) {
+				return ErrVMExitedEarly
+			}
+			return err
+		},
+	}
+}
+
+// Event is ready when the guest emits an event on the virtio-serial event
+// channel named channel (see guest.SerialEventChannel) for which match returns
+// true.
+//
+// The channel is only used for the probe; it cannot be read by other host
+// code. A Probe returned by Event can only be used for one VM.
+func Event[T any](channel string, match func(T) bool) Probe {
+	ready := make(chan struct{})
+	var closed bool
+	return Probe{
+		fn: qevent.EventChannelCallback[T](channel, func(e T) error {
+			if !closed && match(e) {
+				closed = true
+				close(ready)
+			}
+			return nil
+		}),
+		wait: func(ctx context.Context, _ *qemu.VM, exited <-chan struct{}) error {
+			select {
+			case <-ready:
+				return nil
+			case <-exited:
+				return ErrVMExitedEarly
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+type vmSpec struct {
+	name     string
+	start    StartFunc
+	fns      []qemu.Fn
+	networks []network
+	after    []string
+	shares   []string
+	probe    *Probe
+}
+
+type network struct {
+	name string
+	mods []qnetwork.NetDevModifier[qnetwork.SocketBackend]
+}
+
+// VMOption configures a VM in a scenario.
+type VMOption func(*vmSpec)
+
+// OnNetwork attaches the VM to the inter-VM network name (see
+// qnetwork.InterVM), creating it if necessary. mods configure the VM's network
+// device.
+//
+// The first VM started on a network hosts it, so it must be started before
+// the others, e.g. by listing it in their After option.
+func OnNetwork(name string, mods ...qnetwork.NetDevModifier[qnetwork.SocketBackend]) VMOption {
+	return func(s *vmSpec) {
+		s.networks = append(s.networks, network{name: name, mods: mods})
+	}
+}
+
+// After starts the VM only once the VMs named names are ready.
+func After(names ...string) VMOption {
+	return func(s *vmSpec) {
+		s.after = append(s.after, names...)
+	}
+}
+
+// Mount exposes the share named name (see Scenario.AddShare) to the VM as a 9P
+// directory with tag name. vmmount, which scriptvm VMs run, mounts it at
+// /mount/9p/name in the guest; see qemu.P9Directory.
+func Mount(name string) VMOption {
+	return func(s *vmSpec) {
+		s.shares = append(s.shares, name)
+	}
+}
+
+// ReadyWhen sets the probe that tells when the VM is ready. VMs without a
+// probe are ready as soon as they are started.
+func ReadyWhen(p Probe) VMOption {
+	return func(s *vmSpec) {
+		s.probe = &p
+	}
+}
+
+// WithQEMUFn adds QEMU options to the VM.
+func WithQEMUFn(fns ...qemu.Fn) VMOption {
+	return func(s *vmSpec) {
+		s.fns = append(s.fns, fns...)
+	}
+}
+
+// Scenario is a group of VMs that are started together.
+type Scenario struct {
+	t      testing.TB
+	vms    []*vmSpec
+	shares map[string]string
+	errs   []error
+
+	// ReadyTimeout bounds how long Start waits for each VM's readiness
+	// probe. Defaults to DefaultReadyTimeout.
+	ReadyTimeout time.Duration
+}
+
+// New returns an empty scenario for t.
+func New(t testing.TB) *Scenario {
+	return &Scenario{t: t, shares: make(map[string]string), ReadyTimeout: DefaultReadyTimeout}
+}
+
+// AddShare declares the host directory dir as a share named name, which VMs
+// mount with Mount. VMs sharing a directory see each other's changes.
+func (s *Scenario) AddShare(name, dir string) *Scenario {
+	if _, ok := s.shares[name]; ok {
+		s.errs = append(s.errs, fmt.Errorf("%w: %s", ErrDuplicateShare, name))
+	}
+	s.shares[name] = dir
+	return s
+}
+
+// AddVM adds a VM named name, started by start. The VM's console is logged
+// with name as prefix if start uses qemu.StartT, as QEMU and Script do.
+func (s *Scenario) AddVM(name string, start StartFunc, opts ...VMOption) *Scenario {
+	spec := &vmSpec{name: name, start: start}
+	for _, opt := range opts {
+		opt(spec)
+	}
+	s.vms = append(s.vms, spec)
+	return s
+}
+
+// Validate checks the scenario without starting any VM: VM and share names
+// must be unique, dependencies must name VMs of the scenario and not form a
+// cycle, and mounted shares must be declared with an existing directory.
+func (s *Scenario) Validate() error {
+	_, err := s.plan()
+	return err
+}
+
+// plan validates the scenario and returns the VMs in start order.
+func (s *Scenario) plan() ([]*vmSpec, error) {
+	if err := errors.Join(s.errs...); err != nil {
+		return nil, err
+	}
+	order, err := s.order()
+	if err != nil {
+		return nil, err
+	}
+	for name, dir := range s.shares {
+		if fi, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("share %s: %w", name, err)
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("share %s: %s is not a directory", name, dir)
+		}
+	}
+	for _, vm := range s.vms {
+		for _, name := range vm.shares {
+			if _, ok := s.shares[name]; !ok {
+				return nil, fmt.Errorf("%w %q mounted by %s", ErrUnknownShare, name, vm.name)
+			}
+		}
+	}
+	return order, nil
+}
+
+// order returns the VMs in an order that starts each VM after its
+// dependencies, and otherwise in the order they were added.
+func (s *Scenario) order() ([]*vmSpec, error) {
+	byName := make(map[string]*vmSpec)
+	for _, vm := range s.vms {
+		if _, ok := byName[vm.name]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateVM, vm.name)
+		}
+		byName[vm.name] = vm
+	}
+
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int)
+	var order []*vmSpec
+	var visit func(vm *vmSpec) error
+	visit = func(vm *vmSpec) error {
+		switch state[vm.name] {
+		case visiting:
+			return fmt.Errorf("%w: %s", ErrDependencies, vm.name)
+		case done:
+			return nil
+		}
+		state[vm.name] = visiting
+		for _, dep := range vm.after {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("%w %q in dependencies of %s", ErrUnknownVM, dep, vm.name)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[vm.name] = done
+		order = append(order, vm)
+		return nil
+	}
+	for _, vm := range s.vms {
+		if err := visit(vm); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Start validates the scenario (see Validate), then starts all VMs and returns
+// them by name. Each VM is started once all the VMs it depends on are ready.
+// If the scenario is invalid, no VM is started. If a VM cannot be started or
+// does not become ready, the test fails immediately.
+//
+// VMs that were not waited for by the end of the test are killed.
+func (s *Scenario) Start() map[string]*qemu.VM {
+	s.t.Helper()
+
+	order, err := s.plan()
+	if err != nil {
+		s.t.Fatalf("Invalid scenario: %v", err)
+	}
+
+	networks := make(map[string]*qnetwork.InterVM)
+	vms := make(map[string]*qemu.VM)
+	for _, spec := range order {
+		fns := append([]qemu.Fn{}, spec.fns...)
+		for _, n := range spec.networks {
+			if networks[n.name] == nil {
+				networks[n.name] = qnetwork.NewInterVM()
+			}
+			fns = append(fns, networks[n.name].NewVM(n.mods...))
+		}
+		for _, name := range spec.shares {
+			fns = append(fns, qemu.P9Directory(s.shares[name], name))
+		}
+		exited := make(chan struct{})
+		fns = append(fns, qemu.WithTask(qemu.Cleanup(func() error {
+			close(exited)
+			return nil
+		})))
+		if spec.probe != nil && spec.probe.fn != nil {
+			fns = append(fns, spec.probe.fn)
+		}
+
+		vm := spec.start(s.t, spec.name, fns...)
+		vms[spec.name] = vm
+		s.t.Cleanup(func() {
+			if !vm.Waited() {
+				_ = vm.Kill()
+				_ = vm.Wait()
+			}
+		})
+
+		if spec.probe != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), s.ReadyTimeout)
+			err := spec.probe.wait(ctx, vm, exited)
+			cancel()
+			if err != nil {
+				s.t.Fatalf("%v: %s: %v", ErrVMNotReady, spec.name, err)
+			}
+		}
+	}
+	return vms
+}
@@ -0,0 +1,220 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qscenario
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Netflix/go-expect"
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/scriptvm"
+	"github.com/u-root/mkuimage/uimage"
+)
+
+func TestOrder(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		vms  map[string][]string
+		add  []string
+		want []string
+		err  error
+	}{
+		{
+			name: "added-order",
+			add:  []string{"a", "b", "c"},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "dependencies-first",
+			vms: map[string][]string{
+				"client1": {"server"},
+				"client2": {"server", "client1"},
+			},
+			add:  []string{"client2", "client1", "server"},
+			want: []string{"server", "client1", "client2"},
+		},
+		{
+			name: "cycle",
+			vms: map[string][]string{
+				"a": {"b"},
+				"b": {"a"},
+			},
+			add: []string{"a", "b"},
+			err: ErrDependencies,
+		},
+		{
+			name: "unknown",
+			vms: map[string][]string{
+				"a": {"b"},
+			},
+			add: []string{"a"},
+			err: ErrUnknownVM,
+		},
+		{
+			name: "duplicate",
+			add:  []string{"a", "a"},
+			err:  ErrDuplicateVM,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(t)
+			for _, name := range tt.add {
+				s.AddVM(name, nil, After(tt.vms[name]...))
+			}
+			order, err := s.order()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("order = %v, want %v", err, tt.err)
+			}
+			var got []string
+			for _, vm := range order {
+				got = append(got, vm.name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		shares  map[string]string
+		mounts  []string
+		dupe    bool
+		wantErr error
+	}{
+		{
+			name:   "shared",
+			shares: map[string]string{"data": dir},
+			mounts: []string{"data"},
+		},
+		{
+			name:    "unknown",
+			mounts:  []string{"data"},
+			wantErr: ErrUnknownShare,
+		},
+		{
+			name:    "duplicate",
+			shares:  map[string]string{"data": dir},
+			dupe:    true,
+			wantErr: ErrDuplicateShare,
+		},
+		{
+			name:    "missing",
+			shares:  map[string]string{"data": filepath.Join(dir, "missing")},
+			wantErr: os.ErrNotExist,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(t)
+			for name, d := range tt.shares {
+				s.AddShare(name, d)
+				if tt.dupe {
+					s.AddShare(name, d)
+				}
+			}
+			var opts []VMOption
+			for _, m := range tt.mounts {
+				opts = append(opts, Mount(m))
+			}
+			s.AddVM("a", nil, opts...)
+			s.AddVM("b", nil, opts...)
+			if err := s.Validate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	s := New(t).AddShare("data", file)
+	if err := s.Validate(); err == nil {
+		t.Errorf("Validate with a file share = nil, want error")
+	}
+}
+
+func TestConsoleMatches(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p := ConsoleMatches("server up")
+
+	if err := p.wait(ctx, &qemu.VM{Options: &qemu.Options{}}, nil); !errors.Is(err, qemu.ErrNoConsole) {
+		t.Errorf("ConsoleMatches without console = %v, want %v", err, qemu.ErrNoConsole)
+	}
+
+	c, err := expect.NewConsole()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	exited := make(chan struct{})
+	close(exited)
+	if err := p.wait(ctx, &qemu.VM{Console: c, Options: &qemu.Options{}}, exited); !errors.Is(err, ErrVMExitedEarly) {
+		t.Errorf("ConsoleMatches after exit = %v, want %v", err, ErrVMExitedEarly)
+	}
+}
+
+func TestServerClient(t *testing.T) {
+	d := t.TempDir()
+	_ = os.WriteFile(filepath.Join(d, "hello"), []byte("all hello all world\n"), 0o777)
+
+	s := New(t)
+	s.AddShare("www", d)
+	s.AddVM("server", Script(`
+ip addr add 192.168.0.1/24 dev eth0
+ip link set eth0 up
+echo "server up"
+pxeserver -4=false -http-dir=/mount/9p/www
+`,
+		scriptvm.WithUimage(
+			uimage.WithBusyboxCommands(
+				"github.com/u-root/u-root/cmds/core/ip",
+				"github.com/u-root/u-root/cmds/exp/pxeserver",
+			),
+		),
+		scriptvm.WithQEMUFn(qemu.WithVMTimeout(90*time.Second)),
+	),
+		OnNetwork("lan"),
+		Mount("www"),
+		ReadyWhen(ConsoleMatches("server up")),
+	)
+	s.AddVM("client", Script(`
+ip addr add 192.168.0.2/24 dev eth0
+ip link set eth0 up
+wget http://192.168.0.1/hello
+cat ./hello
+`,
+		scriptvm.WithUimage(
+			uimage.WithBusyboxCommands(
+				"github.com/u-root/u-root/cmds/core/cat",
+				"github.com/u-root/u-root/cmds/core/ip",
+				"github.com/u-root/u-root/cmds/core/wget",
+			),
+		),
+		scriptvm.WithQEMUFn(qemu.WithVMTimeout(90*time.Second)),
+	),
+		OnNetwork("lan"),
+		After("server"),
+	)
+	vms := s.Start()
+
+	if _, err := vms["client"].Console.ExpectString("all hello all world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vms["client"].Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qslog forwards the structured logs of a guest to a host
+// slog.Logger.
+//
+// In the guest, log JSON records to an event channel of json.RawMessage:
+//
+//	e, err := guest.SerialEventChannel[json.RawMessage]("slog")
+//	if err != nil { ... }
+//	defer e.Close()
+//	logger := slog.New(slog.NewJSONHandler(e, nil))
+//
+// On the host, add the channel to the VM:
+//
+//	vm := qemu.StartT(t, "vm", qemu.ArchUseEnvv,
+//		qslog.EventChannel("slog", logger),
+//	)
+package qslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/qemu/qevent"
+)
+
+// Option configures how guest records are logged on the host.
+type Option func(*options)
+
+type options struct {
+	level   slog.Leveler
+	replace []func(groups []string, a slog.Attr) slog.Attr
+}
+
+// WithLevel drops guest records below level.
+func WithLevel(level slog.Leveler) Option {
+	return func(o *options) {
+		o.level = level
+	}
+}
+
+// WithReplaceAttr rewrites each attribute of guest records with f before it is
+// logged, like slog.HandlerOptions.ReplaceAttr: groups are the groups
+// enclosing the attribute, and attributes for which f returns the zero
+// slog.Attr are dropped. f is not called for groups themselves, and not for
+// the time, level, and message of the record.
+//
+// Multiple replacements are applied in order.
+func WithReplaceAttr(f func(groups []string, a slog.Attr) slog.Attr) Option {
+	return func(o *options) {
+		o.replace = append(o.replace, f)
+	}
+}
+
+// WithRedactedAttrs replaces the values of attributes with the given keys, in
+// any group, with "REDACTED".
+func WithRedactedAttrs(keys ...string) Option {
+	redact := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		redact[k] = struct{}{}
+	}
+	return WithReplaceAttr(func(_ []string, a slog.Attr) slog.Attr {
+		if _, ok := redact[a.Key]; ok {
+			return slog.String(a.Key, "REDACTED")
+		}
+		return a
+	})
+}
+
+// WithMaxValueLen truncates string attribute values longer than n bytes.
+func WithMaxValueLen(n int) Option {
+	return WithReplaceAttr(func(_ []string, a slog.Attr) slog.Attr {
+		if a.Value.Kind() == slog.KindString && len(a.Value.String()) > n {
+			return slog.String(a.Key, a.Value.String()[:n]+fmt.Sprintf("...(%d bytes truncated)", len(a.Value.String())-n))
+		}
+		return a
+	})
+}
+
+// EventChannel adds an event channel that emits the guest's slog JSON records
+// (as written by slog.JSONHandler with the default keys) on logger, with their
+// guest time, level, message, and attributes. Groups are preserved.
+//
+// Records that are not valid slog JSON records are logged at error level.
+//
+// Use guest.SerialEventChannel[json.RawMessage] with the same name in the
+// guest.
+func EventChannel(name string, logger *slog.Logger, opts ...Option) qemu.Fn {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return qevent.EventChannelCallback[json.RawMessage](name, func(b json.RawMessage) error {
+		ctx := context.Background()
+		r, err := record(b)
+		if err != nil {
+			logger.Error("Invalid guest slog record", "record", string(b), "err", err)
+			return nil
+		}
+		if o.level != nil && r.Level < o.level.Level() {
+			return nil
+		}
+		if !logger.Handler().Enabled(ctx, r.Level) {
+			return nil
+		}
+		if len(o.replace) > 0 {
+			r = replaceAttrs(r, o.replace)
+		}
+		_ = logger.Handler().Handle(ctx, r)
+		return nil
+	})
+}
+
+// replaceAttrs returns a copy of r with its attributes rewritten by replace.
+func replaceAttrs(r slog.Record, replace []func([]string, slog.Attr) slog.Attr) slog.Record {
+	var attrs []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	nr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	nr.AddAttrs(replaceAll(nil, attrs, replace)...)
+	return nr
+}
+
+func replaceAll(groups []string, attrs []slog.Attr, replace []func([]string, slog.Attr) slog.Attr) []slog.Attr {
+	var out []slog.Attr
+	for _, a := range attrs {
+		if a.Value.Kind() == slog.KindGroup {
+			group := replaceAll(append(groups[:len(groups):len(groups)], a.Key), a.Value.Group(), replace)
+			out = append(out, slog.Attr{Key: a.Key, Value: slog.GroupValue(group...)})
+			continue
+		}
+		for _, f := range replace {
+			if a = f(groups, a); a.Equal(slog.Attr{}) {
+				break
+			}
+		}
+		if !a.Equal(slog.Attr{}) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// record converts the slog JSON record b into a slog.Record.
+func record(b []byte) (slog.Record, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil {
+		return slog.Record{}, err
+	} else if t != json.Delim('{') {
+		return slog.Record{}, fmt.Errorf("record is not a JSON object")
+	}
+
+	var (
+		t     time.Time
+		level slog.Level
+		msg   string
+		attrs []slog.Attr
+	)
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return slog.Record{}, err
+		}
+		k := key.(string)
+		v, err := value(dec)
+		if err != nil {
+			return slog.Record{}, fmt.Errorf("%s: %w", k, err)
+		}
+
+		switch s, isString := v.Any().(string); {
+		case k == slog.TimeKey && isString:
+			if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				return slog.Record{}, err
+			}
+		case k == slog.LevelKey && isString:
+			if err := level.UnmarshalText([]byte(s)); err != nil {
+				return slog.Record{}, err
+			}
+		case k == slog.MessageKey && isString:
+			msg = s
+		default:
+			attrs = append(attrs, slog.Attr{Key: k, Value: v})
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return slog.Record{}, err
+	}
+
+	r := slog.NewRecord(t, level, msg, 0)
+	r.AddAttrs(attrs...)
+	return r, nil
+}
+
+// value decodes the next JSON value of dec. Objects become groups, keeping
+// the order of their keys.
+func value(dec *json.Decoder) (slog.Value, error) {
+	t, err := dec.Token()
+	if errors.Is(err, io.EOF) {
+		return slog.Value{}, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return slog.Value{}, err
+	}
+
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			var attrs []slog.Attr
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return slog.Value{}, err
+				}
+				v, err := value(dec)
+				if err != nil {
+					return slog.Value{}, err
+				}
+				attrs = append(attrs, slog.Attr{Key: key.(string), Value: v})
+			}
+			if _, err := dec.Token(); err != nil {
+				return slog.Value{}, err
+			}
+			return slog.GroupValue(attrs...), nil
+
+		case '[':
+			var values []any
+			for dec.More() {
+				v, err := value(dec)
+				if err != nil {
+					return slog.Value{}, err
+				}
+				values = append(values, v.Any())
+			}
+			if _, err := dec.Token(); err != nil {
+				return slog.Value{}, err
+			}
+			return slog.AnyValue(values), nil
+		}
+		return slog.Value{}, fmt.Errorf("unexpected %v", t)
+
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return slog.Int64Value(i), nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return slog.Value{}, err
+		}
+		return slog.Float64Value(f), nil
+
+	case string:
+		return slog.StringValue(t), nil
+	case bool:
+		return slog.BoolValue(t), nil
+	default:
+		// null
+		return slog.AnyValue(nil), nil
+	}
+}
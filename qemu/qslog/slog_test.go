@@ -0,0 +1,96 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qslog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	var guest bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&guest, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	logger.Info("hello", "count", 3, "ratio", 0.5, "ok", true, "nothing", nil)
+	logger.WithGroup("req").Warn("slow", "path", "/foo", slog.Group("timing", "ms", 1500))
+	logger.Log(context.Background(), slog.LevelDebug+2, "custom level", "list", []int{1, 2})
+
+	for _, line := range bytes.SplitAfter(guest.Bytes(), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		r, err := record(line)
+		if err != nil {
+			t.Fatalf("record(%s) = %v", line, err)
+		}
+
+		var host bytes.Buffer
+		if err := slog.NewJSONHandler(&host, &slog.HandlerOptions{Level: slog.LevelDebug}).Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+		if host.String() != string(line) {
+			t.Errorf("Host record = %s, want %s", host.String(), line)
+		}
+	}
+}
+
+func TestRecordTime(t *testing.T) {
+	r, err := record([]byte(`{"time":"2024-01-02T03:04:05.123456789Z","level":"ERROR","msg":"boom"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC); !r.Time.Equal(want) {
+		t.Errorf("Time = %v, want %v", r.Time, want)
+	}
+	if r.Level != slog.LevelError || r.Message != "boom" || r.NumAttrs() != 0 {
+		t.Errorf("Record = %v", r)
+	}
+}
+
+func TestRecordInvalid(t *testing.T) {
+	for _, b := range []string{
+		`[]`,
+		`{"level":"LOUD"}`,
+		`{"time":"yesterday"}`,
+	} {
+		if _, err := record([]byte(b)); err == nil {
+			t.Errorf("record(%s) = nil, want error", b)
+		}
+	}
+}
+
+func TestReplaceAttrs(t *testing.T) {
+	r, err := record([]byte(`{"time":"2024-01-02T03:04:05Z","level":"INFO","msg":"login","user":"root","password":"hunter2","req":{"token":"abc","body":"0123456789","drop":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o options
+	for _, opt := range []Option{
+		WithMaxValueLen(4),
+		WithRedactedAttrs("password", "token"),
+		WithReplaceAttr(func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 1 && groups[0] == "req" && a.Key == "drop" {
+				return slog.Attr{}
+			}
+			if a.Key == "user" {
+				a.Key = "username"
+			}
+			return a
+		}),
+	} {
+		opt(&o)
+	}
+
+	var host bytes.Buffer
+	if err := slog.NewJSONHandler(&host, nil).Handle(context.Background(), replaceAttrs(r, o.replace)); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"time":"2024-01-02T03:04:05Z","level":"INFO","msg":"login","username":"root","password":"REDACTED","req":{"token":"REDACTED","body":"0123...(6 bytes truncated)"}}` + "\n"
+	if host.String() != want {
+		t.Errorf("Host record = %s, want %s", host.String(), want)
+	}
+}
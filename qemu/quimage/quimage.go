@@ -35,8 +35,12 @@ var ErrOutputFileSpecified = errors.New("initramfs output file must be left unsp
 // The arch used to build the initramfs is derived by default from the arch set
 // in qemu.Options, which is either explicitly set, VMTEST_ARCH, or if unset,
 // runtime.GOARCH (the host GOARCH).
+//
+// WithUimage also turns on qemu.WithConsoleArg, so that the guest's output
+// appears on the serial console on all architectures.
 func WithUimage(l *llog.Logger, initrdPath string, mods ...uimage.Modifier) qemu.Fn {
 	return func(alloc *qemu.IDAllocator, opts *qemu.Options) error {
+		opts.ConsoleArg = true
 		if override := os.Getenv("VMTEST_INITRAMFS_OVERRIDE"); len(override) > 0 {
 			opts.Initramfs = override
 			return nil
@@ -30,6 +30,9 @@ func TestOverride(t *testing.T) {
 	if got.Initramfs != want {
 		t.Errorf("Initramfs = %v, want %v", got.Initramfs, want)
 	}
+	if !got.ConsoleArg {
+		t.Errorf("ConsoleArg = false, want true")
+	}
 }
 
 func replaceCtl(str []byte) []byte {
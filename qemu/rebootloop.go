@@ -0,0 +1,114 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrRebootLoop is wrapped by the *RebootLoopError returned by VM.Wait when
+// the guest kernel booted too often.
+var ErrRebootLoop = errors.New("guest is in a reboot loop")
+
+// kernelBanner matches the first line Linux prints on each boot, with or
+// without a printk timestamp.
+var kernelBanner = regexp.MustCompile(`^(\[\s*\d+\.\d+\] )?Linux version \d`)
+
+// rebootLoopLines is how many lines of console output before the last reboot
+// a RebootLoopError includes.
+const rebootLoopLines = 50
+
+// RebootLoopError is returned by VM.Wait when the VM was killed because the
+// guest kernel booted more often than allowed (see WithRebootLoopDetection).
+type RebootLoopError struct {
+	// Boots is how often the kernel booted.
+	Boots int
+
+	// LastBoot is the end of the console output of the boot before the
+	// last one, which usually says why the guest rebooted, e.g. a kernel
+	// panic or triple fault.
+	LastBoot []string
+}
+
+func (e *RebootLoopError) Error() string {
+	s := fmt.Sprintf("%v: kernel booted %d times", ErrRebootLoop, e.Boots)
+	if len(e.LastBoot) > 0 {
+		s += "; console output before the last reboot:\n" + strings.Join(e.LastBoot, "\n")
+	}
+	return s
+}
+
+// Unwrap returns ErrRebootLoop.
+func (e *RebootLoopError) Unwrap() error {
+	return ErrRebootLoop
+}
+
+// WithRebootLoopDetection kills the VM as soon as the guest kernel boots more
+// than maxBoots times, e.g. when a guest that panics (without
+// HaltOnKernelPanic) or triple faults is reset by QEMU over and over. VM.Wait
+// then returns a *RebootLoopError instead of the VM running until its
+// timeout.
+//
+// Boots are counted by the kernel's "Linux version" banner on the serial
+// console, so other output starting with it (e.g. of `cat /proc/version`)
+// counts as a boot, too. Tests that reboot the guest on purpose must allow
+// for the reboots in maxBoots.
+func WithRebootLoopDetection(maxBoots int) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		d := &rebootDetector{max: maxBoots, loop: make(chan struct{})}
+		opts.SerialOutput = append(opts.SerialOutput, LineWriter(StripANSI(ReplaceCtl(d.line))))
+		opts.Tasks = append(opts.Tasks, func(ctx context.Context, n *Notifications) error {
+			select {
+			case <-d.loop:
+				return d.err()
+			case <-ctx.Done():
+				return nil
+			}
+		})
+		return nil
+	}
+}
+
+// rebootDetector counts kernel boots in console lines.
+type rebootDetector struct {
+	max  int
+	loop chan struct{}
+
+	mu       sync.Mutex
+	boots    int
+	lines    []string
+	lastBoot []string
+}
+
+func (d *rebootDetector) line(line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.boots > d.max {
+		return
+	}
+	if kernelBanner.MatchString(line) {
+		d.boots++
+		d.lastBoot, d.lines = d.lines, nil
+		if d.boots > d.max {
+			close(d.loop)
+			return
+		}
+	}
+	d.lines = append(d.lines, line)
+	if len(d.lines) > rebootLoopLines {
+		d.lines = d.lines[1:]
+	}
+}
+
+func (d *rebootDetector) err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return &RebootLoopError{Boots: d.boots, LastBoot: d.lastBoot}
+}
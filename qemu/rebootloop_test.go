@@ -0,0 +1,82 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRebootDetector(t *testing.T) {
+	d := &rebootDetector{max: 2, loop: make(chan struct{})}
+	for _, l := range []string{
+		"SeaBIOS",
+		"[    0.000000] Linux version 6.6.0 (gcc)",
+		"Linux version of the test",
+		"Kernel panic - not syncing: boom",
+		"Linux version 6.6.0 (gcc)",
+	} {
+		d.line(l)
+	}
+	select {
+	case <-d.loop:
+		t.Fatalf("reboot loop detected after 2 boots, want max 2")
+	default:
+	}
+
+	d.line("[    0.000000] Linux version 6.6.0 (gcc)")
+	select {
+	case <-d.loop:
+	default:
+		t.Fatalf("no reboot loop detected after 3 boots")
+	}
+	// Lines after detection are ignored.
+	d.line("Linux version 6.6.0 (gcc)")
+
+	err := d.err()
+	var rle *RebootLoopError
+	if !errors.As(err, &rle) || !errors.Is(err, ErrRebootLoop) {
+		t.Fatalf("err = %v, want RebootLoopError", err)
+	}
+	if rle.Boots != 3 {
+		t.Errorf("Boots = %d, want 3", rle.Boots)
+	}
+	if want := []string{"Linux version 6.6.0 (gcc)"}; !slices.Equal(rle.LastBoot, want) {
+		t.Errorf("LastBoot = %q, want %q", rle.LastBoot, want)
+	}
+}
+
+func TestRebootLoopDetection(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "reboot.sh")
+	if err := os.WriteFile(script, []byte("while true; do echo 'Linux version 6.6.0'; echo 'Kernel panic'; sleep 0.1; done\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := Start(ArchAMD64,
+		WithQEMUCommand("sh "+script),
+		WithVMTimeout(30*time.Second),
+		WithRebootLoopDetection(3),
+		clearArgs(),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start 'VM': %v", err)
+	}
+
+	start := time.Now()
+	err = vm.Wait()
+	var rle *RebootLoopError
+	if !errors.As(err, &rle) {
+		t.Fatalf("Wait = %v, want RebootLoopError", err)
+	}
+	if rle.Boots != 4 {
+		t.Errorf("Boots = %d, want 4", rle.Boots)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("VM was killed after %v, want well before its timeout", d)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SeededRandomSize is how many bytes of randomness WithSeededRandom gives the
+// guest.
+const SeededRandomSize = 1 << 20
+
+// WithRandomSource exposes a virtio random number generator to the guest that
+// reads from the file at path, e.g. a file with fixed contents to make guest
+// randomness reproducible.
+//
+// Once the guest has read the whole file, the device provides no more
+// randomness.
+func WithRandomSource(path string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		id := alloc.ID("rng")
+		opts.AppendQEMU(
+			"-object", fmt.Sprintf("rng-random,id=%s,filename=%s", id, path),
+			"-device", opts.Env().VirtioDevice("virtio-rng")+",rng="+id,
+		)
+		return nil
+	}
+}
+
+// WithSeededRandom exposes a virtio random number generator to the guest that
+// provides the same SeededRandomSize bytes for the same seed (see
+// WithRandomSource).
+//
+// The guest kernel mixes other sources into its random pool, such as RDRAND
+// and interrupt timing. For randomness that is the same on every run, tests
+// must read the hardware RNG, e.g. /dev/hwrng, directly, or boot the kernel
+// with random.trust_cpu=off and without other entropy sources.
+func WithSeededRandom(seed string) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		dir, err := os.MkdirTemp("", "vmtest-rng")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, "random")
+		if err := writeSeededRandom(path, seed, SeededRandomSize); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		opts.Tasks = append(opts.Tasks, Cleanup(func() error {
+			return os.RemoveAll(dir)
+		}))
+		return WithRandomSource(path)(alloc, opts)
+	}
+}
+
+// writeSeededRandom writes size bytes derived from seed to path, as SHA-256
+// in counter mode.
+func writeSeededRandom(path, seed string, size int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var ctr [8]byte
+	for n, i := 0, uint64(0); n < size; i++ {
+		binary.BigEndian.PutUint64(ctr[:], i)
+		block := sha256.Sum256(append([]byte(seed), ctr[:]...))
+		m, _ := w.Write(block[:min(len(block), size-n)])
+		n += m
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RTCClock is the clock that drives the guest's real-time clock.
+type RTCClock string
+
+// RTC clocks supported by QEMU's -rtc clock=.
+const (
+	// RTCClockHost follows the host's system time, including when it is
+	// adjusted.
+	RTCClockHost RTCClock = "host"
+
+	// RTCClockRT runs with the host's monotonic time, unaffected by host
+	// time adjustments.
+	RTCClockRT RTCClock = "rt"
+
+	// RTCClockVM runs with the guest's virtual clock, which stops while the
+	// VM is paused and, with -icount, is independent of host time.
+	RTCClockVM RTCClock = "vm"
+)
+
+// WithRTC sets the guest's real-time clock to start at base and to be driven
+// by clock, to make time-sensitive guest tests reproducible. If base is zero,
+// the RTC starts at the host's current UTC time; base is used in UTC.
+//
+// Only the guest's wall clock time is set; guests must not sync time over
+// the network for it to be reproducible.
+//
+//	qemu.WithRTC(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), qemu.RTCClockVM)
+func WithRTC(base time.Time, clock RTCClock) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		b := "utc"
+		if !base.IsZero() {
+			b = base.UTC().Format("2006-01-02T15:04:05")
+		}
+		opts.AppendQEMU("-rtc", fmt.Sprintf("base=%s,clock=%s", b, clock))
+		return nil
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeededRandom(t *testing.T) {
+	dir := t.TempDir()
+	read := func(name, seed string) []byte {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := writeSeededRandom(path, seed, 100); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 100 {
+			t.Fatalf("Got %d bytes, want 100", len(b))
+		}
+		return b
+	}
+
+	a, b, c := read("a", "seed"), read("b", "seed"), read("c", "other")
+	if !bytes.Equal(a, b) {
+		t.Errorf("Same seed gave different randomness")
+	}
+	if bytes.Equal(a, c) {
+		t.Errorf("Different seeds gave the same randomness")
+	}
+}
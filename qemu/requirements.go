@@ -0,0 +1,215 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ErrUnmetRequirement is returned when the host or QEMU binary does not meet a
+// test's Requirements.
+var ErrUnmetRequirement = errors.New("requirement not met")
+
+// Requirements are capabilities of the host and QEMU binary that a test needs.
+// See SkipUnless.
+type Requirements struct {
+	// KVM requires /dev/kvm to be usable.
+	KVM bool
+
+	// MinVersion is the minimum QEMU version, e.g. "8.0" or "7.2.1".
+	MinVersion string
+
+	// Devices are QEMU device types that must be available, e.g.
+	// "virtio-net-pci", as listed by `-device help`.
+	Devices []string
+
+	// Arches are the guest architectures the test supports. Any
+	// architecture is supported if empty.
+	Arches []Arch
+}
+
+// Capabilities describe a QEMU binary.
+type Capabilities struct {
+	// Version is the QEMU version, e.g. "8.2.1".
+	Version string
+
+	// Devices are the available device types.
+	Devices []string
+}
+
+var (
+	probeMu sync.Mutex
+	probes  = map[string]func() (*Capabilities, error){}
+)
+
+// ProbeCapabilities runs the QEMU binary, the first field of qemuCommand, to
+// find its version and devices. The result is cached per binary for the
+// lifetime of the process.
+func ProbeCapabilities(qemuCommand string) (*Capabilities, error) {
+	fields := strings.Fields(qemuCommand)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: no QEMU command (is VMTEST_QEMU set?)", ErrUnmetRequirement)
+	}
+	bin := fields[0]
+
+	probeMu.Lock()
+	probe, ok := probes[bin]
+	if !ok {
+		probe = sync.OnceValues(func() (*Capabilities, error) {
+			return probeCapabilities(bin)
+		})
+		probes[bin] = probe
+	}
+	probeMu.Unlock()
+	return probe()
+}
+
+func probeCapabilities(bin string) (*Capabilities, error) {
+	out, err := exec.Command(bin, "-version").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s -version: %w: %s", bin, err, bytes.TrimSpace(out))
+	}
+	version, err := parseVersion(out)
+	if err != nil {
+		return nil, fmt.Errorf("%s -version: %w", bin, err)
+	}
+
+	out, err = exec.Command(bin, "-device", "help").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s -device help: %w: %s", bin, err, bytes.TrimSpace(out))
+	}
+	return &Capabilities{Version: version, Devices: parseDevices(out)}, nil
+}
+
+var versionRE = regexp.MustCompile(`version (\d+\.\d+(?:\.\d+)?)`)
+
+// parseVersion parses the output of qemu -version, e.g. "QEMU emulator
+// version 8.2.1 (Debian 1:8.2.1+ds-1)".
+func parseVersion(out []byte) (string, error) {
+	m := versionRE.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("no version in %q", bytes.TrimSpace(out))
+	}
+	return string(m[1]), nil
+}
+
+// parseDevices parses the output of qemu -device help, whose lines look like
+//
+//	name "virtio-net-pci", bus PCI, alias "virtio-net"
+func parseDevices(out []byte) []string {
+	var devices []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		name, ok := strings.CutPrefix(s.Text(), `name "`)
+		if !ok {
+			continue
+		}
+		if i := strings.IndexByte(name, '"'); i > 0 {
+			devices = append(devices, name[:i])
+		}
+		if _, alias, ok := strings.Cut(name, `alias "`); ok {
+			if i := strings.IndexByte(alias, '"'); i > 0 {
+				devices = append(devices, alias[:i])
+			}
+		}
+	}
+	return devices
+}
+
+// compareVersions compares dotted versions a and b numerically, treating
+// missing components as 0.
+func compareVersions(a, b string) (int, error) {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		var err error
+		if i < len(as) {
+			if x, err = strconv.Atoi(as[i]); err != nil {
+				return 0, fmt.Errorf("invalid version %q", a)
+			}
+		}
+		if i < len(bs) {
+			if y, err = strconv.Atoi(bs[i]); err != nil {
+				return 0, fmt.Errorf("invalid version %q", b)
+			}
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// Check returns an error wrapping ErrUnmetRequirement describing the first
+// requirement that the host or the QEMU binary of VMTEST_QEMU does not meet.
+// The QEMU binary is only probed if a requirement needs it.
+func (r Requirements) Check() error {
+	if len(r.Arches) > 0 && !slices.Contains(r.Arches, GuestArch()) {
+		return fmt.Errorf("%w: guest arch is %s, not in %v", ErrUnmetRequirement, GuestArch(), r.Arches)
+	}
+	if r.KVM {
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("%w: KVM is not usable: %w", ErrUnmetRequirement, err)
+		}
+		f.Close()
+	}
+	if r.MinVersion == "" && len(r.Devices) == 0 {
+		return nil
+	}
+
+	caps, err := ProbeCapabilities(os.Getenv("VMTEST_QEMU"))
+	if err != nil {
+		return fmt.Errorf("%w: could not probe QEMU: %w", ErrUnmetRequirement, err)
+	}
+	if r.MinVersion != "" {
+		c, err := compareVersions(caps.Version, r.MinVersion)
+		if err != nil {
+			return err
+		}
+		if c < 0 {
+			return fmt.Errorf("%w: QEMU version is %s, need at least %s", ErrUnmetRequirement, caps.Version, r.MinVersion)
+		}
+	}
+	for _, d := range r.Devices {
+		if !slices.Contains(caps.Devices, d) {
+			return fmt.Errorf("%w: QEMU %s has no device %q", ErrUnmetRequirement, caps.Version, d)
+		}
+	}
+	return nil
+}
+
+// SkipUnless skips the test if VMTEST_QEMU is not set, or with a precise
+// reason if the host or QEMU binary do not meet r, instead of letting the
+// test fail later, e.g. on an unknown device.
+//
+//	qemu.SkipUnless(t, qemu.Requirements{
+//		KVM:        true,
+//		MinVersion: "8.0",
+//		Devices:    []string{"virtio-net-pci"},
+//	})
+func SkipUnless(tb testing.TB, r Requirements) {
+	tb.Helper()
+	SkipWithoutQEMU(tb)
+	if err := r.Check(); errors.Is(err, ErrUnmetRequirement) {
+		tb.Skipf("Skipping test: %v", err)
+	} else if err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const fakeDeviceHelp = `Controller/Bridge/Hub devices:
+name "pci-bridge", bus PCI, desc "Standard PCI Bridge"
+
+Network devices:
+name "e1000", bus PCI, alias "e1000-82540em", desc "Intel Gigabit Ethernet"
+name "virtio-net-pci", bus PCI, alias "virtio-net"
+`
+
+func TestParseCapabilities(t *testing.T) {
+	v, err := parseVersion([]byte("QEMU emulator version 8.2.1 (Debian 1:8.2.1+ds-1)\nCopyright (c) 2003-2023 Fabrice Bellard and the QEMU Project developers\n"))
+	if err != nil || v != "8.2.1" {
+		t.Errorf("parseVersion = %q, %v, want 8.2.1", v, err)
+	}
+	if _, err := parseVersion([]byte("bogus")); err == nil {
+		t.Errorf("parseVersion(bogus) = nil error, want error")
+	}
+
+	got := parseDevices([]byte(fakeDeviceHelp))
+	want := []string{"pci-bridge", "e1000", "e1000-82540em", "virtio-net-pci", "virtio-net"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseDevices = %v, want %v", got, want)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{a: "8.2.1", b: "8.0", want: 1},
+		{a: "8.0", b: "8.0.0", want: 0},
+		{a: "7.2.9", b: "8.0", want: -1},
+		{a: "10.0", b: "9.2", want: 1},
+	} {
+		if got, err := compareVersions(tt.a, tt.b); err != nil || got != tt.want {
+			t.Errorf("compareVersions(%s, %s) = %d, %v, want %d", tt.a, tt.b, got, err, tt.want)
+		}
+	}
+	if _, err := compareVersions("8.x", "8.0"); err == nil {
+		t.Errorf("compareVersions(8.x) = nil error, want error")
+	}
+}
+
+func TestRequirementsCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake QEMU is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "help"), []byte(fakeDeviceHelp), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "qemu-system-fake")
+	script := `#!/bin/sh
+case "$1" in
+-version) echo "QEMU emulator version 7.2.5";;
+-device) cat ` + filepath.Join(dir, "help") + `;;
+esac
+`
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VMTEST_QEMU", bin+" -m 1G")
+
+	for _, tt := range []struct {
+		r       Requirements
+		wantErr string
+	}{
+		{r: Requirements{MinVersion: "7.2", Devices: []string{"virtio-net-pci", "e1000"}}},
+		{r: Requirements{MinVersion: "8.0"}, wantErr: "QEMU version is 7.2.5, need at least 8.0"},
+		{r: Requirements{Devices: []string{"virtio-net-pci", "vhost-vsock-pci"}}, wantErr: `QEMU 7.2.5 has no device "vhost-vsock-pci"`},
+		{r: Requirements{Arches: []Arch{"nonexistent"}}, wantErr: "not in [nonexistent]"},
+	} {
+		err := tt.r.Check()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("Check(%+v) = %v, want nil", tt.r, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrUnmetRequirement) || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Check(%+v) = %v, want %v containing %q", tt.r, err, ErrUnmetRequirement, tt.wantErr)
+		}
+	}
+}
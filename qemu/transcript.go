@@ -0,0 +1,341 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscriptLine is one line of console output.
+type TranscriptLine struct {
+	// Time is when the line started, relative to the first console output.
+	Time time.Duration
+
+	// Text is the line without its trailing newline.
+	Text string
+}
+
+func (l TranscriptLine) String() string {
+	return fmt.Sprintf("[%06.4fs] %s", l.Time.Seconds(), l.Text)
+}
+
+// Default limits of the console output a Transcript keeps in memory. The full
+// output is saved by WithConsoleOutputFile.
+const (
+	DefaultTranscriptLines = 10000
+	DefaultTranscriptBytes = 1 << 20
+)
+
+// maxTranscriptLineBytes is the length at which lines without a newline are
+// split, so that output without newlines cannot grow a transcript unbounded.
+const maxTranscriptLineBytes = 4096
+
+// Transcript records a VM's console output line by line with timestamps.
+//
+// Only the last lines are kept, up to DefaultTranscriptLines lines and
+// DefaultTranscriptBytes bytes of text unless configured otherwise with
+// TranscriptMaxLines and TranscriptMaxBytes. Lines longer than 4096 bytes are
+// split.
+//
+// Transcript is an io.WriteCloser and can be used as SerialOutput. See
+// WithTranscript.
+type Transcript struct {
+	mu       sync.Mutex
+	maxLines int
+	maxBytes int
+	start    time.Time
+	// lines[first:] are the lines kept, with bytes bytes of text.
+	lines       []TranscriptLine
+	first       int
+	bytes       int
+	dropped     int
+	partial     []byte
+	partialTime time.Duration
+}
+
+// TranscriptOption configures NewTranscript.
+type TranscriptOption func(*Transcript)
+
+// TranscriptMaxLines makes a transcript keep the last n lines. If n is 0, the
+// number of lines is not limited.
+func TranscriptMaxLines(n int) TranscriptOption {
+	return func(t *Transcript) {
+		t.maxLines = n
+	}
+}
+
+// TranscriptMaxBytes makes a transcript keep the last lines with up to n bytes
+// of text, but at least one line. If n is 0, the size is not limited.
+func TranscriptMaxBytes(n int) TranscriptOption {
+	return func(t *Transcript) {
+		t.maxBytes = n
+	}
+}
+
+// NewTranscript returns an empty transcript.
+func NewTranscript(opts ...TranscriptOption) *Transcript {
+	t := &Transcript{
+		maxLines: DefaultTranscriptLines,
+		maxBytes: DefaultTranscriptBytes,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Write implements io.Writer.
+func (t *Transcript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	for b := p; len(b) > 0; {
+		if len(t.partial) == 0 {
+			t.partialTime = now.Sub(t.start)
+		}
+		i := bytes.IndexByte(b, '\n')
+		n := i
+		if n < 0 {
+			n = len(b)
+		}
+		if room := maxTranscriptLineBytes - len(t.partial); n > room {
+			t.partial = append(t.partial, b[:room]...)
+			t.flush()
+			b = b[room:]
+			continue
+		}
+		t.partial = append(t.partial, b[:n]...)
+		if i < 0 {
+			break
+		}
+		t.flush()
+		b = b[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush must be called with t.mu held.
+func (t *Transcript) flush() {
+	line := bytes.TrimRight(t.partial, "\r")
+	t.add(TranscriptLine{
+		Time: t.partialTime,
+		Text: string(replaceCtl(line)),
+	})
+	t.partial = t.partial[:0]
+}
+
+// add must be called with t.mu held.
+func (t *Transcript) add(l TranscriptLine) {
+	t.lines = append(t.lines, l)
+	t.bytes += len(l.Text)
+	for kept := len(t.lines) - t.first; kept > 1 && ((t.maxLines > 0 && kept > t.maxLines) || (t.maxBytes > 0 && t.bytes > t.maxBytes)); kept-- {
+		t.bytes -= len(t.lines[t.first].Text)
+		t.first++
+		t.dropped++
+	}
+	// Move the kept lines to the front once half of lines was dropped, so
+	// that appending never grows lines beyond twice the kept lines.
+	if t.first > 0 && t.first >= len(t.lines)/2 {
+		n := copy(t.lines, t.lines[t.first:])
+		clear(t.lines[n:])
+		t.lines = t.lines[:n]
+		t.first = 0
+	}
+}
+
+// Close implements io.Closer. An unterminated last line is recorded.
+func (t *Transcript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.partial) > 0 {
+		t.flush()
+	}
+	return nil
+}
+
+// Lines returns the lines kept so far, including an unterminated last line.
+func (t *Transcript) Lines() []TranscriptLine {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]TranscriptLine(nil), t.lines[t.first:]...)
+	if len(t.partial) > 0 {
+		lines = append(lines, TranscriptLine{
+			Time: t.partialTime,
+			Text: string(replaceCtl(bytes.TrimRight(t.partial, "\r"))),
+		})
+	}
+	return lines
+}
+
+// Dropped returns how many lines were dropped to stay within the transcript's
+// limits.
+func (t *Transcript) Dropped() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+// String returns the transcript with one timestamped line per line.
+func (t *Transcript) String() string {
+	s := formatLines(t.Lines())
+	if n := t.Dropped(); n > 0 {
+		s = fmt.Sprintf("[%d earlier lines dropped]\n", n) + s
+	}
+	return s
+}
+
+func formatLines(lines []TranscriptLine) string {
+	var s strings.Builder
+	for _, l := range lines {
+		s.WriteString(l.String())
+		s.WriteString("\n")
+	}
+	return s.String()
+}
+
+// transcriptContextLines is how many lines of console output an expect error
+// includes.
+const transcriptContextLines = 20
+
+// ExpectError is a failed expectation with context from the console
+// transcript.
+type ExpectError struct {
+	// Want is the string that was expected.
+	Want string
+
+	// Closest is the console line most similar to Want, if any line was
+	// similar enough.
+	Closest *TranscriptLine
+
+	// Tail are the last lines of console output.
+	Tail []TranscriptLine
+
+	// Err is the underlying error from the expect library.
+	Err error
+
+	// Dump is the state dump taken when the expectation failed, if
+	// configured with WithFailureDump.
+	Dump *StateDump
+}
+
+func (e *ExpectError) Error() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "expected %q on console: %v", e.Want, e.Err)
+	if e.Closest != nil {
+		fmt.Fprintf(&s, "\nclosest console line:\n- want: %q\n+ got:  %q (at %06.4fs)", e.Want, e.Closest.Text, e.Closest.Time.Seconds())
+	}
+	if len(e.Tail) > 0 {
+		fmt.Fprintf(&s, "\nlast %d console lines:\n%s", len(e.Tail), strings.TrimSuffix(formatLines(e.Tail), "\n"))
+	} else {
+		s.WriteString("\nno console output")
+	}
+	if e.Dump != nil {
+		fmt.Fprintf(&s, "\n%s", e.Dump)
+	}
+	return s.String()
+}
+
+// Unwrap returns the underlying expect error.
+func (e *ExpectError) Unwrap() error {
+	return e.Err
+}
+
+// expectError returns an ExpectError for want with context from t.
+func (t *Transcript) expectError(want string, err error) *ExpectError {
+	lines := t.Lines()
+	e := &ExpectError{Want: want, Err: err}
+	if n := len(lines); n > transcriptContextLines {
+		e.Tail = lines[n-transcriptContextLines:]
+	} else {
+		e.Tail = lines
+	}
+
+	best := 0.5
+	for i, l := range lines {
+		if sim := similarity(want, l.Text); sim > best {
+			best = sim
+			e.Closest = &lines[i]
+		}
+	}
+	return e
+}
+
+// maxSimilarityLen bounds the cost of comparing long lines.
+const maxSimilarityLen = 512
+
+// similarity returns how similar a and b are between 0 and 1, based on their
+// longest common subsequence.
+func similarity(a, b string) float64 {
+	if len(a) == 0 || len(b) == 0 || len(a) > maxSimilarityLen || len(b) > maxSimilarityLen {
+		return 0
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			switch {
+			case a[i-1] == b[j-1]:
+				cur[j] = prev[j-1] + 1
+			case prev[j] > cur[j-1]:
+				cur[j] = prev[j]
+			default:
+				cur[j] = cur[j-1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return 2 * float64(prev[len(b)]) / float64(len(a)+len(b))
+}
+
+// WithTranscript records console output in t. VM.ExpectString uses it to
+// explain failed expectations.
+//
+// StartT records a transcript with the default limits. To keep more output,
+// e.g. for ExpectGolden, pass a transcript with other limits:
+//
+//	qemu.WithTranscript(qemu.NewTranscript(qemu.TranscriptMaxLines(0), qemu.TranscriptMaxBytes(0)))
+func WithTranscript(t *Transcript) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		opts.Transcript = t
+		opts.SerialOutput = append(opts.SerialOutput, t)
+		return nil
+	}
+}
+
+// defaultTranscript records a transcript unless one was configured already.
+func defaultTranscript() Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if opts.Transcript != nil {
+			return nil
+		}
+		return WithTranscript(NewTranscript())(alloc, opts)
+	}
+}
+
+// ExpectString waits for s to appear on the console.
+//
+// If s does not appear (e.g. due to a timeout or the VM exiting), the error
+// is an *ExpectError describing the console output seen so far if a
+// transcript is recorded (see WithTranscript), and referring to a state dump
+// if configured (see WithFailureDump).
+func (v *VM) ExpectString(s string) error {
+	if v.Console == nil {
+		return ErrNoConsole
+	}
+	_, err := v.Console.ExpectString(s)
+	if err == nil {
+		return err
+	}
+	return v.expectError(s, err)
+}
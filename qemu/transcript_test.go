@@ -0,0 +1,127 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	tr := NewTranscript()
+	for _, s := range []string{"Linux version 6.6\r\n", "Run /init", " as init process\n\x1b[0m", "Hello wrold\npartial"} {
+		if _, err := io.WriteString(tr, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, l := range tr.Lines() {
+		got = append(got, l.Text)
+	}
+	want := []string{"Linux version 6.6", "Run /init as init process", "~[0mHello wrold", "partial"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Lines = %q, want %q", got, want)
+	}
+
+	// Closing records the last line for good.
+	_ = tr.Close()
+	if n := len(tr.Lines()); n != len(want) {
+		t.Errorf("After Close got %d lines, want %d", n, len(want))
+	}
+	if s := tr.String(); !strings.Contains(s, "s] Linux version 6.6\n") {
+		t.Errorf("String = %q, want timestamped lines", s)
+	}
+}
+
+func TestExpectError(t *testing.T) {
+	tr := NewTranscript()
+	_, _ = io.WriteString(tr, "Booting\n~[0mHello wrold\n")
+	for i := 0; i < 30; i++ {
+		_, _ = io.WriteString(tr, "noise\n")
+	}
+
+	errTimeout := errors.New("timeout")
+	err := tr.expectError("Hello world", errTimeout)
+	if !errors.Is(err, errTimeout) {
+		t.Errorf("ExpectError does not wrap %v", errTimeout)
+	}
+	if err.Closest == nil || err.Closest.Text != "~[0mHello wrold" {
+		t.Errorf("Closest = %v, want Hello wrold line", err.Closest)
+	}
+	if len(err.Tail) != transcriptContextLines {
+		t.Errorf("Tail has %d lines, want %d", len(err.Tail), transcriptContextLines)
+	}
+	msg := err.Error()
+	for _, s := range []string{`- want: "Hello world"`, `+ got:  "~[0mHello wrold"`, "last 20 console lines:"} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("Error() = %s\nwant it to contain %q", msg, s)
+		}
+	}
+
+	if err := NewTranscript().expectError("Hello world", errTimeout); err.Closest != nil || !strings.Contains(err.Error(), "no console output") {
+		t.Errorf("Empty transcript error = %v", err)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want float64
+	}{
+		{a: "abc", b: "abc", want: 1},
+		{a: "abc", b: "xyz", want: 0},
+		{a: "abcd", b: "abxd", want: 0.75},
+		{a: "", b: "abc", want: 0},
+	} {
+		if got := similarity(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTranscriptLimits(t *testing.T) {
+	tr := NewTranscript(TranscriptMaxLines(3))
+	for i := 0; i < 100; i++ {
+		_, _ = fmt.Fprintf(tr, "line %d\n", i)
+	}
+	var got []string
+	for _, l := range tr.Lines() {
+		got = append(got, l.Text)
+	}
+	if want := []string{"line 97", "line 98", "line 99"}; !slices.Equal(got, want) {
+		t.Errorf("Lines = %q, want %q", got, want)
+	}
+	if n := tr.Dropped(); n != 97 {
+		t.Errorf("Dropped = %d, want 97", n)
+	}
+	if s := tr.String(); !strings.HasPrefix(s, "[97 earlier lines dropped]\n") {
+		t.Errorf("String = %q, want dropped lines noted", s)
+	}
+	if n := cap(tr.lines); n > 8 {
+		t.Errorf("transcript holds %d lines, want at most 8", n)
+	}
+
+	tr = NewTranscript(TranscriptMaxBytes(10))
+	_, _ = io.WriteString(tr, "12345\n67890\nabc\n")
+	if got := tr.Lines(); len(got) != 2 || got[0].Text != "67890" {
+		t.Errorf("Lines with 10 bytes = %v, want last 2 lines", got)
+	}
+
+	// Output without newlines is split into lines. The unterminated
+	// last line is returned in addition to the lines kept.
+	tr = NewTranscript(TranscriptMaxLines(2))
+	_, _ = io.WriteString(tr, strings.Repeat("x", 3*maxTranscriptLineBytes+1))
+	if got := tr.Lines(); len(got) != 3 || len(got[0].Text) != maxTranscriptLineBytes || got[2].Text != "x" {
+		t.Errorf("Lines of long output = %d lines, want 2 full lines and x", len(got))
+	}
+	if n := len(tr.partial); n != 1 {
+		t.Errorf("partial line has %d bytes, want 1", n)
+	}
+}
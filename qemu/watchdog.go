@@ -0,0 +1,123 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hugelgupf/vmtest/internal/qmp"
+)
+
+// WatchdogModel is a QEMU watchdog device.
+type WatchdogModel string
+
+// Watchdog devices supported by QEMU.
+const (
+	// WatchdogI6300ESB is the Intel 6300ESB PCI watchdog, driven by
+	// Linux's i6300esb driver.
+	WatchdogI6300ESB WatchdogModel = "i6300esb"
+
+	// WatchdogIB700 is the iBASE 700 ISA watchdog, driven by Linux's
+	// ib700wdt driver.
+	WatchdogIB700 WatchdogModel = "ib700"
+)
+
+// WatchdogAction is what QEMU does when the guest's watchdog expires.
+type WatchdogAction string
+
+// Watchdog actions supported by QEMU's -action watchdog=.
+const (
+	WatchdogReset     WatchdogAction = "reset"
+	WatchdogShutdown  WatchdogAction = "shutdown"
+	WatchdogPoweroff  WatchdogAction = "poweroff"
+	WatchdogPause     WatchdogAction = "pause"
+	WatchdogDebug     WatchdogAction = "debug"
+	WatchdogNone      WatchdogAction = "none"
+	WatchdogInjectNMI WatchdogAction = "inject-nmi"
+)
+
+// WithWatchdog adds a watchdog device of model to the VM and makes QEMU take
+// action when it expires, e.g. to test a guest's watchdog daemon or its
+// recovery logic. Use WithWatchdogEvents to be told about expiries.
+//
+// The i6300esb and ib700 watchdogs are only supported by x86 guests.
+func WithWatchdog(model WatchdogModel, action WatchdogAction) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		if a := opts.Arch(); a != ArchAMD64 && a != ArchI386 {
+			return fmt.Errorf("%w: %s watchdog needs an x86 guest, not %s", ErrUnsupportedArch, model, a)
+		}
+		opts.AppendQEMU("-device", string(model), "-action", "watchdog="+string(action))
+		return nil
+	}
+}
+
+// WatchdogEvent is the expiry of the guest's watchdog.
+type WatchdogEvent struct {
+	// Action is what QEMU did.
+	Action WatchdogAction
+
+	// Time is when the watchdog expired.
+	Time time.Time
+}
+
+// WithWatchdogEvents sends an event to events each time the guest's watchdog
+// (see WithWatchdog) expires. events is closed when the VM exits.
+//
+// Events are read from a QMP monitor of their own.
+func WithWatchdogEvents(events chan<- WatchdogEvent) Fn {
+	return func(alloc *IDAllocator, opts *Options) error {
+		path, err := addQMPSocket(opts)
+		if err != nil {
+			return err
+		}
+		opts.Tasks = append(opts.Tasks, func(ctx context.Context, n *Notifications) error {
+			defer close(events)
+			return watchdogEvents(ctx, path, events)
+		})
+		return nil
+	}
+}
+
+func watchdogEvents(ctx context.Context, path string, events chan<- WatchdogEvent) error {
+	c, err := qmp.Dial(ctx, path)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The VM exited or never started.
+			return nil
+		}
+		return fmt.Errorf("watchdog events: %w", err)
+	}
+	defer c.Close()
+	go func() {
+		// Unblock ReadEvent.
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	for {
+		e, err := c.ReadEvent()
+		if err != nil {
+			// QEMU closes the connection on exit.
+			return nil
+		}
+		if e.Name != "WATCHDOG" {
+			continue
+		}
+		var data struct {
+			Action WatchdogAction `json:"action"`
+		}
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("watchdog events: invalid WATCHDOG event %s: %w", e.Data, err)
+		}
+		select {
+		case events <- WatchdogEvent{Action: data.Action, Time: e.Time}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
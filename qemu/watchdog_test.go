@@ -0,0 +1,61 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchdogEvents(t *testing.T) {
+	// Unix socket paths are limited to ~100 bytes.
+	dir, err := os.MkdirTemp("", "vmtest-qmp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "qmp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"QMP": {"version": {}, "capabilities": []}}`)
+		s := bufio.NewScanner(conn)
+		s.Scan()
+		fmt.Fprintln(conn, `{"return": {}}`)
+		fmt.Fprintln(conn, `{"event": "RESUME", "timestamp": {"seconds": 1700000000, "microseconds": 0}}`)
+		fmt.Fprintln(conn, `{"event": "WATCHDOG", "data": {"action": "pause"}, "timestamp": {"seconds": 1700000001, "microseconds": 0}}`)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := make(chan WatchdogEvent, 2)
+	if err := watchdogEvents(ctx, path, events); err != nil {
+		t.Fatalf("watchdogEvents = %v", err)
+	}
+	close(events)
+
+	var got []WatchdogEvent
+	for e := range events {
+		got = append(got, e)
+	}
+	if len(got) != 1 || got[0].Action != WatchdogPause || !got[0].Time.Equal(time.Unix(1700000001, 0)) {
+		t.Errorf("Watchdog events = %v, want one pause event", got)
+	}
+}
@@ -6,14 +6,19 @@
 package scriptvm
 
 import (
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/hugelgupf/vmtest/qemu"
 	"github.com/hugelgupf/vmtest/qemu/qcoverage"
+	"github.com/hugelgupf/vmtest/qemu/qnull"
 	"github.com/hugelgupf/vmtest/qemu/quimage"
+	"github.com/hugelgupf/vmtest/testartifacts"
 	"github.com/hugelgupf/vmtest/testtmp"
 	"github.com/u-root/mkuimage/uimage"
 )
@@ -25,6 +30,16 @@ type Options struct {
 
 	// Initramfs is an optional u-root initramfs to build.
 	Initramfs []uimage.Modifier
+
+	// Shell is the shell command (and args) used to interpret the script
+	// in the guest.
+	//
+	// If empty, gosh is used.
+	Shell []string
+
+	// DebugShell starts an interactive shell in the guest if the script
+	// fails. See WithDebugShell.
+	DebugShell bool
 }
 
 // Modifier is used to configure a VM.
@@ -46,12 +61,43 @@ func WithUimage(mods ...uimage.Modifier) Modifier {
 	}
 }
 
+// WithShell sets the shell used to run the script in the guest, e.g.
+// WithShell("bash") or WithShell("busybox", "sh").
+//
+// The shell must be present in the guest, e.g. added to the initramfs with
+// uimage.WithFiles or uimage.WithBinaryCommands. The script's path is
+// appended as the last argument.
+//
+// The default shell is gosh.
+func WithShell(shell ...string) Modifier {
+	return func(_ testing.TB, v *Options) error {
+		v.Shell = shell
+		return nil
+	}
+}
+
+// WithDebugShell keeps the VM alive when the script fails and serves an
+// interactive shell on a unix domain socket for postmortem inspection. The
+// socket's path is logged at the start of the test.
+//
+// See qemu.WithDebugShell.
+func WithDebugShell() Modifier {
+	return func(_ testing.TB, v *Options) error {
+		v.DebugShell = true
+		return nil
+	}
+}
+
 // Run starts a VM and runs the given script using gosh in the guest.
 //
-// gosh is based on mvdan.cc/sh and strives to be bash-compatible.
+// gosh is based on mvdan.cc/sh and strives to be bash-compatible. Another
+// shell can be chosen with WithShell.
 //
 // If any command fails, the test fails.
 //
+// If VMTEST_GOCOVERDIR is set, commands added with uimage.WithCoveredCommands
+// write their coverage to it, which is synced after each command exits.
+//
 //   - TODO: timeouts for individual individual commands.
 func Run(t testing.TB, name, script string, mods ...Modifier) {
 	vm := Start(t, name, script, mods...)
@@ -65,10 +111,18 @@ func Run(t testing.TB, name, script string, mods ...Modifier) {
 	}
 }
 
-// Start starts a VM and runs the script using gosh in the guest.
-// If the commands return, the VM will be shutdown.
+// Start starts a VM and runs the script using gosh (or the shell given by
+// WithShell) in the guest. If the commands return, the VM will be shutdown.
+//
+// If VMTEST_NULLVM=1, the script runs in a null VM instead (see package
+// qnull).
 func Start(t testing.TB, name, script string, mods ...Modifier) *qemu.VM {
-	qemu.SkipWithoutQEMU(t)
+	var qopts []qemu.Fn
+	if qnull.Enabled() {
+		qopts = append(qopts, qnull.WithNullVM())
+	} else {
+		qemu.SkipWithoutQEMU(t)
+	}
 
 	o := &Options{}
 	for _, mod := range mods {
@@ -80,6 +134,7 @@ func Start(t testing.TB, name, script string, mods ...Modifier) *qemu.VM {
 	}
 
 	sharedDir := testtmp.TempDir(t)
+	testartifacts.CopyOnFailure(t, name+".shelltest", sharedDir)
 
 	// Generate gosh shell script of test commands in o.SharedDir.
 	if len(script) > 0 {
@@ -89,26 +144,73 @@ func Start(t testing.TB, name, script string, mods ...Modifier) *qemu.VM {
 		}
 	}
 
+	cmds := []string{
+		"github.com/u-root/u-root/cmds/core/init",
+		"github.com/hugelgupf/vmtest/vminit/shutdownafter",
+		"github.com/hugelgupf/vmtest/vminit/vmmount",
+		"github.com/hugelgupf/vmtest/vminit/shelluinit",
+	}
+	uinitArgs := []string{"--", "vmmount", "--"}
+	if o.DebugShell {
+		cmds = append(cmds, "github.com/hugelgupf/vmtest/vminit/debugsh")
+		if len(o.Shell) > 0 {
+			uinitArgs = append(uinitArgs, "debugsh", fmt.Sprintf("-shell-argc=%d", len(o.Shell)), "--")
+			uinitArgs = append(uinitArgs, o.Shell...)
+		} else {
+			uinitArgs = append(uinitArgs, "debugsh", "--")
+		}
+	}
+	uinitArgs = append(uinitArgs, "shelluinit")
+	if covered := coveredCommands(o.Initramfs); len(covered) > 0 {
+		uinitArgs = append(uinitArgs, "-covered="+strings.Join(covered, ","))
+	}
+	if len(o.Shell) == 0 || o.Shell[0] == "gosh" {
+		cmds = append(cmds, "github.com/u-root/u-root/cmds/core/gosh")
+	}
+	if len(o.Shell) > 0 {
+		uinitArgs = append(uinitArgs, append([]string{"--"}, o.Shell...)...)
+	}
+
 	initramfs := append([]uimage.Modifier{
-		uimage.WithBusyboxCommands(
-			"github.com/u-root/u-root/cmds/core/init",
-			"github.com/u-root/u-root/cmds/core/gosh",
-			"github.com/hugelgupf/vmtest/vminit/shutdownafter",
-			"github.com/hugelgupf/vmtest/vminit/vmmount",
-			"github.com/hugelgupf/vmtest/vminit/shelluinit",
-		),
+		uimage.WithBusyboxCommands(cmds...),
 		uimage.WithInit("init"),
-		uimage.WithUinit("shutdownafter", "--", "vmmount", "--", "shelluinit"),
+		uimage.WithUinit("shutdownafter", uinitArgs...),
 	}, o.Initramfs...)
 
-	qopts := []qemu.Fn{
+	qopts = append(qopts,
 		quimage.WithUimageT(t, initramfs...),
 		qemu.P9Directory(sharedDir, "shelltest"),
 		qcoverage.CollectKernelCoverage(t),
 		qcoverage.ShareGOCOVERDIR(),
+		qcoverage.ShareLLVMProfileDir(),
 		qemu.WithVmtestIdent(),
+	)
+
+	if o.DebugShell {
+		qopts = append(qopts, qemu.WithDebugShellT(t))
 	}
 
 	// Prepend our default options so user-supplied o.QEMUOpts supersede.
 	return qemu.StartT(t, name, qemu.ArchUseEnvv, append(qopts, o.QEMUOpts...)...)
 }
+
+// coveredCommands returns the names of the commands mods build with coverage,
+// e.g. with uimage.WithCoveredCommands.
+func coveredCommands(mods []uimage.Modifier) []string {
+	var o uimage.Opts
+	// Errors are reported when the initramfs is built.
+	_ = o.Apply(mods...)
+
+	var names []string
+	for _, c := range o.Commands {
+		if c.BuildOpts == nil || !slices.Contains(c.BuildOpts.ExtraArgs, "-cover") {
+			continue
+		}
+		for _, pkg := range c.Packages {
+			if name := path.Base(pkg); !strings.ContainsAny(name, "*?[") {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
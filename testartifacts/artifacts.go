@@ -0,0 +1,153 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package testartifacts gathers the files that help debug a failed test --
+// serial console logs, QEMU debug logs, PCAPs, coverage, and event channel
+// files -- in one directory per test that CI can upload.
+//
+// If VMTEST_ARTIFACTS_DIR is set, each test's artifacts go to
+// VMTEST_ARTIFACTS_DIR/{testName}, which is removed again if the test passes.
+// qemu.StartT then automatically saves each VM's console output, QEMU debug
+// log, and command line there.
+//
+// If VMTEST_ARTIFACTS_DIR is not set, artifacts go to a testtmp directory,
+// which is only retained if the test fails.
+package testartifacts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hugelgupf/vmtest/testtmp"
+	"github.com/u-root/uio/cp"
+)
+
+var (
+	mu   sync.Mutex
+	dirs = map[string]string{}
+)
+
+// Enabled returns whether VMTEST_ARTIFACTS_DIR is set.
+func Enabled() bool {
+	return len(os.Getenv("VMTEST_ARTIFACTS_DIR")) > 0
+}
+
+// dirName maps a test name to a relative directory, with one directory level
+// per subtest.
+func dirName(testName string) string {
+	mapper := func(r rune) rune {
+		if r < utf8.RuneSelf {
+			const allowed = "!#$%&()+,-.=@^_{}~ /"
+			if '0' <= r && r <= '9' ||
+				'a' <= r && r <= 'z' ||
+				'A' <= r && r <= 'Z' {
+				return r
+			}
+			if strings.ContainsRune(allowed, r) {
+				return r
+			}
+		} else if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return r
+		}
+		return -1
+	}
+	var elems []string
+	for _, e := range strings.Split(strings.Map(mapper, testName), "/") {
+		// Don't allow . or .. to escape the artifacts directory.
+		if strings.Trim(e, ".") != "" {
+			elems = append(elems, e)
+		}
+	}
+	return filepath.Join(elems...)
+}
+
+// Dir returns the artifacts directory for t. All calls for the same test
+// return the same directory.
+func Dir(t testing.TB) string {
+	mu.Lock()
+	dir, ok := dirs[t.Name()]
+	mu.Unlock()
+	if ok {
+		return dir
+	}
+
+	root := os.Getenv("VMTEST_ARTIFACTS_DIR")
+	if root == "" {
+		dir = testtmp.TempDir(t)
+	} else {
+		dir = filepath.Join(root, dirName(t.Name()))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Could not create artifacts directory: %v", err)
+		}
+		t.Cleanup(func() {
+			if t.Failed() {
+				t.Logf("Test artifacts saved in %s", dir)
+				return
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				t.Errorf("Failed to remove artifacts directory %s: %v", dir, err)
+			}
+		})
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(dirs, t.Name())
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	dirs[t.Name()] = dir
+	return dir
+}
+
+// Path returns the path of the artifact file name for t.
+func Path(t testing.TB, name string) string {
+	p := filepath.Join(Dir(t), name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("Could not create artifacts directory: %v", err)
+	}
+	return p
+}
+
+// Create creates the artifact file name for t. The file is closed when the
+// test ends.
+func Create(t testing.TB, name string) *os.File {
+	f, err := os.Create(Path(t, name))
+	if err != nil {
+		t.Fatalf("Could not create artifact: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// CopyOnFailure saves a copy of the file or directory src as the artifact
+// name if t fails. Missing sources are ignored, as a failure may happen before
+// they were produced.
+//
+// src is copied when the test ends, so it may be written to until then.
+func CopyOnFailure(t testing.TB, name, src string) {
+	if !Enabled() {
+		// A testtmp src is already retained on failure.
+		return
+	}
+	// Register Dir's cleanup first so that it runs after the copy.
+	dst := Path(t, name)
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			return
+		}
+		if err := cp.CopyTree(src, dst); err != nil {
+			t.Logf("Could not save artifact %s: %v", name, err)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testartifacts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirName(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{name: "TestFoo", want: "TestFoo"},
+		{name: "TestFoo/bar_baz", want: "TestFoo/bar_baz"},
+		{name: "TestFoo/*?", want: "TestFoo"},
+		{name: "TestFoo/../..", want: "TestFoo"},
+	} {
+		if got := dirName(tt.name); got != tt.want {
+			t.Errorf("dirName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPassedTestRemoved(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("VMTEST_ARTIFACTS_DIR", root)
+
+	var dir, src string
+	t.Run("sub", func(t *testing.T) {
+		dir = Dir(t)
+		if want := filepath.Join(root, "TestPassedTestRemoved", "sub"); dir != want {
+			t.Errorf("Dir = %s, want %s", dir, want)
+		}
+		if d := Dir(t); d != dir {
+			t.Errorf("Second Dir = %s, want %s", d, dir)
+		}
+		f := Create(t, "console.log")
+		if _, err := f.WriteString("hello"); err != nil {
+			t.Fatal(err)
+		}
+
+		src = filepath.Join(t.TempDir(), "results.json")
+		if err := os.WriteFile(src, []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		CopyOnFailure(t, "results.json", src)
+	})
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Artifacts of passed test were retained: %v", err)
+	}
+}
@@ -6,3 +6,9 @@ type Event struct {
 	ID     int
 	String string
 }
+
+// Command is the JSON test host command. The guest echoes it as an Event
+// with the same ID.
+type Command struct {
+	ID int
+}
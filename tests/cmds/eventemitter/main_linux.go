@@ -10,9 +10,39 @@ import (
 	"github.com/hugelgupf/vmtest/tests/cmds/eventemitter/event"
 )
 
-var skipClose = flag.Bool("skip-close", false, "Skip closing event channel")
+var (
+	skipClose = flag.Bool("skip-close", false, "Skip closing event channel")
+	commands  = flag.Bool("commands", false, "Echo host commands as events instead of emitting events")
+)
+
+func echoCommands() error {
+	cmds := make(chan event.Command)
+	f, err := guest.SerialCommandChannel[event.Event]("test", func(c event.Command) {
+		cmds <- c
+	})
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f.WaitCommands()
+		close(cmds)
+	}()
+	for c := range cmds {
+		if err := f.Emit(event.Event{ID: c.ID}); err != nil {
+			return err
+		}
+	}
+	return <-errCh
+}
 
 func realMain() error {
+	if *commands {
+		return echoCommands()
+	}
+
 	f, err := guest.SerialEventChannel[event.Event]("test")
 	if err != nil {
 		log.Fatal(err)
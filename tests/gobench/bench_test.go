@@ -1,6 +1,7 @@
 package bench
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/hugelgupf/vmtest/govmtest"
@@ -15,6 +16,24 @@ func TestRunBenchmarkInVM(t *testing.T) {
 	)
 }
 
+func TestRunBenchmarks(t *testing.T) {
+	results := govmtest.RunBenchmarks(t, "vm",
+		govmtest.WithPackageToTest("github.com/hugelgupf/vmtest/tests/gobench"),
+		govmtest.WithUimage(cover.WithCoverInstead("github.com/hugelgupf/vmtest/vminit/benchinit")),
+	)
+
+	var found bool
+	for _, r := range results {
+		t.Logf("Result: %#v", r)
+		if strings.HasPrefix(r.Name, "BenchmarkFib10") && r.N > 0 && r.NsPerOp > 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("No result for BenchmarkFib10 in %v", results)
+	}
+}
+
 func fib(n int) int {
 	if n < 2 {
 		return n
@@ -0,0 +1,17 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+
+// Package gocgo tests running cgo test binaries in the guest.
+package gocgo
+
+// #include <stdlib.h>
+//
+// static int add(int a, int b) { return abs(a) + abs(b); }
+import "C"
+
+func add(a, b int) int {
+	return int(C.add(C.int(a), C.int(b)))
+}
@@ -0,0 +1,31 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+
+package gocgo
+
+import (
+	"testing"
+
+	"github.com/hugelgupf/vmtest/govmtest"
+	"github.com/hugelgupf/vmtest/guest"
+	"github.com/hugelgupf/vmtest/internal/cover"
+)
+
+func TestCgoInVM(t *testing.T) {
+	govmtest.Run(t, "vm",
+		govmtest.WithPackageToTest("github.com/hugelgupf/vmtest/tests/gocgo"),
+		govmtest.WithCgo(),
+		govmtest.WithUimage(cover.WithCoverInstead("github.com/hugelgupf/vmtest/vminit/gouinit")),
+	)
+}
+
+func TestAdd(t *testing.T) {
+	guest.SkipIfNotInVM(t)
+
+	if got := add(-1, 2); got != 3 {
+		t.Errorf("add(-1, 2) = %d, want 3", got)
+	}
+}
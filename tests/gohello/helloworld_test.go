@@ -1,6 +1,7 @@
 package helloworld
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/hugelgupf/vmtest/govmtest"
@@ -13,7 +14,7 @@ import (
 func TestStartVM(t *testing.T) {
 	qemu.SkipWithoutQEMU(t)
 
-	govmtest.Run(t, "vm",
+	results := govmtest.Run(t, "vm",
 		govmtest.WithPackageToTest("github.com/hugelgupf/vmtest/tests/gohello"),
 		govmtest.WithUimage(
 			cover.WithCoverInstead("github.com/hugelgupf/vmtest/vminit/gouinit"),
@@ -27,6 +28,19 @@ func TestStartVM(t *testing.T) {
 			qemu.VirtioRandom(),
 		),
 	)
+
+	var found bool
+	for _, r := range results {
+		if r.Name == "TestHelloWorld" {
+			found = true
+			if r.State != govmtest.StatePass || !strings.Contains(r.Output, "Hello world") {
+				t.Errorf("TestHelloWorld = %s with output %q, want pass with Hello world", r.State, r.Output)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("No result for TestHelloWorld in %v", results)
+	}
 }
 
 func TestHelloWorld(t *testing.T) {
@@ -0,0 +1,54 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package golist
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/govmtest"
+	"github.com/hugelgupf/vmtest/guest"
+)
+
+func TestListTests(t *testing.T) {
+	tests := govmtest.ListTests(t, "vm",
+		govmtest.WithPackageToTest("github.com/hugelgupf/vmtest/tests/golist"),
+	)
+
+	want := map[string]bool{
+		"TestListTests": false,
+		"TestGuestOnly": false,
+		"BenchmarkNop":  false,
+		"Example":       false,
+	}
+	for _, test := range tests {
+		if test.Package != "github.com/hugelgupf/vmtest/tests/golist" {
+			t.Errorf("Test %s in unexpected package %s", test.Name, test.Package)
+		}
+		if _, ok := want[test.Name]; ok {
+			want[test.Name] = true
+		}
+	}
+	for name, found := range want {
+		if !found {
+			t.Errorf("%s not listed in %v", name, tests)
+		}
+	}
+}
+
+func TestGuestOnly(t *testing.T) {
+	guest.SkipIfNotInVM(t)
+
+	t.Fatalf("Listing tests must not run them")
+}
+
+func BenchmarkNop(b *testing.B) {
+	guest.SkipIfNotInVM(b)
+}
+
+func Example() {
+	fmt.Println("hello")
+	// Output: hello
+}
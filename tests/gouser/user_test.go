@@ -0,0 +1,56 @@
+package gouser
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/govmtest"
+	"github.com/hugelgupf/vmtest/qemu"
+)
+
+func TestRunUser(t *testing.T) {
+	if os.Getenv(govmtest.InUserEnv) == "1" {
+		t.Skip("Already running under RunUser")
+	}
+
+	results := govmtest.RunUser(t, "user",
+		govmtest.WithPackageToTest("github.com/hugelgupf/vmtest/tests/gouser"),
+		govmtest.WithSkipTests("TestSkipped"),
+	)
+
+	want := map[string]govmtest.TestState{
+		"TestArch":    govmtest.StatePass,
+		"TestRunUser": govmtest.StateSkip,
+	}
+	for _, r := range results {
+		if r.Name == "TestSkipped" {
+			t.Errorf("TestSkipped ran despite WithSkipTests")
+		}
+		if s, ok := want[r.Name]; ok {
+			if r.State != s {
+				t.Errorf("%s = %s with output %q, want %s", r.Name, r.State, r.Output, s)
+			}
+			delete(want, r.Name)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("No results for %v in %v", want, results)
+	}
+}
+
+func TestArch(t *testing.T) {
+	if os.Getenv(govmtest.InUserEnv) != "1" {
+		t.Skip("Only runs under RunUser")
+	}
+	if got, want := runtime.GOARCH, string(qemu.GuestArch()); got != want {
+		t.Errorf("GOARCH = %s, want %s", got, want)
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	if os.Getenv(govmtest.InUserEnv) != "1" {
+		t.Skip("Only runs under RunUser")
+	}
+	t.Fatal("Not skipped")
+}
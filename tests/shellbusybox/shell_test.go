@@ -0,0 +1,36 @@
+package shellbusybox
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"github.com/hugelgupf/vmtest/scriptvm"
+	"github.com/u-root/mkuimage/uimage"
+)
+
+// TestBusyboxShell runs the script under busybox sh. VMTEST_BUSYBOX is the
+// path of a static busybox binary for the guest architecture.
+func TestBusyboxShell(t *testing.T) {
+	qemu.SkipWithoutQEMU(t)
+
+	busybox := os.Getenv("VMTEST_BUSYBOX")
+	if busybox == "" {
+		t.Skip("Skipping busybox shell test as VMTEST_BUSYBOX is not set")
+	}
+
+	scriptvm.Run(t, "vm", `test "$(busybox readlink /proc/$$/exe)" = /bin/busybox`,
+		scriptvm.WithUimage(uimage.WithFiles(busybox+":bin/busybox")),
+		scriptvm.WithShell("busybox", "sh"),
+	)
+}
+
+// TestGoshArgs runs the script under gosh with arguments, which gosh must
+// still be added to the initramfs for.
+func TestGoshArgs(t *testing.T) {
+	qemu.SkipWithoutQEMU(t)
+
+	scriptvm.Run(t, "vm", `echo "Hello World"`,
+		scriptvm.WithShell("gosh", "-comp=false"),
+	)
+}
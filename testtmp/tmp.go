@@ -6,16 +6,25 @@
 // removed if the test passes.
 //
 // The directories are also retained if --keep-temp-dir is passed to the test.
+// VMTEST_KEEP_TEMP_DIR sets when they are retained: "failed" (the default),
+// "always", or "never".
+//
+// Directories are created in VMTEST_TEMP_DIR, or the OS temp directory if it
+// is not set. Use GC to remove old retained directories.
 package testtmp
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -24,6 +33,44 @@ var (
 	keepTempDir = flag.Bool("keep-temp-dir", false, "Keep temporary directory after test, even if test passed")
 )
 
+// ErrInvalidKeepMode is returned when VMTEST_KEEP_TEMP_DIR has an unknown
+// value.
+var ErrInvalidKeepMode = errors.New("VMTEST_KEEP_TEMP_DIR must be failed, always, or never")
+
+// Values of VMTEST_KEEP_TEMP_DIR.
+const (
+	KeepFailed = "failed"
+	KeepAlways = "always"
+	KeepNever  = "never"
+)
+
+// dirPrefix starts the names of all directories created by TempDir, so that
+// GC does not remove other directories.
+const dirPrefix = "vmtest-"
+
+// Root returns the directory that TempDir creates directories in:
+// VMTEST_TEMP_DIR, or the OS temp directory if it is not set.
+func Root() string {
+	if dir := os.Getenv("VMTEST_TEMP_DIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+func keepMode() (string, error) {
+	if *keepTempDir {
+		return KeepAlways, nil
+	}
+	switch mode := os.Getenv("VMTEST_KEEP_TEMP_DIR"); mode {
+	case "":
+		return KeepFailed, nil
+	case KeepFailed, KeepAlways, KeepNever:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w, not %q", ErrInvalidKeepMode, mode)
+	}
+}
+
 var (
 	mu       sync.Mutex
 	tempDirs = map[string]string{}
@@ -35,8 +82,14 @@ var (
 //
 // Each call to TempDir creates a new directory.
 //
-// If the test fails or if --keep-temp-dir is set, it will not be removed.
+// If the test fails or if --keep-temp-dir is set, it will not be removed and
+// its path is logged. See the package documentation for VMTEST_KEEP_TEMP_DIR.
 func TempDir(t testing.TB) string {
+	mode, err := keepMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	mu.Lock()
 	rootDir, ok := tempDirs[t.Name()]
 	var rootErr error
@@ -64,16 +117,16 @@ func TempDir(t testing.TB) string {
 		}
 		pattern := strings.Map(mapper, t.Name())
 
-		rootDir, rootErr = os.MkdirTemp("", pattern)
+		rootDir, rootErr = os.MkdirTemp(Root(), dirPrefix+pattern)
 		if rootErr == nil {
 			tempDirs[t.Name()] = rootDir
 			t.Cleanup(func() {
 				switch {
-				case t.Failed():
+				case t.Failed() && mode != KeepNever:
 					t.Logf("Keeping temp dir due to test failure: %s", rootDir)
 
-				case *keepTempDir:
-					t.Logf("Keeping temp dir as requested by --keep-temp-dir: %s", rootDir)
+				case mode == KeepAlways:
+					t.Logf("Keeping temp dir as requested: %s", rootDir)
 
 				default:
 					if err := os.RemoveAll(rootDir); err != nil {
@@ -106,3 +159,79 @@ func TempDir(t testing.TB) string {
 	}
 	return dir
 }
+
+// RetentionPolicy limits the directories retained by TempDir. Zero values
+// mean no limit.
+type RetentionPolicy struct {
+	// MaxAge is how long ago a directory may last have been modified.
+	MaxAge time.Duration
+
+	// MaxSize is the total size in bytes of all directories. The oldest
+	// directories are removed first until they fit.
+	MaxSize int64
+}
+
+type retainedDir struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// GC removes the directories created by TempDir in root (see Root) that
+// exceed p, e.g. ones retained by failed tests of earlier runs, and returns
+// their paths.
+//
+// Directories of tests that are still running may be removed if they exceed
+// p, so call GC before starting tests, e.g. in TestMain.
+func GC(root string, p RetentionPolicy) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []retainedDir
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), dirPrefix) {
+			continue
+		}
+		d := retainedDir{path: filepath.Join(root, e.Name())}
+		err := filepath.WalkDir(d.path, func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := de.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(d.modTime) {
+				d.modTime = info.ModTime()
+			}
+			if info.Mode().IsRegular() {
+				d.size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, d)
+	}
+	// Newest first.
+	slices.SortFunc(dirs, func(a, b retainedDir) int {
+		return b.modTime.Compare(a.modTime)
+	})
+
+	var removed []string
+	var size int64
+	now := time.Now()
+	for _, d := range dirs {
+		size += d.size
+		if (p.MaxAge == 0 || now.Sub(d.modTime) <= p.MaxAge) && (p.MaxSize == 0 || size <= p.MaxSize) {
+			continue
+		}
+		if err := os.RemoveAll(d.path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, d.path)
+	}
+	return removed, nil
+}
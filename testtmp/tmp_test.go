@@ -0,0 +1,114 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testtmp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTempDirRoot(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("VMTEST_TEMP_DIR", root)
+
+	dir := TempDir(t)
+	if !strings.HasPrefix(dir, filepath.Join(root, dirPrefix)) {
+		t.Errorf("TempDir = %s, want it in %s", dir, root)
+	}
+}
+
+func TestKeepMode(t *testing.T) {
+	for _, tt := range []struct {
+		env     string
+		want    string
+		wantErr error
+	}{
+		{env: "", want: KeepFailed},
+		{env: "always", want: KeepAlways},
+		{env: "never", want: KeepNever},
+		{env: "sometimes", wantErr: ErrInvalidKeepMode},
+	} {
+		t.Setenv("VMTEST_KEEP_TEMP_DIR", tt.env)
+		got, err := keepMode()
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("keepMode(%q) = %q, %v, want %q, %v", tt.env, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name string
+		p    RetentionPolicy
+		want []string
+	}{
+		{
+			name: "no-limit",
+		},
+		{
+			name: "age",
+			p:    RetentionPolicy{MaxAge: 36 * time.Hour},
+			want: []string{"vmtest-old"},
+		},
+		{
+			name: "size",
+			p:    RetentionPolicy{MaxSize: 15},
+			want: []string{"vmtest-mid", "vmtest-old"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, d := range []struct {
+				name string
+				age  time.Duration
+			}{
+				{"vmtest-new", time.Hour},
+				{"vmtest-mid", 24 * time.Hour},
+				{"vmtest-old", 48 * time.Hour},
+				{"other", 48 * time.Hour},
+			} {
+				dir := filepath.Join(root, d.name)
+				if err := os.Mkdir(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				file := filepath.Join(dir, "file")
+				if err := os.WriteFile(file, []byte("0123456789"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range []string{file, dir} {
+					if err := os.Chtimes(p, now.Add(-d.age), now.Add(-d.age)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			removed, err := GC(root, tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range removed {
+				got = append(got, filepath.Base(r))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("GC removed %v, want %v", got, tt.want)
+			}
+			for _, name := range got {
+				if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+					t.Errorf("%s was not removed: %v", name, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(root, "other")); err != nil {
+				t.Errorf("GC removed a directory not created by TempDir: %v", err)
+			}
+		})
+	}
+}
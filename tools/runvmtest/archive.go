@@ -0,0 +1,362 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Errors returned for archive sources.
+var (
+	ErrChecksumRequired = errors.New("sha256 checksum is required for archive URLs")
+	ErrChecksumMismatch = errors.New("archive checksum mismatch")
+	ErrNotInArchive     = errors.New("path not found in archive")
+	ErrUnsafePath       = errors.New("archive entry escapes target directory")
+)
+
+// archiveFetcher exports files and directories from tar archives at HTTP(S)
+// URLs or local paths, verifying their SHA-256 checksums.
+//
+// Archives may be uncompressed or compressed with gzip or zstd.
+type archiveFetcher struct {
+	mu sync.Mutex
+
+	// checksums are the expected checksums by archive location.
+	checksums map[string]string
+
+	// tmpDir holds downloaded archives.
+	tmpDir string
+
+	// locals are local copies of archives with verified checksums by
+	// location.
+	locals onceMap[string]
+}
+
+func newArchiveFetcher() *archiveFetcher {
+	return &archiveFetcher{
+		checksums: make(map[string]string),
+	}
+}
+
+// add registers the archive at location with its expected hex SHA-256
+// checksum, which may be empty for local archives.
+func (a *archiveFetcher) add(location, checksum string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checksums[location] = strings.ToLower(checksum)
+}
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// digest returns the archive's expected checksum, or the checksum of a local
+// archive without expected checksum.
+func (a *archiveFetcher) digest(ctx context.Context, location string) (string, error) {
+	a.mu.Lock()
+	checksum := a.checksums[location]
+	a.mu.Unlock()
+	if checksum != "" {
+		return "sha256:" + checksum, nil
+	}
+	if isURL(location) {
+		return "", fmt.Errorf("%w: %s", ErrChecksumRequired, location)
+	}
+	sum, err := fileSHA256(location)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + sum, nil
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// local returns a local copy of the archive at location with a verified
+// checksum.
+func (a *archiveFetcher) local(ctx context.Context, location string) (string, error) {
+	return a.locals.do(location, func() (string, error) {
+		a.mu.Lock()
+		want := a.checksums[location]
+		a.mu.Unlock()
+
+		p := location
+		if isURL(location) {
+			if want == "" {
+				return "", fmt.Errorf("%w: %s", ErrChecksumRequired, location)
+			}
+			dir, err := a.downloadDir()
+			if err != nil {
+				return "", err
+			}
+			p = filepath.Join(dir, key(location))
+			if err := download(ctx, location, p); err != nil {
+				return "", fmt.Errorf("could not download %s: %w", location, err)
+			}
+		}
+		if want != "" {
+			got, err := fileSHA256(p)
+			if err != nil {
+				return "", err
+			}
+			if got != want {
+				return "", fmt.Errorf("%w: %s has sha256 %s, want %s", ErrChecksumMismatch, location, got, want)
+			}
+		}
+		return p, nil
+	})
+}
+
+// downloadDir returns the directory to download archives to.
+func (a *archiveFetcher) downloadDir() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.tmpDir == "" {
+		dir, err := os.MkdirTemp("", "runvmtest-download")
+		if err != nil {
+			return "", err
+		}
+		a.tmpDir = dir
+	}
+	return a.tmpDir, nil
+}
+
+func download(ctx context.Context, url, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close removes downloaded archives.
+func (a *archiveFetcher) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(a.tmpDir)
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openTar opens the archive at p, decompressing it based on its magic bytes.
+func openTar(p string) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), f, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), closerFunc(func() error {
+			zr.Close()
+			return f.Close()
+		}), nil
+	default:
+		return tar.NewReader(br), f, nil
+	}
+}
+
+type closerFunc func() error
+
+func (c closerFunc) Close() error {
+	return c()
+}
+
+// cleanEntry returns the archive-relative form of name, so that "/bzImage",
+// "./bzImage" and "bzImage" are the same.
+func cleanEntry(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (a *archiveFetcher) exportFile(ctx context.Context, location, p, dst string) error {
+	return a.extract(ctx, location, p, dst, false)
+}
+
+func (a *archiveFetcher) exportDirectory(ctx context.Context, location, p, dst string) error {
+	return a.extract(ctx, location, p, dst, true)
+}
+
+// extract extracts the file or directory at p in the archive to dst.
+func (a *archiveFetcher) extract(ctx context.Context, location, p, dst string, dir bool) error {
+	local, err := a.local(ctx, location)
+	if err != nil {
+		return err
+	}
+	tr, c, err := openTar(local)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	want := cleanEntry(p)
+	var found bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", location, err)
+		}
+		name := cleanEntry(hdr.Name)
+
+		var target string
+		switch {
+		case name == want:
+			target = dst
+		case dir && (want == "" || strings.HasPrefix(name, want+"/")):
+			target = filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(name, want)))
+		default:
+			continue
+		}
+		found = true
+		if err := writeEntry(tr, hdr, target, dst); err != nil {
+			return err
+		}
+		if !dir {
+			return nil
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %s in %s", ErrNotInArchive, p, location)
+	}
+	if dir {
+		// An archive may not have an entry for the directory itself.
+		return os.MkdirAll(dst, 0o755)
+	}
+	return nil
+}
+
+// writeEntry writes the tar entry hdr to target, which must be within root.
+//
+// Neither target nor the directories between root and it may be symlinks, and
+// symlinks must point within root, so that a symlink extracted before cannot
+// redirect writes outside of root.
+func writeEntry(r io.Reader, hdr *tar.Header, target, root string) error {
+	if !withinRoot(root, target) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, hdr.Name)
+	}
+	if err := checkNoSymlinks(root, target); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrUnsafePath, hdr.Name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	mode := hdr.FileInfo().Mode().Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, mode|0o700)
+	case tar.TypeSymlink:
+		link := filepath.FromSlash(hdr.Linkname)
+		if path.IsAbs(hdr.Linkname) || filepath.IsAbs(link) || !withinRoot(root, filepath.Join(filepath.Dir(target), link)) {
+			return fmt.Errorf("%w: symlink %s -> %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+		}
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	default:
+		// Devices, hard links etc. are not needed for kernels and QEMU.
+		return nil
+	}
+}
+
+// withinRoot returns whether p is root or lexically within it.
+func withinRoot(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkNoSymlinks returns an error if target or any directory between root
+// and target is an existing symlink.
+func checkNoSymlinks(root, target string) error {
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." {
+		return err
+	}
+	p := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func writeTar(t *testing.T, w io.Writer, files map[string]string) {
+	t.Helper()
+	tw := tar.NewWriter(w)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var archiveFiles = map[string]string{
+	"./bzImage":                 "kernel",
+	"zqemu/bin/qemu-system-x86": "qemu",
+	"zqemu/pc-bios/bios.bin":    "bios",
+}
+
+func makeArchives(t *testing.T) map[string][]byte {
+	var plain, gz, zst bytes.Buffer
+	writeTar(t, &plain, archiveFiles)
+
+	gw := gzip.NewWriter(&gz)
+	writeTar(t, gw, archiveFiles)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTar(t, zw, archiveFiles)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"a.tar":     plain.Bytes(),
+		"a.tar.gz":  gz.Bytes(),
+		"a.tar.zst": zst.Bytes(),
+	}
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestArchiveExport(t *testing.T) {
+	archives := makeArchives(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b, ok := archives[filepath.Base(r.URL.Path)]; ok {
+			_, _ = w.Write(b)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	for name, b := range archives {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, b := range archives {
+		for _, location := range []string{filepath.Join(dir, name), srv.URL + "/" + name} {
+			t.Run(location, func(t *testing.T) {
+				a := newArchiveFetcher()
+				defer a.Close()
+				a.add(location, sha256Hex(b))
+
+				if d, err := a.digest(context.Background(), location); err != nil || d != "sha256:"+sha256Hex(b) {
+					t.Errorf("digest = (%s, %v), want sha256:%s", d, err, sha256Hex(b))
+				}
+
+				out := t.TempDir()
+				if err := a.exportFile(context.Background(), location, "/bzImage", filepath.Join(out, "bzImage")); err != nil {
+					t.Fatalf("exportFile = %v", err)
+				}
+				if got := readFile(t, filepath.Join(out, "bzImage")); got != "kernel" {
+					t.Errorf("bzImage = %q, want kernel", got)
+				}
+
+				if err := a.exportDirectory(context.Background(), location, "/zqemu", filepath.Join(out, "zqemu")); err != nil {
+					t.Fatalf("exportDirectory = %v", err)
+				}
+				if got := readFile(t, filepath.Join(out, "zqemu/bin/qemu-system-x86")); got != "qemu" {
+					t.Errorf("qemu = %q, want qemu", got)
+				}
+				if got := readFile(t, filepath.Join(out, "zqemu/pc-bios/bios.bin")); got != "bios" {
+					t.Errorf("bios = %q, want bios", got)
+				}
+
+				if err := a.exportFile(context.Background(), location, "/Image", filepath.Join(out, "Image")); !errors.Is(err, ErrNotInArchive) {
+					t.Errorf("exportFile(/Image) = %v, want %v", err, ErrNotInArchive)
+				}
+			})
+		}
+	}
+}
+
+func TestArchiveChecksum(t *testing.T) {
+	archives := makeArchives(t)
+	p := filepath.Join(t.TempDir(), "a.tar.gz")
+	if err := os.WriteFile(p, archives["a.tar.gz"], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newArchiveFetcher()
+	defer a.Close()
+	a.add(p, sha256Hex([]byte("something else")))
+	if err := a.exportFile(context.Background(), p, "bzImage", filepath.Join(t.TempDir(), "bzImage")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("exportFile = %v, want %v", err, ErrChecksumMismatch)
+	}
+
+	// Local archives without checksum are identified by their contents.
+	a = newArchiveFetcher()
+	defer a.Close()
+	a.add(p, "")
+	if d, err := a.digest(context.Background(), p); err != nil || d != "sha256:"+sha256Hex(archives["a.tar.gz"]) {
+		t.Errorf("digest = (%s, %v), want checksum of archive", d, err)
+	}
+
+	a.add("https://example.com/a.tar.gz", "")
+	if _, err := a.digest(context.Background(), "https://example.com/a.tar.gz"); !errors.Is(err, ErrChecksumRequired) {
+		t.Errorf("digest of URL without checksum = %v, want %v", err, ErrChecksumRequired)
+	}
+}
+
+func TestArchiveUnsafePath(t *testing.T) {
+	var b bytes.Buffer
+	writeTar(t, &b, map[string]string{"dir/../../evil": "evil"})
+	p := filepath.Join(t.TempDir(), "a.tar")
+	if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newArchiveFetcher()
+	defer a.Close()
+	out := t.TempDir()
+	// cleanEntry resolves the entry to "evil" outside of "dir".
+	if err := a.exportDirectory(context.Background(), p, "dir", filepath.Join(out, "dir")); !errors.Is(err, ErrNotInArchive) {
+		t.Errorf("exportDirectory = %v, want %v", err, ErrNotInArchive)
+	}
+	if _, err := os.Stat(filepath.Join(out, "evil")); !os.IsNotExist(err) {
+		t.Errorf("entry escaped target directory: %v", err)
+	}
+}
+
+func TestArchiveSymlinkEscape(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []tar.Header
+	}{
+		{
+			name: "absolute",
+			entries: []tar.Header{
+				{Name: "d/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				{Name: "d/link/passwd", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name: "relative",
+			entries: []tar.Header{
+				{Name: "d/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+				{Name: "d/link/passwd", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name: "through-symlink",
+			entries: []tar.Header{
+				{Name: "d/sub/x", Typeflag: tar.TypeReg},
+				{Name: "d/link", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+				{Name: "d/link/passwd", Typeflag: tar.TypeReg},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			tw := tar.NewWriter(&b)
+			for _, hdr := range tt.entries {
+				hdr := hdr
+				hdr.Mode = 0o644
+				if hdr.Typeflag == tar.TypeReg {
+					hdr.Size = 4
+				}
+				if err := tw.WriteHeader(&hdr); err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeReg {
+					if _, err := tw.Write([]byte("evil")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			p := filepath.Join(t.TempDir(), "a.tar")
+			if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			a := newArchiveFetcher()
+			defer a.Close()
+			out := filepath.Join(t.TempDir(), "out")
+			if err := a.exportDirectory(context.Background(), p, "d", out); !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("exportDirectory = %v, want %v", err, ErrUnsafePath)
+			}
+			if _, err := os.Stat(filepath.Join(out, "sub", "passwd")); !os.IsNotExist(err) {
+				t.Errorf("entry written through symlink: %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveDotDotName(t *testing.T) {
+	var b bytes.Buffer
+	writeTar(t, &b, map[string]string{"d/..foo": "foo"})
+	p := filepath.Join(t.TempDir(), "a.tar")
+	if err := os.WriteFile(p, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newArchiveFetcher()
+	defer a.Close()
+	out := filepath.Join(t.TempDir(), "out")
+	if err := a.exportDirectory(context.Background(), p, "d", out); err != nil {
+		t.Fatalf("exportDirectory = %v", err)
+	}
+	if got := readFile(t, filepath.Join(out, "..foo")); got != "foo" {
+		t.Errorf("..foo = %q, want foo", got)
+	}
+}
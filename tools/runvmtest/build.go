@@ -0,0 +1,167 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// kernelBuild describes how to build the kernel of a VMTEST_ARCH, the same
+// way as the images/kernel-* containers.
+type kernelBuild struct {
+	// arch is the kernel's ARCH.
+	arch string
+
+	// crossCompile is the kernel's CROSS_COMPILE, provided by the Ubuntu
+	// package compiler.
+	crossCompile string
+	compiler     string
+
+	// image is the path of the kernel image in the build tree.
+	image string
+}
+
+// kernelBuilds are the kernel builds by VMTEST_ARCH. They run on amd64.
+var kernelBuilds = map[string]kernelBuild{
+	"amd64": {
+		arch:  "x86_64",
+		image: "arch/x86/boot/bzImage",
+	},
+	"arm": {
+		arch:         "arm",
+		crossCompile: "arm-linux-gnueabi-",
+		compiler:     "gcc-arm-linux-gnueabi",
+		image:        "arch/arm/boot/zImage",
+	},
+	"arm64": {
+		arch:         "arm64",
+		crossCompile: "aarch64-linux-gnu-",
+		compiler:     "gcc-aarch64-linux-gnu",
+		image:        "arch/arm64/boot/Image",
+	},
+	"riscv64": {
+		arch:         "riscv",
+		crossCompile: "riscv64-linux-gnu-",
+		compiler:     "gcc-riscv64-linux-gnu",
+		image:        "arch/riscv/boot/Image",
+	},
+}
+
+const (
+	kernelBuildImage = "ubuntu:rolling"
+	kernelRepo       = "https://git.kernel.org/pub/scm/linux/kernel/git/stable/linux.git"
+)
+
+// key identifies the build of version with config in the artifact cache.
+func (b kernelBuild) key(version string, config []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", kernelBuildImage, b.arch, b.crossCompile, version)
+	h.Write(config)
+	return "kernel-build:sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// container returns a container that has built version with config.
+func (b kernelBuild) container(client *dagger.Client, version string, config *dagger.File) *dagger.Container {
+	packages := []string{"ca-certificates", "bc", "bison", "flex", "gcc", "git", "make", "libelf-dev", "libssl-dev"}
+	if b.compiler != "" {
+		packages = append(packages, b.compiler)
+	}
+	return client.Container(dagger.ContainerOpts{Platform: "linux/amd64"}).
+		From(kernelBuildImage).
+		WithEnvVariable("DEBIAN_FRONTEND", "noninteractive").
+		WithExec([]string{"apt-get", "update"}).
+		WithExec(append([]string{"apt-get", "install", "-y", "--no-install-recommends"}, packages...)).
+		WithWorkdir("/root").
+		WithExec([]string{"git", "clone", "--depth=1", "--branch=" + version, kernelRepo, "linux"}).
+		WithWorkdir("/root/linux").
+		WithFile(".config", config).
+		WithEnvVariable("ARCH", b.arch).
+		WithEnvVariable("CROSS_COMPILE", b.crossCompile).
+		WithExec([]string{"make", "olddefconfig"}).
+		WithExec([]string{"sh", "-c", "make -j$(($(nproc) * 2 + 1))"})
+}
+
+// buildKernel returns the kernel image of arch's kernel version built with
+// config, calling build to build it into the cache c unless it is there
+// already.
+func buildKernel(ctx context.Context, c *artifactCache, arch, version string, config []byte, build exportFunc) (path string, cached bool, err error) {
+	b, ok := kernelBuilds[arch]
+	if !ok {
+		return "", false, fmt.Errorf("%w %q (have %s)", ErrUnknownArch, arch, strings.Join(sortedKeys(kernelBuilds), ", "))
+	}
+	dir, err := c.dir(b.key(version, config))
+	if err != nil {
+		return "", false, err
+	}
+	dst := filepath.Join(dir, filepath.Base(b.image))
+	if _, err := os.Stat(dst); err == nil {
+		return dst, true, nil
+	}
+	if err := exportOnce(ctx, build, version, b.image, dst); err != nil {
+		return "", false, fmt.Errorf("failed to build kernel %s for %s: %w", version, arch, err)
+	}
+	return dst, false, nil
+}
+
+func buildKernelCmd(args []string) error {
+	fs := flag.NewFlagSet("build-kernel", flag.ExitOnError)
+	kconfig := fs.String("config", "", "Kernel .config or defconfig to build with (required)")
+	version := fs.String("version", "v6.6", "Kernel git tag to build")
+	arch := fs.String("arch", "", "VMTEST_ARCH to build for (default: $VMTEST_ARCH or GOARCH)")
+	fs.StringVar(cacheDir, "cache-dir", "", "Directory artifacts are cached in (default: $XDG_CACHE_HOME/vmtest/runvmtest)")
+	_ = fs.Parse(args)
+
+	if *kconfig == "" {
+		return fmt.Errorf("usage: `%s build-kernel -config path/to/defconfig [-version v6.6] [-arch amd64]`", os.Args[0])
+	}
+	if *arch == "" {
+		*arch = envOr("VMTEST_ARCH", runtime.GOARCH)
+	}
+	config, err := os.ReadFile(*kconfig)
+	if err != nil {
+		return err
+	}
+	c, err := openArtifactCache(*cacheDir)
+	if err != nil {
+		return err
+	}
+
+	d := &daggerFetcher{opts: []dagger.ClientOpt{dagger.WithLogOutput(os.Stderr)}}
+	defer d.Close()
+	build := func(ctx context.Context, version, path, dst string) error {
+		client, err := d.connect(ctx)
+		if err != nil {
+			return err
+		}
+		b := kernelBuilds[*arch]
+		if ok, err := b.container(client, version, client.Host().File(*kconfig)).File(path).Export(ctx, dst); !ok || err != nil {
+			return fmt.Errorf("failed kernel export: %w", err)
+		}
+		return nil
+	}
+
+	path, cached, err := buildKernel(context.Background(), c, *arch, *version, config, build)
+	if err != nil {
+		return err
+	}
+	if cached {
+		fmt.Fprintf(os.Stderr, "Using cached kernel %s for %s with %s\n", *version, *arch, *kconfig)
+	} else {
+		fmt.Fprintf(os.Stderr, "Built kernel %s for %s with %s\n", *version, *arch, *kconfig)
+	}
+	// For eval, like -print-env.
+	fmt.Printf("export VMTEST_KERNEL=%s\n", shellQuote(path))
+	return nil
+}
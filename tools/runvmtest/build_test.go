@@ -0,0 +1,75 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildKernel(t *testing.T) {
+	c, err := openArtifactCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var builds int
+	build := func(ctx context.Context, version, p, dst string) error {
+		builds++
+		if version != "v6.6" || p != "arch/x86/boot/bzImage" {
+			t.Errorf("build(%s, %s), want v6.6 arch/x86/boot/bzImage", version, p)
+		}
+		return os.WriteFile(dst, []byte("kernel"), 0o644)
+	}
+	ctx := context.Background()
+
+	p, cached, err := buildKernel(ctx, c, "amd64", "v6.6", []byte("CONFIG_GCOV_KERNEL=y\n"), build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached || filepath.Base(p) != "bzImage" || readFile(t, p) != "kernel" {
+		t.Errorf("buildKernel = (%s, %t), want newly built bzImage", p, cached)
+	}
+
+	p2, cached, err := buildKernel(ctx, c, "amd64", "v6.6", []byte("CONFIG_GCOV_KERNEL=y\n"), build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached || p2 != p || builds != 1 {
+		t.Errorf("buildKernel = (%s, %t) after %d builds, want cached %s after 1 build", p2, cached, builds, p)
+	}
+
+	// A different config is built again.
+	p3, _, err := buildKernel(ctx, c, "amd64", "v6.6", []byte("CONFIG_9P_FS=y\n"), build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p3 == p || builds != 2 {
+		t.Errorf("buildKernel = %s after %d builds, want new build", p3, builds)
+	}
+
+	if _, _, err := buildKernel(ctx, c, "mips", "v6.6", nil, build); !errors.Is(err, ErrUnknownArch) {
+		t.Errorf("buildKernel(mips) = %v, want %v", err, ErrUnknownArch)
+	}
+}
+
+// The built kernel has the same name as in the default kernel container.
+func TestKernelBuildsMatchDefaults(t *testing.T) {
+	for arch, b := range kernelBuilds {
+		kernel, ok := defaultConfig[arch]["VMTEST_KERNEL"]
+		if !ok {
+			t.Errorf("No default VMTEST_KERNEL for %s", arch)
+			continue
+		}
+		for _, file := range kernel.Files {
+			if path.Base(file) != path.Base(b.image) {
+				t.Errorf("%s: built kernel %s, default kernel %s", arch, path.Base(b.image), file)
+			}
+		}
+	}
+}
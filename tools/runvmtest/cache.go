@@ -0,0 +1,169 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// artifactCache stores files exported from container images, keyed by image
+// digest.
+//
+// Each image has its own directory named after its digest, whose contents
+// mirror the paths in the image. A directory's modification time is when it
+// was last used. The refs directory records the digest that each image
+// reference last resolved to.
+//
+// internal/imagecache, used by qfirmware.DownloadOVMF and package qartifacts,
+// reads and writes the cache in the default directory as well, so the layout
+// must remain compatible.
+type artifactCache struct {
+	root string
+}
+
+// defaultCacheDir returns $XDG_CACHE_HOME/vmtest/runvmtest or its platform
+// equivalent.
+func defaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("could not find user cache directory (use -cache-dir or -no-cache): %w", err)
+	}
+	return filepath.Join(dir, "vmtest", "runvmtest"), nil
+}
+
+// openArtifactCache opens the cache in root, or in the default cache
+// directory if root is empty.
+func openArtifactCache(root string) (*artifactCache, error) {
+	if root == "" {
+		var err error
+		if root, err = defaultCacheDir(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+	return &artifactCache{root: root}, nil
+}
+
+// refsDir is the name of the directory in the cache root recording which
+// digest image references resolved to.
+const refsDir = "refs"
+
+// key returns a file name for s, which may contain characters such as ':'
+// that are not valid in file names everywhere.
+func key(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:16])
+}
+
+// imageDir returns the cache directory for image digest.
+func (c *artifactCache) imageDir(digest string) string {
+	return filepath.Join(c.root, key(digest))
+}
+
+// dir returns the cache directory for image digest and marks it as used.
+func (c *artifactCache) dir(digest string) (string, error) {
+	dir := c.imageDir(digest)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("could not create cache directory: %w", err)
+	}
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// recordRef records that ref resolved to digest.
+func (c *artifactCache) recordRef(ref, digest string) error {
+	dir := filepath.Join(c.root, refsDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// Several variables may come from the same ref, so write atomically.
+	f, err := os.CreateTemp(dir, ".ref-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(digest); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, key(ref)))
+}
+
+// lookupRef returns the digest ref last resolved to, if any.
+func (c *artifactCache) lookupRef(ref string) (string, bool) {
+	b, err := os.ReadFile(filepath.Join(c.root, refsDir, key(ref)))
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// gc removes image directories that were last used before cutoff and returns
+// their number.
+func (c *artifactCache) gc(cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, e := range entries {
+		if e.Name() == refsDir {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return removed, err
+		}
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.root, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func cacheCmd(args []string) error {
+	if len(args) < 1 || args[0] != "gc" {
+		return fmt.Errorf("usage: `%s cache gc [-max-age=720h] [-all]`", os.Args[0])
+	}
+
+	fs := flag.NewFlagSet("cache gc", flag.ExitOnError)
+	dir := fs.String("cache-dir", "", "Directory artifacts are cached in (default: $XDG_CACHE_HOME/vmtest/runvmtest)")
+	maxAge := fs.Duration("max-age", 30*24*time.Hour, "Remove artifacts of images not used for this long")
+	all := fs.Bool("all", false, "Remove all cached artifacts")
+	_ = fs.Parse(args[1:])
+
+	c, err := openArtifactCache(*dir)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-*maxAge)
+	if *all {
+		cutoff = time.Now().Add(time.Hour)
+	}
+	n, err := c.gc(cutoff)
+	if err != nil {
+		return fmt.Errorf("cache gc: %w", err)
+	}
+	fmt.Printf("Removed %d cached image(s) from %s\n", n, c.root)
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExportOnce(t *testing.T) {
+	c, err := openArtifactCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := c.dir("sha256:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exports int
+	export := func(ctx context.Context, ref, path, dst string) error {
+		exports++
+		return os.WriteFile(dst, []byte(ref+":"+path), 0o644)
+	}
+	dst := filepath.Join(dir, "bzImage")
+	for i := 0; i < 2; i++ {
+		if err := exportOnce(context.Background(), export, "kernel:main", "/bzImage", dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exports != 1 {
+		t.Errorf("exported %d times, want 1", exports)
+	}
+	if b, err := os.ReadFile(dst); err != nil || string(b) != "kernel:main:/bzImage" {
+		t.Errorf("exported file = (%q, %v), want kernel:main:/bzImage", b, err)
+	}
+
+	if again, err := c.dir("sha256:1234"); err != nil || again != dir {
+		t.Errorf("dir = (%s, %v), want %s", again, err, dir)
+	}
+	if other, err := c.dir("sha256:5678"); err != nil || other == dir {
+		t.Errorf("dir of other digest = (%s, %v), want != %s", other, err, dir)
+	}
+}
+
+func TestCacheGC(t *testing.T) {
+	c, err := openArtifactCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := c.dir("sha256:old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := c.dir("sha256:fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastUsed := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := c.gc(time.Now().Add(-24 * time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("gc = (%d, %v), want 1", n, err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old cache entry still exists: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh cache entry was removed: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// cliFetcher exports from container images using the docker or podman CLI,
+// which do not need an engine container like dagger does.
+type cliFetcher struct {
+	// bin is the CLI binary, e.g. docker or podman.
+	bin string
+
+	// output receives progress output of pulls, if non-nil.
+	output io.Writer
+
+	// pulls are the images that were pulled.
+	pulls onceMap[struct{}]
+	// containers are created (but never started) containers by image.
+	containers onceMap[string]
+}
+
+func newCLIFetcher(bin string, output io.Writer) *cliFetcher {
+	return &cliFetcher{
+		bin:    bin,
+		output: output,
+	}
+}
+
+func (c *cliFetcher) command(ctx context.Context, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.bin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", c.bin, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// pull pulls ref unless it was pulled already.
+func (c *cliFetcher) pull(ctx context.Context, ref string) error {
+	_, err := c.pulls.do(ref, func() (struct{}, error) {
+		return struct{}{}, c.pullOnce(ctx, ref)
+	})
+	return err
+}
+
+func (c *cliFetcher) pullOnce(ctx context.Context, ref string) error {
+	cmd := exec.CommandContext(ctx, c.bin, "pull", ref)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if c.output != nil {
+		cmd.Stdout = c.output
+		cmd.Stderr = io.MultiWriter(c.output, &stderr)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s pull %s: %w: %s", c.bin, ref, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (c *cliFetcher) digest(ctx context.Context, ref string) (string, error) {
+	if err := c.pull(ctx, ref); err != nil {
+		return "", err
+	}
+	out, err := c.command(ctx, "image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", ref)
+	if err != nil {
+		return "", err
+	}
+	// Repo digests are name@sha256:...
+	for _, line := range strings.Split(out, "\n") {
+		if _, digest, ok := strings.Cut(strings.TrimSpace(line), "@"); ok {
+			return digest, nil
+		}
+	}
+	// Locally built images have no repo digest.
+	return c.command(ctx, "image", "inspect", "--format", "{{.Id}}", ref)
+}
+
+// container returns a container created from ref.
+func (c *cliFetcher) container(ctx context.Context, ref string) (string, error) {
+	return c.containers.do(ref, func() (string, error) {
+		if err := c.pull(ctx, ref); err != nil {
+			return "", err
+		}
+		// Images with only files may not have a command, but create
+		// requires one. It is never run.
+		return c.command(ctx, "create", ref, "/nonexistent")
+	})
+}
+
+func (c *cliFetcher) copy(ctx context.Context, ref, path, dst string) error {
+	id, err := c.container(ctx, ref)
+	if err != nil {
+		return err
+	}
+	_, err = c.command(ctx, "cp", id+":"+path, dst)
+	return err
+}
+
+func (c *cliFetcher) exportFile(ctx context.Context, ref, path, dst string) error {
+	return c.copy(ctx, ref, path, dst)
+}
+
+func (c *cliFetcher) exportDirectory(ctx context.Context, ref, path, dst string) error {
+	return c.copy(ctx, ref, path, dst)
+}
+
+// Close removes created containers.
+func (c *cliFetcher) Close() error {
+	var errs []error
+	for _, id := range c.containers.values() {
+		if _, err := c.command(context.Background(), "rm", "-f", id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
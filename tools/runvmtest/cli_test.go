@@ -0,0 +1,84 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeDocker is a docker CLI that logs its arguments and copies files from
+// the directory $ROOT.
+const fakeDocker = `#!/bin/sh
+echo "$@" >> "$LOG"
+case "$1" in
+pull) echo "pulled $2" ;;
+image) echo "ghcr.io/hugelgupf/vmtest/kernel-amd64@sha256:abcd" ;;
+create) echo "container-1" ;;
+cp) cp -r "$ROOT/${2#container-1:}" "$3" ;;
+rm) ;;
+*) exit 1 ;;
+esac
+`
+
+func TestCLIFetcher(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "docker")
+	if err := os.WriteFile(bin, []byte(fakeDocker), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "zqemu/bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "bzImage"), []byte("kernel"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "zqemu/bin/qemu"), []byte("qemu"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "log")
+	t.Setenv("LOG", log)
+	t.Setenv("ROOT", root)
+
+	const ref = "ghcr.io/hugelgupf/vmtest/kernel-amd64:main"
+	c := newCLIFetcher(bin, nil)
+	ctx := context.Background()
+	if d, err := c.digest(ctx, ref); err != nil || d != "sha256:abcd" {
+		t.Errorf("digest = (%s, %v), want sha256:abcd", d, err)
+	}
+
+	out := t.TempDir()
+	if err := c.exportFile(ctx, ref, "/bzImage", filepath.Join(out, "bzImage")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.exportDirectory(ctx, ref, "/zqemu", filepath.Join(out, "zqemu")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(out, "bzImage")); got != "kernel" {
+		t.Errorf("bzImage = %q, want kernel", got)
+	}
+	if got := readFile(t, filepath.Join(out, "zqemu/bin/qemu")); got != "qemu" {
+		t.Errorf("qemu = %q, want qemu", got)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"pull " + ref,
+		"image inspect --format {{range .RepoDigests}}{{println .}}{{end}} " + ref,
+		"create " + ref + " /nonexistent",
+		"cp container-1:/bzImage " + filepath.Join(out, "bzImage"),
+		"cp container-1:/zqemu " + filepath.Join(out, "zqemu"),
+		"rm -f container-1",
+	}
+	if got := strings.Split(strings.TrimSpace(readFile(t, log)), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("docker invocations = \n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownArch is returned when config init is asked for an architecture
+// without default config.
+var ErrUnknownArch = errors.New("no default config for architecture")
+
+const configHeader = `runvmtest config, found in the current directory or any of its parents.
+
+Top-level keys are values of VMTEST_ARCH (or GOARCH if VMTEST_ARCH is unset).
+For each arch, keys are the environment variables runvmtest sets, unless they
+are already set when runvmtest is invoked.
+
+Entries are merged over the built-in defaults, so only the arches, variables
+and fields that differ need to be listed. Setting container, archive, or only
+executables replaces the others. "inherit: false" at the top level, for an arch, or for a
+variable replaces the defaults at that level instead.
+
+Each environment variable has:
+
+  container:   image to copy files and directories from, or
+  archive:     HTTP(S) URL or local path of a tar archive (optionally gzip or
+               zstd compressed) to copy them from instead
+  executables: template variable name -> executable on the host, found in
+               $PATH or Homebrew, e.g. QEMU on macOS
+  sha256:      hex-encoded SHA-256 of archive, required for URLs
+  tag:         replaces the tag of container, e.g. to select a kernel version
+  files:       template variable name -> path of a file in the image/archive
+  directories: template variable name -> path of a directory
+  template:    text/template for the value of the variable. {{.name}} is
+               the local path of the file or directory called name.`
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func scalar(value, comment string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.ScalarNode, Value: value, HeadComment: comment}
+	if strings.ContainsAny(value, "{}:#") {
+		n.Style = yaml.DoubleQuotedStyle
+	}
+	return n
+}
+
+func stringMap(m map[string]string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	for _, k := range sortedKeys(m) {
+		n.Content = append(n.Content, scalar(k, ""), scalar(m[k], ""))
+	}
+	return n
+}
+
+// envVarNode returns v as YAML with comments explaining each field.
+func envVarNode(v EnvVar) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	add := func(key, comment string, value *yaml.Node) {
+		n.Content = append(n.Content, scalar(key, comment), value)
+	}
+	switch {
+	case v.Archive != "":
+		add("archive", "Tar archive to copy files from.", scalar(v.Archive, ""))
+		if v.SHA256 != "" {
+			add("sha256", "", scalar(v.SHA256, ""))
+		}
+	case v.fromHost():
+		// Only executables on the host.
+	default:
+		add("container", "Image to copy files from.", scalar(v.Container, ""))
+		if v.Tag != "" {
+			add("tag", "", scalar(v.Tag, ""))
+		}
+	}
+	if len(v.Files) > 0 {
+		add("files", "Template variable -> file path in the image.", stringMap(v.Files))
+	}
+	if len(v.Directories) > 0 {
+		add("directories", "Template variable -> directory path in the image.", stringMap(v.Directories))
+	}
+	if len(v.Executables) > 0 {
+		add("executables", "Template variable -> executable on the host.", stringMap(v.Executables))
+	}
+	add("template", "Value of the environment variable.", scalar(v.Template, ""))
+	return n
+}
+
+// inheritKey opts a config level out of merging with the defaults.
+const inheritKey = "inherit"
+
+// splitInherit removes the inherit key from the mapping n, returning its value
+// or true if there is none.
+func splitInherit(n *yaml.Node) (bool, error) {
+	if n.Kind != yaml.MappingNode {
+		return true, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value != inheritKey {
+			continue
+		}
+		var inherit bool
+		if err := n.Content[i+1].Decode(&inherit); err != nil {
+			return false, err
+		}
+		n.Content = append(n.Content[:i], n.Content[i+2:]...)
+		return inherit, nil
+	}
+	return true, nil
+}
+
+// merge returns v with the fields set in o replacing its own. Files,
+// Directories and Executables are replaced as a whole, as they go together
+// with Template.
+func (v EnvVar) merge(o EnvVar) EnvVar {
+	if o.Container != "" {
+		v.Container, v.Tag, v.Archive, v.SHA256, v.Executables = o.Container, "", "", "", nil
+	}
+	if o.Archive != "" {
+		v.Archive, v.SHA256, v.Container, v.Tag, v.Executables = o.Archive, "", "", "", nil
+	}
+	if o.Executables != nil {
+		v.Executables = o.Executables
+		if o.fromHost() {
+			v.Container, v.Tag, v.Archive, v.SHA256, v.Files, v.Directories = "", "", "", "", nil, nil
+		}
+	}
+	if o.Tag != "" {
+		v.Tag = o.Tag
+	}
+	if o.SHA256 != "" {
+		v.SHA256 = o.SHA256
+	}
+	if o.Template != "" {
+		v.Template = o.Template
+	}
+	if o.Files != nil {
+		v.Files = o.Files
+	}
+	if o.Directories != nil {
+		v.Directories = o.Directories
+	}
+	return v
+}
+
+// parseConfig decodes the YAML config b and merges it over base, which is not
+// modified.
+func parseConfig(b []byte, base Config) (Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	config := make(Config)
+	if len(doc.Content) == 0 {
+		// Empty file.
+		for arch, ec := range base {
+			config[arch] = maps.Clone(ec)
+		}
+		return config, nil
+	}
+
+	root := doc.Content[0]
+	inherit, err := splitInherit(root)
+	if err != nil {
+		return nil, err
+	}
+	if inherit {
+		for arch, ec := range base {
+			config[arch] = maps.Clone(ec)
+		}
+	}
+
+	var arches map[string]yaml.Node
+	if err := root.Decode(&arches); err != nil {
+		return nil, err
+	}
+	for arch, an := range arches {
+		inherit, err := splitInherit(&an)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", arch, err)
+		}
+		if !inherit || config[arch] == nil {
+			config[arch] = make(EnvConfig)
+		}
+
+		var vars map[string]yaml.Node
+		if err := an.Decode(&vars); err != nil {
+			return nil, fmt.Errorf("%s: %w", arch, err)
+		}
+		for name, vn := range vars {
+			inherit, err := splitInherit(&vn)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", arch, name, err)
+			}
+			var v EnvVar
+			if err := vn.Decode(&v); err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", arch, name, err)
+			}
+			if inherit {
+				v = config[arch][name].merge(v)
+			}
+			config[arch][name] = v
+		}
+	}
+	return config, nil
+}
+
+// writeConfig writes the config of arches as commented YAML to w.
+func writeConfig(w io.Writer, config Config, arches []string) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for i, arch := range arches {
+		ec, ok := config[arch]
+		if !ok {
+			return fmt.Errorf("%w %q (have %s)", ErrUnknownArch, arch, strings.Join(sortedKeys(config), ", "))
+		}
+		vars := &yaml.Node{Kind: yaml.MappingNode}
+		for _, name := range sortedKeys(ec) {
+			vars.Content = append(vars.Content, scalar(name, ""), envVarNode(ec[name]))
+		}
+		key := scalar(arch, "")
+		if i == 0 {
+			key.HeadComment = configHeader
+		}
+		root.Content = append(root.Content, key, vars)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func configCmd(args []string) error {
+	if len(args) < 1 || args[0] != "init" {
+		return fmt.Errorf("usage: `%s config init [-o .vmtest.yaml] [-force] [arch...]`", os.Args[0])
+	}
+
+	fs := flag.NewFlagSet("config init", flag.ExitOnError)
+	out := fs.String("o", ".vmtest.yaml", "File to write config to, or - for stdout")
+	force := fs.Bool("force", false, "Overwrite an existing config file")
+	_ = fs.Parse(args[1:])
+
+	arches := fs.Args()
+	if len(arches) == 0 {
+		arches = sortedKeys(defaultConfig)
+	}
+
+	if *out == "-" {
+		return writeConfig(os.Stdout, defaultConfig, arches)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(*out, flags, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", *out)
+	} else if err != nil {
+		return err
+	}
+	if err := writeConfig(f, defaultConfig, arches); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote default config for %s to %s\n", strings.Join(arches, ", "), *out)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteConfig(t *testing.T) {
+	var b strings.Builder
+	if err := writeConfig(&b, defaultConfig, sortedKeys(defaultConfig)); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Config:\n%s", b.String())
+
+	var got Config
+	if err := yaml.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatalf("Could not decode written config: %v", err)
+	}
+	if !reflect.DeepEqual(got, defaultConfig) {
+		t.Errorf("Written config = %+v, want %+v", got, defaultConfig)
+	}
+	for _, want := range []string{"# runvmtest config", "# Image to copy files from.", "# Value of the environment variable."} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Written config does not contain %q", want)
+		}
+	}
+}
+
+func TestWriteConfigArch(t *testing.T) {
+	var b strings.Builder
+	if err := writeConfig(&b, defaultConfig, []string{"arm64"}); err != nil {
+		t.Fatal(err)
+	}
+	var got Config
+	if err := yaml.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatalf("Could not decode written config: %v", err)
+	}
+	if want := (Config{"arm64": defaultConfig["arm64"]}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Written config = %+v, want %+v", got, want)
+	}
+
+	if err := writeConfig(&b, defaultConfig, []string{"mips"}); !errors.Is(err, ErrUnknownArch) {
+		t.Errorf("writeConfig(mips) = %v, want %v", err, ErrUnknownArch)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	base := Config{
+		"amd64": {
+			"VMTEST_KERNEL": {Container: "kernel-amd64:main", Template: "{{.bzImage}}", Files: map[string]string{"bzImage": "/bzImage"}},
+			"VMTEST_QEMU":   {Container: "qemu:main", Template: "{{.qemu}}/bin/qemu", Directories: map[string]string{"qemu": "/zqemu"}},
+		},
+		"arm64": {
+			"VMTEST_KERNEL": {Container: "kernel-arm64:main", Template: "{{.Image}}", Files: map[string]string{"Image": "/Image"}},
+		},
+	}
+	for _, tt := range []struct {
+		name   string
+		config string
+		want   Config
+	}{
+		{
+			name: "empty",
+			want: base,
+		},
+		{
+			name: "field",
+			config: `
+amd64:
+  VMTEST_KERNEL:
+    container: my-kernel:latest
+`,
+			want: Config{
+				"amd64": {
+					"VMTEST_KERNEL": {Container: "my-kernel:latest", Template: "{{.bzImage}}", Files: map[string]string{"bzImage": "/bzImage"}},
+					"VMTEST_QEMU":   base["amd64"]["VMTEST_QEMU"],
+				},
+				"arm64": base["arm64"],
+			},
+		},
+		{
+			name: "archive-replaces-container",
+			config: `
+arm64:
+  VMTEST_KERNEL:
+    archive: kernel.tar
+    files:
+      Image: /boot/Image
+`,
+			want: Config{
+				"amd64": base["amd64"],
+				"arm64": {
+					"VMTEST_KERNEL": {Archive: "kernel.tar", Template: "{{.Image}}", Files: map[string]string{"Image": "/boot/Image"}},
+				},
+			},
+		},
+		{
+			name: "executables-replace-container",
+			config: `
+amd64:
+  VMTEST_QEMU:
+    executables:
+      qemu: qemu-system-x86_64
+    template: "{{.qemu}} -accel hvf"
+`,
+			want: Config{
+				"amd64": {
+					"VMTEST_KERNEL": base["amd64"]["VMTEST_KERNEL"],
+					"VMTEST_QEMU":   {Executables: map[string]string{"qemu": "qemu-system-x86_64"}, Template: "{{.qemu}} -accel hvf"},
+				},
+				"arm64": base["arm64"],
+			},
+		},
+		{
+			name: "new-arch-and-var",
+			config: `
+amd64:
+  VMTEST_INITRAMFS:
+    container: initramfs:main
+riscv64:
+  VMTEST_KERNEL:
+    container: kernel-riscv64:main
+`,
+			want: Config{
+				"amd64": {
+					"VMTEST_KERNEL":    base["amd64"]["VMTEST_KERNEL"],
+					"VMTEST_QEMU":      base["amd64"]["VMTEST_QEMU"],
+					"VMTEST_INITRAMFS": {Container: "initramfs:main"},
+				},
+				"arm64":   base["arm64"],
+				"riscv64": {"VMTEST_KERNEL": {Container: "kernel-riscv64:main"}},
+			},
+		},
+		{
+			name: "no-inherit-var",
+			config: `
+amd64:
+  VMTEST_KERNEL:
+    inherit: false
+    container: my-kernel:latest
+`,
+			want: Config{
+				"amd64": {
+					"VMTEST_KERNEL": {Container: "my-kernel:latest"},
+					"VMTEST_QEMU":   base["amd64"]["VMTEST_QEMU"],
+				},
+				"arm64": base["arm64"],
+			},
+		},
+		{
+			name: "no-inherit-arch",
+			config: `
+amd64:
+  inherit: false
+  VMTEST_KERNEL:
+    container: my-kernel:latest
+`,
+			want: Config{
+				"amd64": {"VMTEST_KERNEL": {Container: "my-kernel:latest"}},
+				"arm64": base["arm64"],
+			},
+		},
+		{
+			name: "no-inherit",
+			config: `
+inherit: false
+amd64:
+  VMTEST_KERNEL:
+    container: my-kernel:latest
+`,
+			want: Config{
+				"amd64": {"VMTEST_KERNEL": {Container: "my-kernel:latest"}},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig([]byte(tt.config), base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// The base config must not be modified.
+	if got := base["amd64"]["VMTEST_KERNEL"].Container; got != "kernel-amd64:main" {
+		t.Errorf("base config was modified: VMTEST_KERNEL container = %q", got)
+	}
+	if _, ok := base["amd64"]["VMTEST_INITRAMFS"]; ok {
+		t.Errorf("base config was modified: VMTEST_INITRAMFS was added")
+	}
+
+	if _, err := parseConfig([]byte("inherit: maybe\n"), base); err == nil {
+		t.Errorf("parseConfig(inherit: maybe) = nil, want error")
+	}
+}
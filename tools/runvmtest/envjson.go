@@ -0,0 +1,43 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// envDescription is the JSON written by -json-out, for tools that set up
+// the same environment as runvmtest without running it.
+type envDescription struct {
+	// Env are all environment variables runvmtest sets.
+	Env map[string]string `json:"env"`
+
+	// Variables describe the variables resolved from the config. Variables
+	// already set by the caller are not included.
+	Variables map[string]resolvedVar `json:"variables"`
+}
+
+// writeEnvJSON writes the environment of extraEnv and vars as JSON to path.
+func writeEnvJSON(path string, extraEnv []string, vars []resolvedVar) error {
+	desc := envDescription{
+		Env:       make(map[string]string),
+		Variables: make(map[string]resolvedVar),
+	}
+	for _, kv := range extraEnv {
+		name, value, _ := strings.Cut(kv, "=")
+		desc.Env[name] = value
+	}
+	for _, v := range vars {
+		desc.Env[v.Name] = v.Value
+		desc.Variables[v.Name] = v
+	}
+	b, err := json.MarshalIndent(desc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteEnvJSON(t *testing.T) {
+	vars := []resolvedVar{
+		{
+			Name:      "VMTEST_KERNEL",
+			Value:     "/cache/abcd/bzImage",
+			Source:    "ghcr.io/hugelgupf/vmtest/kernel-amd64:main",
+			Digest:    "sha256:abcd",
+			Artifacts: map[string]string{"bzImage": "/cache/abcd/bzImage"},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "env.json")
+	if err := writeEnvJSON(path, []string{"VMTEST_ARCH=amd64"}, vars); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("JSON:\n%s", b)
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"env": map[string]any{
+			"VMTEST_ARCH":   "amd64",
+			"VMTEST_KERNEL": "/cache/abcd/bzImage",
+		},
+		"variables": map[string]any{
+			"VMTEST_KERNEL": map[string]any{
+				"value":     "/cache/abcd/bzImage",
+				"source":    "ghcr.io/hugelgupf/vmtest/kernel-amd64:main",
+				"digest":    "sha256:abcd",
+				"artifacts": map[string]any{"bzImage": "/cache/abcd/bzImage"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// fetcher exports files and directories from container images.
+type fetcher interface {
+	// digest returns an identifier of the image that ref currently refers
+	// to, which changes when the image does.
+	digest(ctx context.Context, ref string) (string, error)
+
+	// exportFile exports the file at path in the image ref to dst.
+	exportFile(ctx context.Context, ref, path, dst string) error
+
+	// exportDirectory exports the directory at path in the image ref to
+	// dst.
+	exportDirectory(ctx context.Context, ref, path, dst string) error
+}
+
+// daggerFetcher exports from container images using dagger. It only connects
+// to the dagger engine once it is first used.
+type daggerFetcher struct {
+	opts []dagger.ClientOpt
+
+	mu     sync.Mutex
+	client *dagger.Client
+}
+
+func (d *daggerFetcher) connect(ctx context.Context) (*dagger.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+	client, err := dagger.Connect(ctx, d.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to client: %w", err)
+	}
+	d.client = client
+	return client, nil
+}
+
+// Close closes the connection to the dagger engine, if any.
+func (d *daggerFetcher) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	return d.client.Close()
+}
+
+func (d *daggerFetcher) digest(ctx context.Context, ref string) (string, error) {
+	client, err := d.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	imageRef, err := client.Container().From(ref).ImageRef(ctx)
+	if err != nil {
+		return "", err
+	}
+	// imageRef is name@sha256:...
+	if _, digest, ok := strings.Cut(imageRef, "@"); ok {
+		return digest, nil
+	}
+	return imageRef, nil
+}
+
+func (d *daggerFetcher) exportFile(ctx context.Context, ref, path, dst string) error {
+	client, err := d.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if ok, err := client.Container().From(ref).File(path).Export(ctx, dst); !ok || err != nil {
+		return fmt.Errorf("failed file export: %w", err)
+	}
+	return nil
+}
+
+func (d *daggerFetcher) exportDirectory(ctx context.Context, ref, path, dst string) error {
+	client, err := d.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if ok, err := client.Container().From(ref).Directory(path).Export(ctx, dst); !ok || err != nil {
+		return fmt.Errorf("failed directory export: %w", err)
+	}
+	return nil
+}
+
+// Backends to fetch container images with.
+const (
+	backendDagger = "dagger"
+	backendDocker = "docker"
+	backendPodman = "podman"
+)
+
+// ErrUnknownBackend is returned for an unsupported -backend.
+var ErrUnknownBackend = errors.New("unknown backend")
+
+// containerFetcher returns the fetcher of backend, which writes progress
+// output to output if it is non-nil.
+func containerFetcher(backend string, output io.Writer) (interface {
+	fetcher
+	io.Closer
+}, error) {
+	switch backend {
+	case backendDagger:
+		d := &daggerFetcher{}
+		if output != nil {
+			d.opts = append(d.opts, dagger.WithLogOutput(output))
+		}
+		return d, nil
+	case backendDocker, backendPodman:
+		return newCLIFetcher(backend, output), nil
+	default:
+		return nil, fmt.Errorf("%w %q, must be one of %s, %s, %s", ErrUnknownBackend, backend, backendDagger, backendDocker, backendPodman)
+	}
+}
+
+// sources picks the fetcher for each env var's config.
+type sources struct {
+	containers interface {
+		fetcher
+		io.Closer
+	}
+	archives *archiveFetcher
+
+	// output receives progress output, if non-nil.
+	output io.Writer
+
+	// logFormat is the format of output (see -log-format).
+	logFormat string
+}
+
+// newSources fetches container images with backend (see -backend) and
+// writes progress to output in the format of -log-format.
+//
+// Only the tty format includes the backend's own progress output.
+func newSources(backend string, output io.Writer) (*sources, error) {
+	format, err := resolveLogFormat(*logFormat, output)
+	if err != nil {
+		return nil, err
+	}
+	backendOutput := output
+	if format != logTTY {
+		backendOutput = nil
+	}
+	containers, err := containerFetcher(backend, backendOutput)
+	if err != nil {
+		return nil, err
+	}
+	return &sources{
+		containers: containers,
+		archives:   newArchiveFetcher(),
+		output:     output,
+		logFormat:  format,
+	}, nil
+}
+
+// forVar returns the fetcher for v and the reference to fetch from.
+func (s *sources) forVar(v EnvVar) (fetcher, string) {
+	if v.Archive != "" {
+		s.archives.add(v.Archive, v.SHA256)
+		return s.archives, v.Archive
+	}
+	return s.containers, v.Image()
+}
+
+// Close releases resources of all fetchers.
+func (s *sources) Close() error {
+	return errors.Join(s.containers.Close(), s.archives.Close())
+}
+
+// onceMap calls a function at most once per key and remembers its result. It
+// is safe for concurrent use.
+type onceMap[V any] struct {
+	mu sync.Mutex
+	m  map[string]*onceResult[V]
+}
+
+type onceResult[V any] struct {
+	once sync.Once
+	v    V
+	err  error
+}
+
+// do returns the result of fn for key, calling fn only if do was not called
+// for key before. Concurrent calls for the same key wait for the first.
+func (o *onceMap[V]) do(key string, fn func() (V, error)) (V, error) {
+	o.mu.Lock()
+	if o.m == nil {
+		o.m = make(map[string]*onceResult[V])
+	}
+	r, ok := o.m[key]
+	if !ok {
+		r = &onceResult[V]{}
+		o.m[key] = r
+	}
+	o.mu.Unlock()
+
+	r.once.Do(func() { r.v, r.err = fn() })
+	return r.v, r.err
+}
+
+// values returns the successful results by key, waiting for calls in
+// progress.
+func (o *onceMap[V]) values() map[string]V {
+	o.mu.Lock()
+	results := make(map[string]*onceResult[V], len(o.m))
+	for k, r := range o.m {
+		results[k] = r
+	}
+	o.mu.Unlock()
+
+	values := make(map[string]V)
+	for k, r := range results {
+		r.once.Do(func() {})
+		if r.err == nil {
+			values[k] = r.v
+		}
+	}
+	return values
+}
+
+type exportFunc func(ctx context.Context, ref, path, dst string) error
+
+// exportOnce exports path from ref to dst unless dst exists.
+//
+// The export goes to a temporary path first, so that an interrupted export
+// is not mistaken for a complete one.
+func exportOnce(ctx context.Context, export exportFunc, ref, path, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	out := filepath.Join(tmp, filepath.Base(dst))
+	if err := export(ctx, ref, path, out); err != nil {
+		return err
+	}
+	return os.Rename(out, dst)
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// ErrExecutableNotFound is returned when an executable of the config is not
+// installed on the host.
+var ErrExecutableNotFound = errors.New("executable not found in $PATH or Homebrew")
+
+// homebrewBinDirs are where Homebrew installs executables on Apple silicon
+// and Intel Macs, which may not be in $PATH of non-interactive shells.
+var homebrewBinDirs = []string{"/opt/homebrew/bin", "/usr/local/bin"}
+
+// findExecutable returns the path of the executable name.
+func findExecutable(name string) (string, error) {
+	if p, err := exec.LookPath(name); err == nil {
+		return filepath.Abs(p)
+	}
+	for _, dir := range homebrewBinDirs {
+		if p, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrExecutableNotFound, name)
+}
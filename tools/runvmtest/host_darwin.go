@@ -0,0 +1,33 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// The QEMU container has Linux binaries, so macOS hosts use QEMU installed
+// with Homebrew (brew install qemu) instead.
+//
+// Hypervisor.framework accelerates guests of the host's architecture. QEMU
+// falls back to the next -accel, TCG, for all others.
+func init() {
+	for arch, qemu := range map[string]EnvVar{
+		"amd64": {
+			Executables: map[string]string{"qemu": "qemu-system-x86_64"},
+			Template:    "{{.qemu}} -accel hvf -accel tcg -m 1G",
+		},
+		"arm": {
+			Executables: map[string]string{"qemu": "qemu-system-arm"},
+			Template:    "{{.qemu}} -M virt,highmem=off -accel tcg",
+		},
+		"arm64": {
+			Executables: map[string]string{"qemu": "qemu-system-aarch64"},
+			Template:    "{{.qemu}} -machine virt -cpu max -accel hvf -accel tcg -m 1G",
+		},
+		"riscv64": {
+			Executables: map[string]string{"qemu": "qemu-system-riscv64"},
+			Template:    "{{.qemu}} -M virt -cpu rv64 -accel tcg -m 1G",
+		},
+	} {
+		defaultConfig[arch]["VMTEST_QEMU"] = qemu
+	}
+}
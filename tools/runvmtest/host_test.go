@@ -0,0 +1,63 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestHostExecutables(t *testing.T) {
+	dir := t.TempDir()
+	qemu := filepath.Join(dir, "qemu-system-x86_64")
+	if err := os.WriteFile(qemu, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	if p, err := findExecutable("qemu-system-x86_64"); err != nil || p != qemu {
+		t.Errorf("findExecutable = (%s, %v), want %s", p, err, qemu)
+	}
+	if _, err := findExecutable("qemu-system-nonexistent"); !errors.Is(err, ErrExecutableNotFound) {
+		t.Errorf("findExecutable = %v, want %v", err, ErrExecutableNotFound)
+	}
+
+	src, err := newSources(backendDagger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	c, err := openArtifactCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VMTEST_QEMU", "")
+
+	config := EnvConfig{
+		"VMTEST_QEMU": {
+			Executables: map[string]string{"qemu": "qemu-system-x86_64"},
+			Template:    "{{.qemu}} -accel hvf -accel tcg",
+		},
+	}
+	vars, err := resolveEnv(context.Background(), src, config, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := environ(vars), []string{"VMTEST_QEMU=" + qemu + " -accel hvf -accel tcg"}; !slices.Equal(got, want) {
+		t.Errorf("resolveEnv = %v, want %v", got, want)
+	}
+
+	config["VMTEST_QEMU"] = EnvVar{
+		Executables: map[string]string{"qemu": "qemu-system-x86_64"},
+		Files:       map[string]string{"bios": "/bios.bin"},
+	}
+	if _, err := resolveEnv(context.Background(), src, config, c, ""); !errors.Is(err, ErrNoSource) {
+		t.Errorf("resolveEnv = %v, want %v", err, ErrNoSource)
+	}
+}
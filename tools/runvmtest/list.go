@@ -0,0 +1,135 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// cacheStatus describes whether the artifacts of v are in c.
+func cacheStatus(c *artifactCache, v EnvVar) string {
+	if v.fromHost() {
+		return "not needed (host executables)"
+	}
+	if c == nil {
+		return "cache disabled"
+	}
+	var digest string
+	if v.Archive != "" {
+		a := newArchiveFetcher()
+		a.add(v.Archive, v.SHA256)
+		d, err := a.digest(context.Background(), v.Archive)
+		if err != nil {
+			return fmt.Sprintf("unknown (%v)", err)
+		}
+		digest = d
+	} else {
+		d, ok := c.lookupRef(v.Image())
+		if !ok {
+			return "no (never downloaded)"
+		}
+		digest = d
+	}
+
+	dir := c.imageDir(digest)
+	var paths []string
+	for _, p := range v.Files {
+		paths = append(paths, p)
+	}
+	for _, p := range v.Directories {
+		paths = append(paths, p)
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+			return fmt.Sprintf("no (%s missing for %s)", p, digest)
+		}
+	}
+	return fmt.Sprintf("yes (%s)", digest)
+}
+
+// writeList writes the config for all arches to w, marking selected.
+func writeList(w io.Writer, config Config, selected string, cache *artifactCache) {
+	for _, arch := range sortedKeys(config) {
+		mark := ""
+		if arch == selected {
+			mark = " (selected)"
+		}
+		fmt.Fprintf(w, "\n%s%s:\n", arch, mark)
+		for _, name := range sortedKeys(config[arch]) {
+			v := config[arch][name]
+			fmt.Fprintf(w, "  %s:\n", name)
+			switch {
+			case v.Archive != "":
+				fmt.Fprintf(w, "    archive:   %s\n", v.Archive)
+			case v.Container != "":
+				fmt.Fprintf(w, "    container: %s\n", v.Image())
+			}
+			for _, templateName := range sortedKeys(v.Executables) {
+				fmt.Fprintf(w, "    host:      %s\n", v.Executables[templateName])
+			}
+			fmt.Fprintf(w, "    template:  %s\n", v.Template)
+			if arch == selected && os.Getenv(name) != "" {
+				fmt.Fprintf(w, "    set in environment, will not be downloaded: %s=%s\n", name, os.Getenv(name))
+			}
+			fmt.Fprintf(w, "    cached:    %s\n", cacheStatus(cache, v))
+		}
+	}
+}
+
+func listCmd(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.StringVar(configFile, "config", "", "Path to YAML config file")
+	fs.StringVar(cacheDir, "cache-dir", "", "Directory artifacts are cached in (default: $XDG_CACHE_HOME/vmtest/runvmtest)")
+	fs.StringVar(kernelTag, "kernel-tag", "", "Tag of the VMTEST_KERNEL container to use")
+	fs.StringVar(qemuTag, "qemu-tag", "", "Tag of the VMTEST_QEMU container to use")
+	_ = fs.Parse(args)
+
+	config, path, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		fmt.Println("Config: built-in defaults (no .vmtest.yaml found)")
+	} else {
+		fmt.Printf("Config: %s\n", path)
+	}
+	if lock, err := readLock(lockPath(path)); err == nil && len(lock) > 0 {
+		fmt.Printf("Lock: %s (%d image(s) pinned)\n", lockPath(path), len(lock))
+	}
+
+	arch, ok := selectArch(config)
+	if ok {
+		setTags(config[arch], map[string]string{
+			"VMTEST_KERNEL": *kernelTag,
+			"VMTEST_QEMU":   *qemuTag,
+		})
+	}
+	switch {
+	case !ok:
+		fmt.Printf("Architecture: %s is not supported by the config (supported: %s); VMTEST_* variables must be set by the caller\n", arch, strings.Join(sortedKeys(config), ", "))
+	case os.Getenv("VMTEST_ARCH") == arch:
+		fmt.Printf("Architecture: %s (from VMTEST_ARCH)\n", arch)
+	case os.Getenv("VMTEST_ARCH") != "":
+		fmt.Printf("Architecture: %s (from GOARCH, as VMTEST_ARCH=%s is not in the config)\n", arch, os.Getenv("VMTEST_ARCH"))
+	default:
+		fmt.Printf("Architecture: %s (from GOARCH=%s, VMTEST_ARCH is not set)\n", arch, runtime.GOARCH)
+	}
+
+	cache, err := openArtifactCache(*cacheDir)
+	if err != nil {
+		fmt.Printf("Cache: %v\n", err)
+	} else {
+		fmt.Printf("Cache: %s\n", cache.root)
+	}
+	writeList(os.Stdout, config, arch, cache)
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheStatus(t *testing.T) {
+	c, err := openArtifactCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := EnvVar{
+		Container: "ghcr.io/hugelgupf/vmtest/kernel-amd64:main",
+		Files:     map[string]string{"bzImage": "/bzImage"},
+	}
+	if got := cacheStatus(c, v); !strings.HasPrefix(got, "no (never downloaded)") {
+		t.Errorf("cacheStatus = %q, want never downloaded", got)
+	}
+
+	if err := c.recordRef(v.Container, "sha256:abcd"); err != nil {
+		t.Fatal(err)
+	}
+	if got := cacheStatus(c, v); !strings.HasPrefix(got, "no (/bzImage missing") {
+		t.Errorf("cacheStatus = %q, want /bzImage missing", got)
+	}
+
+	dir, err := c.dir("sha256:abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bzImage"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cacheStatus(c, v), "yes (sha256:abcd)"; got != want {
+		t.Errorf("cacheStatus = %q, want %q", got, want)
+	}
+	if got, want := cacheStatus(nil, v), "cache disabled"; got != want {
+		t.Errorf("cacheStatus = %q, want %q", got, want)
+	}
+}
+
+func TestSelectArch(t *testing.T) {
+	config := Config{"amd64": nil, "arm64": nil, "riscv64": nil}
+
+	t.Setenv("VMTEST_ARCH", "arm64")
+	if arch, ok := selectArch(config); arch != "arm64" || !ok {
+		t.Errorf("selectArch = (%s, %t), want (arm64, true)", arch, ok)
+	}
+
+	t.Setenv("VMTEST_ARCH", "mips")
+	if arch, ok := selectArch(Config{}); arch != "mips" || ok {
+		t.Errorf("selectArch = (%s, %t), want (mips, false)", arch, ok)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+)
+
+// lockFileName is the lock file written by `runvmtest lock`, next to the
+// config file.
+const lockFileName = ".vmtest.lock"
+
+const lockHeader = `Written by runvmtest lock. Do not edit.
+
+Maps container images of .vmtest.yaml to the digests they resolved to, which
+runvmtest uses instead of the tags. Run runvmtest lock again to update.`
+
+// lockFile maps container images to their digests.
+type lockFile map[string]string
+
+// lockPath returns the lock file of the config at configPath, or of the
+// default config if configPath is empty.
+func lockPath(configPath string) string {
+	if configPath != "" {
+		return filepath.Join(filepath.Dir(configPath), lockFileName)
+	}
+	if p, err := findConfigFile(lockFileName); err == nil {
+		return p
+	}
+	return lockFileName
+}
+
+// readLock reads the lock file at path. It returns an empty lock file if there
+// is none.
+func readLock(path string) (lockFile, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lockFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lock := lockFile{}
+	if err := yaml.Unmarshal(b, &lock); err != nil {
+		return nil, fmt.Errorf("could not decode lock file %s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// pinned returns ref pinned to digest.
+func pinned(ref, digest string) string {
+	name, _, _ := strings.Cut(ref, "@")
+	return name + "@" + digest
+}
+
+// apply pins the containers of config that are in l to their digest.
+//
+// A tag set later (e.g. by -kernel-tag) still replaces the pinned digest.
+func (l lockFile) apply(config Config) {
+	for _, ec := range config {
+		for name, v := range ec {
+			if v.Archive != "" || v.Container == "" {
+				continue
+			}
+			if digest, ok := l[v.Image()]; ok {
+				v.Container, v.Tag = pinned(v.Image(), digest), ""
+				ec[name] = v
+			}
+		}
+	}
+}
+
+// lockConfig resolves the containers of arches in config to digests with f.
+func lockConfig(ctx context.Context, f fetcher, config Config, arches []string) (lockFile, error) {
+	refs := make(map[string]bool)
+	for _, arch := range arches {
+		ec, ok := config[arch]
+		if !ok {
+			return nil, fmt.Errorf("%w %q (have %s)", ErrUnknownArch, arch, strings.Join(sortedKeys(config), ", "))
+		}
+		for _, v := range ec {
+			if v.Archive == "" && v.Container != "" {
+				refs[v.Image()] = true
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	lock := lockFile{}
+	g, ctx := errgroup.WithContext(ctx)
+	for ref := range refs {
+		ref := ref
+		g.Go(func() error {
+			digest, err := f.digest(ctx, ref)
+			if err != nil {
+				return fmt.Errorf("could not resolve %s: %w", ref, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			lock[ref] = digest
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// writeLock writes l as YAML to w.
+func writeLock(w io.Writer, l lockFile) error {
+	root := &yaml.Node{Kind: yaml.MappingNode, HeadComment: lockHeader}
+	for _, ref := range sortedKeys(l) {
+		root.Content = append(root.Content, scalar(ref, ""), scalar(l[ref], ""))
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func lockCmd(args []string) error {
+	fs := flag.NewFlagSet("lock", flag.ExitOnError)
+	fs.StringVar(configFile, "config", "", "Path to YAML config file")
+	fs.StringVar(backend, "backend", *backend, "How to fetch container images: dagger, docker, or podman")
+	out := fs.String("o", "", "File to write the lock file to (default: "+lockFileName+" next to the config file)")
+	_ = fs.Parse(args)
+
+	config, configPath, err := readConfig()
+	if err != nil {
+		return err
+	}
+	arches := fs.Args()
+	if len(arches) == 0 {
+		arches = sortedKeys(config)
+	}
+
+	src, err := newSources(*backend, os.Stderr)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	lock, err := lockConfig(context.Background(), src.containers, config, arches)
+	if err != nil {
+		return err
+	}
+
+	path := *out
+	if path == "" {
+		path = lockPath(configPath)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeLock(f, lock); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Locked %d image(s) for %s in %s\n", len(lock), strings.Join(arches, ", "), path)
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// digestFetcher resolves refs to fixed digests.
+type digestFetcher struct {
+	fetcher
+	digests map[string]string
+}
+
+func (d digestFetcher) digest(ctx context.Context, ref string) (string, error) {
+	if digest, ok := d.digests[ref]; ok {
+		return digest, nil
+	}
+	return "", os.ErrNotExist
+}
+
+func TestLock(t *testing.T) {
+	config := Config{
+		"amd64": {
+			"VMTEST_KERNEL": {Container: "ghcr.io/hugelgupf/vmtest/kernel-amd64:main", Template: "{{.bzImage}}"},
+			"VMTEST_QEMU":   {Container: "ghcr.io/hugelgupf/vmtest/qemu:main", Tag: "v9"},
+			"VMTEST_OTHER":  {Archive: "other.tar", SHA256: "1234"},
+		},
+		"arm64": {
+			"VMTEST_KERNEL": {Container: "ghcr.io/hugelgupf/vmtest/kernel-arm64:main"},
+		},
+	}
+	f := digestFetcher{digests: map[string]string{
+		"ghcr.io/hugelgupf/vmtest/kernel-amd64:main": "sha256:aaaa",
+		"ghcr.io/hugelgupf/vmtest/qemu:v9":           "sha256:bbbb",
+	}}
+
+	lock, err := lockConfig(context.Background(), f, config, []string{"amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (lockFile{
+		"ghcr.io/hugelgupf/vmtest/kernel-amd64:main": "sha256:aaaa",
+		"ghcr.io/hugelgupf/vmtest/qemu:v9":           "sha256:bbbb",
+	}); !reflect.DeepEqual(lock, want) {
+		t.Errorf("lockConfig = %v, want %v", lock, want)
+	}
+	if _, err := lockConfig(context.Background(), f, config, []string{"arm64"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lockConfig(arm64) = %v, want %v", err, os.ErrNotExist)
+	}
+	if _, err := lockConfig(context.Background(), f, config, []string{"mips"}); !errors.Is(err, ErrUnknownArch) {
+		t.Errorf("lockConfig(mips) = %v, want %v", err, ErrUnknownArch)
+	}
+
+	path := filepath.Join(t.TempDir(), lockFileName)
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLock(out, lock); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	got, err := readLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, lock) {
+		t.Errorf("readLock = %v, want %v", got, lock)
+	}
+
+	got.apply(config)
+	if got, want := config["amd64"]["VMTEST_KERNEL"].Image(), "ghcr.io/hugelgupf/vmtest/kernel-amd64:main@sha256:aaaa"; got != want {
+		t.Errorf("Locked VMTEST_KERNEL = %s, want %s", got, want)
+	}
+	if got, want := config["amd64"]["VMTEST_QEMU"].Image(), "ghcr.io/hugelgupf/vmtest/qemu:v9@sha256:bbbb"; got != want {
+		t.Errorf("Locked VMTEST_QEMU = %s, want %s", got, want)
+	}
+	if got, want := config["arm64"]["VMTEST_KERNEL"].Image(), "ghcr.io/hugelgupf/vmtest/kernel-arm64:main"; got != want {
+		t.Errorf("Unlocked VMTEST_KERNEL = %s, want %s", got, want)
+	}
+
+	// A different tag replaces the pinned digest.
+	setTags(config["amd64"], map[string]string{"VMTEST_KERNEL": "6.6"})
+	if got, want := config["amd64"]["VMTEST_KERNEL"].Image(), "ghcr.io/hugelgupf/vmtest/kernel-amd64:6.6"; got != want {
+		t.Errorf("Retagged VMTEST_KERNEL = %s, want %s", got, want)
+	}
+
+	if l, err := readLock(filepath.Join(t.TempDir(), lockFileName)); err != nil || len(l) != 0 {
+		t.Errorf("readLock(missing) = (%v, %v), want empty", l, err)
+	}
+}
@@ -3,44 +3,98 @@
 // license that can be found in the LICENSE file.
 
 // runvmtest sets VMTEST_QEMU and VMTEST_KERNEL (if not already set) with
-// binaries downloaded from Docker images, then executes a command.
+// binaries downloaded from Docker images or tar archives, then executes a
+// command.
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
 
-	"dagger.io/dagger"
-	"gopkg.in/yaml.v3"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
 	keepArtifacts = flag.Bool("keep-artifacts", false, "Keep artifacts directory available after exiting (alias -k)")
 	configFile    = flag.String("config", "", "Path to YAML config file")
-	artifactsDir  = flag.String("artifacts-dir", "", "Directory to store artifacts in, will be created if not exist (default: temp dir)")
-	quiet         = flag.Bool("quiet", false, "Suppress output from docker image downloads")
+	artifactsDir  = flag.String("artifacts-dir", "", "Directory to store artifacts in, will be created if not exist (default: artifact cache, or temp dir with -no-cache)")
+	quiet         = flag.Bool("quiet", false, "Suppress all output about downloads")
+	logFormat     = flag.String("log-format", logAuto, "Download output: tty (progress of image downloads), plain (one line per artifact), json (one JSON object per artifact), or auto (tty on terminals, otherwise plain)")
+	noCache       = flag.Bool("no-cache", false, "Do not use or populate the artifact cache; download artifacts into the artifacts directory")
+	backend       = flag.String("backend", envOr("RUNVMTEST_BACKEND", backendDagger), "How to fetch container images: dagger, docker (docker create + docker cp), or podman; defaults to $RUNVMTEST_BACKEND if set")
+	printEnv      = flag.Bool("print-env", false, "Download artifacts and print shell export commands for eval instead of running a command; implies -keep-artifacts")
+	kernelTag     = flag.String("kernel-tag", "", "Tag of the VMTEST_KERNEL container to use, e.g. 6.6 (default: from config)")
+	qemuTag       = flag.String("qemu-tag", "", "Tag of the VMTEST_QEMU container to use (default: from config)")
+	archs         = flag.String("arch", "", "Comma-separated VMTEST_ARCH values to run the command for, once each (default: $VMTEST_ARCH or GOARCH)")
+	dryRun        = flag.Bool("dry-run", false, "Print what would be fetched, its cache status, and the resulting environment without fetching anything or running the command")
+	jsonOut       = flag.String("json-out", "", "Write the resolved environment (variables, artifact paths, digests) as JSON to this file; without a command, only resolve the environment")
+	cacheDir      = flag.String("cache-dir", "", "Directory to cache artifacts in (default: $XDG_CACHE_HOME/vmtest/runvmtest)")
 )
 
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
 func init() {
 	flag.BoolVar(keepArtifacts, "k", false, "Keep artifacts directory available after exiting")
-	flag.StringVar(artifactsDir, "d", "", "Directory to store artifacts in, will be created if not exist (default: temp dir)")
-	flag.BoolVar(quiet, "q", false, "Suppress output from docker image downloads")
+	flag.StringVar(artifactsDir, "d", "", "Directory to store artifacts in, will be created if not exist (default: artifact cache, or temp dir with -no-cache)")
+	flag.BoolVar(quiet, "q", false, "Suppress all output about downloads")
 }
 
+// exitInfra is the exit code when runvmtest itself fails, rather than the
+// command it runs. Like docker run, it uses 125.
+const exitInfra = 125
+
 func main() {
 	if err := run(); err != nil {
-		log.Fatalf("Error: %v", err)
+		log.Printf("Error: %v", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode returns the exit code of the command that failed with err, or
+// exitInfra if runvmtest failed before or instead of running it.
+//
+// For -arch with multiple architectures, it is exitInfra if runvmtest failed
+// for any architecture, and otherwise the first command's exit code.
+func exitCode(err error) int {
+	var m *matrixError
+	if errors.As(err, &m) {
+		code := exitInfra
+		for i := len(m.errs) - 1; i >= 0; i-- {
+			if code = exitCode(m.errs[i]); code == exitInfra {
+				return exitInfra
+			}
+		}
+		return code
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return exitInfra
 	}
+	// Like shells, report death by signal as 128+signal.
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
 }
 
 // EnvConfig is a map of env var name -> variable config.
@@ -55,6 +109,10 @@ type EnvVar struct {
 	// Container is the name of the container to pull files from.
 	Container string
 
+	// Tag, if set, replaces the tag of Container, e.g. to select a kernel
+	// version.
+	Tag string
+
 	// Template uses text/template syntax and is evaluated to become the env var.
 	//
 	// {{.$name}} can be used to refer to files extracted from the
@@ -67,8 +125,31 @@ type EnvVar struct {
 
 	// Map of template variable name -> path in container
 	Directories map[string]string
+
+	// Archive is an HTTP(S) URL or local path of a tar archive to take
+	// Files and Directories from instead of Container. The archive may be
+	// compressed with gzip or zstd.
+	Archive string
+
+	// SHA256 is the hex-encoded SHA-256 checksum of Archive. Required for
+	// URLs; if set for local archives, it is verified as well.
+	SHA256 string
+
+	// Map of template variable name -> executable on the host, looked up
+	// in $PATH and Homebrew's bin directories. Variables with only
+	// Executables need no Container or Archive.
+	Executables map[string]string
 }
 
+// fromHost is whether v has no container or archive to fetch from.
+func (v EnvVar) fromHost() bool {
+	return v.Container == "" && v.Archive == ""
+}
+
+// ErrNoSource is returned for variables with files or directories but no
+// container or archive to take them from.
+var ErrNoSource = errors.New("files and directories need a container or archive")
+
 var defaultConfig = Config{
 	"amd64": map[string]EnvVar{
 		"VMTEST_KERNEL": {
@@ -81,6 +162,18 @@ var defaultConfig = Config{
 			Template:    "{{.qemu}}/bin/qemu-system-x86_64 -L {{.qemu}}/pc-bios -m 1G",
 			Directories: map[string]string{"qemu": "/zqemu"},
 		},
+		// For qfirmware.WithDefaultOVMF, which finds these in the
+		// cache as well (see qfirmware.OVMFImage).
+		"VMTEST_OVMF_CODE": {
+			Container: "ghcr.io/hugelgupf/vmtest/ovmf:main",
+			Template:  "{{.code}}",
+			Files:     map[string]string{"code": "/OVMF_CODE.fd"},
+		},
+		"VMTEST_OVMF_VARS": {
+			Container: "ghcr.io/hugelgupf/vmtest/ovmf:main",
+			Template:  "{{.vars}}",
+			Files:     map[string]string{"vars": "/OVMF_VARS.fd"},
+		},
 	},
 	"arm": map[string]EnvVar{
 		"VMTEST_KERNEL": {
@@ -120,13 +213,54 @@ var defaultConfig = Config{
 	},
 }
 
-func archConfig(config Config) EnvConfig {
+// Image returns the container image to pull, with Tag applied.
+func (v EnvVar) Image() string {
+	if v.Tag == "" {
+		return v.Container
+	}
+	return withTag(v.Container, v.Tag)
+}
+
+// withTag returns ref with its tag and digest replaced by tag.
+func withTag(ref, tag string) string {
+	name, _, _ := strings.Cut(ref, "@")
+	// A ':' after the last '/' separates the tag; others are registry
+	// ports.
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name + ":" + tag
+}
+
+// setTags sets the tag of the container of each env var in tags.
+func setTags(config EnvConfig, tags map[string]string) {
+	for name, tag := range tags {
+		if v, ok := config[name]; ok && tag != "" {
+			v.Tag = tag
+			config[name] = v
+		}
+	}
+}
+
+// selectArch returns the config key used for the current VMTEST_ARCH or
+// GOARCH, and whether config has it.
+func selectArch(config Config) (string, bool) {
 	arch := os.Getenv("VMTEST_ARCH")
-	if c, ok := config[arch]; ok {
-		return c
+	if _, ok := config[arch]; ok {
+		return arch, true
+	}
+	if _, ok := config[runtime.GOARCH]; ok {
+		return runtime.GOARCH, true
 	}
-	if c, ok := config[runtime.GOARCH]; ok {
-		return c
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	return arch, false
+}
+
+func archConfig(config Config) EnvConfig {
+	if arch, ok := selectArch(config); ok {
+		return config[arch]
 	}
 	// On other architectures, user has to provide all values via flags.
 	return EnvConfig{}
@@ -147,13 +281,35 @@ func findConfigFile(name string) (string, error) {
 	return "", fmt.Errorf("could not find %s in current directory or any parent", name)
 }
 
-func run() error {
-	flag.Parse()
+// subcommands are run as `runvmtest <name> [args...]`. Anything else is a
+// command to run with VMTEST_* set.
+var subcommands = map[string]func(args []string) error{
+	"build-kernel": buildKernelCmd,
+	"cache":        cacheCmd,
+	"config":       configCmd,
+	"list":         listCmd,
+	"lock":         lockCmd,
+}
 
-	if flag.NArg() < 1 {
-		return fmt.Errorf("too few arguments: usage: `%s -- ./cmd-to-run`", os.Args[0])
+// loadConfig returns the config, with containers pinned by its lock file if
+// there is one, and the path it was read from, which is empty for the
+// default config.
+func loadConfig() (Config, string, error) {
+	config, configPath, err := readConfig()
+	if err != nil {
+		return nil, "", err
 	}
+	lock, err := readLock(lockPath(configPath))
+	if err != nil {
+		return nil, "", err
+	}
+	lock.apply(config)
+	return config, configPath, nil
+}
 
+// readConfig returns the config and the path it was read from, which is
+// empty for the default config.
+func readConfig() (Config, string, error) {
 	var configPath string
 	if *configFile != "" {
 		configPath = *configFile
@@ -161,111 +317,414 @@ func run() error {
 		configPath, _ = findConfigFile(".vmtest.yaml")
 	}
 
-	var config Config = defaultConfig
-	if configPath != "" {
-		b, err := os.ReadFile(configPath)
-		if err != nil {
-			return err
+	if configPath == "" {
+		config, err := parseConfig(nil, defaultConfig)
+		return config, "", err
+	}
+	b, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := parseConfig(b, defaultConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decode YAML config from %s: %v", configPath, err)
+	}
+	return config, configPath, nil
+}
+
+func run() error {
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			return sub(os.Args[2:])
 		}
-		if err := yaml.Unmarshal(b, &config); err != nil {
-			return fmt.Errorf("could not decode YAML config from %s: %v", configPath, err)
+	}
+
+	flag.Parse()
+
+	if flag.NArg() < 1 && !*printEnv && !*dryRun && *jsonOut == "" {
+		return fmt.Errorf("too few arguments: usage: `%s -- ./cmd-to-run` or `eval $(%s -print-env)`", os.Args[0], os.Args[0])
+	}
+	if *printEnv || (*jsonOut != "" && flag.NArg() < 1) {
+		// Artifacts must outlive runvmtest.
+		*keepArtifacts = true
+	}
+
+	config, _, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	arches := splitList(*archs)
+	if *printEnv && len(arches) > 1 {
+		return fmt.Errorf("-print-env can only be used with one -arch")
+	}
+	if *jsonOut != "" && len(arches) > 1 {
+		return fmt.Errorf("-json-out can only be used with one -arch")
+	}
+	for _, arch := range arches {
+		if _, ok := config[arch]; !ok {
+			return fmt.Errorf("%w %q (have %s)", ErrUnknownArch, arch, strings.Join(sortedKeys(config), ", "))
 		}
 	}
-	c := archConfig(config)
+	tags := map[string]string{
+		"VMTEST_KERNEL": *kernelTag,
+		"VMTEST_QEMU":   *qemuTag,
+	}
+
+	// With -print-env, stdout is for the shell to evaluate.
+	var output io.Writer = os.Stdout
+	if *printEnv {
+		output = os.Stderr
+	}
+	if *quiet {
+		output = nil
+	}
+	src, err := newSources(*backend, output)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
 
 	ctx := context.Background()
-	var clientOpts []dagger.ClientOpt
-	if !*quiet {
-		clientOpts = append(clientOpts, dagger.WithLogOutput(os.Stdout))
+	if len(arches) == 0 {
+		c := archConfig(config)
+		setTags(c, tags)
+		return runNatively(ctx, src, c, nil, flag.Args())
+	}
+	return runMatrix(ctx, src, config, arches, tags, flag.Args())
+}
+
+// runMatrix runs args once for each of arches with VMTEST_ARCH set, continuing
+// after failures to report all of them. It stops when runvmtest or a command
+// was interrupted, so that Ctrl-C stops the whole matrix.
+func runMatrix(ctx context.Context, src *sources, config Config, arches []string, tags map[string]string, args []string) error {
+	m := &matrixError{}
+	for _, arch := range arches {
+		c := config[arch]
+		setTags(c, tags)
+		if len(arches) > 1 {
+			fmt.Fprintf(os.Stderr, "=== runvmtest: VMTEST_ARCH=%s\n", arch)
+		}
+		if err := runNatively(ctx, src, c, []string{"VMTEST_ARCH=" + arch}, args); err != nil {
+			if len(arches) == 1 {
+				return err
+			}
+			log.Printf("VMTEST_ARCH=%s: %v", arch, err)
+			m.arches = append(m.arches, arch)
+			m.errs = append(m.errs, err)
+			if errors.Is(err, ErrInterrupted) {
+				log.Printf("Interrupted, not running the remaining VMTEST_ARCH values")
+				break
+			}
+		}
+	}
+	if len(m.errs) > 0 {
+		return m
+	}
+	return nil
+}
+
+// ErrMatrixFailed is returned when the command failed for some -arch.
+var ErrMatrixFailed = errors.New("command failed")
+
+// ErrInterrupted is returned when runvmtest received SIGINT or SIGTERM, or the
+// command was killed by one.
+var ErrInterrupted = errors.New("interrupted")
+
+// matrixError is returned by runMatrix for the arches that failed.
+type matrixError struct {
+	arches []string
+	errs   []error
+}
+
+func (m *matrixError) Error() string {
+	return fmt.Sprintf("%v for VMTEST_ARCH=%s", ErrMatrixFailed, strings.Join(m.arches, ","))
+}
+
+func (m *matrixError) Unwrap() []error {
+	return append([]error{ErrMatrixFailed}, m.errs...)
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// resolvedVar is an environment variable with its artifacts exported.
+type resolvedVar struct {
+	Name  string `json:"-"`
+	Value string `json:"value"`
+
+	// Source is the container image or archive the artifacts are from.
+	Source string `json:"source"`
+
+	// Digest identifies the image or archive. It is only resolved when
+	// the cache is used.
+	Digest string `json:"digest,omitempty"`
+
+	// Artifacts are the local paths of files and directories by template
+	// variable name.
+	Artifacts map[string]string `json:"artifacts"`
+}
+
+// environ returns vars as NAME=value pairs.
+func environ(vars []resolvedVar) []string {
+	envv := make([]string, 0, len(vars))
+	for _, v := range vars {
+		envv = append(envv, v.Name+"="+v.Value)
+	}
+	return envv
+}
+
+// resolveEnv exports the artifacts of config into cache, or into tmp if cache
+// is nil, and returns the resulting environment variables sorted by name.
+//
+// All variables and all of their files and directories are exported
+// concurrently.
+func resolveEnv(ctx context.Context, src *sources, config EnvConfig, cache *artifactCache, tmp string) ([]resolvedVar, error) {
+	p := &progress{w: src.output, json: src.logFormat == logJSON}
+	for varName, varConf := range config {
+		// Already set by caller.
+		if os.Getenv(varName) == "" {
+			p.total += len(varConf.Files) + len(varConf.Directories)
+		}
+	}
+
+	var exports onceMap[struct{}]
+	var mu sync.Mutex
+	var vars []resolvedVar
+	g, ctx := errgroup.WithContext(ctx)
+	for varName, varConf := range config {
+		// Already set by caller.
+		if os.Getenv(varName) != "" {
+			continue
+		}
+
+		varName, varConf := varName, varConf
+		g.Go(func() error {
+			v, err := resolveVar(ctx, src, varName, varConf, cache, tmp, &exports, p)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			vars = append(vars, v)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
 	}
-	client, err := dagger.Connect(ctx, clientOpts...)
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars, nil
+}
+
+// resolveVar exports the artifacts of the variable varName. exports
+// deduplicates exports to the same destination by different variables.
+func resolveVar(ctx context.Context, src *sources, varName string, varConf EnvVar, cache *artifactCache, tmp string, exports *onceMap[struct{}], p *progress) (resolvedVar, error) {
+	tmpl, err := template.New(varName).Parse(varConf.Template)
 	if err != nil {
-		return fmt.Errorf("unable to connect to client: %w", err)
+		return resolvedVar{}, fmt.Errorf("invalid %s template: %w", varName, err)
+	}
+
+	files := make(map[string]string)
+	for templateName, name := range varConf.Executables {
+		if files[templateName], err = findExecutable(name); err != nil {
+			return resolvedVar{}, fmt.Errorf("%s: %w", varName, err)
+		}
+	}
+
+	var f fetcher
+	var ref string
+	if !varConf.fromHost() {
+		f, ref = src.forVar(varConf)
+	} else if len(varConf.Files) > 0 || len(varConf.Directories) > 0 {
+		return resolvedVar{}, fmt.Errorf("%w: %s", ErrNoSource, varName)
+	}
+
+	// Where files are exported to.
+	root := tmp
+	var digest string
+	if cache != nil && f != nil {
+		digest, err = f.digest(ctx, ref)
+		if err != nil {
+			return resolvedVar{}, fmt.Errorf("could not resolve %s source %s: %w", varName, ref, err)
+		}
+		if root, err = cache.dir(digest); err != nil {
+			return resolvedVar{}, err
+		}
+		if err := cache.recordRef(ref, digest); err != nil {
+			return resolvedVar{}, err
+		}
+	}
+
+	var mu sync.Mutex
+	g, ctx := errgroup.WithContext(ctx)
+	export := func(templateName, path string, exportFn exportFunc) {
+		dst := filepath.Join(root, path)
+		mu.Lock()
+		files[templateName] = dst
+		mu.Unlock()
+
+		g.Go(func() error {
+			_, cached := os.Stat(dst)
+			_, err := exports.do(dst, func() (struct{}, error) {
+				return struct{}{}, exportOnce(ctx, exportFn, ref, path, dst)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to export %s from %s: %w", path, ref, err)
+			}
+			p.report(varName, path, ref, cached == nil)
+			return nil
+		})
+	}
+	for templateName, file := range varConf.Files {
+		export(templateName, file, f.exportFile)
+	}
+	for templateName, dir := range varConf.Directories {
+		export(templateName, dir, f.exportDirectory)
+	}
+	if err := g.Wait(); err != nil {
+		return resolvedVar{}, err
 	}
-	defer client.Close()
 
-	return runNatively(ctx, client, c, flag.Args())
+	var s strings.Builder
+	if err := tmpl.Execute(&s, files); err != nil {
+		return resolvedVar{}, fmt.Errorf("failed to substitute %s template variables: %w", varName, err)
+	}
+	return resolvedVar{
+		Name:      varName,
+		Value:     s.String(),
+		Source:    ref,
+		Digest:    digest,
+		Artifacts: files,
+	}, nil
 }
 
-func runNatively(ctx context.Context, client *dagger.Client, config EnvConfig, args []string) error {
-	var tmpDir string
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
 
-	if !*keepArtifacts {
-		c := make(chan os.Signal, 1)
-		defer close(c)
+// runNatively runs args with the artifacts of config and extraEnv in its
+// environment.
+//
+// If runvmtest received SIGINT or SIGTERM meanwhile, or the command was killed
+// by one, the error wraps ErrInterrupted.
+func runNatively(ctx context.Context, src *sources, config EnvConfig, extraEnv []string, args []string) (err error) {
+	var tmpDir string
 
-		signal.Notify(c, os.Interrupt)
-		defer signal.Stop(c)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	// Until the command is started, SIGINT and SIGTERM abort downloading
+	// artifacts. Afterwards, they are forwarded to the command. Either
+	// way, runvmtest cleans up once the command exits.
+	var procMu sync.Mutex
+	var proc *os.Process
+	var interrupted bool
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	defer func() {
+		procMu.Lock()
+		defer procMu.Unlock()
+		if !interrupted || errors.Is(err, ErrInterrupted) {
+			return
+		}
+		if err == nil {
+			err = ErrInterrupted
+		} else {
+			err = fmt.Errorf("%w: %w", ErrInterrupted, err)
+		}
+	}()
+	go func() {
+		for {
 			select {
-			case <-c:
-				os.RemoveAll(tmpDir)
+			case sig := <-sigs:
+				procMu.Lock()
+				interrupted = true
+				if proc != nil {
+					_ = proc.Signal(sig)
+				} else {
+					cancel()
+				}
+				procMu.Unlock()
 
 			case <-ctx.Done():
 				return
 			}
-		}()
-
-		defer wg.Wait()
+		}
+	}()
+
+	// Artifacts are exported into the cache, unless it is disabled or
+	// the user asked for a specific artifacts directory.
+	var cache *artifactCache
+	if !*noCache && *artifactsDir == "" {
+		var err error
+		if cache, err = openArtifactCache(*cacheDir); err != nil {
+			return err
+		}
 	}
 
-	// Cancel before wg.Wait(), so goroutine can exit.
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	if *dryRun {
+		var tmp string
+		if *artifactsDir != "" {
+			var err error
+			if tmp, err = filepath.Abs(*artifactsDir); err != nil {
+				return fmt.Errorf("could not retrieve absolute path: %w", err)
+			}
+		}
+		return writePlan(os.Stdout, src, config, cache, tmp, extraEnv, args)
+	}
 
-	var err error
 	if *artifactsDir != "" {
 		tmpDir = *artifactsDir
 		if err := os.MkdirAll(tmpDir, 0o700); err != nil {
 			return fmt.Errorf("could not create artifact directory: %v", err)
 		}
-	} else if tmpDir, err = os.MkdirTemp(".", "runvmtest-artifacts"); err != nil {
-		return fmt.Errorf("unable to create tmp dir: %w", err)
+	} else if cache == nil {
+		if tmpDir, err = os.MkdirTemp(".", "runvmtest-artifacts"); err != nil {
+			return fmt.Errorf("unable to create tmp dir: %w", err)
+		}
 	}
-	if !*keepArtifacts {
+	if !*keepArtifacts && tmpDir != "" {
 		defer os.RemoveAll(tmpDir)
 	}
-	tmp, err := filepath.Abs(tmpDir)
-	if err != nil {
-		return fmt.Errorf("could not retrieve absolute path: %w", err)
+	var tmp string
+	if tmpDir != "" {
+		if tmp, err = filepath.Abs(tmpDir); err != nil {
+			return fmt.Errorf("could not retrieve absolute path: %w", err)
+		}
 	}
 
-	base := client.Container()
-	var envv []string
-	for varName, varConf := range config {
-		// Already set by caller.
-		if os.Getenv(varName) != "" {
-			continue
-		}
+	vars, err := resolveEnv(ctx, src, config, cache, tmp)
+	if err != nil {
+		return err
+	}
+	envv := append(extraEnv, environ(vars)...)
 
-		files := make(map[string]string)
-		for templateName, file := range varConf.Files {
-			base = base.WithFile(file, client.Container().From(varConf.Container).File(file))
-			files[templateName] = filepath.Join(tmp, file)
-		}
-		for templateName, dir := range varConf.Directories {
-			base = base.WithDirectory(dir, client.Container().From(varConf.Container).Directory(dir))
-			files[templateName] = filepath.Join(tmp, dir)
+	if *jsonOut != "" {
+		if err := writeEnvJSON(*jsonOut, extraEnv, vars); err != nil {
+			return fmt.Errorf("could not write -json-out: %w", err)
 		}
+	}
 
-		tmpl, err := template.New(varName).Parse(varConf.Template)
-		if err != nil {
-			return fmt.Errorf("invalid %s template: %w", varName, err)
-		}
-		var s strings.Builder
-		if err := tmpl.Execute(&s, files); err != nil {
-			return fmt.Errorf("failed to substitute %s template variables: %w", varName, err)
+	if *printEnv {
+		for _, kv := range envv {
+			name, value, _ := strings.Cut(kv, "=")
+			fmt.Printf("export %s=%s\n", name, shellQuote(value))
 		}
-		envv = append(envv, varName+"="+s.String())
+		return nil
 	}
-	artifacts := base.Directory("/")
-
-	if ok, err := artifacts.Export(ctx, tmp); !ok || err != nil {
-		return fmt.Errorf("failed artifact export: %w", err)
+	if len(args) == 0 {
+		// Only -json-out.
+		return nil
 	}
 
 	cmd := exec.Command(args[0], args[1:]...)
@@ -282,8 +741,33 @@ func runNatively(ctx context.Context, client *dagger.Client, config EnvConfig, a
 		}()
 	}
 
-	if err := cmd.Run(); err != nil {
+	procMu.Lock()
+	if ctx.Err() != nil {
+		procMu.Unlock()
+		return fmt.Errorf("%w: %w", ErrInterrupted, ctx.Err())
+	}
+	err = cmd.Start()
+	proc = cmd.Process
+	procMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed execution: %w", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if killedByInterrupt(err) {
+			return fmt.Errorf("failed execution: %w: %w", ErrInterrupted, err)
+		}
 		return fmt.Errorf("failed execution: %w", err)
 	}
 	return nil
 }
+
+// killedByInterrupt returns whether err is the exit of a command killed by
+// SIGINT or SIGTERM, e.g. by Ctrl-C sent to the terminal's process group.
+func killedByInterrupt(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && (status.Signal() == syscall.SIGINT || status.Signal() == syscall.SIGTERM)
+}
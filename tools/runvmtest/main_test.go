@@ -0,0 +1,227 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestResolveEnv(t *testing.T) {
+	archives := makeArchives(t)
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	if err := os.WriteFile(archive, archives["a.tar.gz"], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := openArtifactCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	src, err := newSources(backendDagger, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	config := EnvConfig{
+		"VMTEST_KERNEL": {
+			Archive:  archive,
+			Template: "{{.bzImage}}",
+			Files:    map[string]string{"bzImage": "/bzImage"},
+		},
+		"VMTEST_QEMU": {
+			Archive:     archive,
+			Template:    "{{.qemu}}/bin/qemu-system-x86 -L {{.qemu}}/pc-bios",
+			Directories: map[string]string{"qemu": "/zqemu"},
+		},
+	}
+	// Variables set by the caller are not resolved.
+	t.Setenv("VMTEST_KERNEL", "")
+	t.Setenv("VMTEST_QEMU", "")
+
+	vars, err := resolveEnv(context.Background(), src, config, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envv := environ(vars)
+	digest := "sha256:" + sha256Hex(archives["a.tar.gz"])
+	dir := c.imageDir(digest)
+	want := []string{
+		"VMTEST_KERNEL=" + filepath.Join(dir, "bzImage"),
+		"VMTEST_QEMU=" + filepath.Join(dir, "zqemu") + "/bin/qemu-system-x86 -L " + filepath.Join(dir, "zqemu") + "/pc-bios",
+	}
+	if !slices.Equal(envv, want) {
+		t.Errorf("resolveEnv = %v, want %v", envv, want)
+	}
+	if got := readFile(t, filepath.Join(dir, "zqemu/bin/qemu-system-x86")); got != "qemu" {
+		t.Errorf("qemu = %q, want qemu", got)
+	}
+	if got := vars[0]; got.Source != archive || got.Digest != digest || got.Artifacts["bzImage"] != filepath.Join(dir, "bzImage") {
+		t.Errorf("resolveEnv VMTEST_KERNEL = %+v, want source %s, digest %s, bzImage in %s", got, archive, digest, dir)
+	}
+	for _, want := range []string{"[1/2] ", "[2/2] ", "VMTEST_KERNEL: exported /bzImage from " + archive} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("progress output %q does not contain %q", out.String(), want)
+		}
+	}
+
+	out.Reset()
+	t.Setenv("VMTEST_KERNEL", "/my/kernel")
+	vars, err = resolveEnv(context.Background(), src, config, c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envv = environ(vars)
+	if !slices.Equal(envv, want[1:]) {
+		t.Errorf("resolveEnv = %v, want %v", envv, want[1:])
+	}
+	if want := "[1/1] VMTEST_QEMU: /zqemu from " + archive + " (cached)\n"; out.String() != want {
+		t.Errorf("progress output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"/tmp/bzImage", `'/tmp/bzImage'`},
+		{"qemu -L /x -m 1G", `'qemu -L /x -m 1G'`},
+		{"it's", `'it'\''s'`},
+	} {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestImage(t *testing.T) {
+	for _, tt := range []struct {
+		v    EnvVar
+		want string
+	}{
+		{
+			v:    EnvVar{Container: "ghcr.io/hugelgupf/vmtest/kernel-amd64:main"},
+			want: "ghcr.io/hugelgupf/vmtest/kernel-amd64:main",
+		},
+		{
+			v:    EnvVar{Container: "ghcr.io/hugelgupf/vmtest/kernel-amd64:main", Tag: "6.6"},
+			want: "ghcr.io/hugelgupf/vmtest/kernel-amd64:6.6",
+		},
+		{
+			v:    EnvVar{Container: "localhost:5000/kernel", Tag: "6.6"},
+			want: "localhost:5000/kernel:6.6",
+		},
+		{
+			v:    EnvVar{Container: "localhost:5000/kernel:main@sha256:abcd", Tag: "6.6"},
+			want: "localhost:5000/kernel:6.6",
+		},
+	} {
+		if got := tt.v.Image(); got != tt.want {
+			t.Errorf("%+v.Image() = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestRunMatrix(t *testing.T) {
+	archives := makeArchives(t)
+	archive := filepath.Join(t.TempDir(), "a.tar")
+	if err := os.WriteFile(archive, archives["a.tar"], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	*cacheDir = t.TempDir()
+	defer func() { *cacheDir = "" }()
+
+	src, err := newSources(backendDagger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	kernel := EnvVar{
+		Archive:  archive,
+		Template: "{{.bzImage}}",
+		Files:    map[string]string{"bzImage": "/bzImage"},
+	}
+	config := Config{
+		"amd64": {"VMTEST_KERNEL": kernel},
+		"arm64": {"VMTEST_KERNEL": kernel},
+	}
+	t.Setenv("VMTEST_KERNEL", "")
+
+	out := filepath.Join(t.TempDir(), "out")
+	// Fails for arm64 only.
+	script := `echo "$VMTEST_ARCH $(cat $VMTEST_KERNEL)" >> ` + out + `; test "$VMTEST_ARCH" != arm64 || exit 3`
+	err = runMatrix(context.Background(), src, config, []string{"amd64", "arm64"}, nil, []string{"sh", "-c", script})
+	if !errors.Is(err, ErrMatrixFailed) || !strings.Contains(err.Error(), "VMTEST_ARCH=arm64") {
+		t.Errorf("runMatrix = %v, want failure for arm64", err)
+	}
+	if got := exitCode(err); got != 3 {
+		t.Errorf("exitCode = %d, want 3", got)
+	}
+	if got, want := readFile(t, out), "amd64 kernel\narm64 kernel\n"; got != want {
+		t.Errorf("command output = %q, want %q", got, want)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cmdErr := func(script string) error {
+		err := exec.Command("sh", "-c", script).Run()
+		return fmt.Errorf("failed execution: %w", err)
+	}
+	infraErr := fmt.Errorf("could not fetch: %w", ErrChecksumMismatch)
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "command", err: cmdErr("exit 3"), want: 3},
+		{name: "signal", err: cmdErr("kill -TERM $$"), want: 128 + int(syscall.SIGTERM)},
+		{name: "infra", err: infraErr, want: exitInfra},
+		{name: "matrix-command", err: &matrixError{arches: []string{"amd64", "arm64"}, errs: []error{cmdErr("exit 4"), cmdErr("exit 5")}}, want: 4},
+		{name: "matrix-infra", err: &matrixError{arches: []string{"amd64", "arm64"}, errs: []error{cmdErr("exit 4"), infraErr}}, want: exitInfra},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunMatrixInterrupted(t *testing.T) {
+	*cacheDir = t.TempDir()
+	defer func() { *cacheDir = "" }()
+
+	src, err := newSources(backendDagger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	config := Config{"amd64": {}, "arm64": {}}
+	out := filepath.Join(t.TempDir(), "out")
+	// The first command dies of SIGINT, as on Ctrl-C in a terminal.
+	script := `echo "$VMTEST_ARCH" >> ` + out + `; kill -INT $$`
+	err = runMatrix(context.Background(), src, config, []string{"amd64", "arm64"}, nil, []string{"sh", "-c", script})
+	if !errors.Is(err, ErrInterrupted) || !errors.Is(err, ErrMatrixFailed) {
+		t.Errorf("runMatrix = %v, want %v", err, ErrInterrupted)
+	}
+	if got := exitCode(err); got != 130 {
+		t.Errorf("exitCode = %d, want 130", got)
+	}
+	if got, want := readFile(t, out), "amd64\n"; got != want {
+		t.Errorf("command output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// planRoot returns where the artifacts of v would be exported to, and its
+// digest if known without contacting the network.
+func planRoot(src *sources, v EnvVar, cache *artifactCache, tmp string) (root, digest string) {
+	if cache == nil {
+		if tmp == "" {
+			return "<artifacts dir>", ""
+		}
+		return tmp, ""
+	}
+	if v.Archive != "" {
+		src.archives.add(v.Archive, v.SHA256)
+		d, err := src.archives.digest(context.Background(), v.Archive)
+		if err != nil {
+			return filepath.Join(cache.root, "<digest>"), ""
+		}
+		return cache.imageDir(d), d
+	}
+	d, ok := cache.lookupRef(v.Image())
+	if !ok {
+		return filepath.Join(cache.root, "<digest>"), ""
+	}
+	return cache.imageDir(d), d
+}
+
+// writePlan writes what running args with config would fetch and set to w,
+// without fetching anything.
+//
+// Cache status is based on the digest each image last resolved to. A run
+// resolves the digest again, so a tag that moved since is fetched anyway.
+func writePlan(w io.Writer, src *sources, config EnvConfig, cache *artifactCache, tmp string, extraEnv, args []string) error {
+	for _, name := range sortedKeys(config) {
+		v := config[name]
+		fmt.Fprintf(w, "%s:\n", name)
+		if value := os.Getenv(name); value != "" {
+			fmt.Fprintf(w, "  set in environment, will not be fetched: %s=%s\n", name, value)
+			continue
+		}
+
+		tmpl, err := template.New(name).Parse(v.Template)
+		if err != nil {
+			return fmt.Errorf("invalid %s template: %w", name, err)
+		}
+
+		root, digest := planRoot(src, v, cache, tmp)
+		ref := v.Image()
+		if v.Archive != "" {
+			ref = v.Archive
+		}
+		switch {
+		case v.fromHost():
+			fmt.Fprintf(w, "  source:    host\n")
+		case digest != "":
+			fmt.Fprintf(w, "  source:    %s (%s)\n", ref, digest)
+		case cache != nil:
+			fmt.Fprintf(w, "  source:    %s (never downloaded)\n", ref)
+		default:
+			fmt.Fprintf(w, "  source:    %s\n", ref)
+		}
+
+		files := make(map[string]string)
+		plan := func(kind string, m map[string]string) {
+			for _, templateName := range sortedKeys(m) {
+				files[templateName] = filepath.Join(root, m[templateName])
+				status := "fetch"
+				if _, err := os.Stat(files[templateName]); digest != "" && err == nil {
+					status = "cached"
+				}
+				fmt.Fprintf(w, "  %-10s %s: %s (%s)\n", kind+":", templateName, m[templateName], status)
+			}
+		}
+		plan("file", v.Files)
+		plan("directory", v.Directories)
+		for _, templateName := range sortedKeys(v.Executables) {
+			p, err := findExecutable(v.Executables[templateName])
+			if err != nil {
+				p = "not found"
+			}
+			files[templateName] = p
+			fmt.Fprintf(w, "  %-10s %s: %s (%s)\n", "host:", templateName, v.Executables[templateName], p)
+		}
+
+		var s strings.Builder
+		if err := tmpl.Execute(&s, files); err != nil {
+			return fmt.Errorf("failed to substitute %s template variables: %w", name, err)
+		}
+		fmt.Fprintf(w, "  value:     %s\n", s.String())
+	}
+
+	if len(args) > 0 {
+		var cmd []string
+		for _, kv := range extraEnv {
+			name, value, _ := strings.Cut(kv, "=")
+			cmd = append(cmd, name+"="+shellQuote(value))
+		}
+		for _, arg := range args {
+			cmd = append(cmd, shellQuote(arg))
+		}
+		fmt.Fprintf(w, "Would run: %s\n", strings.Join(cmd, " "))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePlan(t *testing.T) {
+	archives := makeArchives(t)
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	if err := os.WriteFile(archive, archives["a.tar.gz"], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := openArtifactCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSources(backendDagger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	config := EnvConfig{
+		"VMTEST_KERNEL": {
+			Archive:  archive,
+			Template: "{{.bzImage}}",
+			Files:    map[string]string{"bzImage": "/bzImage"},
+		},
+		"VMTEST_QEMU": {
+			Container:   "ghcr.io/hugelgupf/vmtest/qemu:main",
+			Template:    "{{.qemu}}/bin/qemu-system-x86_64",
+			Directories: map[string]string{"qemu": "/zqemu"},
+		},
+		"VMTEST_INITRAMFS": {
+			Container: "initramfs:main",
+		},
+	}
+	t.Setenv("VMTEST_KERNEL", "")
+	t.Setenv("VMTEST_QEMU", "")
+	t.Setenv("VMTEST_INITRAMFS", "/my/initramfs")
+
+	plan := func() string {
+		var b strings.Builder
+		if err := writePlan(&b, src, config, c, "", []string{"VMTEST_ARCH=amd64"}, []string{"go", "test", "./..."}); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("Plan:\n%s", b.String())
+		return b.String()
+	}
+
+	dir := c.imageDir("sha256:" + sha256Hex(archives["a.tar.gz"]))
+	got := plan()
+	for _, want := range []string{
+		"  file:      bzImage: /bzImage (fetch)\n",
+		"  value:     " + filepath.Join(dir, "bzImage") + "\n",
+		"  source:    ghcr.io/hugelgupf/vmtest/qemu:main (never downloaded)\n",
+		"  directory: qemu: /zqemu (fetch)\n",
+		"  value:     " + filepath.Join(c.root, "<digest>", "zqemu") + "/bin/qemu-system-x86_64\n",
+		"  set in environment, will not be fetched: VMTEST_INITRAMFS=/my/initramfs\n",
+		"Would run: VMTEST_ARCH='amd64' 'go' 'test' './...'\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Plan does not contain %q", want)
+		}
+	}
+	if entries, _ := os.ReadDir(c.root); len(entries) != 0 {
+		t.Errorf("Plan populated the cache: %v", entries)
+	}
+
+	delete(config, "VMTEST_QEMU")
+	if _, err := resolveEnv(context.Background(), src, config, c, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := plan(), "  file:      bzImage: /bzImage (cached)\n"; !strings.Contains(got, want) {
+		t.Errorf("Plan does not contain %q", want)
+	}
+}
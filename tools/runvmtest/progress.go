@@ -0,0 +1,93 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Formats of download output (see -log-format).
+const (
+	logAuto  = "auto"
+	logTTY   = "tty"
+	logPlain = "plain"
+	logJSON  = "json"
+)
+
+// ErrUnknownLogFormat is returned for an unsupported -log-format.
+var ErrUnknownLogFormat = errors.New("unknown log format")
+
+// resolveLogFormat returns the log format for format, resolving auto based on
+// whether w is a terminal.
+func resolveLogFormat(format string, w io.Writer) (string, error) {
+	switch format {
+	case logTTY, logPlain, logJSON:
+		return format, nil
+	case logAuto:
+		if f, ok := w.(*os.File); ok {
+			if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+				return logTTY, nil
+			}
+		}
+		return logPlain, nil
+	default:
+		return "", fmt.Errorf("%w %q (want %s, %s, %s or %s)", ErrUnknownLogFormat, format, logAuto, logTTY, logPlain, logJSON)
+	}
+}
+
+// progressEvent is a JSON line of -log-format=json.
+type progressEvent struct {
+	Time     time.Time `json:"time"`
+	Variable string    `json:"variable"`
+	Path     string    `json:"path"`
+	Source   string    `json:"source"`
+	Cached   bool      `json:"cached"`
+	Done     int       `json:"done"`
+	Total    int       `json:"total"`
+}
+
+// progress reports exported artifacts as "[done/total] ..." or, if json is
+// set, as progressEvent JSON lines.
+type progress struct {
+	w    io.Writer
+	json bool
+
+	mu    sync.Mutex
+	done  int
+	total int
+}
+
+// report reports that path of variable was exported from source, or was
+// already cached.
+func (p *progress) report(variable, path, source string, cached bool) {
+	if p.w == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+
+	if p.json {
+		_ = json.NewEncoder(p.w).Encode(progressEvent{
+			Time:     time.Now().UTC(),
+			Variable: variable,
+			Path:     path,
+			Source:   source,
+			Cached:   cached,
+			Done:     p.done,
+			Total:    p.total,
+		})
+	} else if cached {
+		fmt.Fprintf(p.w, "[%d/%d] %s: %s from %s (cached)\n", p.done, p.total, variable, path, source)
+	} else {
+		fmt.Fprintf(p.w, "[%d/%d] %s: exported %s from %s\n", p.done, p.total, variable, path, source)
+	}
+}
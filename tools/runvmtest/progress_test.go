@@ -0,0 +1,55 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	var b strings.Builder
+	p := &progress{w: &b, total: 2}
+	p.report("VMTEST_KERNEL", "/bzImage", "kernel:main", false)
+	p.report("VMTEST_QEMU", "/zqemu", "qemu:main", true)
+	if got, want := b.String(), "[1/2] VMTEST_KERNEL: exported /bzImage from kernel:main\n[2/2] VMTEST_QEMU: /zqemu from qemu:main (cached)\n"; got != want {
+		t.Errorf("plain progress = %q, want %q", got, want)
+	}
+
+	b.Reset()
+	p = &progress{w: &b, json: true, total: 1}
+	p.report("VMTEST_KERNEL", "/bzImage", "kernel:main", true)
+	var got progressEvent
+	if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatalf("Progress is not JSON: %v: %q", err, b.String())
+	}
+	if got.Variable != "VMTEST_KERNEL" || got.Path != "/bzImage" || got.Source != "kernel:main" || !got.Cached || got.Done != 1 || got.Total != 1 || got.Time.IsZero() {
+		t.Errorf("JSON progress = %+v", got)
+	}
+
+	// Must not panic without output, as with -quiet.
+	(&progress{}).report("VMTEST_KERNEL", "/bzImage", "kernel:main", false)
+}
+
+func TestResolveLogFormat(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		want   string
+		err    error
+	}{
+		{format: logAuto, want: logPlain},
+		{format: logTTY, want: logTTY},
+		{format: logJSON, want: logJSON},
+		{format: "xml", err: ErrUnknownLogFormat},
+	} {
+		// Not a terminal.
+		got, err := resolveLogFormat(tt.format, &strings.Builder{})
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("resolveLogFormat(%s) = (%s, %v), want (%s, %v)", tt.format, got, err, tt.want, tt.err)
+		}
+	}
+}
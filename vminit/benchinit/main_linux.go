@@ -0,0 +1,142 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command benchinit runs Go benchmarks in a guest VM and streams their results
+// to the host over the "benchmarks" virtio-serial event channel.
+//
+// Positional arguments are passed to each test binary as additional flags.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hugelgupf/vmtest/guest"
+	"github.com/hugelgupf/vmtest/internal/testevent"
+	"golang.org/x/tools/benchmark/parse"
+)
+
+var (
+	bench                 = flag.String("bench", ".", "Regular expression of benchmarks to run, passed to -test.bench")
+	individualTestTimeout = flag.Duration("test_timeout", 10*time.Minute, "timeout per Go package")
+)
+
+func walkTests(testRoot string, fn func(string, string)) error {
+	return filepath.Walk(testRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(path, ".test") {
+			return nil
+		}
+
+		t2, err := filepath.Rel(testRoot, path)
+		if err != nil {
+			return err
+		}
+		pkgName := filepath.Dir(t2)
+
+		fn(path, pkgName)
+		return nil
+	})
+}
+
+func runBenchmarks() error {
+	errorEvents, err := guest.EventChannel[testevent.ErrorEvent]("/mount/9p/gotestdata/errors.json")
+	if err != nil {
+		return err
+	}
+	defer errorEvents.Close()
+
+	if err := run(errorEvents); err != nil {
+		_ = errorEvents.Emit(testevent.ErrorEvent{
+			Error: fmt.Sprintf("running benchmarks failed: %v", err),
+		})
+		return err
+	}
+	return nil
+}
+
+func run(errorEvents *guest.Emitter[testevent.ErrorEvent]) error {
+	results, err := guest.SerialEventChannel[testevent.BenchmarkEvent]("benchmarks")
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	return walkTests("/mount/9p/gotestdata/tests", func(path, pkgName string) {
+		ctx, cancel := context.WithTimeout(context.Background(), *individualTestTimeout)
+		defer cancel()
+
+		r, w := io.Pipe()
+		// Additional test flags given by the host.
+		args := append([]string{"-test.run=^$", "-test.bench=" + *bench, "-test.benchmem"}, flag.Args()...)
+		cmd := exec.CommandContext(ctx, path, args...)
+		cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+		cmd.Stdout = io.MultiWriter(os.Stdout, w)
+
+		// Start benchmark in its own dir so that testdata is available
+		// as a relative directory.
+		cmd.Dir = filepath.Dir(path)
+		if err := cmd.Start(); err != nil {
+			_ = errorEvents.Emit(testevent.ErrorEvent{
+				Binary: path,
+				Error:  fmt.Sprintf("failed to start: %v", err),
+			})
+			log.Printf("Failed to start %q: %v", path, err)
+			return
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s := bufio.NewScanner(r)
+			for s.Scan() {
+				b, err := parse.ParseLine(s.Text())
+				if err != nil {
+					// Not a benchmark result line.
+					continue
+				}
+				if err := results.Emit(testevent.BenchmarkEvent{
+					Package:           pkgName,
+					Name:              b.Name,
+					N:                 b.N,
+					NsPerOp:           b.NsPerOp,
+					AllocedBytesPerOp: b.AllocedBytesPerOp,
+					AllocsPerOp:       b.AllocsPerOp,
+					MBPerS:            b.MBPerS,
+				}); err != nil {
+					log.Printf("Failed to emit benchmark result: %v", err)
+				}
+			}
+		}()
+
+		if err := cmd.Wait(); err != nil {
+			_ = errorEvents.Emit(testevent.ErrorEvent{
+				Binary: path,
+				Error:  fmt.Sprintf("benchmark exited with non-zero status: %v", err),
+			})
+			log.Printf("Error: benchmark %q exited with non-zero status: %v", pkgName, err)
+		}
+		w.Close()
+		<-done
+	})
+}
+
+func main() {
+	flag.Parse()
+
+	if err := runBenchmarks(); err != nil {
+		log.Fatalf("Benchmarks failed: %v", err)
+	}
+}
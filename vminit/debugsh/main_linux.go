@@ -0,0 +1,90 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command debugsh runs a command and, if it fails, starts an interactive shell
+// for postmortem inspection before exiting.
+//
+// The shell is only started when VMTEST_DEBUG_SHELL is set, which
+// qemu.WithDebugShell does. Its value is the name of the virtio-serial port
+// the shell is served on. If that port cannot be found, the shell is started
+// on the console.
+//
+// The shell is gosh unless given by -shell, or, to keep arguments with spaces
+// intact, as the first -shell-argc positional arguments, e.g.
+// `debugsh -shell-argc=2 -- busybox sh shelluinit -- busybox sh`.
+//
+// If the command failed, debugsh exits non-zero once the shell exits.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/hugelgupf/vmtest/guest"
+)
+
+var (
+	shell     = flag.String("shell", "gosh", "Shell (and space-separated args) to start when the command fails")
+	shellArgc = flag.Int("shell-argc", 0, "Number of positional args that are the shell (and its args) to start when the command fails, instead of -shell")
+)
+
+func debugShell(port string, sh []string) error {
+	stdio := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	if dev, err := guest.VirtioSerialDevice(port); err != nil {
+		log.Printf("Debug shell port %s not found, using console: %v", port, err)
+	} else {
+		f, err := os.OpenFile(dev, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stdio = []*os.File{f, f, f}
+		log.Printf("Debug shell started on virtio-serial port %s", port)
+	}
+
+	c := exec.Command(sh[0], sh[1:]...)
+	c.Stdin, c.Stdout, c.Stderr = stdio[0], stdio[1], stdio[2]
+	c.Env = append(os.Environ(), "PS1=debugsh$ ")
+	return c.Run()
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return c.Run()
+}
+
+func main() {
+	flag.Parse()
+	sh, args := strings.Fields(*shell), flag.Args()
+	if n := *shellArgc; n > 0 {
+		if n > len(args) {
+			log.Fatalf("-shell-argc=%d, but only %d args given", n, len(args))
+		}
+		sh, args = args[:n], args[n:]
+	}
+	if len(sh) == 0 {
+		sh = []string{"gosh"}
+	}
+
+	err := run(args)
+	if err == nil {
+		return
+	}
+	log.Printf("Failed: %v", err)
+
+	if port, ok := os.LookupEnv("VMTEST_DEBUG_SHELL"); ok {
+		log.Printf("Starting debug shell %q; exit the shell to shut down", sh)
+		if err := debugShell(port, sh); err != nil {
+			log.Printf("Debug shell: %v", err)
+		}
+	}
+	os.Exit(1)
+}
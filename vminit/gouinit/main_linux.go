@@ -3,10 +3,29 @@
 // license that can be found in the LICENSE file.
 
 // Command gouinit runs Go tests in a guest VM.
+//
+// Positional arguments are passed to each test binary as additional flags.
+//
+// With -list, tests are not run. Instead, the names of all tests in each test
+// binary are reported.
+//
+// With -wrapper, each test binary is run under another command such as strace
+// or perf record. "{output}" in the wrapper's arguments is replaced with a
+// per-package file in -trace_dir.
+//
+// If the host collects KCOV coverage with qcoverage.CollectKCOV, each test
+// binary is run under kcovexec and the kernel PCs it covered are sent to the
+// host.
+//
+// If /mount/9p/gotestdata/gouinit.args exists, the JSON list of arguments in it
+// is used before the command-line arguments, so that a prebuilt initramfs can
+// run any tests.
 package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -18,13 +37,16 @@ import (
 	"time"
 
 	"github.com/hugelgupf/vmtest/guest"
-	"github.com/hugelgupf/vmtest/internal/json2test"
 	"github.com/hugelgupf/vmtest/internal/testevent"
+	"github.com/hugelgupf/vmtest/json2test"
 )
 
 var (
 	coverProfile          = flag.String("coverprofile", "", "Filename to write coverage data to")
 	individualTestTimeout = flag.Duration("test_timeout", time.Minute, "timeout per Go package")
+	list                  = flag.Bool("list", false, "Only list the tests of each test binary")
+	wrapper               = flag.String("wrapper", "", "Command (and space-separated args) to run each test binary under")
+	traceDir              = flag.String("trace_dir", "/mount/9p/gotestdata/traces", "Directory to place {output} files of -wrapper in")
 )
 
 func walkTests(testRoot string, fn func(string, string)) error {
@@ -70,59 +92,201 @@ func AppendFile(srcFile, targetFile string) error {
 	return out.Close()
 }
 
+// wrapCommand returns the command to run the test binary at path with args,
+// taking -wrapper into account.
+func wrapCommand(path, pkgName string, args []string) (string, []string, error) {
+	w := strings.Fields(*wrapper)
+	if len(w) == 0 {
+		return path, args, nil
+	}
+	output := filepath.Join(*traceDir, pkgName+".trace")
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return "", nil, err
+	}
+	for i := range w {
+		w[i] = strings.ReplaceAll(w[i], "{output}", output)
+	}
+	return w[0], append(append(w[1:], path), args...), nil
+}
+
+// kcovChunk is the number of PCs per KCOV event, keeping events well below the
+// event channel's line limit.
+const kcovChunk = 1024
+
+// openKCOV opens a KCOV buffer and the event channel to send its PCs on if the
+// host collects KCOV coverage. It returns nil if the host does not.
+func openKCOV() (*guest.KCOV, *guest.Emitter[testevent.KCOVEvent], error) {
+	if _, err := guest.VirtioSerialDevice("kcov"); err != nil {
+		return nil, nil, nil
+	}
+	events, err := guest.SerialEventChannel[testevent.KCOVEvent]("kcov")
+	if err != nil {
+		return nil, nil, err
+	}
+	kcov, err := guest.OpenKCOV(guest.DefaultKCOVEntries)
+	if err != nil {
+		events.Close()
+		return nil, nil, err
+	}
+	return kcov, events, nil
+}
+
+// emitKCOV sends the PCs covered by pkgName's test binary to the host.
+func emitKCOV(events *guest.Emitter[testevent.KCOVEvent], pkgName string, pcs []uint64) error {
+	for len(pcs) > 0 {
+		n := min(len(pcs), kcovChunk)
+		if err := events.Emit(testevent.KCOVEvent{Package: pkgName, PCs: pcs[:n]}); err != nil {
+			return err
+		}
+		pcs = pcs[n:]
+	}
+	return nil
+}
+
+// listTests reports the tests of each test binary.
+func listTests(testEvents *guest.Emitter[testevent.ErrorEvent]) error {
+	lists, err := guest.EventChannel[testevent.TestListEvent]("/mount/9p/gotestdata/list.json")
+	if err != nil {
+		return err
+	}
+	defer lists.Close()
+
+	return walkTests("/mount/9p/gotestdata/tests", func(path, pkgName string) {
+		ctx, cancel := context.WithTimeout(context.Background(), *individualTestTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, path, "-test.list=.")
+		cmd.Dir = filepath.Dir(path)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			_ = testEvents.Emit(testevent.ErrorEvent{
+				Binary: path,
+				Error:  fmt.Sprintf("listing tests failed: %v", err),
+			})
+			log.Printf("Listing tests of %q failed: %v", pkgName, err)
+			return
+		}
+		if err := lists.Emit(testevent.TestListEvent{
+			Package: pkgName,
+			Names:   strings.Fields(string(out)),
+		}); err != nil {
+			log.Printf("Failed to emit test list: %v", err)
+		}
+	})
+}
+
+// argsFile has arguments from the host for prebuilt initramfs images.
+const argsFile = "/mount/9p/gotestdata/gouinit.args"
+
+// parseFlags parses the arguments in argsFile, if any, and the command line.
+func parseFlags() error {
+	var args []string
+	if b, err := os.ReadFile(argsFile); err == nil {
+		if err := json.Unmarshal(b, &args); err != nil {
+			return fmt.Errorf("invalid %s: %w", argsFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return flag.CommandLine.Parse(append(args, os.Args[1:]...))
+}
+
 // runTest mounts a vfat or 9pfs volume and runs the tests within.
 func runTest() error {
-	flag.Parse()
-
 	testEvents, err := guest.EventChannel[testevent.ErrorEvent]("/mount/9p/gotestdata/errors.json")
 	if err != nil {
 		return err
 	}
 	defer testEvents.Close()
 
-	if err := run(testEvents); err != nil {
+	if *list {
+		if err := listTests(testEvents); err != nil {
+			_ = testEvents.Emit(testevent.ErrorEvent{
+				Error: fmt.Sprintf("listing tests failed: %v", err),
+			})
+			return err
+		}
+		return nil
+	}
+
+	failed, err := run(testEvents)
+	if err != nil {
 		_ = testEvents.Emit(testevent.ErrorEvent{
 			Error: fmt.Sprintf("running tests failed: %v", err),
 		})
 		return err
 	}
+	if len(failed) > 0 {
+		// Failures were already reported by the test events.
+		return fmt.Errorf("%w: %s", errTestsFailed, strings.Join(failed, ", "))
+	}
 	return nil
 }
 
-func run(testEvents *guest.Emitter[testevent.ErrorEvent]) error {
+// run runs all tests and returns the package names of tests that failed.
+func run(testEvents *guest.Emitter[testevent.ErrorEvent]) ([]string, error) {
 	defer guest.CollectKernelCoverage()
 
 	goTestEvents, err := guest.EventChannel[json2test.TestEvent]("/mount/9p/gotestdata/results.json")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer goTestEvents.Close()
 
-	return walkTests("/mount/9p/gotestdata/tests", func(path, pkgName string) {
+	kcov, kcovEvents, err := openKCOV()
+	if err != nil {
+		_ = testEvents.Emit(testevent.ErrorEvent{
+			Error: fmt.Sprintf("KCOV coverage is not collected: %v", err),
+		})
+		log.Printf("KCOV coverage is not collected: %v", err)
+	} else if kcov != nil {
+		defer kcovEvents.Close()
+		defer kcov.Close()
+	}
+
+	var failed []string
+	if err := walkTests("/mount/9p/gotestdata/tests", func(path, pkgName string) {
+		guest.Phase("test " + pkgName)
+
 		// Send the kill signal with a 500ms grace period.
 		ctx, cancel := context.WithTimeout(context.Background(), *individualTestTimeout+500*time.Millisecond)
 		defer cancel()
 
-		r, w, err := os.Pipe()
-		if err != nil {
-			log.Printf("Failed to get pipe: %v", err)
-			return
-		}
-
-		args := []string{"-test.v", "-test.bench=.", "-test.run=."}
+		args := []string{"-test.bench=.", "-test.run=."}
+		// Additional test flags given by the host.
+		args = append(args, flag.Args()...)
+		// Last, so that a -test.v of the host does not override it:
+		// json2test only parses output framed for test2json.
+		args = append(args, "-test.v=test2json")
 		coverFile := filepath.Join(filepath.Dir(path), "coverage.txt")
 		if len(*coverProfile) > 0 {
 			args = append(args, "-test.coverprofile", coverFile)
 		}
 
-		cmd := exec.CommandContext(ctx, path, args...)
+		name, args, err := wrapCommand(path, pkgName, args)
+		if err != nil {
+			_ = testEvents.Emit(testevent.ErrorEvent{
+				Binary: path,
+				Error:  fmt.Sprintf("failed to set up wrapper: %v", err),
+			})
+			log.Printf("Failed to set up wrapper for %q: %v", path, err)
+			return
+		}
+		if kcov != nil {
+			kcov.Reset()
+			name, args = "kcovexec", append([]string{"--", name}, args...)
+		}
+		cmd := exec.CommandContext(ctx, name, args...)
 		cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+		if kcov != nil {
+			cmd.ExtraFiles = []*os.File{kcov.File()}
+		}
 
-		// Write to stdout for humans, write to w for the JSON converter.
-		//
-		// The test collector will gobble up JSON for statistics, and
-		// print non-JSON for humans to consume.
-		cmd.Stdout = io.MultiWriter(os.Stdout, w)
+		// Write to stdout for humans, and convert to JSON test events
+		// for the host.
+		conv := json2test.NewConverter(pkgName, goTestEvents.Emit)
+		cmd.Stdout = io.MultiWriter(os.Stdout, conv)
 
 		// Start test in its own dir so that testdata is available as a
 		// relative directory.
@@ -136,39 +300,24 @@ func run(testEvents *guest.Emitter[testevent.ErrorEvent]) error {
 			return
 		}
 
-		// The test2json is not run with a context as it does not
-		// block. If we cancelled test2json with the same context as
-		// the test, we may lose some of the last few lines.
-		j := exec.Command("test2json", "-t", "-p", pkgName)
-		j.Stdin = r
-		j.Stdout, cmd.Stderr = goTestEvents, os.Stderr
-		if err := j.Start(); err != nil {
-			_ = testEvents.Emit(testevent.ErrorEvent{
-				Binary: path,
-				Error:  fmt.Sprintf("failed to start test2json: %v", err),
-			})
-			log.Printf("Failed to start test2json: %v", err)
-			return
-		}
-
-		if err := cmd.Wait(); err != nil {
+		err = cmd.Wait()
+		conv.Exited(err)
+		if err != nil {
 			_ = testEvents.Emit(testevent.ErrorEvent{
 				Binary: path,
 				Error:  fmt.Sprintf("test exited with non-zero status: %v", err),
 			})
 			log.Printf("Error: test %q exited with non-zero status: %v", pkgName, err)
+			failed = append(failed, pkgName)
 		}
-
-		// Close the pipe so test2json will quit.
-		if err := w.Close(); err != nil {
-			log.Printf("Failed to close pipe: %v", err)
+		if err := conv.Close(); err != nil {
+			log.Printf("Failed to emit test events: %v", err)
 		}
-		if err := j.Wait(); err != nil {
-			_ = testEvents.Emit(testevent.ErrorEvent{
-				Binary: path,
-				Error:  fmt.Sprintf("test2json exited with non-zero status: %v", err),
-			})
-			log.Printf("Failed to stop test2json: %v", err)
+
+		if kcov != nil {
+			if err := emitKCOV(kcovEvents, pkgName, kcov.PCs()); err != nil {
+				log.Printf("Failed to emit KCOV coverage: %v", err)
+			}
 		}
 
 		if len(*coverProfile) > 0 {
@@ -180,13 +329,21 @@ func run(testEvents *guest.Emitter[testevent.ErrorEvent]) error {
 				log.Printf("Could not append to cover file: %v", err)
 			}
 		}
-	})
+	}); err != nil {
+		return nil, err
+	}
+	return failed, nil
 }
 
+var errTestsFailed = errors.New("tests failed")
+
 func main() {
-	flag.Parse()
+	if err := parseFlags(); err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
 
 	if err := runTest(); err != nil {
-		log.Printf("Tests failed: %v", err)
+		// Exit non-zero so wrappers like debugsh can tell.
+		log.Fatalf("Tests failed: %v", err)
 	}
 }
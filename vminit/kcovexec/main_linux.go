@@ -0,0 +1,47 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command kcovexec enables KCOV on the KCOV buffer passed as file descriptor 3
+// and executes the command given in args, so that the kernel code the command
+// exercises is collected into the buffer.
+//
+// Only the command's initial thread is covered.
+package main
+
+import (
+	"flag"
+	"log"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/hugelgupf/vmtest/guest"
+)
+
+func init() {
+	// The thread that enables KCOV must be the one calling execve.
+	runtime.LockOSThread()
+}
+
+func run() error {
+	args := flag.Args()
+	if len(args) == 0 {
+		log.Fatalf("Usage: kcovexec -- command [args...]")
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	if err := guest.EnableKCOV(3); err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, syscall.Environ())
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatalf("kcovexec: %v", err)
+	}
+}
@@ -2,19 +2,84 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Command shelluinit runs commands from an elvish script.
+// Command shelluinit runs commands from a shell script.
+//
+// The shell and its arguments may be given as positional arguments, e.g.
+// `shelluinit -- busybox sh`. The default shell is gosh.
+//
+// If GOCOVERDIR is set, the commands given by -covered (commands built with
+// coverage) are run under `shelluinit -cover-exec`, which exports GOCOVERDIR
+// to the command and syncs it after the command exits. Scripts need not sync
+// coverage themselves before shutting down.
 package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/hugelgupf/vmtest/guest"
+	"golang.org/x/sys/unix"
 )
 
+var (
+	covered   = flag.String("covered", "", "Comma-separated commands built with coverage to export GOCOVERDIR to")
+	coverExec = flag.String("cover-exec", "", "Instead of running the test script, run this command with the given args and sync GOCOVERDIR after")
+)
+
+// coverShims writes an executable for each covered command that runs it under
+// `shelluinit -cover-exec`. It returns the directory to prepend to $PATH.
+func coverShims(cmds []string) (string, error) {
+	self, err := exec.LookPath("shelluinit")
+	if err != nil {
+		return "", err
+	}
+	if self, err = filepath.Abs(self); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "vmtest-covered")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range cmds {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", err
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+		// The kernel passes the rest of the line as one argument.
+		shim := fmt.Sprintf("#!%s -cover-exec=%s\n", self, path)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(shim), 0o755); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// runCovered runs path with the args of a cover shim and syncs GOCOVERDIR.
+func runCovered(path string) error {
+	// The first arg is the shim itself.
+	args := flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Args[0] = filepath.Base(path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+
+	// Coverage is written when the command exits.
+	unix.Sync()
+	return err
+}
+
 func runTest() error {
 	defer guest.CollectKernelCoverage()
 
@@ -23,8 +88,20 @@ func runTest() error {
 	if _, err := os.Stat(test); os.IsNotExist(err) {
 		return errors.New("could not find any test script to run")
 	}
-	cmd := exec.Command("gosh", test)
+	shell := flag.Args()
+	if len(shell) == 0 {
+		shell = []string{"gosh"}
+	}
+	guest.Phase("script")
+	cmd := exec.Command(shell[0], append(shell[1:], test)...)
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if *covered != "" && os.Getenv("GOCOVERDIR") != "" {
+		dir, err := coverShims(strings.Split(*covered, ","))
+		if err != nil {
+			return fmt.Errorf("could not set up coverage of %s: %v", *covered, err)
+		}
+		cmd.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"))
+	}
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("test.sh ran unsuccessfully: %v", err)
@@ -33,9 +110,19 @@ func runTest() error {
 }
 
 func main() {
+	flag.Parse()
+	if *coverExec != "" {
+		var exitErr *exec.ExitError
+		if err := runCovered(*coverExec); errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		} else if err != nil {
+			log.Fatalf("%s: %v", *coverExec, err)
+		}
+		return
+	}
 	if err := runTest(); err != nil {
-		log.Printf("Tests failed: %v", err)
-	} else {
-		log.Print("TESTS PASSED MARKER")
+		// Exit non-zero so wrappers like debugsh can tell.
+		log.Fatalf("Tests failed: %v", err)
 	}
+	log.Print("TESTS PASSED MARKER")
 }
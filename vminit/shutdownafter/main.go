@@ -0,0 +1,54 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command shutdownafter runs a command given in args and shuts down.
+//
+// If GOCOVERDIR is set, shutdownafter creates it before running the command,
+// and streams it to the host before shutting down if the host set that up
+// with qcoverage.StreamGOCOVERDIR.
+//
+// shutdownafter marks the init and shutdown phases for qemu.WithPhaseReport.
+//
+// shutdownafter also runs as init (or from rc) in FreeBSD guests.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/hugelgupf/vmtest/guest"
+)
+
+func run() error {
+	args := flag.Args()
+	if len(args) == 0 {
+		return nil
+	}
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	return c.Run()
+}
+
+func main() {
+	flag.Parse()
+	if mono, err := guest.InitStarted(); err == nil {
+		guest.PhaseAt("init", mono)
+	}
+	if dir := os.Getenv("GOCOVERDIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Printf("Failed to create GOCOVERDIR: %v", err)
+		}
+	}
+	if err := run(); err != nil {
+		log.Printf("Failed: %v", err)
+	}
+	guest.Phase("shutdown")
+	guest.StreamGOCOVERDIR()
+
+	if err := guest.PowerOff(); err != nil {
+		log.Fatalf("Failed to shutdown: %v", err)
+	}
+}
@@ -2,12 +2,16 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Command vmmount mounts 9P directories as defined by env vars, runs a
-// command, and unmounts them.
+// Command vmmount mounts file systems as defined by env vars, runs a command,
+// and unmounts them.
 //
 // The 9P directories are mounted via virtio; their tags are derived from any
 // env var that matches VMTEST_MOUNT9P_*=$tag. The mount location is
 // /mount/9p/$tag.
+//
+// Arbitrary mounts can be described by VMTEST_MOUNT$n env vars as added by
+// qemu.WithGuestMount. They are mounted in order of $n after the 9P
+// directories.
 package main
 
 import (
@@ -19,9 +23,32 @@ import (
 	"strings"
 
 	"github.com/hugelgupf/vmtest/guest"
+	"github.com/hugelgupf/vmtest/internal/mountspec"
+	"github.com/u-root/u-root/pkg/mount"
 )
 
+func mountSpec(m mountspec.Mount) (*mount.MountPoint, error) {
+	if m.FSType == "9p" && m.Options == "" {
+		return guest.Mount9PDir(m.Target, m.Source)
+	}
+	if err := os.MkdirAll(m.Target, 0o755); err != nil {
+		return nil, err
+	}
+	return mount.Mount(m.Source, m.Target, m.FSType, m.Options, 0)
+}
+
 func run() error {
+	guest.Phase("mounts")
+
+	var mps []*mount.MountPoint
+	defer func() {
+		for i := len(mps) - 1; i >= 0; i-- {
+			if err := mps[i].Unmount(0); err != nil {
+				log.Printf("Failed to unmount: %v", err)
+			}
+		}
+	}()
+
 	for _, v := range os.Environ() {
 		if !strings.HasPrefix(v, "VMTEST_MOUNT9P_") {
 			continue
@@ -31,18 +58,29 @@ func run() error {
 		mp, err := guest.Mount9PDir(filepath.Join("/mount/9p", e[1]), e[1])
 		if err != nil {
 			log.Printf("Tried to mount 9P tag %s at /mount/9p/%s: %v", e[1], e[1], err)
+			continue
 		}
-		defer func() {
-			if err := mp.Unmount(0); err != nil {
-				log.Printf("Failed to unmount: %v", err)
-			}
-		}()
+		mps = append(mps, mp)
+	}
+
+	mounts, err := mountspec.FromEnv(os.Environ())
+	if err != nil {
+		log.Printf("Invalid mount table: %v", err)
+	}
+	for _, m := range mounts {
+		mp, err := mountSpec(m)
+		if err != nil {
+			log.Printf("Tried to mount %s (%s) at %s: %v", m.Source, m.FSType, m.Target, err)
+			continue
+		}
+		mps = append(mps, mp)
 	}
 
 	args := flag.Args()
 	if len(args) == 0 {
 		return nil
 	}
+	guest.Phase(filepath.Base(args[0]))
 	c := exec.Command(args[0], args[1:]...)
 	c.Stdout, c.Stderr = os.Stdout, os.Stderr
 	return c.Run()